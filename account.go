@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Courses synced at once by default when syncing the courses of an account, which can number in
+// the thousands.
+const defaultMaxConcurrentAccountCourses = 4
+
+// AccountCourses says which courses of a Canvas account to list, for admins syncing every course
+// in it rather than the courses that they are enrolled in.
+type AccountCourses struct {
+	Id uint64
+	// Enrollment terms to list the courses of. If empty, courses in every term are listed.
+	TermIds []uint64
+	// States of the courses to list. If empty, Canvas lists all but deleted courses.
+	States []string
+}
+
+// MakeAccountCoursesUrls returns the URLs to list the courses in an account and its sub-accounts,
+// one for each term, as Canvas can only filter by one term at a time.
+func (api *CanvasApi) MakeAccountCoursesUrls(account *AccountCourses) []string {
+	query := url.Values{}
+	query.Set("per_page", "100")
+	query.Add("include[]", "term")
+	for _, state := range account.States {
+		query.Add("state[]", state)
+	}
+
+	if len(account.TermIds) == 0 {
+		return []string{fmt.Sprintf("%s/api/v1/accounts/%d/courses?%s", api.RootUrl, account.Id, query.Encode())}
+	}
+
+	urls := make([]string, 0, len(account.TermIds))
+	for _, termId := range account.TermIds {
+		query.Set("enrollment_term_id", fmt.Sprint(termId))
+		urls = append(urls, fmt.Sprintf("%s/api/v1/accounts/%d/courses?%s", api.RootUrl, account.Id, query.Encode()))
+	}
+	return urls
+}
+
+// coursesUrls returns the URLs to list the courses to sync: those of the account if there is one,
+// and otherwise the user's own.
+func (api *CanvasApi) coursesUrls() []string {
+	if api.Account != nil {
+		return api.MakeAccountCoursesUrls(api.Account)
+	}
+	return []string{api.MakeCoursesUrl()}
+}
+
+func validateAccountCourseStates(states []string) error {
+	for _, state := range states {
+		switch state {
+		case "created", "claimed", "available", "completed", "deleted", "all":
+		default:
+			return fmt.Errorf("unknown state %q, must be one of \"created\", \"claimed\", \"available\", \"completed\", \"deleted\" or \"all\"", state)
+		}
+	}
+	return nil
+}
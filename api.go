@@ -1,22 +1,57 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/peterhellberg/link"
 )
 
 type Course struct {
+	Id         uint64     `json:"id"`
+	Name       string     `json:"name"`
+	CourseCode string     `json:"course_code"`
+	StartAt    *time.Time `json:"start_at"`
+	Term       *Term      `json:"term"`
+	Teachers   []Teacher  `json:"teachers"`
+
+	// Directory, relative to the sync directory, that the course directory is nested in under the
+	// layout setting.
+	Parent string `json:"-"`
+	// Name of the course directory from course_dir_template, if it is set.
+	DirName string `json:"-"`
+}
+
+// Teacher is a teacher of a course, as listed with the course.
+type Teacher struct {
+	Id   uint64 `json:"id"`
+	Name string `json:"display_name"`
+}
+
+type User struct {
 	Id   uint64 `json:"id"`
 	Name string `json:"name"`
 }
 
+type Group struct {
+	Id   uint64 `json:"id"`
+	Name string `json:"name"`
+	// The course the group belongs to, or zero if it is not part of a course.
+	CourseId uint64 `json:"course_id"`
+}
+
 type Folder struct {
 	Id           uint64    `json:"id"`
 	ParentId     uint64    `json:"parent_folder_id"` // zero if no parent
@@ -25,6 +60,11 @@ type Folder struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 	FoldersCount uint64    `json:"folders_count"`
 	FilesCount   uint64    `json:"files_count"`
+	// Order of the folder among its siblings in the Canvas UI, or zero if Canvas does not say.
+	Position int `json:"position"`
+
+	Hidden        bool `json:"hidden"`
+	HiddenForUser bool `json:"hidden_for_user"`
 }
 
 type File struct {
@@ -35,20 +75,174 @@ type File struct {
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	DownloadUrl string    `json:"url"`
+
+	// When the content of the file last changed. Canvas also changes updated_at when only its
+	// metadata, such as whether it is locked, changes.
+	ModifiedAt  *time.Time `json:"modified_at,omitempty"`
+	ContentType string     `json:"content-type,omitempty"`
+	// The name the file was uploaded with, which it is downloaded as. Canvas escapes it as in a
+	// query string.
+	UploadName string `json:"filename,omitempty"`
 }
 
 type CanvasApi struct {
 	Client  *http.Client
 	RootUrl string
 	Token   string
+
+	// Limiter, if not nil, bounds the number of simultaneous API calls.
+	Limiter *RequestLimiter
+	// DownloadLimiter, if not nil, bounds the number of simultaneous downloads. Downloads acquire
+	// it before they start and DownloadFile adapts it to how the server responds.
+	DownloadLimiter *RequestLimiter
+	// TransportStats, if not nil, records how the connections made by Client are reused.
+	TransportStats *TransportStats
+	// Listings, if not nil, caches the responses to API calls between runs.
+	Listings *ListingCache
+	// Usage, if not nil, accounts for the network traffic of API calls and downloads.
+	Usage *Usage
+	// Timeout, if not zero, limits how long each API call can take.
+	Timeout time.Duration
+	// UseNicknames names courses by the nicknames the user has given them on Canvas.
+	UseNicknames bool
+	// ListTeachers lists the teachers of each course along with it.
+	ListTeachers bool
+	// Layout decides the directory that each course is nested in.
+	Layout string
+	// DirTemplate, if not nil, names course directories.
+	DirTemplate *template.Template
+	// UseModifiedAt treats a file as updated when its content last changed rather than its
+	// updated_at.
+	UseModifiedAt bool
+	// FileNames decides which of the names Canvas gives a file it is saved as.
+	FileNames string
+	// UseGraphQL lists courses with the GraphQL API, falling back to the REST API if it fails.
+	UseGraphQL bool
+	// CourseTokens, if not nil, chooses between several access tokens, of which Token is the first,
+	// for API calls about courses.
+	CourseTokens *CourseTokens
+	// AsUser, if not empty, is the ID of the user to make API calls on behalf of.
+	AsUser string
+	// Account, if not nil, is the account whose courses are listed instead of the user's own.
+	Account *AccountCourses
+
+	graphQLFailed atomic.Bool
+
+	nicknamesMu sync.Mutex
+	nicknames   map[uint64]string
+}
+
+type courseContextKey struct{}
+
+// withCourse records in the context the course that API calls are being made on behalf of, so that
+// the request limiter can prioritise between courses.
+func withCourse(ctx context.Context, courseId uint64) context.Context {
+	return context.WithValue(ctx, courseContextKey{}, courseId)
+}
+
+func courseFromContext(ctx context.Context) uint64 {
+	courseId, _ := ctx.Value(courseContextKey{}).(uint64)
+	return courseId
 }
 
 func (api *CanvasApi) MakeCoursesUrl() string {
-	return fmt.Sprintf("%s/api/v1/courses?per_page=100", api.RootUrl)
+	return fmt.Sprintf("%s/api/v1/courses?per_page=100&%s", api.RootUrl, api.courseIncludes())
+}
+
+// courseIncludes returns the query parameters asking for what to list along with courses.
+func (api *CanvasApi) courseIncludes() string {
+	if api.ListTeachers {
+		return "include[]=term&include[]=teachers"
+	}
+	return "include[]=term"
 }
 
 func (canvas *CanvasApi) Courses(ctx context.Context, url string) (courses []Course, next string, err error) {
-	courses, next, err = callAPI[Course](canvas, canvas.Client, url)
+	courses, next, err = callAPI[Course](withListingCache(ctx), canvas, url)
+	if err != nil {
+		return
+	}
+
+	for i := range courses {
+		if err = canvas.prepareCourse(ctx, &courses[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (canvas *CanvasApi) Course(ctx context.Context, courseId uint64) (Course, error) {
+	course, err := getAPI[Course](withListingCache(ctx), canvas, fmt.Sprintf("%s/api/v1/courses/%d?%s", canvas.RootUrl, courseId, canvas.courseIncludes()))
+	if err != nil {
+		return course, err
+	}
+
+	err = canvas.prepareCourse(ctx, &course)
+	return course, err
+}
+
+type CourseNickname struct {
+	CourseId uint64 `json:"course_id"`
+	Name     string `json:"name"`
+	Nickname string `json:"nickname"`
+}
+
+// prepareCourse names a course and places it in the layout as the config file asks.
+func (canvas *CanvasApi) prepareCourse(ctx context.Context, course *Course) error {
+	if err := canvas.applyNickname(ctx, course); err != nil {
+		return err
+	}
+	course.Parent = courseParent(*course, canvas.Layout)
+	if canvas.DirTemplate != nil {
+		course.DirName = courseDirName(canvas.DirTemplate, *course)
+	}
+	return nil
+}
+
+// applyNickname renames a course to the nickname the user has given it, if UseNicknames is set.
+// The nicknames are listed the first time they are needed.
+func (canvas *CanvasApi) applyNickname(ctx context.Context, course *Course) error {
+	if !canvas.UseNicknames {
+		return nil
+	}
+
+	canvas.nicknamesMu.Lock()
+	defer canvas.nicknamesMu.Unlock()
+
+	if canvas.nicknames == nil {
+		apiCall := fmt.Sprintf("%s/api/v1/users/self/course_nicknames", canvas.RootUrl)
+		nicknames, err := listAll(ctx, apiCall, func(ctx context.Context, url string) ([]CourseNickname, string, error) {
+			return callAPI[CourseNickname](withListingCache(ctx), canvas, url)
+		})
+		if err != nil {
+			return fmt.Errorf("cannot list course nicknames: %w", err)
+		}
+
+		canvas.nicknames = make(map[uint64]string, len(nicknames))
+		for _, nickname := range nicknames {
+			if nickname.Nickname != "" {
+				canvas.nicknames[nickname.CourseId] = nickname.Nickname
+			}
+		}
+	}
+
+	if nickname, ok := canvas.nicknames[course.Id]; ok {
+		course.Name = nickname
+	}
+	return nil
+}
+
+// Self returns the user that the access token belongs to.
+func (canvas *CanvasApi) Self(ctx context.Context) (User, error) {
+	return getAPI[User](ctx, canvas, fmt.Sprintf("%s/api/v1/users/self", canvas.RootUrl))
+}
+
+func (api *CanvasApi) MakeGroupsUrl() string {
+	return fmt.Sprintf("%s/api/v1/users/self/groups?per_page=100", api.RootUrl)
+}
+
+func (canvas *CanvasApi) Groups(ctx context.Context, url string) (groups []Group, next string, err error) {
+	groups, next, err = callAPI[Group](withListingCache(ctx), canvas, url)
 	return
 }
 
@@ -57,77 +251,456 @@ func (api *CanvasApi) MakeFoldersInCourseUrl(courseId uint64) string {
 }
 
 func (canvas *CanvasApi) FoldersInCourse(ctx context.Context, url string) (folders []Folder, next string, err error) {
-	folders, next, err = callAPI[Folder](canvas, canvas.Client, url)
+	folders, next, err = callAPI[Folder](withListingCache(ctx), canvas, url)
+	return
+}
+
+func (api *CanvasApi) MakeFoldersInGroupUrl(groupId uint64) string {
+	return fmt.Sprintf("%s/api/v1/groups/%d/folders?per_page=100", api.RootUrl, groupId)
+}
+
+func (api *CanvasApi) MakeFoldersOfUserUrl() string {
+	return fmt.Sprintf("%s/api/v1/users/self/folders?per_page=100", api.RootUrl)
+}
+
+func (api *CanvasApi) MakeMediaObjectsInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/media_objects?per_page=100", api.RootUrl, courseId)
+}
+
+func (canvas *CanvasApi) MediaObjectsInCourse(ctx context.Context, url string) (media []MediaObject, next string, err error) {
+	media, next, err = callAPI[MediaObject](ctx, canvas, url)
+	return
+}
+
+func (api *CanvasApi) MakeDiscussionTopicsInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/discussion_topics?per_page=100", api.RootUrl, courseId)
+}
+
+func (canvas *CanvasApi) DiscussionTopicsInCourse(ctx context.Context, url string) (topics []DiscussionTopic, next string, err error) {
+	topics, next, err = callAPI[DiscussionTopic](ctx, canvas, url)
+	return
+}
+
+func (canvas *CanvasApi) DiscussionView(ctx context.Context, courseId uint64, topicId uint64) (DiscussionView, error) {
+	return getAPI[DiscussionView](ctx, canvas, fmt.Sprintf("%s/api/v1/courses/%d/discussion_topics/%d/view", canvas.RootUrl, courseId, topicId))
+}
+
+func (api *CanvasApi) MakeAnnouncementsInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/discussion_topics?only_announcements=true&per_page=100", api.RootUrl, courseId)
+}
+
+func (api *CanvasApi) MakePagesInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/pages?include[]=body&per_page=100", api.RootUrl, courseId)
+}
+
+func (canvas *CanvasApi) PagesInCourse(ctx context.Context, url string) (pages []Page, next string, err error) {
+	pages, next, err = callAPI[Page](ctx, canvas, url)
+	return
+}
+
+func (api *CanvasApi) MakeAssignmentsInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/assignments?per_page=100", api.RootUrl, courseId)
+}
+
+func (canvas *CanvasApi) AssignmentsInCourse(ctx context.Context, url string) (assignments []Assignment, next string, err error) {
+	assignments, next, err = callAPI[Assignment](ctx, canvas, url)
+	return
+}
+
+func (api *CanvasApi) MakeQuizzesInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/quizzes?per_page=100", api.RootUrl, courseId)
+}
+
+// QuizzesInCourse returns the quizzes as Canvas sent them, so that they can be exported without
+// losing any of their settings.
+func (canvas *CanvasApi) QuizzesInCourse(ctx context.Context, url string) (quizzes []json.RawMessage, next string, err error) {
+	quizzes, next, err = callAPI[json.RawMessage](ctx, canvas, url)
 	return
 }
 
+func (api *CanvasApi) MakeOwnEnrollmentsInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/enrollments?user_id=self&per_page=100", api.RootUrl, courseId)
+}
+
+func (canvas *CanvasApi) Enrollments(ctx context.Context, url string) (enrollments []Enrollment, next string, err error) {
+	enrollments, next, err = callAPI[Enrollment](ctx, canvas, url)
+	return
+}
+
+func (api *CanvasApi) MakeOwnSubmissionsInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/students/submissions?student_ids[]=self&include[]=assignment&per_page=100", api.RootUrl, courseId)
+}
+
+// MakeStudentSubmissionsInCourseUrl returns the URL to list the submissions of every student in a
+// course, which only teachers can see.
+func (api *CanvasApi) MakeStudentSubmissionsInCourseUrl(courseId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/students/submissions?student_ids[]=all&include[]=assignment&include[]=user&per_page=100", api.RootUrl, courseId)
+}
+
+func (canvas *CanvasApi) Submissions(ctx context.Context, url string) (submissions []Submission, next string, err error) {
+	submissions, next, err = callAPI[Submission](ctx, canvas, url)
+	return
+}
+
+// MakeCalendarEventsUrl returns the URL to list the calendar events of a type, either "event" or
+// "assignment", in the contexts such as "course_123".
+func (api *CanvasApi) MakeCalendarEventsUrl(eventType string, contextCodes []string) string {
+	query := url.Values{}
+	query.Set("type", eventType)
+	query.Set("all_events", "true")
+	query.Set("per_page", "100")
+	for _, code := range contextCodes {
+		query.Add("context_codes[]", code)
+	}
+	return fmt.Sprintf("%s/api/v1/calendar_events?%s", api.RootUrl, query.Encode())
+}
+
+func (canvas *CanvasApi) CalendarEvents(ctx context.Context, url string) (events []CalendarEvent, next string, err error) {
+	events, next, err = callAPI[CalendarEvent](ctx, canvas, url)
+	return
+}
+
+func (canvas *CanvasApi) CourseQuota(ctx context.Context, courseId uint64) (CourseQuota, error) {
+	return getAPI[CourseQuota](withListingCache(ctx), canvas, fmt.Sprintf("%s/api/v1/courses/%d/files/quota", canvas.RootUrl, courseId))
+}
+
+func (canvas *CanvasApi) CourseFile(ctx context.Context, courseId uint64, fileId uint64) (File, error) {
+	file, err := getAPI[File](ctx, canvas, fmt.Sprintf("%s/api/v1/courses/%d/files/%d", canvas.RootUrl, courseId, fileId))
+	canvas.prepareFile(&file)
+	return file, err
+}
+
+// File looks up a file by ID, wherever it is, always asking Canvas rather than the listings cache,
+// as it is used to get a new download URL when the one listed has expired.
+func (canvas *CanvasApi) File(ctx context.Context, fileId uint64) (File, error) {
+	file, err := getAPI[File](withoutListingCache(ctx), canvas, fmt.Sprintf("%s/api/v1/files/%d", canvas.RootUrl, fileId))
+	canvas.prepareFile(&file)
+	return file, err
+}
+
 func (api *CanvasApi) MakeFilesInFolderUrl(folderId uint64) string {
 	return fmt.Sprintf("%s/api/v1/folders/%d/files?per_page=100", api.RootUrl, folderId)
 }
 
 func (canvas *CanvasApi) FilesInFolder(ctx context.Context, url string) (files []File, next string, err error) {
-	files, next, err = callAPI[File](canvas, canvas.Client, url)
+	// Download URLs carry a verifier that expires, so they are not kept in the cache, and one is
+	// fetched when a file listed from the cache is downloaded.
+	files, next, err = callAPI[File](withListingCache(ctx, "url"), canvas, url)
+	for i := range files {
+		canvas.prepareFile(&files[i])
+	}
 	return
 }
 
-func (canvas *CanvasApi) DownloadFile(ctx context.Context, w io.WriteCloser, downloadUrl string) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", downloadUrl, nil)
-	if err != nil {
-		return err
+// prepareFile, with UseModifiedAt, sets the UpdatedAt of a file, which decides whether it needs to
+// be downloaded again and is given to the local copy as its modification time, to when its content
+// last changed. With FileNames, it names the file after the name it was uploaded with.
+func (canvas *CanvasApi) prepareFile(file *File) {
+	if canvas.UseModifiedAt && file.ModifiedAt != nil && !file.ModifiedAt.IsZero() {
+		file.UpdatedAt = *file.ModifiedAt
 	}
+	file.FileName = fileName(*file, canvas.FileNames)
+}
+
+// Values of the file_names setting.
+const (
+	fileNamesDisplayName  = "display_name"
+	fileNamesUploadName   = "filename"
+	fileNamesAddExtension = "add_extension"
+)
 
-	resp, err := canvas.Client.Do(req)
+// fileName returns the name to save a file as. By default, this is the name shown on Canvas, which
+// teachers can change and often leave without an extension. fileNamesUploadName uses the name the
+// file was uploaded with instead, and fileNamesAddExtension adds its extension to the name shown on
+// Canvas if that has none.
+func fileName(file File, fileNames string) string {
+	if file.UploadName == "" {
+		return file.FileName
+	}
+	uploadName, err := url.QueryUnescape(file.UploadName)
 	if err != nil {
-		return fmt.Errorf("client error for %s: %w", downloadUrl, err)
+		uploadName = file.UploadName
+	}
+
+	switch fileNames {
+	case fileNamesUploadName:
+		return uploadName
+	case fileNamesAddExtension:
+		if path.Ext(file.FileName) == "" {
+			return file.FileName + path.Ext(uploadName)
+		}
 	}
+	return file.FileName
+}
+
+// Validators are the cache validators returned with a download, used to make conditional requests.
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Number of times a download that is cut off part way through, such as after being paused for
+// long enough that the server gives up on the connection, is resumed from where it stopped.
+const downloadResumes = 3
 
-	// TODO: rate limiting
+// DownloadFile downloads a file into w. If cached is not empty, the download is conditional:
+// errNotModified is returned if the content has not changed since the validators were received.
+// If the connection fails part way through and the server supports range requests, the download
+// carries on from where it stopped rather than failing. If the download URL has expired, a new one
+// is fetched.
+func (canvas *CanvasApi) DownloadFile(ctx context.Context, w io.WriteCloser, file File, cached Validators) (Validators, error) {
+	downloadUrl := file.DownloadUrl
+	var validators Validators
+	var written int64
+	// The validator to resume the download with, if it can be.
+	var ifRange string
+	resumes := 0
+	refreshed := false
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP error for %s: %d", downloadUrl, resp.StatusCode)
+	// Files listed from the listings cache have no download URL.
+	if downloadUrl == "" {
+		fresh, err := canvas.File(ctx, file.Id)
+		if err != nil {
+			return Validators{}, fmt.Errorf("cannot get a download URL for %s: %w", file.FileName, err)
+		}
+		downloadUrl = fresh.DownloadUrl
+		refreshed = true
 	}
 
-	defer resp.Body.Close()
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		return err
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", downloadUrl, nil)
+		if err != nil {
+			return Validators{}, err
+		}
+		// Files that are not public need the token to download from Canvas, which redirects to
+		// where the file is stored without it.
+		if root, err := url.Parse(canvas.RootUrl); err == nil && req.URL.Host == root.Host {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", canvas.tokensFor(courseFromContext(ctx))[0]))
+		}
+
+		if written == 0 {
+			if cached.ETag != "" {
+				req.Header.Set("If-None-Match", cached.ETag)
+			}
+			if cached.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cached.LastModified)
+			}
+		} else {
+			// Only carry on if the file has not changed meanwhile; otherwise the server sends
+			// all of it, which is treated as a failure.
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			req.Header.Set("If-Range", ifRange)
+		}
+
+		start := time.Now()
+		resp, err := canvas.Client.Do(req)
+		if err != nil {
+			logDebugf("GET %s: %v", redactUrl(downloadUrl), err)
+			return Validators{}, fmt.Errorf("client error for %s: %w", downloadUrl, err)
+		}
+		logDebugf("GET %s: %s in %s", redactUrl(downloadUrl), resp.Status, time.Since(start).Round(time.Millisecond))
+		canvas.DownloadLimiter.Observe(resp, time.Since(start))
+
+		// The download URLs of files carry a verifier that expires, and on a long sync can do so
+		// before the file is reached, or while a download is paused.
+		if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && !refreshed && hasVerifier(downloadUrl) {
+			resp.Body.Close()
+			refreshed = true
+			fresh, err := canvas.File(ctx, file.Id)
+			if err != nil {
+				return Validators{}, fmt.Errorf("download URL for %s has expired and cannot get a new one: %w", redactUrl(downloadUrl), err)
+			}
+			logDebugf("Download URL for %s has expired, so using a new one", redactUrl(downloadUrl))
+			downloadUrl = fresh.DownloadUrl
+			continue
+		}
+
+		if written == 0 {
+			if resp.StatusCode == http.StatusNotModified {
+				resp.Body.Close()
+				return cached, errNotModified
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return Validators{}, &HTTPError{Url: downloadUrl, StatusCode: resp.StatusCode}
+			}
+
+			validators = Validators{
+				ETag:         resp.Header.Get("ETag"),
+				LastModified: resp.Header.Get("Last-Modified"),
+			}
+			if resp.Header.Get("Accept-Ranges") == "bytes" {
+				// Weak ETags cannot be used in If-Range.
+				if validators.ETag != "" && validators.ETag[0] == '"' {
+					ifRange = validators.ETag
+				} else {
+					ifRange = validators.LastModified
+				}
+			}
+		} else if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return Validators{}, &HTTPError{Url: downloadUrl, StatusCode: resp.StatusCode, Message: "cannot resume download"}
+		}
+
+		body := &readErrorReader{r: resp.Body}
+		n, err := io.Copy(w, body)
+		resp.Body.Close()
+		written += n
+		canvas.Usage.AddDownload(courseFromContext(ctx), n)
+		if err == nil {
+			break
+		}
+
+		// Only failures to read from the server can be resumed, not failures to write the file.
+		if ifRange == "" || body.err == nil || ctx.Err() != nil || resumes == downloadResumes {
+			return Validators{}, err
+		}
+		resumes++
+		logDebugf("Download from %s cut off after %d bytes, resuming: %v", redactUrl(downloadUrl), written, err)
+	}
+
+	return validators, w.Close()
+}
+
+// hasVerifier reports whether a download URL carries a verifier, as the URLs of Canvas files do,
+// rather than being, for example, the URL of a recording on a media server.
+func hasVerifier(downloadUrl string) bool {
+	u, err := url.Parse(downloadUrl)
+	return err == nil && u.Query().Has("verifier")
+}
+
+// readErrorReader records the error, if any, from reading r.
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err != nil && err != io.EOF {
+		r.err = err
 	}
+	return n, err
+}
 
-	return w.Close()
+// isRateLimited reports whether Canvas refused a request because of its rate limit, to which it
+// responds 403 with no quota remaining, or sometimes 429.
+func isRateLimited(res *http.Response) bool {
+	if res.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if res.StatusCode != http.StatusForbidden {
+		return false
+	}
+	remaining, err := strconv.ParseFloat(res.Header.Get("X-Rate-Limit-Remaining"), 64)
+	return err == nil && remaining <= 0
 }
 
 var errForbidden error = errors.New("forbidden")
+var errNotModified error = errors.New("not modified")
 
-func callAPI[T interface{}](canvas *CanvasApi, client *http.Client, apiCall string) ([]T, string, error) {
-	req, err := http.NewRequestWithContext(context.TODO(), "GET", apiCall, nil)
-	if err != nil {
-		return nil, "", fmt.Errorf("new request error for %s: %w", apiCall, err)
+// get makes an authenticated GET request to the API, passing the body of the response to read, and
+// returns the URL of the next page of results, if there is one.
+func (canvas *CanvasApi) get(ctx context.Context, apiCall string, read func(body io.Reader) error) (string, error) {
+	apiCall = canvas.masquerade(apiCall)
+
+	listings, _ := canvas.listingCacheFor(ctx)
+	if cached, ok, err := listings.Get(apiCall); err != nil {
+		return "", err
+	} else if ok {
+		logDebugf("GET %s: cached %s ago", redactUrl(apiCall), time.Since(cached.FetchedAt).Round(time.Second))
+		if err := read(bytes.NewReader(cached.Body)); err != nil {
+			return "", err
+		}
+		return cached.Next, nil
+	}
+
+	// With several tokens, API calls about a course that one token cannot see are made again with
+	// the next.
+	courseId := courseFromContext(ctx)
+	var err error
+	for i, token := range canvas.tokensFor(courseId) {
+		if i > 0 {
+			logDebugf("%s; trying the next access token", err)
+		}
+
+		var next string
+		if next, err = canvas.getWithToken(ctx, apiCall, token, read); err == nil {
+			if canvas.CourseTokens != nil && courseId != 0 {
+				canvas.CourseTokens.Worked(courseId, token)
+			}
+			return next, nil
+		}
+		if !tokenDenied(err) {
+			return "", err
+		}
+	}
+	return "", err
+}
+
+// getWithToken makes the request for get with an access token.
+func (canvas *CanvasApi) getWithToken(ctx context.Context, apiCall string, token string, read func(body io.Reader) error) (string, error) {
+	if canvas.Limiter != nil {
+		if err := canvas.Limiter.Acquire(ctx, courseFromContext(ctx)); err != nil {
+			return "", err
+		}
+		defer canvas.Limiter.Release()
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", canvas.Token))
+	// Waiting for the limiter does not count towards the timeout.
+	reqCtx := ctx
+	if canvas.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, canvas.Timeout)
+		defer cancel()
+	}
 
-	res, err := client.Do(req)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", apiCall, nil)
 	if err != nil {
-		return nil, "", fmt.Errorf("client error for %s: %w", apiCall, err)
+		return "", fmt.Errorf("new request error for %s: %w", apiCall, err)
 	}
 
-	// TODO: rate limiting
-	// X-Rate-Limit-Remaining
-	// X-Request-Cost
-	// res.StatusCode == http.StatusTooManyRequests
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	if res.StatusCode == http.StatusForbidden {
-		return nil, "", errForbidden
+	start := time.Now()
+	res, err := canvas.Client.Do(req)
+	if err != nil {
+		logDebugf("GET %s: %v", redactUrl(apiCall), err)
+		if ctx.Err() == nil && reqCtx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("no response from %s within the timeout of %s: %w", redactUrl(apiCall), canvas.Timeout, err)
+		}
+		return "", fmt.Errorf("client error for %s: %w", apiCall, err)
 	}
+	defer res.Body.Close()
+	logDebugf("GET %s: %s in %s", redactUrl(apiCall), res.Status, time.Since(start).Round(time.Millisecond))
+	metrics.APIRequest(isRateLimited(res))
+	canvas.Limiter.Observe(res, time.Since(start))
 
 	if res.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("HTTP error for %s: %d", apiCall, res.StatusCode)
+		httpErr := apiError(apiCall, res)
+
+		// Canvas also responds 401 to valid tokens that are not allowed to do something, but only
+		// asks for new credentials when the token itself is invalid.
+		if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") != "" {
+			return "", &TokenError{httpErr}
+		}
+		if isInsufficientScope(httpErr) {
+			return "", &ScopeError{httpErr}
+		}
+		return "", httpErr
 	}
 
-	defer res.Body.Close()
-	body, err := io.ReadAll(res.Body)
+	listings, omit := canvas.listingCacheFor(ctx)
+	body := &countingReader{r: res.Body}
+	var cached bytes.Buffer
+	var r io.Reader = body
+	if listings != nil {
+		r = io.TeeReader(body, &cached)
+	}
+	err = read(r)
+	canvas.Usage.AddRequest(courseFromContext(ctx), body.n)
 	if err != nil {
-		return nil, "", fmt.Errorf("HTTP read error for %s: %w", apiCall, err)
+		return "", err
 	}
 
 	// Check Link header for next paginated request
@@ -139,10 +712,44 @@ func callAPI[T interface{}](canvas *CanvasApi, client *http.Client, apiCall stri
 		}
 	}
 
-	var j []T
-	if err := json.Unmarshal(body, &j); err != nil {
-		return nil, "", fmt.Errorf("JSON error for %s: %w", apiCall, err)
+	listings.Put(apiCall, omitFields(cached.Bytes(), omit), next)
+	return next, nil
+}
+
+// callAPI makes a request for a page of a list of objects. The objects are decoded one at a time
+// so that, if the response is cut off part way through, the page is requested again and only the
+// objects that were not received the first time are decoded.
+func callAPI[T interface{}](ctx context.Context, canvas *CanvasApi, apiCall string) ([]T, string, error) {
+	page := pageDecoder[T]{url: apiCall}
+
+	for attempt := 1; ; attempt++ {
+		next, err := canvas.get(ctx, apiCall, page.Decode)
+		if err == nil {
+			return page.items, next, nil
+		}
+
+		var cutOff *cutOffError
+		if !errors.As(err, &cutOff) || attempt == pageAttempts {
+			return nil, "", err
+		}
+
+		logInfof("%v; requesting the rest of the page again", err)
+		if err := sleepContext(ctx, time.Duration(attempt)*time.Second); err != nil {
+			return nil, "", err
+		}
 	}
+}
+
+// getAPI makes a request for a single object.
+func getAPI[T interface{}](ctx context.Context, canvas *CanvasApi, apiCall string) (T, error) {
+	var j T
+
+	_, err := canvas.get(ctx, apiCall, func(body io.Reader) error {
+		if err := json.NewDecoder(body).Decode(&j); err != nil {
+			return fmt.Errorf("JSON error for %s: %w", apiCall, err)
+		}
+		return nil
+	})
 
-	return j, next, nil
+	return j, err
 }
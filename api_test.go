@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadFiles reads files, as Canvas lists them, from testdata.
+func loadFiles(t *testing.T) []File {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", "files.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []File
+	if err := json.Unmarshal(content, &files); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func mustParseTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestPrepareFileModifiedAt(t *testing.T) {
+	tests := []struct {
+		useModifiedAt bool
+		fileId        uint64
+		want          string
+	}{
+		// Only the metadata of file 501 changed after its content did.
+		{false, 501, "2024-09-15T14:30:00Z"},
+		{true, 501, "2024-08-21T10:15:00Z"},
+		// File 502 has no modified_at, so updated_at is all there is.
+		{false, 502, "2024-09-01T08:00:00Z"},
+		{true, 502, "2024-09-01T08:00:00Z"},
+	}
+	for _, test := range tests {
+		canvas := &CanvasApi{UseModifiedAt: test.useModifiedAt}
+		for _, file := range loadFiles(t) {
+			if file.Id != test.fileId {
+				continue
+			}
+			canvas.prepareFile(&file)
+			if want := mustParseTime(t, test.want); !file.UpdatedAt.Equal(want) {
+				t.Errorf("with use_modified_at %v, file %d has UpdatedAt %v, want %v",
+					test.useModifiedAt, file.Id, file.UpdatedAt, want)
+			}
+		}
+	}
+}
+
+// TestModifiedAtNeedsSync checks that a file downloaded with use_modified_at is not downloaded again
+// when only its metadata changes on Canvas, and is without it.
+func TestModifiedAtNeedsSync(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, useModifiedAt := range []bool{false, true} {
+		canvas := &CanvasApi{UseModifiedAt: useModifiedAt}
+		for _, file := range loadFiles(t) {
+			canvas.prepareFile(&file)
+
+			// Download the file as it was before its metadata changed, at when its content did.
+			filePath := filepath.Join(dir, localName(file.FileName))
+			if err := os.WriteFile(filePath, []byte(strings.Repeat("x", int(file.Size))), 0644); err != nil {
+				t.Fatal(err)
+			}
+			downloadedAt := file.UpdatedAt
+			if file.ModifiedAt != nil {
+				downloadedAt = *file.ModifiedAt
+			}
+			if err := os.Chtimes(filePath, downloadedAt, downloadedAt); err != nil {
+				t.Fatal(err)
+			}
+
+			needsSync, err := fileNeedsSync(&TreeFile{file}, filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := !useModifiedAt && file.ModifiedAt != nil
+			if needsSync != want {
+				t.Errorf("with use_modified_at %v, file %d needs sync %v, want %v",
+					useModifiedAt, file.Id, needsSync, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ArchiveWriter adds files and directories to an archive. Names are slash separated.
+type ArchiveWriter interface {
+	Mkdir(name string, modTime time.Time) error
+	// Create starts a file in the archive, which must be written in full before the next is created.
+	Create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+// NewArchiveWriter returns an ArchiveWriter for the format given by the extension of fileName:
+// .zip, .tar.gz or .tgz.
+func NewArchiveWriter(w io.Writer, fileName string) (ArchiveWriter, error) {
+	lower := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return &zipArchive{zip.NewWriter(w)}, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz := gzip.NewWriter(w)
+		return &tarArchive{gz: gz, tw: tar.NewWriter(gz)}, nil
+	default:
+		return nil, fmt.Errorf("cannot tell the archive format of %s: use .zip, .tar.gz or .tgz", fileName)
+	}
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) Mkdir(name string, modTime time.Time) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modTime})
+	return err
+}
+
+func (a *zipArchive) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchive) Mkdir(name string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: modTime})
+}
+
+func (a *tarArchive) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	if err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: modTime}); err != nil {
+		return nil, err
+	}
+	return a.tw, nil
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// runArchive implements the archive subcommand, which writes the files in a course, in the same
+// folders as they are synced to, to a zip or tar.gz archive. Files are streamed from Canvas into
+// the archive, or with --local, taken from the sync directory where they are up to date. With
+// --offline, only the files already in the sync directory are archived, without Canvas.
+func runArchive(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	courseId := flags.Uint64("course", 0, "ID of the course to archive")
+	output := flags.String("output", "", "archive to write, ending in .zip, .tar.gz or .tgz")
+	local := flags.Bool("local", false, "use the synced copies of files that are up to date instead of downloading them")
+	flags.Parse(args)
+
+	if *courseId == 0 || *output == "" || flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync archive --course <course id> --output <file> [--local]")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if opts.Offline {
+		return archiveCourseOffline(config, *courseId, *output)
+	}
+
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+
+	api.Usage, err = LoadUsage()
+	if err != nil {
+		return err
+	}
+
+	course, err := api.Course(ctx, *courseId)
+	if err != nil {
+		return err
+	}
+
+	tree, err := BuildTree(ctx, api, course, config.SkipFoldersFor(course.Id), func(tree *CourseTree, folder *TreeFolder, parents []*TreeFolder) error {
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	archive, err := NewArchiveWriter(f, *output)
+	if err != nil {
+		f.Close()
+		os.Remove(*output)
+		return err
+	}
+
+	var files, fromDisk int
+	var size int64
+	ctx = withCourse(ctx, course.Id)
+	err = tree.TraverseWithParents(func(folder *TreeFolder, parents []*TreeFolder) error {
+		folderPath := tree.LocalPath(config.Directory, folder, parents)
+		rel, err := filepath.Rel(config.Directory, folderPath)
+		if err != nil {
+			return err
+		}
+		dirName := filepath.ToSlash(rel)
+
+		if err := archive.Mkdir(dirName, folder.UpdatedAt); err != nil {
+			return err
+		}
+
+		for _, file := range folder.files {
+			name := path.Join(dirName, localName(file.FileName))
+			w, err := archive.Create(name, file.Size, file.UpdatedAt)
+			if err != nil {
+				return err
+			}
+
+			copied, err := archiveLocalFile(w, file, filepath.Join(folderPath, localName(file.FileName)), *local)
+			if err != nil {
+				return fmt.Errorf("cannot archive %s: %w", name, err)
+			}
+			if copied {
+				fromDisk++
+			} else {
+				_, err := api.DownloadFile(ctx, nopWriteCloser{w}, file.File, Validators{})
+				if err != nil {
+					return fmt.Errorf("cannot archive %s: %w", name, err)
+				}
+			}
+
+			files++
+			size += file.Size
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = archive.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if saveErr := api.Usage.Save(); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+
+	fmt.Printf("✓ Archived %d files (%s) from %s to %s", files, humanize.Bytes(uint64(size)), course.Name, *output)
+	if *local {
+		fmt.Printf(", %d of them from the sync directory", fromDisk)
+	}
+	fmt.Println(".")
+
+	return nil
+}
+
+// archiveCourseOffline writes the files downloaded from a course that are still in the sync
+// directory to a zip or tar.gz archive, and lists those that are only on Canvas.
+func archiveCourseOffline(config *Config, courseId uint64, output string) error {
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+	files, err := offlineFiles(manifest, courseId)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no files have been synced from course %d", courseId)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	archive, err := NewArchiveWriter(f, output)
+	if err != nil {
+		f.Close()
+		os.Remove(output)
+		return err
+	}
+
+	archived, size, remote, err := archiveOffline(archive, config, files)
+	if err == nil {
+		err = archive.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+
+	fmt.Printf("✓ Archived %d files (%s) from the sync directory to %s.\n", archived, humanize.Bytes(uint64(size)), output)
+	if len(remote) > 0 {
+		canvasUrl := strings.TrimSuffix(config.Url, "/")
+		fmt.Printf("! %d files are no longer in the sync directory and are only on Canvas:\n", len(remote))
+		for _, file := range remote {
+			fmt.Printf("  %s: %s/files/%d\n", config.displayPath(file.Path), canvasUrl, file.Id)
+		}
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// archiveLocalFile copies the synced copy of a file at filePath to w if local is set and the copy
+// is up to date, reporting whether it did so.
+func archiveLocalFile(w io.Writer, file *TreeFile, filePath string, local bool) (bool, error) {
+	if !local {
+		return false, nil
+	}
+
+	needsSync, err := fileNeedsSync(file, filePath)
+	if err != nil || needsSync {
+		return false, err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !windows
+
+package main
+
+import "os/exec"
+
+// openBrowser opens url in the default web browser.
+func openBrowser(url string) error {
+	return exec.Command("xdg-open", url).Run()
+}
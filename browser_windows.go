@@ -0,0 +1,8 @@
+package main
+
+import "os/exec"
+
+// openBrowser opens url in the default web browser.
+func openBrowser(url string) error {
+	return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Run()
+}
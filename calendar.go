@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Name of the calendar file written to the sync directory.
+const calendarFileName = "canvas.ics"
+
+// Canvas limits the number of courses that calendar events can be listed for at once.
+const maxCalendarContexts = 10
+
+type CalendarEvent struct {
+	Id           calendarEventId `json:"id"`
+	Title        string          `json:"title"`
+	Description  string          `json:"description"`
+	StartAt      *time.Time      `json:"start_at"`
+	EndAt        *time.Time      `json:"end_at"`
+	AllDay       bool            `json:"all_day"`
+	AllDayDate   string          `json:"all_day_date"`
+	LocationName string          `json:"location_name"`
+	HtmlUrl      string          `json:"html_url"`
+	ContextCode  string          `json:"context_code"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// calendarEventId is the ID of a calendar event, which is a number for events but a string such
+// as "assignment_123" for assignment due dates.
+type calendarEventId string
+
+func (id *calendarEventId) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*id = calendarEventId(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*id = calendarEventId(n.String())
+	return nil
+}
+
+// writeCalendar writes the events and assignment due dates in the courses to an iCalendar file at
+// path, which calendar apps can subscribe to.
+func writeCalendar(ctx context.Context, api *CanvasApi, courses []Course, path string) error {
+	courseNames := make(map[string]string)
+	var contextCodes []string
+	for _, course := range courses {
+		code := fmt.Sprintf("course_%d", course.Id)
+		courseNames[code] = course.Name
+		contextCodes = append(contextCodes, code)
+	}
+
+	var events []CalendarEvent
+	for start := 0; start < len(contextCodes); start += maxCalendarContexts {
+		end := start + maxCalendarContexts
+		if end > len(contextCodes) {
+			end = len(contextCodes)
+		}
+
+		for _, eventType := range []string{"event", "assignment"} {
+			results, err := listAll(ctx, api.MakeCalendarEventsUrl(eventType, contextCodes[start:end]), api.CalendarEvents)
+			if err != nil && !errors.Is(err, errForbidden) {
+				return err
+			}
+			events = append(events, results...)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].start().Equal(events[j].start()) {
+			return events[i].start().Before(events[j].start())
+		}
+		return events[i].Id < events[j].Id
+	})
+
+	host := "canvas"
+	if u, err := url.Parse(api.RootUrl); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//canvas-sync//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "X-WR-CALNAME:"+escapeICS("Canvas ("+host+")"))
+
+	for _, event := range events {
+		if event.StartAt == nil && event.AllDayDate == "" {
+			continue
+		}
+
+		summary := event.Title
+		if name, ok := courseNames[event.ContextCode]; ok {
+			summary = fmt.Sprintf("[%s] %s", name, event.Title)
+		}
+
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, fmt.Sprintf("UID:%s@%s", event.Id, host))
+		writeICSLine(&b, "DTSTAMP:"+formatICSTime(event.UpdatedAt))
+		if event.AllDay && event.AllDayDate != "" {
+			if day, err := time.Parse("2006-01-02", event.AllDayDate); err == nil {
+				writeICSLine(&b, "DTSTART;VALUE=DATE:"+day.Format("20060102"))
+				writeICSLine(&b, "DTEND;VALUE=DATE:"+day.AddDate(0, 0, 1).Format("20060102"))
+			}
+		} else {
+			end := event.StartAt
+			if event.EndAt != nil && event.EndAt.After(*event.StartAt) {
+				end = event.EndAt
+			}
+			writeICSLine(&b, "DTSTART:"+formatICSTime(*event.StartAt))
+			writeICSLine(&b, "DTEND:"+formatICSTime(*end))
+		}
+		writeICSLine(&b, "SUMMARY:"+escapeICS(summary))
+		if event.Description != "" {
+			writeICSLine(&b, "DESCRIPTION:"+escapeICS(strings.TrimSpace(htmlToMarkdown(event.Description))))
+		}
+		if event.LocationName != "" {
+			writeICSLine(&b, "LOCATION:"+escapeICS(event.LocationName))
+		}
+		if event.HtmlUrl != "" {
+			writeICSLine(&b, "URL:"+event.HtmlUrl)
+		}
+		writeICSLine(&b, "END:VEVENT")
+	}
+
+	writeICSLine(&b, "END:VCALENDAR")
+
+	return writeFileIfChanged(path, []byte(b.String()))
+}
+
+func (event CalendarEvent) start() time.Time {
+	if event.StartAt == nil {
+		return time.Time{}
+	}
+	return *event.StartAt
+}
+
+func formatICSTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func escapeICS(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// writeICSLine writes a content line, folded so that no line is longer than 75 bytes, as
+// iCalendar requires.
+func writeICSLine(b *strings.Builder, line string) {
+	const maxLength = 75
+
+	first := true
+	for len(line) > 0 {
+		limit := maxLength
+		if !first {
+			// Continuation lines start with a space.
+			limit--
+			b.WriteString(" ")
+		}
+		first = false
+
+		if len(line) <= limit {
+			b.WriteString(line)
+			break
+		}
+
+		// Do not split a multi-byte character.
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n")
+		line = line[cut:]
+	}
+	b.WriteString("\r\n")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
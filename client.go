@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	defaultUserAgent = "canvas-sync (+https://github.com/james-atkins/canvas-sync)"
+
+	defaultConnectTimeout  = 30 * time.Second
+	defaultResponseTimeout = 60 * time.Second
+
+	// Most redirects followed for a request. Downloads can go through several, from Canvas to its
+	// file service and then to the storage the file is in.
+	maxRedirects = 20
+)
+
+// newCanvasApi creates a client for the Canvas server set in the config file.
+func newCanvasApi(config *Config) (*CanvasApi, error) {
+	transportStats := NewTransportStats()
+	client, err := newHTTPClient(config, transportStats)
+	if err != nil {
+		return nil, err
+	}
+
+	if asUser != "" {
+		logInfof("Acting as Canvas user %s: every API call is made on their behalf, and so only sees what they can see", asUser)
+	}
+
+	api := &CanvasApi{
+		Client:  client,
+		RootUrl: config.Url,
+		Token:   config.Token,
+		Limiter: NewRequestLimiter(config.MaxConcurrentRequests()),
+
+		DownloadLimiter: NewAdaptiveLimiter("downloads", numDownloaders, maxDownloaders),
+		TransportStats:  transportStats,
+
+		UseNicknames:  config.CourseNicknames,
+		ListTeachers:  config.CourseInfo,
+		Layout:        config.Layout,
+		DirTemplate:   config.courseDirTemplate,
+		UseModifiedAt: config.UseModifiedAt,
+		FileNames:     config.FileNames,
+		UseGraphQL:    config.UseGraphQL,
+		AsUser:        asUser,
+		Account:       config.Account(),
+	}
+
+	if len(config.ExtraTokens) > 0 {
+		if api.CourseTokens, err = LoadCourseTokens(append([]string{config.Token}, config.ExtraTokens...)); err != nil {
+			return nil, err
+		}
+	}
+
+	return api, nil
+}
+
+// newHTTPClient creates the HTTP client used for all requests, with the timeouts, TLS settings,
+// proxy, User-Agent and extra headers from the config file. If stats is not nil, it records how
+// connections are made and reused.
+func newHTTPClient(config *Config, stats *TransportStats) (*http.Client, error) {
+	connectTimeout := defaultConnectTimeout
+	if config.ConnectTimeoutSeconds > 0 {
+		connectTimeout = time.Duration(config.ConnectTimeoutSeconds) * time.Second
+	}
+
+	responseTimeout := defaultResponseTimeout
+	if config.ResponseTimeoutSeconds > 0 {
+		responseTimeout = time.Duration(config.ResponseTimeoutSeconds) * time.Second
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// Nearly every request goes to the Canvas server or its file storage, so keep enough idle
+	// connections to each host for all the downloaders and API calls to reuse.
+	connsPerHost := maxDownloaders + config.MaxConcurrentRequests()
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          4 * connsPerHost,
+		MaxIdleConnsPerHost:   connsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: responseTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if config.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, &ConfigError{fmt.Errorf("cannot read CA bundle: %w", err)}
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &ConfigError{fmt.Errorf("no certificates found in CA bundle %s", config.CABundle)}
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if config.Proxy != "" {
+		proxyUrl, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, &ConfigError{fmt.Errorf("invalid proxy %q: %w", config.Proxy, err)}
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	canvasUrl, err := url.Parse(config.Url)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid url %q: %w", config.Url, err)}
+	}
+
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	var base http.RoundTripper = transport
+	if stats != nil {
+		base = &tracingTransport{base: transport, stats: stats}
+	}
+
+	client := &http.Client{
+		Transport: &headerTransport{
+			base:       base,
+			userAgent:  userAgent,
+			headers:    config.Headers,
+			canvasHost: canvasUrl.Host,
+		},
+		CheckRedirect: redirectPolicy(canvasUrl),
+	}
+
+	return client, nil
+}
+
+// redirectPolicy follows up to maxRedirects redirects, and removes the access token from requests
+// redirected anywhere but the Canvas server. The HTTP client only removes it when redirected to
+// another domain, but storage services can be on subdomains of the Canvas server, and some reject
+// requests that carry credentials they do not expect.
+func redirectPolicy(canvasUrl *url.URL) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Host != canvasUrl.Host || req.URL.Scheme != canvasUrl.Scheme {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
+}
+
+// headerTransport sets the User-Agent on every request, and adds extra headers to requests to the
+// Canvas server. The extra headers, which may contain credentials for an authenticating proxy,
+// are not sent to other hosts such as the storage servers that file downloads redirect to.
+type headerTransport struct {
+	base       http.RoundTripper
+	userAgent  string
+	headers    map[string]string
+	canvasHost string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given.
+	req = req.Clone(req.Context())
+
+	req.Header.Set("User-Agent", t.userAgent)
+	if req.URL.Host == t.canvasHost {
+		for name, value := range t.headers {
+			req.Header.Set(name, value)
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
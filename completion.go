@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The subcommands, for completion. Syncing is the default, with no subcommand.
+var subcommands = []struct {
+	name, description string
+}{
+	{"archive", "write the files of a course to an archive"},
+	{"browse", "list the synced files without connecting to Canvas"},
+	{"completion", "write a shell completion script"},
+	{"diff", "list the files changed on Canvas since the last sync"},
+	{"digest", "summarise the files recently published on Canvas"},
+	{"doctor", "check for common problems"},
+	{"exclude", "leave folders out of syncs"},
+	{"finalize", "check and close out a finished course"},
+	{"get", "download a file or folder from Canvas without syncing"},
+	{"grades", "report your grades"},
+	{"log", "list recent syncs and what they downloaded"},
+	{"ls", "list the files on Canvas without syncing them"},
+	{"lsl", "list the files on Canvas with their sizes and times"},
+	{"mount", "serve your courses on Canvas for the file manager to mount"},
+	{"open", "open the Canvas page of a synced file"},
+	{"push", "make a folder on Canvas match a local directory"},
+	{"put", "upload files to a folder on Canvas"},
+	{"quota", "report how much the files of each course take up"},
+	{"search", "find synced files by the words in them"},
+	{"select", "choose the courses to sync"},
+	{"serve", "sync when asked through an HTTP API"},
+	{"service", "install a service that syncs on a schedule"},
+	{"state", "export or import the state kept between syncs"},
+	{"stats", "show how much space courses take up"},
+	{"status", "list the downloads waiting to be retried"},
+	{"submit", "hand in files for an assignment"},
+	{"trash", "delete old files from the trash"},
+}
+
+// Flags, global or of a subcommand, that take the ID of a course, which are completed with the
+// courses that have been synced.
+var courseFlags = []string{"course", "refresh"}
+
+// runCompletion implements the completion subcommand, which writes a script for a shell to
+// complete the subcommands and flags of canvas-sync, and the IDs of synced courses.
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: canvas-sync completion bash|zsh|fish|powershell")
+	}
+
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout)
+	case "zsh":
+		writeZshCompletion(os.Stdout)
+	case "fish":
+		writeFishCompletion(os.Stdout)
+	case "powershell":
+		writePowerShellCompletion(os.Stdout)
+	default:
+		return fmt.Errorf("unknown shell %q: must be bash, zsh, fish or powershell", args[0])
+	}
+	return nil
+}
+
+// runCompleteCourses implements the hidden __complete subcommand that completion scripts call to
+// list the synced courses, one per line as the course ID, a tab and the name of the course
+// directory. It only reads the state directory, so that completion is quick and works offline.
+func runCompleteCourses(args []string) error {
+	if len(args) != 1 || args[0] != "courses" {
+		return fmt.Errorf("usage: canvas-sync __complete courses")
+	}
+
+	courseDirs, err := loadCourseDirectories()
+	if err != nil {
+		return err
+	}
+	ids := sortedKeys(courseDirs)
+	sort.Slice(ids, func(i, j int) bool {
+		return filepath.Base(courseDirs[ids[i]]) < filepath.Base(courseDirs[ids[j]])
+	})
+	for _, id := range ids {
+		fmt.Printf("%d\t%s\n", id, filepath.Base(courseDirs[id]))
+	}
+	return nil
+}
+
+type completionFlag struct {
+	name, usage string
+	// Whether the flag takes a value, rather than being a switch.
+	hasValue bool
+}
+
+// globalFlags returns the flags that come before the subcommand.
+func globalFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{f.Name, f.Usage, !ok || !b.IsBoolFlag()})
+	})
+	return flags
+}
+
+// flagSpelling returns a flag as it is usually typed: with one dash if it is a single letter, and
+// otherwise two.
+func flagSpelling(name string) string {
+	if len(name) == 1 {
+		return "-" + name
+	}
+	return "--" + name
+}
+
+// courseFlagPattern returns a shell case pattern that matches the course flags with one or two
+// dashes.
+func courseFlagPattern() string {
+	var patterns []string
+	for _, name := range courseFlags {
+		patterns = append(patterns, "-"+name, "--"+name)
+	}
+	return strings.Join(patterns, "|")
+}
+
+func writeBashCompletion(w io.Writer) {
+	var commands, flags []string
+	for _, c := range subcommands {
+		commands = append(commands, c.name)
+	}
+	for _, f := range globalFlags() {
+		flags = append(flags, flagSpelling(f.name))
+	}
+
+	fmt.Fprintf(w, `# bash completion for canvas-sync. Load it with: source <(canvas-sync completion bash)
+_canvas_sync() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        %s)
+            COMPREPLY=($(compgen -W "$(canvas-sync __complete courses 2>/dev/null | cut -f1)" -- "$cur"))
+            return
+            ;;
+    esac
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    else
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    fi
+}
+complete -F _canvas_sync canvas-sync
+`, courseFlagPattern(), strings.Join(flags, " "), strings.Join(commands, " "))
+}
+
+func writeZshCompletion(w io.Writer) {
+	var commands, flags []string
+	for _, c := range subcommands {
+		commands = append(commands, zshQuote(c.name+":"+c.description))
+	}
+	for _, f := range globalFlags() {
+		flags = append(flags, zshQuote(flagSpelling(f.name)+":"+f.usage))
+	}
+
+	fmt.Fprintf(w, `#compdef canvas-sync
+# zsh completion for canvas-sync. Load it with: source <(canvas-sync completion zsh)
+_canvas_sync() {
+    local -a candidates
+    case "${words[CURRENT-1]}" in
+        %s)
+            candidates=(${(f)"$(canvas-sync __complete courses 2>/dev/null | tr '\t' ':')"})
+            _describe 'course' candidates
+            return
+            ;;
+    esac
+    if [[ "$PREFIX" == -* ]]; then
+        candidates=(%s)
+        _describe 'flag' candidates
+    else
+        candidates=(%s)
+        _describe 'command' candidates
+    fi
+}
+compdef _canvas_sync canvas-sync
+`, courseFlagPattern(), strings.Join(flags, " "), strings.Join(commands, " "))
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion for canvas-sync. Load it with: canvas-sync completion fish | source")
+	fmt.Fprintln(w, "complete -c canvas-sync -f")
+	for _, c := range subcommands {
+		fmt.Fprintf(w, "complete -c canvas-sync -n __fish_use_subcommand -a %s -d %s\n", fishQuote(c.name), fishQuote(c.description))
+	}
+	for _, f := range globalFlags() {
+		option := "-l " + f.name
+		if len(f.name) == 1 {
+			option = "-s " + f.name
+		}
+		value := ""
+		if f.hasValue {
+			value = " -r"
+		}
+		fmt.Fprintf(w, "complete -c canvas-sync %s%s -d %s\n", option, value, fishQuote(f.usage))
+	}
+	for _, name := range courseFlags {
+		fmt.Fprintf(w, "complete -c canvas-sync -l %s -x -a '(canvas-sync __complete courses 2>/dev/null)'\n", name)
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func writePowerShellCompletion(w io.Writer) {
+	var commands, flags, courseFlagNames []string
+	for _, c := range subcommands {
+		commands = append(commands, powerShellQuote(c.name))
+	}
+	for _, f := range globalFlags() {
+		flags = append(flags, powerShellQuote(flagSpelling(f.name)))
+	}
+	for _, name := range courseFlags {
+		courseFlagNames = append(courseFlagNames, powerShellQuote("-"+name), powerShellQuote("--"+name))
+	}
+
+	fmt.Fprintf(w, `# PowerShell completion for canvas-sync. Load it with: canvas-sync completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName 'canvas-sync', 'canvas-sync.exe' -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    $prev = if ($wordToComplete) { $words[-2] } else { $words[-1] }
+    if ($prev -in @(%s)) {
+        canvas-sync __complete courses 2>$null | ForEach-Object {
+            $id, $name = $_ -split "`+"`t"+`", 2
+            if ($id -like "$wordToComplete*") {
+                [System.Management.Automation.CompletionResult]::new($id, "$id $name", 'ParameterValue', $name)
+            }
+        }
+        return
+    }
+    $candidates = if ($wordToComplete -like '-*') { @(%s) } else { @(%s) }
+    $candidates | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`, strings.Join(courseFlagNames, ", "), strings.Join(flags, ", "), strings.Join(commands, ", "))
+}
+
+func powerShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
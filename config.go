@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	atomicFile "github.com/natefinch/atomic"
+	"golang.org/x/text/unicode/norm"
+)
+
+type Config struct {
+	Url            string   `json:"url"`
+	Token          string   `json:"token"`
+	Directory      string   `json:"directory"`
+	IgnoredCourses []uint64 `json:"ignored_courses"`
+
+	// More access tokens, such as one for a TA account, tried in turn for the courses that token
+	// cannot see.
+	ExtraTokens []string `json:"extra_tokens"`
+
+	// Groups that the user is a member of but does not want to be synced.
+	IgnoredGroups []uint64 `json:"ignored_groups"`
+	// Directory, relative to Directory, where group files are synced to. Defaults to "Groups".
+	GroupsDir string `json:"groups_directory"`
+
+	// How course directories are arranged in Directory: "flat", the default, or nested in a
+	// directory for their enrollment "term" or its "year".
+	Layout string `json:"layout"`
+
+	// Template for the names of course directories, such as "{{.CourseCode}}". Defaults to the
+	// name of the course.
+	CourseDirTemplate string `json:"course_dir_template"`
+
+	courseDirTemplate *template.Template
+
+	// Name course directories after the nicknames the user has given the courses on Canvas.
+	CourseNicknames bool `json:"course_nicknames"`
+
+	// List courses with the GraphQL API, in one request rather than page by page.
+	UseGraphQL bool `json:"graphql"`
+
+	// For Canvas admins, sync the courses in this account and its sub-accounts rather than those
+	// the user is enrolled in, optionally only those in some enrollment terms and states.
+	AccountId           uint64   `json:"account_id"`
+	AccountTermIds      []uint64 `json:"account_term_ids"`
+	AccountCourseStates []string `json:"account_course_states"`
+	// Most courses synced at once. Defaults to 4 with account_id, and otherwise no limit.
+	MaxCoursesSetting int `json:"max_concurrent_courses"`
+
+	// Sync the user's own files, "My Files" on Canvas, into a Personal directory.
+	SyncPersonalFiles bool `json:"sync_personal_files"`
+
+	// Download audio and video recordings in courses into a Media directory in each course.
+	SyncMedia bool `json:"sync_media"`
+	// Largest recording, in megabytes, to download. If every rendition of a recording is bigger
+	// than this, it is skipped. Zero means no limit.
+	MediaMaxSizeMB int64 `json:"media_max_size_mb"`
+
+	// Export the discussions in courses as Markdown into a Discussions directory in each course.
+	SyncDiscussions bool `json:"sync_discussions"`
+
+	// For teachers, download the files that students have submitted for each assignment into a
+	// Submissions directory in each course, named after the students unless anonymized.
+	SyncSubmissions      bool `json:"sync_submissions"`
+	AnonymizeSubmissions bool `json:"anonymize_submissions"`
+
+	// Download files that are linked to from pages, assignments and announcements but are not in
+	// any folder that can be seen, into a Linked Files directory in each course.
+	SyncLinkedFiles bool `json:"sync_linked_files"`
+
+	// Export quizzes, and the rubrics of assignments, as JSON and Markdown into Quizzes and Rubrics
+	// directories in each course.
+	SyncQuizzes bool `json:"sync_quizzes"`
+	SyncRubrics bool `json:"sync_rubrics"`
+
+	// Write a report of the user's grades in each course whenever they change.
+	GradesSnapshot bool `json:"grades_snapshot"`
+
+	// Write the ID, code, term and teachers of each course to .canvas-course.json in its directory.
+	CourseInfo bool `json:"course_info"`
+
+	// Write the events and assignment due dates in the synced courses to a calendar file.
+	SyncCalendar bool `json:"sync_calendar"`
+
+	// Courses whose files take up more than this, such as "5GB", are not synced.
+	MaxCourseSizeSetting string `json:"max_course_size"`
+	// Files are not downloaded if they would make the files synced by canvas-sync take up more
+	// than this, such as "50GB".
+	MaxTotalSizeSetting string `json:"max_total_size"`
+
+	maxCourseSize int64
+	maxTotalSize  int64
+
+	// Log everything, including every request, to this file, which is rotated once it grows past
+	// log_file_max_size, such as "10MB".
+	LogFile               string `json:"log_file"`
+	LogFileMaxSizeSetting string `json:"log_file_max_size"`
+
+	logFileMaxSize int64
+
+	// Unicode normalization form, "nfc" or "nfd", that the names of files and folders are converted
+	// to. By default they are left as Canvas sends them.
+	UnicodeNormalization string `json:"unicode_normalization"`
+
+	// What to do when a file would be downloaded through a symbolic link in the sync directory:
+	// "follow" it, the default, "skip" the file or stop the sync with an "error".
+	Symlinks string `json:"symlinks"`
+
+	// Treat files as updated when their content last changed, rather than when Canvas last changed
+	// anything about them.
+	UseModifiedAt bool `json:"use_modified_at"`
+
+	// Which name to save files as: the "display_name" shown on Canvas, the default, the "filename"
+	// they were uploaded with, or the display name with the extension of the file name if it has
+	// none, "add_extension".
+	FileNames string `json:"file_names"`
+
+	// Keep the index that the search subcommand uses up to date on every sync.
+	SearchIndex bool `json:"search_index"`
+
+	// Extract downloaded zip files into a directory next to them.
+	ExtractZips bool `json:"extract_zips"`
+
+	// Commands to run on downloaded files, such as to convert them to PDF, and how many may run
+	// at once.
+	FileHooks          []FileHook `json:"file_hooks"`
+	MaxConcurrentHooks int        `json:"max_concurrent_hooks"`
+
+	// Where to record the Canvas IDs of downloaded files: in their "xattr" extended attributes or
+	// a "sidecar" file in each directory. By default they are only kept in the manifest.
+	FileMetadata string `json:"file_metadata"`
+
+	// How to tell whether local copies are up-to-date: "mtime", the default, compares their size
+	// and modification time, and "hash" also compares their content with what was downloaded.
+	CheckMode string `json:"check_mode"`
+
+	// How --dedupe stores files with the same content only once: "hardlink", the default, or
+	// "reflink" on file systems that support it.
+	DedupeMethodSetting string `json:"dedupe_method"`
+
+	// Tags maps a tag name to the IDs of the courses that have that tag.
+	Tags map[string][]uint64 `json:"tags"`
+
+	// Well-known folders to leave out of every course: "unfiled", "course_image" and "hidden".
+	SkipFolders []string `json:"skip_folders"`
+	// Folders to leave out of particular courses, replacing skip_folders for those courses.
+	CourseSkipFolders map[uint64][]string `json:"course_skip_folders"`
+
+	// Folders to leave out of particular courses, by course ID and then folder ID. Folders can also
+	// be excluded with the exclude command.
+	ExcludedFolders map[uint64][]uint64 `json:"excluded_folders"`
+
+	// Folders excluded with the exclude command, loaded from the state directory.
+	excludedFolders ExcludedFolders
+
+	PostSyncHook *PostSyncHook `json:"post_sync_hook"`
+
+	// Keep previous versions of files updated on Canvas in a .versions directory next to them.
+	KeepVersions bool `json:"keep_versions"`
+
+	// User-Agent sent with every request. Defaults to identifying canvas-sync.
+	UserAgent string `json:"user_agent"`
+	// Extra headers sent with every request to the Canvas server, for example a cookie needed by
+	// an authenticating proxy in front of it.
+	Headers map[string]string `json:"headers"`
+	// URL of an HTTP, HTTPS or SOCKS5 proxy. Defaults to the proxy set in the environment.
+	Proxy string `json:"proxy"`
+
+	// Path to a file of PEM encoded certificates to trust in addition to the system's, for
+	// networks that intercept TLS.
+	CABundle string `json:"ca_bundle"`
+	// Seconds allowed to connect to a server. Defaults to 30.
+	ConnectTimeoutSeconds int `json:"connect_timeout_seconds"`
+	// Seconds allowed for a server to start responding to a request. Defaults to 60.
+	ResponseTimeoutSeconds int `json:"response_timeout_seconds"`
+
+	// Maximum number of API calls in flight at once. Defaults to 8.
+	MaxRequests int `json:"max_concurrent_requests"`
+
+	// Minutes without any progress after which a sync is stopped and diagnostics are written.
+	// Defaults to 10; a negative number disables the watchdog.
+	WatchdogMinutes int `json:"watchdog_minutes"`
+
+	// Number of days to keep replaced files in the trash. Defaults to 30.
+	TrashRetentionDays int `json:"trash_retention_days"`
+
+	// Rules that skip files, or save them somewhere else, by their content type and size.
+	ContentTypeRules []ContentTypeRule `json:"content_type_rules"`
+}
+
+// SyncRoots returns the directories that files are synced to: the sync directory and any other
+// directories that content_type_rules save files under.
+func (config *Config) SyncRoots() []string {
+	roots := []string{config.Directory}
+	for _, rule := range config.ContentTypeRules {
+		if rule.Directory == "" || syncRootOf(roots, rule.Directory) != "" {
+			continue
+		}
+		roots = append(roots, rule.Directory)
+	}
+	return roots
+}
+
+// syncRootOf returns the one of roots that path is inside, or "" if none.
+func syncRootOf(roots []string, path string) string {
+	for _, root := range roots {
+		if _, ok := pathWithin(root, path); ok {
+			return root
+		}
+	}
+	return ""
+}
+
+// CourseDirectory returns the directory that the files in a course are synced to.
+func (config *Config) CourseDirectory(course Course) string {
+	return filepath.Join(config.Directory, course.localDirectory())
+}
+
+// CalendarPath returns the path of the calendar file in the sync directory.
+func (config *Config) CalendarPath() string {
+	return filepath.Join(config.Directory, calendarFileName)
+}
+
+func (config *Config) GroupsDirectory() string {
+	if config.GroupsDir == "" {
+		return filepath.Join(config.Directory, defaultGroupsDirectory)
+	}
+
+	return filepath.Join(config.Directory, config.GroupsDir)
+}
+
+// Account returns the account whose courses are synced, or nil to sync the user's own courses.
+func (config *Config) Account() *AccountCourses {
+	if config.AccountId == 0 {
+		return nil
+	}
+	return &AccountCourses{Id: config.AccountId, TermIds: config.AccountTermIds, States: config.AccountCourseStates}
+}
+
+// MaxConcurrentCourses returns the most courses to sync at once, or zero for no limit.
+func (config *Config) MaxConcurrentCourses() int {
+	if config.MaxCoursesSetting > 0 || config.AccountId == 0 {
+		return config.MaxCoursesSetting
+	}
+	return defaultMaxConcurrentAccountCourses
+}
+
+// MaxCourseSize returns the largest course that will be synced in bytes, or zero for no limit.
+func (config *Config) MaxCourseSize() int64 {
+	return config.maxCourseSize
+}
+
+// MaxTotalSize returns the most space that the files synced by canvas-sync may take up in bytes, or
+// zero for no limit.
+func (config *Config) MaxTotalSize() int64 {
+	return config.maxTotalSize
+}
+
+func (config *Config) DedupeMethod() string {
+	if config.DedupeMethodSetting == "" {
+		return dedupeHardlink
+	}
+
+	return config.DedupeMethodSetting
+}
+
+func (config *Config) MaxConcurrentRequests() int {
+	if config.MaxRequests <= 0 {
+		return defaultMaxConcurrentRequests
+	}
+
+	return config.MaxRequests
+}
+
+func (config *Config) WatchdogTimeout() time.Duration {
+	if config.WatchdogMinutes < 0 {
+		return 0
+	}
+	if config.WatchdogMinutes == 0 {
+		return defaultWatchdogTimeout
+	}
+
+	return time.Duration(config.WatchdogMinutes) * time.Minute
+}
+
+func (config *Config) TrashRetention() time.Duration {
+	if config.TrashRetentionDays <= 0 {
+		return defaultTrashRetention
+	}
+
+	return time.Duration(config.TrashRetentionDays) * 24 * time.Hour
+}
+
+const (
+	defaultMaxConcurrentRequests = 8
+	defaultGroupsDirectory       = "Groups"
+	personalDirectory            = "Personal"
+)
+
+// ConfigError is returned when the config file is missing or invalid.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configDir returns the directory containing the config file.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find config directory: %w", err)
+	}
+
+	return filepath.Join(dir, "canvas-sync"), nil
+}
+
+// configPath returns the path of the config file.
+func configPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// setConfigSetting sets a setting in the config file to value, keeping the rest of the file as it
+// is, including the order of the settings.
+func setConfigSetting(key string, value any) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return &ConfigError{fmt.Errorf("cannot open config file: %w", err)}
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	// Find where the value of the setting is, or else the end of the last setting, and the space
+	// before the first setting to put before a new one.
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return &ConfigError{fmt.Errorf("invalid config file: not a JSON object")}
+	}
+	rest := content[dec.InputOffset():]
+	indent := rest[:len(rest)-len(bytes.TrimLeft(rest, " \t\r\n"))]
+	var start, end int64
+	found := false
+	for dec.More() {
+		name, err := dec.Token()
+		if err != nil {
+			return &ConfigError{fmt.Errorf("invalid config file: %w", err)}
+		}
+		valueStart := dec.InputOffset()
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return &ConfigError{fmt.Errorf("invalid config file: %w", err)}
+		}
+		start, end = valueStart, dec.InputOffset()
+		if name == key {
+			found = true
+			break
+		}
+	}
+
+	var b bytes.Buffer
+	switch {
+	case found:
+		// start is just after the name, before the colon.
+		b.Write(content[:start])
+		fmt.Fprintf(&b, ": %s", encoded)
+		b.Write(content[end:])
+	case end > 0:
+		b.Write(content[:end])
+		fmt.Fprintf(&b, ",%s%q: %s", indent, key, encoded)
+		b.Write(content[end:])
+	default:
+		fmt.Fprintf(&b, "{\n    %q: %s\n}\n", key, encoded)
+	}
+
+	return atomicFile.WriteFile(path, &b)
+}
+
+func loadConfig() (*Config, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("cannot open config file: %w", err)}
+	}
+
+	var config Config
+	if err := decodeConfig(content, &config); err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid config file %s: %w", path, err)}
+	}
+	if err := expandPaths(&config, filepath.Dir(path)); err != nil {
+		return nil, &ConfigError{err}
+	}
+	if err := validateRequired(&config); err != nil {
+		return nil, &ConfigError{err}
+	}
+
+	if config.maxCourseSize, err = parseSize(config.MaxCourseSizeSetting); err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid max_course_size: %w", err)}
+	}
+	if config.maxTotalSize, err = parseSize(config.MaxTotalSizeSetting); err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid max_total_size: %w", err)}
+	}
+	if config.logFileMaxSize, err = parseSize(config.LogFileMaxSizeSetting); err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid log_file_max_size: %w", err)}
+	}
+
+	switch config.UnicodeNormalization {
+	case "":
+		nameNormalization = nil
+	case "nfc":
+		nameNormalization = norm.NFC.String
+	case "nfd":
+		nameNormalization = norm.NFD.String
+	default:
+		return nil, &ConfigError{fmt.Errorf("invalid unicode_normalization %q: must be \"nfc\" or \"nfd\"", config.UnicodeNormalization)}
+	}
+
+	switch config.Symlinks {
+	case "", symlinksFollow, symlinksSkip, symlinksError:
+	default:
+		return nil, &ConfigError{fmt.Errorf("invalid symlinks %q: must be \"follow\", \"skip\" or \"error\"", config.Symlinks)}
+	}
+
+	switch config.Layout {
+	case "", layoutFlat, layoutTerm, layoutYear:
+	default:
+		return nil, &ConfigError{fmt.Errorf("invalid layout %q: must be \"flat\", \"term\" or \"year\"", config.Layout)}
+	}
+
+	if config.CourseDirTemplate != "" {
+		if config.courseDirTemplate, err = parseCourseDirTemplate(config.CourseDirTemplate); err != nil {
+			return nil, &ConfigError{fmt.Errorf("invalid course_dir_template: %w", err)}
+		}
+	}
+
+	switch config.FileMetadata {
+	case "", fileMetadataSidecar:
+	case fileMetadataXattr:
+		if !xattrSupported {
+			return nil, &ConfigError{fmt.Errorf("file_metadata cannot be \"xattr\" as extended attributes are not supported on this system: use \"sidecar\" instead")}
+		}
+	default:
+		return nil, &ConfigError{fmt.Errorf("invalid file_metadata %q: must be \"xattr\" or \"sidecar\"", config.FileMetadata)}
+	}
+
+	switch config.FileNames {
+	case "", fileNamesDisplayName, fileNamesUploadName, fileNamesAddExtension:
+	default:
+		return nil, &ConfigError{fmt.Errorf("invalid file_names %q: must be \"display_name\", \"filename\" or \"add_extension\"", config.FileNames)}
+	}
+
+	for i := range config.FileHooks {
+		if err := config.FileHooks[i].validate(); err != nil {
+			return nil, &ConfigError{fmt.Errorf("invalid file_hooks: %w", err)}
+		}
+	}
+
+	for i := range config.ContentTypeRules {
+		if err := config.ContentTypeRules[i].validate(); err != nil {
+			return nil, &ConfigError{fmt.Errorf("invalid content_type_rules: %w", err)}
+		}
+	}
+
+	switch config.CheckMode {
+	case "", checkModeMtime, checkModeHash:
+	default:
+		return nil, &ConfigError{fmt.Errorf("invalid check_mode %q: must be \"mtime\" or \"hash\"", config.CheckMode)}
+	}
+
+	switch config.DedupeMethodSetting {
+	case "", dedupeHardlink, dedupeReflink:
+	default:
+		return nil, &ConfigError{fmt.Errorf("invalid dedupe_method %q: must be \"hardlink\" or \"reflink\"", config.DedupeMethodSetting)}
+	}
+
+	if err := validateAccountCourseStates(config.AccountCourseStates); err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid account_course_states: %w", err)}
+	}
+	if config.AccountId == 0 && (len(config.AccountTermIds) > 0 || len(config.AccountCourseStates) > 0) {
+		return nil, &ConfigError{fmt.Errorf("account_term_ids and account_course_states need account_id to be set")}
+	}
+
+	if err := validateSkipFolders(config.SkipFolders); err != nil {
+		return nil, &ConfigError{fmt.Errorf("invalid skip_folders: %w", err)}
+	}
+	for courseId, skip := range config.CourseSkipFolders {
+		if err := validateSkipFolders(skip); err != nil {
+			return nil, &ConfigError{fmt.Errorf("invalid course_skip_folders for course %d: %w", courseId, err)}
+		}
+	}
+
+	if config.excludedFolders, err = loadExcludedFolders(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// parseSize parses a size such as "500MB" or "5 GiB" into bytes. An empty size is zero.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	size, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// decodeConfig decodes the config file, rejecting settings that canvas-sync does not know, which
+// are most likely misspelt, and saying where in the file any mistake is.
+func decodeConfig(content []byte, config *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(config)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%s: %s", configPosition(content, syntaxErr.Offset), syntaxErr)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("%s: %s should be %s, not %s", configPosition(content, typeErr.Offset), typeErr.Field, jsonTypeName(typeErr.Type), jsonValueName(typeErr.Value))
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("the file ends part way through a setting: check for a missing } or ]")
+	}
+
+	// The decoder does not say where unknown settings are, so look for their name.
+	if name, ok := unknownField(err); ok {
+		msg := fmt.Sprintf("unknown setting %q", name)
+		if suggestion := closestSetting(name); suggestion != "" {
+			msg += fmt.Sprintf(": did you mean %q?", suggestion)
+		}
+		if i := bytes.Index(content, []byte(strconv.Quote(name))); i >= 0 {
+			msg = configPosition(content, int64(i)+1) + ": " + msg
+		}
+		return errors.New(msg)
+	}
+	return err
+}
+
+// unknownField returns the name of the setting in an error from a decoder that disallows unknown
+// fields.
+func unknownField(err error) (string, bool) {
+	const prefix = "json: unknown field "
+	if !strings.HasPrefix(err.Error(), prefix) {
+		return "", false
+	}
+	name, err := strconv.Unquote(strings.TrimPrefix(err.Error(), prefix))
+	return name, err == nil
+}
+
+// configPosition describes where the byte at offset is in the config file.
+func configPosition(content []byte, offset int64) string {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	line := 1 + bytes.Count(content[:offset], []byte("\n"))
+	column := offset - int64(bytes.LastIndexByte(content[:offset], '\n'))
+	return fmt.Sprintf("line %d, column %d", line, column)
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list of " + strings.TrimPrefix(strings.TrimPrefix(jsonTypeName(t.Elem()), "a "), "an ") + "s"
+	default:
+		return "an object"
+	}
+}
+
+// jsonValueName describes the kind of JSON value given in an UnmarshalTypeError.
+func jsonValueName(value string) string {
+	kind, _, _ := strings.Cut(value, " ")
+	switch kind {
+	case "bool":
+		return "true or false"
+	case "array":
+		return "a list"
+	case "object":
+		return "an object"
+	default:
+		return "a " + value
+	}
+}
+
+// closestSetting returns the known setting most like name, if any is close enough to be a typo.
+func closestSetting(name string) string {
+	best, bestDistance := "", len(name)/3+1
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		setting, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if setting == "" || setting == "-" {
+			continue
+		}
+		if d := editDistance(name, setting); d < bestDistance {
+			best, bestDistance = setting, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// expandPath expands a leading ~ in a path from the config file to the user's home directory, and
+// $VAR or ${VAR} to the value of the environment variable, and makes a relative path relative to
+// base, the directory of the config file, so that it does not depend on where canvas-sync is run
+// from.
+func expandPath(path string, base string) (string, error) {
+	var unset []string
+	path = os.Expand(path, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(unset, " and "))
+	}
+
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// expandPaths expands the paths in the config file with expandPath.
+func expandPaths(config *Config, base string) error {
+	type setting struct {
+		name string
+		path *string
+	}
+	paths := []setting{{"directory", &config.Directory}, {"ca_bundle", &config.CABundle}, {"log_file", &config.LogFile}}
+	for i := range config.ContentTypeRules {
+		paths = append(paths, setting{"content_type_rules directory", &config.ContentTypeRules[i].Directory})
+	}
+
+	for _, p := range paths {
+		if *p.path == "" {
+			continue
+		}
+		expanded, err := expandPath(*p.path, base)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", p.name, *p.path, err)
+		}
+		*p.path = expanded
+	}
+	return nil
+}
+
+// validateRequired checks the settings that canvas-sync cannot work without: the address of a
+// Canvas server, a token and a sync directory that exists or can be created.
+func validateRequired(config *Config) error {
+	if config.Url == "" || config.Token == "" || config.Directory == "" {
+		var missing []string
+		for _, s := range []struct{ name, value string }{{"url", config.Url}, {"token", config.Token}, {"directory", config.Directory}} {
+			if s.value == "" {
+				missing = append(missing, s.name)
+			}
+		}
+		return fmt.Errorf("%s must be set", strings.Join(missing, " and "))
+	}
+
+	u, err := url.Parse(config.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q: it should be the address you use to log in to Canvas, such as https://canvas.northwestern.edu", config.Url)
+	}
+
+	return validateDirectory(config.Directory)
+}
+
+// validateDirectory checks that the sync directory is a directory or can be created.
+func validateDirectory(dir string) error {
+	for path := dir; ; path = filepath.Dir(path) {
+		fi, err := os.Stat(path)
+		switch {
+		case err == nil && fi.IsDir():
+			return nil
+		case err == nil:
+			return fmt.Errorf("invalid directory %q: %s is a file, not a directory", dir, path)
+		case !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR):
+			return fmt.Errorf("invalid directory %q: %w", dir, err)
+		case filepath.Dir(path) == path:
+			return fmt.Errorf("invalid directory %q: cannot be created", dir)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandPaths(t *testing.T) {
+	home := filepath.Join(t.TempDir(), "home")
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("CANVAS_DIR", filepath.Join(home, "Canvas"))
+	t.Setenv("CANVAS_NAME", "Canvas")
+
+	base := filepath.Join(t.TempDir(), "config")
+	abs := filepath.Join(t.TempDir(), "elsewhere", "Canvas")
+
+	tests := []struct {
+		path string
+		want string
+		// Part of the error expected instead, if not empty.
+		err string
+	}{
+		{"~", home, ""},
+		{"~/Canvas", filepath.Join(home, "Canvas"), ""},
+		{"$CANVAS_DIR", filepath.Join(home, "Canvas"), ""},
+		{"${CANVAS_DIR}/Media", filepath.Join(home, "Canvas", "Media"), ""},
+		{"~/${CANVAS_NAME}-media", filepath.Join(home, "Canvas-media"), ""},
+		{"$CANVAS_UNSET/Canvas", "", "environment variable CANVAS_UNSET is not set"},
+		{"${CANVAS_UNSET}/$CANVAS_OTHER", "", "CANVAS_UNSET and CANVAS_OTHER"},
+		{"Canvas", filepath.Join(base, "Canvas"), ""},
+		{filepath.Join("..", "Canvas"), filepath.Join(filepath.Dir(base), "Canvas"), ""},
+		{abs, abs, ""},
+		{abs + string(filepath.Separator), abs, ""},
+	}
+	for _, test := range tests {
+		config := &Config{
+			Directory:        test.path,
+			ContentTypeRules: []ContentTypeRule{{Directory: test.path}},
+		}
+		err := expandPaths(config, base)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expandPaths(%q) gives error %v, want one with %q", test.path, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandPaths(%q): %v", test.path, err)
+			continue
+		}
+		if config.Directory != test.want {
+			t.Errorf("expandPaths(%q) gives directory %q, want %q", test.path, config.Directory, test.want)
+		}
+		if config.ContentTypeRules[0].Directory != test.want {
+			t.Errorf("expandPaths(%q) gives rule directory %q, want %q", test.path, config.ContentTypeRules[0].Directory, test.want)
+		}
+	}
+
+	// Settings that are not set stay that way.
+	config := &Config{}
+	if err := expandPaths(config, base); err != nil {
+		t.Fatal(err)
+	}
+	if config.Directory != "" || config.CABundle != "" || config.LogFile != "" {
+		t.Errorf("expandPaths set paths that were not set: %+v", config)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ContentTypeRule is a rule from content_type_rules, which skips the files of some content types,
+// or saves them under another directory, such as one on an external drive.
+type ContentTypeRule struct {
+	// The content type the rule is for, such as "application/zip", or a pattern such as "video/*".
+	ContentType string `json:"content_type"`
+	// Only apply the rule to files larger than this, such as "500 MB".
+	LargerThanSetting string `json:"larger_than"`
+	largerThan        int64
+
+	// Do not download the files.
+	Skip bool `json:"skip"`
+	// Save the files under this directory instead of the sync directory, keeping the same path
+	// within it.
+	Directory string `json:"directory"`
+}
+
+// validate checks a rule from the config file.
+func (rule *ContentTypeRule) validate() error {
+	if rule.ContentType == "" {
+		return fmt.Errorf("content_type must be set")
+	}
+	if _, err := path.Match(rule.ContentType, ""); err != nil {
+		return fmt.Errorf("invalid content_type %q: %w", rule.ContentType, err)
+	}
+
+	var err error
+	if rule.largerThan, err = parseSize(rule.LargerThanSetting); err != nil {
+		return fmt.Errorf("invalid larger_than: %w", err)
+	}
+
+	if rule.Skip == (rule.Directory != "") {
+		return fmt.Errorf("the rule for %q must either skip files or give a directory for them", rule.ContentType)
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to a file.
+func (rule *ContentTypeRule) matches(file File) bool {
+	if file.Size <= rule.largerThan {
+		return false
+	}
+
+	contentType, _, err := mime.ParseMediaType(file.ContentType)
+	if err != nil {
+		return false
+	}
+	ok, _ := path.Match(strings.ToLower(rule.ContentType), contentType)
+	return ok
+}
+
+// ContentRules decides, from the content type and size of each file, whether it is downloaded and
+// where it goes. The methods of a nil ContentRules download every file where it would be anyway.
+type ContentRules struct {
+	rules []ContentTypeRule
+	// The sync directory, which the paths of files routed elsewhere are relative to.
+	root string
+}
+
+// NewContentRules returns the content_type_rules in the config file, or nil if there are none.
+func NewContentRules(config *Config) *ContentRules {
+	if len(config.ContentTypeRules) == 0 {
+		return nil
+	}
+	return &ContentRules{rules: config.ContentTypeRules, root: config.Directory}
+}
+
+// Route returns the path to save a file to, given the path it would be saved to otherwise, and
+// reports whether it is to be downloaded at all. The first rule that matches the file applies.
+func (r *ContentRules) Route(file File, filePath string) (string, bool) {
+	if r == nil {
+		return filePath, true
+	}
+
+	for _, rule := range r.rules {
+		if !rule.matches(file) {
+			continue
+		}
+		if rule.Skip {
+			return "", false
+		}
+
+		rel, ok := pathWithin(r.root, filePath)
+		if !ok {
+			return filePath, true
+		}
+		return filepath.Join(rule.Directory, rel), true
+	}
+	return filePath, true
+}
+
+type contentRulesContextKey struct{}
+
+// withContentRules records in the context the rules that decide which files are downloaded and
+// where to.
+func withContentRules(ctx context.Context, rules *ContentRules) context.Context {
+	return context.WithValue(ctx, contentRulesContextKey{}, rules)
+}
+
+func contentRulesFromContext(ctx context.Context) *ContentRules {
+	rules, _ := ctx.Value(contentRulesContextKey{}).(*ContentRules)
+	return rules
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+const courseDirectoriesStateFile = "course_directories.json"
+
+// Longest name, in characters, that course_dir_template can give a course directory.
+const maxCourseDirNameLength = 80
+
+// CourseDirData is what course_dir_template can refer to.
+type CourseDirData struct {
+	Id         uint64
+	Name       string
+	CourseCode string
+	// Name of the course's enrollment term, if it has one.
+	Term string
+}
+
+func parseCourseDirTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("course_dir_template").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch references to fields that do not exist now rather than on every sync.
+	if err := tmpl.Execute(io.Discard, CourseDirData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// courseDirName returns the name that tmpl gives the directory of a course, shortened if it is
+// too long, or the name of the course if it gives none.
+func courseDirName(tmpl *template.Template, course Course) string {
+	data := CourseDirData{Id: course.Id, Name: course.Name, CourseCode: course.CourseCode}
+	if course.Term != nil {
+		data.Term = course.Term.Name
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		logErrorf("cannot name the directory of %s with course_dir_template: %s", course.Name, err)
+		return course.Name
+	}
+
+	name := strings.TrimSpace(b.String())
+	if utf8.RuneCountInString(name) > maxCourseDirNameLength {
+		name = string([]rune(name)[:maxCourseDirNameLength])
+		name = strings.TrimRight(name, " -_,.;:(")
+	}
+	if name == "" {
+		return course.Name
+	}
+	return name
+}
+
+func loadCourseDirectories() (map[uint64]string, error) {
+	dirs := make(map[uint64]string)
+	if err := loadState(courseDirectoriesStateFile, &dirs); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// moveCourseDirectory moves the directory that a course was last synced to, recorded in dirs, to
+// the directory it is synced to now, if they differ, so that a course whose directory is named
+// differently, after a change to course_dir_template or layout, is not downloaded again. Courses
+// not in dirs were last synced to a directory named after them in the sync directory.
+func moveCourseDirectory(config *Config, manifest *Manifest, dirs map[uint64]string, course Course) error {
+	newDir := config.CourseDirectory(course)
+	oldDir, ok := dirs[course.Id]
+	if !ok {
+		oldDir = filepath.Join(config.Directory, localName(course.Name))
+	}
+	if oldDir == newDir {
+		dirs[course.Id] = newDir
+		return nil
+	}
+
+	if _, err := os.Stat(oldDir); errors.Is(err, os.ErrNotExist) {
+		dirs[course.Id] = newDir
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(newDir); err == nil {
+		logInfof("Not moving %s to %s as it already exists", oldDir, newDir)
+		dirs[course.Id] = newDir
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return fmt.Errorf("cannot move %s to %s: %w", oldDir, newDir, err)
+	}
+	manifest.Move(oldDir, newDir)
+	dirs[course.Id] = newDir
+
+	logInfof("Moved %s to %s", oldDir, newDir)
+	return nil
+}
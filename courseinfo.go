@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Name of the file in each course directory that describes the course, with course_info set.
+const courseInfoFileName = ".canvas-course.json"
+
+// CourseInfo describes a course, so that its directory still says what it holds long after the
+// course has gone from Canvas.
+type CourseInfo struct {
+	Id         uint64     `json:"id"`
+	Name       string     `json:"name"`
+	CourseCode string     `json:"course_code"`
+	Term       string     `json:"term,omitempty"`
+	StartAt    *time.Time `json:"start_at,omitempty"`
+	Teachers   []string   `json:"teachers,omitempty"`
+	// Address of the course on Canvas.
+	Url string `json:"url"`
+}
+
+// writeCourseInfo writes the CourseInfo of a course to courseInfoFileName in its directory.
+func writeCourseInfo(canvasUrl string, course Course, courseDir string) error {
+	info := CourseInfo{
+		Id:         course.Id,
+		Name:       course.Name,
+		CourseCode: course.CourseCode,
+		StartAt:    course.StartAt,
+		Url:        fmt.Sprintf("%s/courses/%d", strings.TrimSuffix(canvasUrl, "/"), course.Id),
+	}
+	if course.Term != nil {
+		info.Term = course.Term.Name
+	}
+	for _, teacher := range course.Teachers {
+		info.Teachers = append(info.Teachers, teacher.Name)
+	}
+
+	content, err := marshalExport(info)
+	if err != nil {
+		return err
+	}
+	return writeFileIfChanged(filepath.Join(courseDir, courseInfoFileName), content)
+}
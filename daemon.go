@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runDaemon syncs every opts.Watch until the context is cancelled. Errors from a sync are logged
+// rather than stopping the daemon.
+//
+// On Unix, SIGHUP starts a sync immediately, SIGUSR1 writes the state of the running sync to
+// the log and SIGUSR2 pauses or resumes downloads.
+func runDaemon(ctx context.Context, opts *Options) error {
+	syncNow := make(chan os.Signal, 1)
+	dumpState := make(chan os.Signal, 1)
+	togglePause := make(chan os.Signal, 1)
+	notifyDaemonSignals(syncNow, dumpState, togglePause)
+	defer signal.Stop(syncNow)
+	defer signal.Stop(dumpState)
+	defer signal.Stop(togglePause)
+
+	if opts.MetricsAddr != "" {
+		metrics = NewMetrics()
+		if err := ServeMetrics(ctx, opts.MetricsAddr, metrics); err != nil {
+			return err
+		}
+	}
+
+	var current atomic.Pointer[Pipeline]
+	var nextSync atomic.Int64
+
+	// Downloads stay paused across syncs until they are resumed.
+	pauser := NewPauser()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-dumpState:
+				if p := current.Load(); p != nil {
+					var b strings.Builder
+					p.Dump(&b)
+					logInfof("%s", b.String())
+				} else {
+					logInfof("idle, next sync at %s", time.Unix(nextSync.Load(), 0).Format(time.RFC3339))
+				}
+			case <-togglePause:
+				if pauser.Toggle() {
+					logInfof("Paused downloads; send SIGUSR2 again to resume")
+				} else {
+					logInfof("Resumed downloads")
+				}
+			}
+		}
+	}()
+
+	for {
+		pipeline := NewPipeline()
+		pipeline.Pauser = pauser
+		current.Store(pipeline)
+		startedAt := time.Now()
+		// The config is loaded for each sync, so that changes to it take effect.
+		config, err := loadConfig()
+		if err == nil {
+			err = runSync(ctx, config, opts, pipeline)
+		}
+		current.Store(nil)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		metrics.SyncFinished(startedAt, err)
+		// Syncing again will not help until the token is replaced.
+		if isTokenRejected(err) {
+			return err
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logErrorf("%s", err)
+		}
+		// --force and --refresh only download files again once, not on every sync.
+		if err == nil {
+			opts.Force, opts.Refresh, opts.RefreshPaths = false, nil, nil
+		}
+
+		nextSync.Store(time.Now().Add(opts.Watch).Unix())
+		timer := time.NewTimer(opts.Watch)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		case <-syncNow:
+			timer.Stop()
+			logInfof("Syncing now...")
+		}
+	}
+}
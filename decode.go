@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Number of times a page of a listing is requested when its response is cut off.
+const pageAttempts = 3
+
+// Most bytes of an object that cannot be parsed to include in the log.
+const snippetLength = 200
+
+// cutOffError is returned when the response for a page of a listing ends, or stops being valid
+// JSON, before the end of the list.
+type cutOffError struct {
+	Url      string
+	Received int
+	Err      error
+}
+
+func (e *cutOffError) Error() string {
+	return fmt.Sprintf("response for %s cut off after %d objects: %v", redactUrl(e.Url), e.Received, e.Err)
+}
+
+func (e *cutOffError) Unwrap() error {
+	return e.Err
+}
+
+// pageDecoder decodes the objects in a page of a listing as they arrive. It keeps the objects
+// decoded from earlier, cut off, responses for the same page and skips over them in later ones.
+type pageDecoder[T any] struct {
+	url   string
+	items []T
+	// Number of objects in the page that have been read, including any that could not be parsed.
+	seen int
+}
+
+func (page *pageDecoder[T]) Decode(body io.Reader) error {
+	dec := json.NewDecoder(body)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return &cutOffError{Url: page.url, Received: page.seen, Err: err}
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("JSON error for %s: expected a list but got %v", page.url, tok)
+	}
+
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				logInfof("invalid JSON in object %d of %s: %v: %s", i, redactUrl(page.url), err, bufferedSnippet(dec))
+			}
+			return &cutOffError{Url: page.url, Received: page.seen, Err: err}
+		}
+
+		// Already read from an earlier response.
+		if i < page.seen {
+			continue
+		}
+		page.seen++
+
+		// A single object that does not match what we expect should not stop the rest of the
+		// listing, but it should be reported.
+		var item T
+		if err := json.Unmarshal(raw, &item); err != nil {
+			logInfof("cannot parse object %d of %s, skipping it: %v: %s", i, redactUrl(page.url), err, snippet(raw))
+			continue
+		}
+		page.items = append(page.items, item)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return &cutOffError{Url: page.url, Received: page.seen, Err: err}
+	}
+
+	return nil
+}
+
+func snippet(b []byte) string {
+	b = bytes.TrimSpace(b)
+	if len(b) > snippetLength {
+		return string(b[:snippetLength]) + "..."
+	}
+	return string(b)
+}
+
+func bufferedSnippet(dec *json.Decoder) string {
+	b, _ := io.ReadAll(io.LimitReader(dec.Buffered(), snippetLength+1))
+	return snippet(b)
+}
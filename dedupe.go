@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Values of the dedupe_method setting.
+const (
+	dedupeHardlink = "hardlink"
+	dedupeReflink  = "reflink"
+)
+
+type DedupeReport struct {
+	// Number of files replaced by a link to another copy.
+	Linked int
+	// Bytes no longer taken up by separate copies.
+	Saved int64
+}
+
+// Dedupe replaces files in the manifest that have the same content as another with a hard link or
+// reflink to it, so that the content is only stored once. Files are only linked once their
+// content on disk has been checked against the hash recorded when they were downloaded, so that
+// local changes are never lost. skip reports whether a file must be left alone.
+//
+// Hard linked files share a modification time, which is used to tell whether a file is up to date
+// with Canvas, so only files with the same modification time on Canvas are hard linked.
+func Dedupe(entries []ManifestEntry, method string, skip func(entry ManifestEntry) bool) (DedupeReport, error) {
+	type key struct {
+		sha256    string
+		size      int64
+		updatedAt time.Time
+	}
+
+	groups := make(map[key][]ManifestEntry)
+	for _, entry := range entries {
+		if entry.SHA256 == "" || entry.Size == 0 || skip(entry) {
+			continue
+		}
+
+		k := key{sha256: entry.SHA256, size: entry.Size}
+		if method == dedupeHardlink {
+			k.updatedAt = entry.UpdatedAt
+		}
+		groups[k] = append(groups[k], entry)
+	}
+
+	var report DedupeReport
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].Path < group[j].Path })
+
+		// The first copy that is intact is kept and the others are linked to it.
+		var original string
+		var originalInfo os.FileInfo
+		for _, entry := range group {
+			if original == "" {
+				if intact, err := fileIntact(entry); err != nil {
+					return report, err
+				} else if intact {
+					original = entry.Path
+					if originalInfo, err = os.Stat(original); err != nil {
+						return report, err
+					}
+				}
+				continue
+			}
+
+			fi, err := os.Stat(entry.Path)
+			if err != nil {
+				continue
+			}
+			if os.SameFile(originalInfo, fi) {
+				continue
+			}
+			intact, err := fileIntact(entry)
+			if err != nil {
+				return report, err
+			}
+			if !intact {
+				continue
+			}
+
+			if err := linkFile(original, entry, method); err != nil {
+				logInfof("Cannot link %s to %s: %s", entry.Path, original, err)
+				continue
+			}
+			report.Linked++
+			report.Saved += entry.Size
+		}
+	}
+
+	return report, nil
+}
+
+// fileIntact reports whether the file at entry.Path has the content recorded in the manifest.
+func fileIntact(entry ManifestEntry) (bool, error) {
+	f, err := os.Open(entry.Path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return false, err
+	}
+
+	return n == entry.Size && hex.EncodeToString(hash.Sum(nil)) == entry.SHA256, nil
+}
+
+// linkFile replaces the file at entry.Path with a link to original.
+func linkFile(original string, entry ManifestEntry, method string) error {
+	tempPath := filepath.Join(filepath.Dir(entry.Path), fmt.Sprintf("%s-dedupe-%d", tempFilePrefix, os.Getpid()))
+	os.Remove(tempPath)
+
+	switch method {
+	case dedupeHardlink:
+		if err := os.Link(original, tempPath); err != nil {
+			return err
+		}
+	case dedupeReflink:
+		if err := reflink(original, tempPath); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+		if err := os.Chtimes(tempPath, entry.UpdatedAt, entry.UpdatedAt); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown dedupe_method %q", method)
+	}
+
+	if err := os.Rename(tempPath, entry.Path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileChange is a difference between the files on Canvas and those recorded in the manifest.
+type FileChange struct {
+	// A for a file added on Canvas, M for modified, R for renamed or moved, and D for removed.
+	Kind    byte
+	Path    string
+	OldPath string
+}
+
+// TreeDiff collects the changes to the files of a course, group or the user's personal files.
+type TreeDiff struct {
+	Name string
+	// Directory the files are synced to.
+	Root string
+	// Whether all the files could be listed, so that files not listed were removed.
+	Complete bool
+
+	mu      sync.Mutex
+	changes []FileChange
+}
+
+func (d *TreeDiff) add(change FileChange) {
+	d.mu.Lock()
+	d.changes = append(d.changes, change)
+	d.mu.Unlock()
+}
+
+// runDiff implements the diff subcommand, which lists the files added, modified, moved or removed
+// on Canvas since they were last synced. It only lists folders and files, and downloads nothing.
+func runDiff(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync diff")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+	entries := manifest.EntriesById()
+	rules := NewContentRules(config)
+
+	finalized, err := loadFinalizedCourses()
+	if err != nil {
+		return err
+	}
+
+	var seenMu sync.Mutex
+	seen := make(map[uint64]bool)
+	var diffs []*TreeDiff
+
+	diffTree := func(directory string, build func(folderListed FolderListedFunc) (*CourseTree, error)) error {
+		d := &TreeDiff{}
+		tree, err := build(func(tree *CourseTree, folder *TreeFolder, parents []*TreeFolder) error {
+			folderPath := tree.LocalPath(directory, folder, parents)
+			for _, file := range folder.files {
+				filePath, ok := rules.Route(file.File, filepath.Join(folderPath, localName(file.FileName)))
+
+				seenMu.Lock()
+				seen[file.Id] = true
+				seenMu.Unlock()
+				if !ok {
+					continue
+				}
+
+				entry, ok := entries[file.Id]
+				switch {
+				case !ok:
+					d.add(FileChange{Kind: 'A', Path: filePath})
+				case entry.Path != filePath:
+					d.add(FileChange{Kind: 'R', Path: filePath, OldPath: entry.Path})
+				case !entry.UpdatedAt.Equal(file.UpdatedAt) || entry.Size != file.Size:
+					d.add(FileChange{Kind: 'M', Path: filePath})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		d.Name = tree.Name
+		d.Root = filepath.Join(directory, tree.localDirectory())
+		d.Complete = !tree.FoldersForbidden && len(tree.ForbiddenFolders) == 0
+		diffs = append(diffs, d)
+		return nil
+	}
+
+	if err := forEachSyncedTree(ctx, api, config, opts.Tags, finalized, diffTree); err != nil {
+		return err
+	}
+
+	// Files that were synced into a tree but are no longer listed in it have been removed, except
+	// for those, such as discussion attachments, that do not come from the course's folders.
+	notFromFolders := []string{linkedFilesDirectory, discussionsDirectory, mediaDirectory}
+	for fileId, entry := range entries {
+		if seen[fileId] {
+			continue
+		}
+
+	DiffLoop:
+		for _, d := range diffs {
+			rel, err := filepath.Rel(d.Root, entry.Path)
+			if !d.Complete || err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			for _, dir := range notFromFolders {
+				if strings.HasPrefix(rel, dir+string(filepath.Separator)) {
+					continue DiffLoop
+				}
+			}
+			d.add(FileChange{Kind: 'D', Path: entry.Path})
+			break
+		}
+	}
+
+	changed := 0
+	for _, d := range diffs {
+		if len(d.changes) == 0 {
+			continue
+		}
+		changed += len(d.changes)
+
+		relPath := func(path string) string {
+			if rel, err := filepath.Rel(d.Root, path); err == nil && !strings.HasPrefix(rel, "..") {
+				return rel
+			}
+			return path
+		}
+
+		sort.Slice(d.changes, func(i, j int) bool { return d.changes[i].Path < d.changes[j].Path })
+
+		fmt.Println(d.Name)
+		for _, change := range d.changes {
+			if change.Kind == 'R' {
+				fmt.Printf("  R %s -> %s\n", relPath(change.OldPath), relPath(change.Path))
+			} else {
+				fmt.Printf("  %c %s\n", change.Kind, relPath(change.Path))
+			}
+		}
+	}
+
+	if changed == 0 {
+		fmt.Println("✓ Nothing has changed on Canvas since the last sync.")
+	}
+
+	return nil
+}
+
+// forEachSyncedTree calls visit with the directory that the files of each course, group and, if
+// they are synced, the user's personal files are synced to, and a function to build its tree, for
+// the trees that a sync with tags would sync.
+func forEachSyncedTree(ctx context.Context, api *CanvasApi, config *Config, tags []string, finalized map[uint64]FinalizedCourse, visit func(directory string, build func(folderListed FolderListedFunc) (*CourseTree, error)) error) error {
+	courses, err := api.AllCourses(ctx)
+	if err != nil {
+		return err
+	}
+
+	syncCourse := func(courseId uint64) bool {
+		for _, ignoredCourseId := range config.IgnoredCourses {
+			if courseId == ignoredCourseId {
+				return false
+			}
+		}
+		_, ok := finalized[courseId]
+		return !ok && config.HasAnyTag(courseId, tags)
+	}
+
+	for _, course := range courses {
+		if !syncCourse(course.Id) {
+			continue
+		}
+
+		course := course
+		err := visit(config.Directory, func(folderListed FolderListedFunc) (*CourseTree, error) {
+			return BuildTree(ctx, api, course, config.SkipFoldersFor(course.Id), folderListed)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.SyncPersonalFiles && len(tags) == 0 {
+		err := visit(config.Directory, func(folderListed FolderListedFunc) (*CourseTree, error) {
+			return BuildPersonalTree(ctx, api, FolderSkip{Kinds: config.SkipFolders}, folderListed)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	groups, err := listAll(ctx, api.MakeGroupsUrl(), api.Groups)
+	if err != nil && !errors.Is(err, errForbidden) {
+		return err
+	}
+
+GroupLoop:
+	for _, group := range groups {
+		for _, ignoredGroupId := range config.IgnoredGroups {
+			if group.Id == ignoredGroupId {
+				continue GroupLoop
+			}
+		}
+		if !syncCourse(group.CourseId) {
+			continue
+		}
+
+		group := group
+		err := visit(config.GroupsDirectory(), func(folderListed FolderListedFunc) (*CourseTree, error) {
+			return BuildGroupTree(ctx, api, group, config.SkipFoldersFor(group.CourseId), folderListed)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// DigestFile is a file published or updated on Canvas within the period of a digest.
+type DigestFile struct {
+	File
+	// Path relative to the course directory.
+	Path    string
+	Updated bool
+}
+
+// DigestTree lists the new files in a course, group or the user's personal files.
+type DigestTree struct {
+	Name  string
+	Files []DigestFile
+}
+
+// runDigest implements the digest subcommand, which writes a summary of the files published or
+// updated on Canvas recently, as plain text or HTML. With --to, it is written as an email that can
+// be piped to sendmail -t. Nothing is written if there are no new files.
+func runDigest(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("digest", flag.ExitOnError)
+	since := flags.Duration("since", 24*time.Hour, "include files published or updated on Canvas in this period")
+	format := flags.String("format", "text", "text or html")
+	to := flags.String("to", "", "write the digest as an email to this address, with headers for sendmail -t")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || (*format != "text" && *format != "html") {
+		return fmt.Errorf("usage: canvas-sync digest [--since 24h] [--format text|html] [--to <address>]")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+
+	finalized, err := loadFinalizedCourses()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-*since)
+	var trees []*DigestTree
+	count := 0
+
+	err = forEachSyncedTree(ctx, api, config, opts.Tags, finalized, func(directory string, build func(folderListed FolderListedFunc) (*CourseTree, error)) error {
+		tree, err := build(func(*CourseTree, *TreeFolder, []*TreeFolder) error { return nil })
+		if err != nil {
+			return err
+		}
+
+		// Walk the tree once it is built, rather than as folders are listed, so that the files are
+		// in the order that Canvas shows them.
+		root := filepath.Join(directory, tree.localDirectory())
+		var files []DigestFile
+		err = tree.TraverseSubfoldersFirst(func(folder *TreeFolder, parents []*TreeFolder) error {
+			folderPath := tree.LocalPath(directory, folder, parents)
+			for _, file := range folder.files {
+				if file.UpdatedAt.Before(cutoff) {
+					continue
+				}
+
+				path, err := filepath.Rel(root, filepath.Join(folderPath, localName(file.FileName)))
+				if err != nil {
+					return err
+				}
+				files = append(files, DigestFile{File: file.File, Path: filepath.ToSlash(path), Updated: file.CreatedAt.Before(cutoff)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(files) > 0 {
+			trees = append(trees, &DigestTree{Name: tree.Name, Files: files})
+			count += len(files)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	if *to != "" {
+		subject := fmt.Sprintf("%d new or updated files on Canvas", count)
+		if count == 1 {
+			subject = "1 new or updated file on Canvas"
+		}
+		contentType := "text/plain"
+		if *format == "html" {
+			contentType = "text/html"
+		}
+		fmt.Printf("To: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: %s; charset=utf-8\r\n\r\n", *to, subject, contentType)
+	}
+
+	if *format == "html" {
+		writeHTMLDigest(os.Stdout, config.Url, *since, trees)
+	} else {
+		writeTextDigest(os.Stdout, config.Url, *since, trees)
+	}
+	return nil
+}
+
+// describeDigestFile describes the size of a file and when it was published or updated.
+func describeDigestFile(file DigestFile) string {
+	if file.Updated {
+		return fmt.Sprintf("%s, updated %s", humanize.Bytes(uint64(file.Size)), file.UpdatedAt.Local().Format("Mon 2 Jan 15:04"))
+	}
+	return fmt.Sprintf("%s, published %s", humanize.Bytes(uint64(file.Size)), file.CreatedAt.Local().Format("Mon 2 Jan 15:04"))
+}
+
+// shortDuration formats a duration without zero minutes and seconds, such as 24h rather than
+// 24h0m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// canvasFileUrl returns the address of the page for a file on Canvas.
+func canvasFileUrl(canvasUrl string, file DigestFile) string {
+	return fmt.Sprintf("%s/files/%d", strings.TrimSuffix(canvasUrl, "/"), file.Id)
+}
+
+func writeTextDigest(w io.Writer, canvasUrl string, since time.Duration, trees []*DigestTree) {
+	fmt.Fprintf(w, "New on %s in the last %s\n", canvasUrl, shortDuration(since))
+	for _, tree := range trees {
+		fmt.Fprintf(w, "\n%s\n", tree.Name)
+		for _, file := range tree.Files {
+			fmt.Fprintf(w, "  %s (%s)\n    %s\n", file.Path, describeDigestFile(file), canvasFileUrl(canvasUrl, file))
+		}
+	}
+}
+
+func writeHTMLDigest(w io.Writer, canvasUrl string, since time.Duration, trees []*DigestTree) {
+	fmt.Fprintf(w, "<html>\n<body>\n<h1>New on %s in the last %s</h1>\n", html.EscapeString(canvasUrl), shortDuration(since))
+	for _, tree := range trees {
+		fmt.Fprintf(w, "<h2>%s</h2>\n<ul>\n", html.EscapeString(tree.Name))
+		for _, file := range tree.Files {
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%s)</li>\n", html.EscapeString(canvasFileUrl(canvasUrl, file)), html.EscapeString(file.Path), html.EscapeString(describeDigestFile(file)))
+		}
+		fmt.Fprint(w, "</ul>\n")
+	}
+	fmt.Fprint(w, "</body>\n</html>\n")
+}
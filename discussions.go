@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+// Directory inside a course directory where discussions are exported to.
+const discussionsDirectory = "Discussions"
+
+type DiscussionTopic struct {
+	Id          uint64    `json:"id"`
+	Title       string    `json:"title"`
+	Message     string    `json:"message"`
+	UserName    string    `json:"user_name"`
+	PostedAt    time.Time `json:"posted_at"`
+	LastReplyAt time.Time `json:"last_reply_at"`
+	Attachments []File    `json:"attachments"`
+}
+
+// LastActivity returns when the topic was posted or last replied to.
+func (topic DiscussionTopic) LastActivity() time.Time {
+	if topic.LastReplyAt.After(topic.PostedAt) {
+		return topic.LastReplyAt
+	}
+	return topic.PostedAt
+}
+
+// DiscussionView is the full discussion of a topic, with every reply.
+type DiscussionView struct {
+	Participants []DiscussionParticipant `json:"participants"`
+	View         []DiscussionEntry       `json:"view"`
+}
+
+type DiscussionParticipant struct {
+	Id          uint64 `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+type DiscussionEntry struct {
+	Id          uint64            `json:"id"`
+	UserId      uint64            `json:"user_id"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Message     string            `json:"message"`
+	Deleted     bool              `json:"deleted"`
+	Attachment  *File             `json:"attachment"`
+	Attachments []File            `json:"attachments"`
+	Replies     []DiscussionEntry `json:"replies"`
+}
+
+// files returns the files attached to the entry. Canvas has used both a single attachment and a
+// list of them.
+func (entry DiscussionEntry) files() []File {
+	files := entry.Attachments
+	if entry.Attachment != nil {
+		files = append(files, *entry.Attachment)
+	}
+	return files
+}
+
+// discussionsToSync exports the discussions in a course as Markdown files in the directory
+// discussionsPath. The files attached to each discussion and its replies are sent to the
+// fileToSyncC channel, to be downloaded into a directory named after the discussion. A discussion
+// is only exported again when it has been replied to since it was last exported.
+// This does NOT close the fileToSyncC channel after exiting.
+func discussionsToSync(ctx context.Context, api *CanvasApi, fileToSyncC chan<- FileToSync, courseId uint64, discussionsPath string) error {
+	ctx = withCourse(ctx, courseId)
+
+	topics, err := listAll(ctx, api.MakeDiscussionTopicsInCourseUrl(courseId), api.DiscussionTopicsInCourse)
+	if errors.Is(err, errForbidden) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		name := safeFileName(topic.Title)
+		if name == "" {
+			name = fmt.Sprintf("Discussion %d", topic.Id)
+		}
+		markdownPath := filepath.Join(discussionsPath, name+".md")
+		attachmentsPath := filepath.Join(discussionsPath, name)
+
+		attachments := topic.Attachments
+
+		lastActivity := topic.LastActivity()
+		fi, err := os.Stat(markdownPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err != nil || lastActivity.IsZero() || !lastActivity.Equal(fi.ModTime()) {
+			view, err := api.DiscussionView(ctx, courseId, topic.Id)
+			// Students cannot see the replies to some discussions until they have posted
+			// themselves.
+			if err != nil && !errors.Is(err, errForbidden) {
+				return err
+			}
+
+			var b strings.Builder
+			writeDiscussion(&b, topic, view, attachmentsPath, discussionsPath)
+
+			if err := os.MkdirAll(discussionsPath, 0755); err != nil {
+				return err
+			}
+			if err := atomicFile.WriteFile(markdownPath, strings.NewReader(b.String())); err != nil {
+				return err
+			}
+			if !lastActivity.IsZero() {
+				if err := os.Chtimes(markdownPath, lastActivity, lastActivity); err != nil {
+					return err
+				}
+			}
+
+			var walk func(entries []DiscussionEntry)
+			walk = func(entries []DiscussionEntry) {
+				for _, entry := range entries {
+					attachments = append(attachments, entry.files()...)
+					walk(entry.Replies)
+				}
+			}
+			walk(view.View)
+		}
+
+		folder := &TreeFolder{}
+		for _, file := range attachments {
+			api.prepareFile(&file)
+			folder.files = append(folder.files, &TreeFile{File: file})
+		}
+		if err := folderFilesToSync(ctx, fileToSyncC, courseId, folder, attachmentsPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeDiscussion(b *strings.Builder, topic DiscussionTopic, view DiscussionView, attachmentsPath, discussionsPath string) {
+	names := make(map[uint64]string)
+	for _, p := range view.Participants {
+		names[p.Id] = p.DisplayName
+	}
+
+	fmt.Fprintf(b, "# %s\n\n", topic.Title)
+	if topic.UserName != "" {
+		fmt.Fprintf(b, "Posted by %s on %s.\n\n", topic.UserName, formatDiscussionTime(topic.PostedAt))
+	}
+	b.WriteString(htmlToMarkdown(topic.Message))
+	writeAttachmentLinks(b, "", topic.Attachments, attachmentsPath, discussionsPath)
+
+	if len(view.View) == 0 {
+		return
+	}
+
+	b.WriteString("\n## Replies\n")
+
+	var writeEntries func(entries []DiscussionEntry, depth int)
+	writeEntries = func(entries []DiscussionEntry, depth int) {
+		prefix := strings.Repeat("> ", depth)
+		for _, entry := range entries {
+			b.WriteString(strings.TrimRight(prefix, " ") + "\n")
+
+			if entry.Deleted {
+				b.WriteString(prefix + "*This reply has been deleted.*\n")
+			} else {
+				name := names[entry.UserId]
+				if name == "" {
+					name = fmt.Sprintf("User %d", entry.UserId)
+				}
+				fmt.Fprintf(b, "%s**%s**, %s:\n%s\n", prefix, name, formatDiscussionTime(entry.CreatedAt), strings.TrimRight(prefix, " "))
+
+				message := strings.TrimRight(htmlToMarkdown(entry.Message), "\n")
+				for _, line := range strings.Split(message, "\n") {
+					b.WriteString(strings.TrimRight(prefix+line, " ") + "\n")
+				}
+				writeAttachmentLinks(b, prefix, entry.files(), attachmentsPath, discussionsPath)
+			}
+
+			writeEntries(entry.Replies, depth+1)
+		}
+	}
+	writeEntries(view.View, 0)
+}
+
+// writeAttachmentLinks writes a list of links to where the attachments are downloaded to,
+// relative to the Markdown file.
+func writeAttachmentLinks(b *strings.Builder, prefix string, files []File, attachmentsPath, discussionsPath string) {
+	if len(files) == 0 {
+		return
+	}
+
+	fmt.Fprintf(b, "%s\n%sAttachments:\n", strings.TrimRight(prefix, " "), prefix)
+	for _, file := range files {
+		rel, err := filepath.Rel(discussionsPath, filepath.Join(attachmentsPath, localName(file.FileName)))
+		if err != nil {
+			continue
+		}
+		link := strings.ReplaceAll(filepath.ToSlash(rel), " ", "%20")
+		fmt.Fprintf(b, "%s* [%s](%s)\n", prefix, file.FileName, link)
+	}
+}
+
+func formatDiscussionTime(t time.Time) string {
+	if t.IsZero() {
+		return "an unknown date"
+	}
+	return t.Local().Format("2 January 2006 15:04")
+}
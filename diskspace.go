@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Space always left free on the disk, so that canvas-sync does not fill it completely.
+const minFreeSpace = 100 * 1024 * 1024
+
+var errDiskFull = errors.New("not enough disk space")
+
+// SpaceCheck stops a sync before it downloads a file that will not fit on the disk, rather than
+// failing part way through writing it. Room is reserved for each file while it downloads, and the
+// free space measured before each download is counted down by the room reserved for those still
+// downloading.
+type SpaceCheck struct {
+	mu       sync.Mutex
+	dir      string
+	reserved uint64
+}
+
+func NewSpaceCheck(dir string) (*SpaceCheck, error) {
+	// On the first sync, the directory may not exist yet.
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	if _, err := freeDiskSpace(dir); err != nil {
+		return nil, fmt.Errorf("cannot find free disk space for %s: %w", dir, err)
+	}
+
+	return &SpaceCheck{dir: dir}, nil
+}
+
+// available returns how much more can be downloaded while leaving minFreeSpace free on the disk.
+// It must be called with c.mu held.
+func (c *SpaceCheck) available() (uint64, error) {
+	free, err := freeDiskSpace(c.dir)
+	if err != nil {
+		return 0, fmt.Errorf("cannot find free disk space for %s: %w", c.dir, err)
+	}
+	if free < c.reserved+minFreeSpace {
+		return 0, nil
+	}
+	return free - c.reserved - minFreeSpace, nil
+}
+
+// Reserve makes room for a file to be downloaded, returning an error wrapping errDiskFull if it
+// will not fit. Room is needed for the whole file even if it replaces an older version, as the
+// old version is kept in the trash. The room must be given back with Release once the file has
+// been written, or the download has failed.
+func (c *SpaceCheck) Reserve(file FileToSync) error {
+	if c == nil {
+		return nil
+	}
+
+	size := uint64(file.File.Size)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	available, err := c.available()
+	if err != nil {
+		return err
+	}
+	if size > available {
+		return fmt.Errorf("%w to download %s (%s) into %s: only %s left", errDiskFull, file.Path, humanize.Bytes(size), c.dir, humanize.Bytes(available))
+	}
+	c.reserved += size
+	return nil
+}
+
+// Release gives back the room reserved for a file.
+func (c *SpaceCheck) Release(file FileToSync) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reserved -= uint64(file.File.Size)
+}
+
+// check returns an error wrapping errDiskFull if size bytes will not fit on the disk.
+func (c *SpaceCheck) check(size uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	available, err := c.available()
+	if err != nil {
+		return err
+	}
+	if size > available {
+		return fmt.Errorf("%w to download %s into %s: only %s left", errDiskFull, humanize.Bytes(size), c.dir, humanize.Bytes(available))
+	}
+	return nil
+}
+
+// SpaceChecks checks the free space on the disk of each sync root, as files saved under other
+// directories by content_type_rules may be on other disks.
+type SpaceChecks struct {
+	roots  []string
+	checks map[string]*SpaceCheck
+}
+
+func NewSpaceChecks(roots []string) (*SpaceChecks, error) {
+	checks := make(map[string]*SpaceCheck, len(roots))
+	for _, root := range roots {
+		check, err := NewSpaceCheck(root)
+		if err != nil {
+			return nil, err
+		}
+		checks[root] = check
+	}
+	return &SpaceChecks{roots: roots, checks: checks}, nil
+}
+
+// For returns the check for the disk that a file is saved on, or nil, which checks nothing, if
+// it is under none of the sync roots.
+func (s *SpaceChecks) For(path string) *SpaceCheck {
+	if s == nil {
+		return nil
+	}
+	return s.checks[syncRootOf(s.roots, path)]
+}
+
+// SpaceNeeded adds up the sizes of files to download under each sync root.
+type SpaceNeeded map[string]uint64
+
+// Add counts a file to download in needed.
+func (s *SpaceChecks) Add(needed SpaceNeeded, file FileToSync) {
+	needed[syncRootOf(s.roots, file.Path)] += uint64(file.File.Size)
+}
+
+// Preflight returns an error wrapping errDiskFull if the files to download under any of the sync
+// roots will not all fit on its disk.
+func (s *SpaceChecks) Preflight(needed SpaceNeeded) error {
+	for _, root := range s.roots {
+		if err := s.checks[root].check(needed[root]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spaceWriter reserves room for a file when the first of it is written, so that no room is
+// reserved for a file whose local copy turns out to be up-to-date.
+type spaceWriter struct {
+	space    *SpaceCheck
+	file     FileToSync
+	reserved bool
+}
+
+func (w *spaceWriter) Write(b []byte) (int, error) {
+	if !w.reserved {
+		if err := w.space.Reserve(w.file); err != nil {
+			return 0, err
+		}
+		w.reserved = true
+	}
+	return len(b), nil
+}
+
+// Release gives back the room reserved for the file, if any.
+func (w *spaceWriter) Release() {
+	if w.reserved {
+		w.space.Release(w.file)
+		w.reserved = false
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Number of requests made to measure the latency of the Canvas API.
+const doctorLatencySamples = 3
+
+// API latency above which doctor warns that syncs will be slow.
+const slowLatency = 2 * time.Second
+
+// runDoctor implements the doctor subcommand, which checks for the problems that most often stop
+// canvas-sync from working and says what to do about them.
+func runDoctor(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: canvas-sync doctor")
+	}
+
+	problems := 0
+	ok := func(format string, args ...any) {
+		fmt.Printf("✓ "+format+"\n", args...)
+	}
+	problem := func(format string, args ...any) {
+		problems++
+		fmt.Printf("✗ "+format+"\n", args...)
+	}
+
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(dir, "config.json")
+
+	config, err := loadConfig()
+	if err != nil {
+		problem("Config file %s: %s", configPath, err)
+		fmt.Println("  Create it as described in the README, or fix the error above.")
+		return fmt.Errorf("doctor found %d problems", problems)
+	}
+	ok("Config file %s is valid", configPath)
+
+	checkCanvas(ctx, config, ok, problem)
+	checkDirectory(config, ok, problem)
+
+	if problems > 0 {
+		return fmt.Errorf("doctor found %d problems", problems)
+	}
+	fmt.Println("✓ No problems found.")
+	return nil
+}
+
+// checkCanvas checks that the Canvas server can be reached and accepts the access token, and
+// measures how long API calls take.
+func checkCanvas(ctx context.Context, config *Config, ok, problem func(string, ...any)) {
+	api, err := newCanvasApi(config)
+	if err != nil {
+		problem("Cannot set up connections to Canvas: %s", err)
+		return
+	}
+
+	var latencies []time.Duration
+	var user User
+	for i := 0; i < doctorLatencySamples; i++ {
+		start := time.Now()
+		user, err = api.Self(ctx)
+		if err != nil {
+			break
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+
+	var httpErr *HTTPError
+	switch {
+	case err == nil:
+	case errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized:
+		problem("Canvas rejected the access token")
+		fmt.Println("  The token may have expired or been deleted. Generate a new one under Account, Settings, Approved integrations on Canvas and put it in the config file.")
+		return
+	case errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound:
+		problem("%s does not look like a Canvas server", config.Url)
+		fmt.Println("  Check url in the config file: it should be the address you use to log in to Canvas, such as https://canvas.northwestern.edu.")
+		return
+	case errors.Is(err, errForbidden):
+		problem("The access token is not allowed to look up its own user")
+		fmt.Println("  Your institution may limit tokens to some scopes; the token needs at least read access to users, courses, folders and files.")
+		return
+	default:
+		problem("Cannot reach %s: %s", config.Url, err)
+		fmt.Println("  Check your network connection, and the proxy and ca_bundle settings if your network needs them.")
+		return
+	}
+	ok("Access token belongs to %s (user %d)", user.Name, user.Id)
+
+	// Check the scopes needed to sync, as scoped tokens can look up the user but nothing else.
+	courses, _, err := api.Courses(ctx, api.MakeCoursesUrl())
+	if err != nil {
+		problem("The access token cannot list your courses: %s", err)
+		fmt.Println("  If your institution limits tokens to some scopes, the token needs read access to courses, folders and files.")
+		return
+	}
+	ok("The access token can list your courses (%d on the first page)", len(courses))
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	latency := latencies[len(latencies)/2]
+	if latency > slowLatency {
+		problem("API calls take %s, so syncs will be slow", latency.Round(time.Millisecond))
+		fmt.Println("  Canvas may be busy, or your connection or proxy slow; try again later.")
+	} else {
+		ok("API calls take %s", latency.Round(time.Millisecond))
+	}
+}
+
+// checkDirectory checks that files can be written to the sync directory and that there is space
+// for them.
+func checkDirectory(config *Config, ok, problem func(string, ...any)) {
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		problem("Cannot create the sync directory: %s", err)
+		fmt.Println("  Check directory in the config file, and that you are allowed to create it.")
+		return
+	}
+
+	f, err := os.CreateTemp(config.Directory, tempFilePrefix)
+	if err != nil {
+		problem("Cannot write to the sync directory %s: %s", config.Directory, err)
+		fmt.Println("  Check that you own the directory, and that it is not a read-only or full disk.")
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	ok("Sync directory %s can be written to", config.Directory)
+
+	free, err := freeDiskSpace(config.Directory)
+	if err != nil {
+		problem("Cannot tell how much space is free for the sync directory: %s", err)
+		return
+	}
+	if free < minFreeSpace {
+		problem("Only %s is free for the sync directory", humanize.Bytes(free))
+		fmt.Println("  canvas-sync stops syncing when less than 100 MB would be left; free up some space.")
+		return
+	}
+	ok("%s is free for the sync directory", humanize.Bytes(free))
+}
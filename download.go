@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+// Number of files downloaded at the same time to start with. It adapts to how the server copes,
+// up to maxDownloaders.
+const (
+	numDownloaders = 10
+	maxDownloaders = 32
+)
+
+// Values of the check_mode setting.
+const (
+	// Local copies are up-to-date if their size and modification time match the file on Canvas.
+	checkModeMtime = "mtime"
+	// Local copies whose modification time does not match are also up-to-date if their content has
+	// the hash recorded when they were downloaded.
+	checkModeHash = "hash"
+)
+
+// errMoved is returned by Downloader.Sync when the local copy of a file was moved to where it now
+// belongs rather than downloaded again. It is also an errNotModified.
+var errMoved = fmt.Errorf("moved: %w", errNotModified)
+
+// Files are downloaded to temporary files, whose names start with this, next to where they will
+// end up.
+const tempFilePrefix = "canvassync"
+
+// Downloader writes files from Canvas to the local disk.
+type Downloader struct {
+	api      *CanvasApi
+	trash    *Trash
+	retries  *RetryQueue
+	manifest *Manifest
+	pipeline *Pipeline
+	// Journal, if not nil, records the temporary files being downloaded to.
+	journal *Journal
+
+	// Keep previous versions of updated files alongside them rather than in the trash.
+	keepVersions bool
+	// Always download the whole file, even if the local copy might be up-to-date.
+	force bool
+	// Before downloading a file, check whether the local copy has the content recorded in the
+	// manifest.
+	checkHash bool
+	// Metadata, if not nil, records the Canvas IDs of downloaded files next to them.
+	metadata *MetadataWriter
+	// Extract downloaded zip files into a directory next to them.
+	extractZips bool
+	// Spaces, if not nil, stops downloads that will not fit on the disk.
+	spaces *SpaceChecks
+}
+
+// Sync downloads a file, trying a few times before parking it in the retry queue. It returns
+// errParked if the file could not be downloaded, errDeferred if it was skipped because it failed
+// on a recent run and errNotModified if the local copy turned out to be up-to-date, or errMoved if
+// it was moved to where the file now belongs.
+func (d *Downloader) Sync(ctx context.Context, file FileToSync) error {
+	if d.retries.Deferred(file.File.Id, time.Now()) {
+		logDebugf("Not downloading %s, which failed recently, until a later run", file.Path)
+		return errDeferred
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := d.DownloadAndWriteFile(ctx, file)
+		if err == nil || errors.Is(err, errNotModified) {
+			d.retries.Remove(file.File.Id)
+			return err
+		}
+		// Trying again will not make room on the disk.
+		if errors.Is(err, errDiskFull) {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if attempt == downloadAttempts {
+			logDebugf("Giving up on %s after %d attempts: %v", file.Path, attempt, err)
+			d.retries.Park(file, err, time.Now())
+			return &parkedError{err: err}
+		}
+
+		logDebugf("Downloading %s failed, trying again in %s: %v", file.Path, time.Duration(attempt)*time.Second, err)
+		if err := sleepContext(ctx, time.Duration(attempt)*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Downloader) DownloadAndWriteFile(ctx context.Context, file FileToSync) error {
+	ctx = withCourse(ctx, file.CourseId)
+
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+		return err
+	}
+
+	if moved, err := d.moveRenamed(file); err != nil {
+		return err
+	} else if moved {
+		return errMoved
+	}
+
+	if intact, err := d.checkIntact(file); err != nil {
+		return err
+	} else if intact {
+		return errNotModified
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(file.Path), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+		d.journal.End(f.Name())
+	}()
+	if err := d.journal.Begin(f.Name()); err != nil {
+		return err
+	}
+
+	// Canvas changes updated_at when only the metadata of a file changes, so if the local copy
+	// looks otherwise intact, ask the server whether the content has actually changed.
+	var cached Validators
+	entry, inManifest := d.manifest.Get(file.File.Id)
+	if inManifest && entry.Path == file.Path && !d.force && !file.Force {
+		if fi, err := os.Stat(file.Path); err == nil && fi.Size() == file.File.Size {
+			cached = Validators{ETag: entry.ETag, LastModified: entry.LastModified}
+		}
+	}
+
+	space := &spaceWriter{space: d.spaces.For(file.Path), file: file}
+	defer space.Release()
+
+	hash := sha256.New()
+	w := struct {
+		io.Writer
+		io.Closer
+	}{io.MultiWriter(space, pauseWriter{ctx, d.pipeline.Pauser}, f, hash, progressWriter{d.pipeline, file.Path}), f}
+
+	validators, err := d.api.DownloadFile(ctx, w, file.File, cached)
+	if errors.Is(err, errNotModified) {
+		if err := os.Chtimes(file.Path, file.File.UpdatedAt, file.File.UpdatedAt); err != nil {
+			return err
+		}
+		d.record(file, validators, entry.SHA256)
+		return errNotModified
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(f.Name(), file.File.UpdatedAt, file.File.UpdatedAt); err != nil {
+		return err
+	}
+
+	// Keep the out-of-date copy, if there is one, in case the new version on Canvas is not wanted.
+	if d.keepVersions {
+		if err := keepVersion(file.Path); err != nil {
+			return err
+		}
+	} else {
+		if err := d.trash.Keep(file.Path); err != nil {
+			return err
+		}
+	}
+
+	if err := atomicFile.ReplaceFile(longPath(f.Name()), longPath(file.Path)); err != nil {
+		return err
+	}
+
+	d.record(file, validators, hex.EncodeToString(hash.Sum(nil)))
+	if err := d.metadata.Write(file); err != nil {
+		logErrorf("cannot record the Canvas IDs of %s: %s", file.Path, err)
+	}
+	if d.extractZips && isZipFile(file) {
+		d.extract(file)
+	}
+	return nil
+}
+
+// moveRenamed moves the local copy of a file that was downloaded to a different path, because the
+// file or a folder it is in has been renamed or moved on Canvas, to where it now belongs, rather
+// than downloading it again. It reports whether the file was moved.
+func (d *Downloader) moveRenamed(file FileToSync) (bool, error) {
+	entry, ok := d.manifest.Get(file.File.Id)
+	if !ok || d.force || file.Force || entry.Path == file.Path || entry.Size != file.File.Size || !entry.UpdatedAt.Equal(file.File.UpdatedAt) {
+		return false, nil
+	}
+
+	if _, err := os.Lstat(file.Path); !errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	// Check that the old copy is still the one that was downloaded, and has not been changed or
+	// replaced by another file since.
+	fi, err := os.Stat(entry.Path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != entry.Size {
+		return false, nil
+	}
+	if entry.SHA256 != "" {
+		if intact, err := fileIntact(entry); err != nil || !intact {
+			return false, nil
+		}
+	}
+
+	if err := os.Rename(longPath(entry.Path), longPath(file.Path)); err != nil {
+		// A file that content_type_rules now saves on another disk cannot be moved there, so it
+		// is downloaded again instead.
+		logDebugf("Cannot move %s to %s, so downloading it again: %s", entry.Path, file.Path, err)
+		return false, nil
+	}
+	logDebugf("Moved %s to %s", entry.Path, file.Path)
+	if err := d.metadata.Move(entry.Path, file); err != nil {
+		logErrorf("cannot record the Canvas IDs of %s: %s", file.Path, err)
+	}
+
+	// Tidy up the folders the file was in if they are now empty, as the whole of a renamed course
+	// or folder is left behind.
+	removeEmptyDirs(filepath.Dir(entry.Path), syncRootOf(d.trash.roots, entry.Path))
+
+	entry.Path = file.Path
+	entry.CourseId = file.CourseId
+	if entry.Extracted != nil {
+		entry.Extracted = moveExtracted(entry.Extracted, extractDirectory(file.Path))
+	}
+	d.manifest.Put(file.File.Id, entry)
+	return true, nil
+}
+
+// removeEmptyDirs removes dir, and then each directory it is in, for as long as they are empty,
+// stopping at root.
+func removeEmptyDirs(dir, root string) {
+	for {
+		if rel, ok := pathWithin(root, dir); !ok || rel == "." {
+			return
+		}
+		if err := os.Remove(longPath(dir)); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// checkIntact, with check_mode set to hash, reports whether the local copy of a file, which looked
+// out-of-date from its modification time, has the content that was downloaded, as it would after
+// being copied between computers or restored from a backup. If so, its modification time is set
+// to match Canvas again so that it is not checked on every sync.
+func (d *Downloader) checkIntact(file FileToSync) (bool, error) {
+	if !d.checkHash || d.force || file.Force {
+		return false, nil
+	}
+
+	entry, ok := d.manifest.Get(file.File.Id)
+	if !ok || entry.Path != file.Path || entry.SHA256 == "" || entry.Size != file.File.Size || !entry.UpdatedAt.Equal(file.File.UpdatedAt) {
+		return false, nil
+	}
+
+	intact, err := fileIntact(entry)
+	if err != nil || !intact {
+		return false, err
+	}
+
+	logDebugf("%s has the content that was downloaded", file.Path)
+	if err := os.Chtimes(file.Path, file.File.UpdatedAt, file.File.UpdatedAt); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *Downloader) record(file FileToSync, validators Validators, hash string) {
+	previous, _ := d.manifest.Get(file.File.Id)
+	d.manifest.Put(file.File.Id, ManifestEntry{
+		CourseId:     file.CourseId,
+		Path:         file.Path,
+		Size:         file.File.Size,
+		UpdatedAt:    file.File.UpdatedAt,
+		SHA256:       hash,
+		ETag:         validators.ETag,
+		LastModified: validators.LastModified,
+		Extracted:    previous.Extracted,
+	})
+}
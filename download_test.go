@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMoveRenamed(t *testing.T) {
+	updatedAt := time.Date(2024, 9, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		oldPath string
+		newPath string
+		// Another file left behind, which keeps its folders.
+		other string
+		// The folders that should be gone, and those that should be kept.
+		removed []string
+		kept    []string
+	}{
+		{
+			name:    "renamed course",
+			oldPath: "ECON 101/Lectures/Week 1/slides.pdf",
+			newPath: "ECON 101 Fall/Lectures/Week 1/slides.pdf",
+			removed: []string{"ECON 101"},
+		},
+		{
+			name:    "renamed nested folder",
+			oldPath: "ECON 101/Lectures/Week 1/Slides/slides.pdf",
+			newPath: "ECON 101/Lectures/Week One/Slides/slides.pdf",
+			removed: []string{"ECON 101/Lectures/Week 1"},
+			kept:    []string{"ECON 101/Lectures"},
+		},
+		{
+			name:    "folder with other files",
+			oldPath: "ECON 101/Lectures/Week 1/slides.pdf",
+			newPath: "ECON 101/Lectures/Week One/slides.pdf",
+			other:   "ECON 101/Lectures/Week 1/notes.pdf",
+			kept:    []string{"ECON 101/Lectures/Week 1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			path := func(name string) string { return filepath.Join(root, filepath.FromSlash(name)) }
+			write := func(name string) {
+				if err := os.MkdirAll(filepath.Dir(path(name)), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path(name), []byte("content"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write(test.oldPath)
+			if test.other != "" {
+				write(test.other)
+			}
+			if err := os.MkdirAll(filepath.Dir(path(test.newPath)), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			manifest := &Manifest{files: make(map[uint64]*ManifestEntry)}
+			manifest.Put(1, ManifestEntry{Path: path(test.oldPath), Size: 7, UpdatedAt: updatedAt})
+			d := &Downloader{manifest: manifest, trash: NewTrash([]string{root}, updatedAt)}
+
+			file := FileToSync{File: File{Id: 1, Size: 7, UpdatedAt: updatedAt}, Path: path(test.newPath)}
+			moved, err := d.moveRenamed(file)
+			if err != nil || !moved {
+				t.Fatalf("moveRenamed returned %v, %v, want true, nil", moved, err)
+			}
+			if _, err := os.Stat(path(test.newPath)); err != nil {
+				t.Errorf("the file was not moved: %v", err)
+			}
+			if entry, _ := manifest.Get(1); entry.Path != path(test.newPath) {
+				t.Errorf("the manifest has the file at %s, want %s", entry.Path, path(test.newPath))
+			}
+			for _, dir := range test.removed {
+				if _, err := os.Stat(path(dir)); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind", dir)
+				}
+			}
+			for _, dir := range test.kept {
+				if _, err := os.Stat(path(dir)); err != nil {
+					t.Errorf("%s was removed", dir)
+				}
+			}
+			if _, err := os.Stat(root); err != nil {
+				t.Errorf("the sync directory was removed")
+			}
+		})
+	}
+}
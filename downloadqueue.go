@@ -0,0 +1,189 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// Files up to this size are downloaded before larger ones.
+const smallFileSize = 16 * 1024 * 1024
+
+// DownloadQueue holds the files found to sync until there is a downloader free for them.
+//
+// Every course gets an equal share of the downloaders: the next file goes to the course with the
+// fewest downloads in flight, so that a course with a lot to download cannot hold up the others,
+// although it can use the downloaders that the others do not need. Within a course, the most
+// useful files go first: small files before large ones, and of the small files, those most
+// recently updated on Canvas first. Large files go in order of size, so that lecture slides are
+// not stuck behind a long video.
+type DownloadQueue struct {
+	mu      sync.Mutex
+	courses map[uint64]*courseQueue
+	queued  int
+	seq     uint64
+	closed  bool
+	// Closed and replaced when a file is queued or the queue is closed, to wake up Next.
+	changed chan struct{}
+}
+
+type courseQueue struct {
+	files    downloadHeap
+	inFlight int
+}
+
+type queuedFile struct {
+	file FileToSync
+	seq  uint64
+}
+
+func NewDownloadQueue() *DownloadQueue {
+	return &DownloadQueue{
+		courses: make(map[uint64]*courseQueue),
+		changed: make(chan struct{}),
+	}
+}
+
+func (q *DownloadQueue) courseQueue(courseId uint64) *courseQueue {
+	course, ok := q.courses[courseId]
+	if !ok {
+		course = &courseQueue{}
+		q.courses[courseId] = course
+	}
+	return course
+}
+
+func (q *DownloadQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Push queues a file to download.
+func (q *DownloadQueue) Push(file FileToSync) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	heap.Push(&q.courseQueue(file.CourseId).files, queuedFile{file: file, seq: q.seq})
+	q.seq++
+	q.queued++
+	q.notify()
+}
+
+// Close records that no more files will be queued.
+func (q *DownloadQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notify()
+}
+
+// Drain removes every queued file, returning how many there were.
+func (q *DownloadQueue) Drain() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.queued
+	for _, course := range q.courses {
+		course.files = nil
+	}
+	q.queued = 0
+	return n
+}
+
+// Next blocks until there is a file to download and returns it, or returns false once the queue
+// is closed and empty. Done must be called when the download of the file has finished.
+func (q *DownloadQueue) Next(ctx context.Context) (FileToSync, bool, error) {
+	for {
+		q.mu.Lock()
+		if q.queued > 0 {
+			course := q.pick()
+			file := heap.Pop(&course.files).(queuedFile).file
+			course.inFlight++
+			q.queued--
+			q.mu.Unlock()
+			return file, true, nil
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return FileToSync{}, false, nil
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return FileToSync{}, false, ctx.Err()
+		}
+	}
+}
+
+// pick returns the course whose file should be downloaded next: of the courses with files queued,
+// the one with the fewest downloads in flight, or if several have as few, the one with the most
+// useful file.
+func (q *DownloadQueue) pick() *courseQueue {
+	var best *courseQueue
+	for _, course := range q.courses {
+		if len(course.files) == 0 {
+			continue
+		}
+		switch {
+		case best == nil, course.inFlight < best.inFlight:
+			best = course
+		case course.inFlight == best.inFlight && before(course.files[0], best.files[0]):
+			best = course
+		}
+	}
+	return best
+}
+
+// Done records that the download of a file returned by Next has finished.
+func (q *DownloadQueue) Done(file FileToSync) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.courseQueue(file.CourseId).inFlight--
+}
+
+// before reports whether a should be downloaded before b.
+func before(a, b queuedFile) bool {
+	fa, fb := a.file.File, b.file.File
+
+	aSmall, bSmall := fa.Size <= smallFileSize, fb.Size <= smallFileSize
+	if aSmall != bSmall {
+		return aSmall
+	}
+	if aSmall {
+		if !fa.UpdatedAt.Equal(fb.UpdatedAt) {
+			return fa.UpdatedAt.After(fb.UpdatedAt)
+		}
+	} else if fa.Size != fb.Size {
+		return fa.Size < fb.Size
+	}
+
+	// Otherwise keep the order in which the files were found.
+	return a.seq < b.seq
+}
+
+// downloadHeap implements heap.Interface, ordered so that the file to download first is on top.
+type downloadHeap []queuedFile
+
+func (h downloadHeap) Len() int { return len(h) }
+
+func (h downloadHeap) Less(i, j int) bool { return before(h[i], h[j]) }
+
+func (h downloadHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *downloadHeap) Push(x any) {
+	*h = append(*h, x.(queuedFile))
+}
+
+func (h *downloadHeap) Pop() any {
+	old := *h
+	n := len(old)
+	f := old[n-1]
+	old[n-1] = queuedFile{}
+	*h = old[:n-1]
+	return f
+}
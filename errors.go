@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// HTTPError is returned when Canvas responds with an unexpected status code. Message and Status
+// are taken from the error in the body of an API response, if there is one.
+type HTTPError struct {
+	Url        string
+	StatusCode int
+	Message    string
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("HTTP error for %s: %d", redactUrl(e.Url), e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Status != "" {
+		msg += " (" + e.Status + ")"
+	}
+	return msg
+}
+
+// Is makes a 403 response match errForbidden.
+func (e *HTTPError) Is(target error) bool {
+	return target == errForbidden && e.StatusCode == http.StatusForbidden
+}
+
+// Largest error body read from an API response.
+const maxErrorBodySize = 64 * 1024
+
+// apiError reads the error that Canvas describes in the body of an API response, in the form
+// {"status": "unauthorized", "errors": [{"message": "..."}]} or {"message": "..."}.
+func apiError(apiCall string, res *http.Response) *HTTPError {
+	httpErr := &HTTPError{Url: apiCall, StatusCode: res.StatusCode}
+
+	var body struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Errors  json.RawMessage `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxErrorBodySize)).Decode(&body); err != nil {
+		return httpErr
+	}
+	httpErr.Status = body.Status
+
+	// Validation errors are an object of fields rather than a list, and are not worth unpicking.
+	var errs []struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(body.Errors, &errs)
+
+	var messages []string
+	for _, e := range errs {
+		if e.Message != "" {
+			messages = append(messages, e.Message)
+		}
+	}
+	if len(messages) == 0 && body.Message != "" {
+		messages = append(messages, body.Message)
+	}
+	httpErr.Message = strings.Join(messages, "; ")
+
+	return httpErr
+}
+
+// TokenError is returned when Canvas does not accept the access token at all, because it has
+// expired or been deleted, as opposed to the token not being allowed to do one thing. Nothing can be
+// synced without a valid token, so it stops the sync.
+type TokenError struct {
+	*HTTPError
+}
+
+func (e *TokenError) Error() string {
+	return "Canvas rejected the access token, which may have expired or been deleted: generate a new one under Account, Settings, Approved integrations on Canvas and put it in the config file"
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.HTTPError
+}
+
+func isTokenRejected(err error) bool {
+	var tokenErr *TokenError
+	return errors.As(err, &tokenErr)
+}
+
+// ErrorCode is a stable identifier for a class of failure, for programs consuming the JSON output.
+type ErrorCode string
+
+const (
+	ErrCodeRateLimit       ErrorCode = "E_RATE_LIMIT"
+	ErrCodeUnauthorized    ErrorCode = "E_UNAUTHORIZED"
+	ErrCodeForbidden       ErrorCode = "E_FORBIDDEN"
+	ErrCodeForbiddenCourse ErrorCode = "E_FORBIDDEN_COURSE"
+	ErrCodeForbiddenFolder ErrorCode = "E_FORBIDDEN_FOLDER"
+	ErrCodeNotFound        ErrorCode = "E_NOT_FOUND"
+	ErrCodeServer          ErrorCode = "E_SERVER"
+	ErrCodeHTTP            ErrorCode = "E_HTTP"
+	ErrCodeNetwork         ErrorCode = "E_NETWORK"
+	ErrCodeDiskFull        ErrorCode = "E_DISK_FULL"
+	ErrCodePermission      ErrorCode = "E_PERMISSION"
+	ErrCodeStalled         ErrorCode = "E_STALLED"
+	ErrCodeConfig          ErrorCode = "E_CONFIG"
+	ErrCodeUnknown         ErrorCode = "E_UNKNOWN"
+)
+
+// errorCode classifies an error.
+func errorCode(err error) ErrorCode {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			return ErrCodeRateLimit
+		case httpErr.StatusCode == http.StatusUnauthorized:
+			return ErrCodeUnauthorized
+		case httpErr.StatusCode == http.StatusForbidden:
+			return ErrCodeForbidden
+		case httpErr.StatusCode == http.StatusNotFound:
+			return ErrCodeNotFound
+		case httpErr.StatusCode >= 500:
+			return ErrCodeServer
+		default:
+			return ErrCodeHTTP
+		}
+	}
+
+	var urlErr *url.Error
+	var opErr *net.OpError
+	var configErr *ConfigError
+	switch {
+	case errors.As(err, &configErr):
+		return ErrCodeConfig
+	case errors.Is(err, errStalled):
+		return ErrCodeStalled
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, errDiskFull):
+		return ErrCodeDiskFull
+	case errors.Is(err, fs.ErrPermission):
+		return ErrCodePermission
+	case errors.As(err, &urlErr), errors.As(err, &opErr):
+		return ErrCodeNetwork
+	}
+
+	return ErrCodeUnknown
+}
+
+// redactUrl removes the query string, which may contain access tokens such as download verifiers,
+// from a URL.
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "(invalid URL)"
+	}
+
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// SyncEvent is something that happens during a sync. The sync publishes events on an EventBus,
+// and the progress bar, the log and the JSON output are subscribers that report them.
+type SyncEvent interface {
+	syncEvent()
+}
+
+// FileDiscovered is published when a file that needs to be downloaded is found.
+type FileDiscovered struct {
+	File FileToSync
+}
+
+// DownloadStarted is published when a file starts downloading.
+type DownloadStarted struct {
+	File FileToSync
+}
+
+// DownloadFinished is published once for every file discovered, when it has been dealt with. Err
+// says why the file was not downloaded, if it was not: it may have been skipped, been up to date
+// or have failed.
+type DownloadFinished struct {
+	File FileToSync
+	Err  error
+}
+
+// CourseComplete is published when every folder in a course, or group, has been listed.
+type CourseComplete struct {
+	Tree *CourseTree
+}
+
+// ErrorReported is published for problems that do not stop the sync.
+type ErrorReported struct {
+	Event ErrorEvent
+	Err   error
+}
+
+func (FileDiscovered) syncEvent()   {}
+func (DownloadStarted) syncEvent()  {}
+func (DownloadFinished) syncEvent() {}
+func (CourseComplete) syncEvent()   {}
+func (ErrorReported) syncEvent()    {}
+
+// Number of events that can be waiting for the subscribers before Publish blocks.
+const eventBufferSize = 256
+
+// EventBus delivers the events published during a sync to its subscribers, in order, on a
+// goroutine of its own, so that subscribers never hold up the sync for long.
+type EventBus struct {
+	events      chan SyncEvent
+	subscribers []func(SyncEvent)
+	done        chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewEventBus(subscribers ...func(SyncEvent)) *EventBus {
+	b := &EventBus{
+		events:      make(chan SyncEvent, eventBufferSize),
+		subscribers: subscribers,
+		done:        make(chan struct{}),
+	}
+
+	go func() {
+		defer close(b.done)
+		for event := range b.events {
+			for _, subscriber := range b.subscribers {
+				subscriber(event)
+			}
+		}
+	}()
+
+	return b
+}
+
+// Publish sends an event to every subscriber. Events published after Close are dropped.
+func (b *EventBus) Publish(event SyncEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if !b.closed {
+		b.events <- event
+	}
+}
+
+// Close waits for every event published to be delivered. It may be called more than once.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.events)
+	}
+	b.mu.Unlock()
+
+	<-b.done
+}
+
+// logEvent is the subscriber that logs events in verbose mode.
+func logEvent(event SyncEvent) {
+	switch e := event.(type) {
+	case DownloadStarted:
+		logDebugf("Downloading %s", e.File.Path)
+	case DownloadFinished:
+		if e.Err != nil && !errors.Is(e.Err, errNotModified) {
+			logDebugf("Did not download %s: %v", e.File.Path, e.Err)
+		}
+	case CourseComplete:
+		logDebugf("Listed every folder in %s", e.Tree.Name)
+	case ErrorReported:
+		logDebugf("%v", e.Err)
+	}
+}
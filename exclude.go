@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const excludedStateFile = "excluded.json"
+
+// ExcludedFolders records the folders excluded with the exclude command, by course ID and then
+// folder ID, together with the path of each folder when it was excluded.
+type ExcludedFolders map[uint64]map[uint64]string
+
+func loadExcludedFolders() (ExcludedFolders, error) {
+	excluded := make(ExcludedFolders)
+	if err := loadState(excludedStateFile, &excluded); err != nil {
+		return nil, err
+	}
+	return excluded, nil
+}
+
+// runExclude implements the exclude subcommand, which stops a folder in a course, and everything
+// inside it, from being synced. Folders are remembered by ID, so they stay excluded if they are
+// renamed or moved on Canvas.
+func runExclude(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("exclude", flag.ExitOnError)
+	remove := flags.Bool("remove", false, "sync the folder again")
+	list := flags.Bool("list", false, "list the excluded folders")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("usage: canvas-sync exclude [--remove] <course id> <folder path or id> | --list")
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		if flags.NArg() != 0 {
+			return usage
+		}
+		printExcludedFolders(config)
+		return nil
+	}
+
+	if flags.NArg() != 2 {
+		return usage
+	}
+	courseId, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if err != nil {
+		return usage
+	}
+
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+
+	folders, err := listAll(withCourse(ctx, courseId), api.MakeFoldersInCourseUrl(courseId), api.FoldersInCourse)
+	if errors.Is(err, errForbidden) {
+		return fmt.Errorf("cannot list the folders in course %d", courseId)
+	}
+	if err != nil {
+		return err
+	}
+
+	folder, ok := findFolder(folders, flags.Arg(1))
+	if !ok {
+		return fmt.Errorf("there is no folder %q in course %d", flags.Arg(1), courseId)
+	}
+	if folder.ParentId == 0 {
+		return fmt.Errorf("cannot exclude the root folder of a course; add the course to ignored_courses instead")
+	}
+	folderPath := relativeFolderPath(folders, folder)
+
+	excluded := config.excludedFolders
+	if *remove {
+		if _, ok := excluded[courseId][folder.Id]; !ok {
+			return fmt.Errorf("%s in course %d is not excluded", folderPath, courseId)
+		}
+		delete(excluded[courseId], folder.Id)
+		if len(excluded[courseId]) == 0 {
+			delete(excluded, courseId)
+		}
+	} else {
+		if excluded[courseId] == nil {
+			excluded[courseId] = make(map[uint64]string)
+		}
+		excluded[courseId][folder.Id] = folderPath
+	}
+
+	if err := saveState(excludedStateFile, excluded); err != nil {
+		return err
+	}
+
+	if *remove {
+		fmt.Printf("✓ %s in course %d will be synced again.\n", folderPath, courseId)
+	} else {
+		fmt.Printf("✓ %s in course %d will no longer be synced. Files already synced from it have been left where they are.\n", folderPath, courseId)
+	}
+	return nil
+}
+
+// findFolder finds a folder in a course by ID or by its path relative to the root folder of the
+// course, such as "Lecture Recordings/Week 1".
+func findFolder(folders []Folder, nameOrId string) (Folder, bool) {
+	if id, err := strconv.ParseUint(nameOrId, 10, 64); err == nil {
+		for _, folder := range folders {
+			if folder.Id == id {
+				return folder, true
+			}
+		}
+	}
+
+	want := strings.Trim(nameOrId, "/")
+	for _, folder := range folders {
+		if strings.EqualFold(relativeFolderPath(folders, folder), want) {
+			return folder, true
+		}
+	}
+	return Folder{}, false
+}
+
+// relativeFolderPath returns the path of a folder relative to the root folder of the course, which
+// Canvas calls "course files".
+func relativeFolderPath(folders []Folder, folder Folder) string {
+	for _, root := range folders {
+		if root.ParentId == 0 {
+			return strings.TrimPrefix(folder.Path, root.Path+"/")
+		}
+	}
+	return folder.Path
+}
+
+func printExcludedFolders(config *Config) {
+	courses := make(map[uint64]bool)
+	for courseId := range config.excludedFolders {
+		courses[courseId] = true
+	}
+	for courseId := range config.ExcludedFolders {
+		courses[courseId] = true
+	}
+
+	if len(courses) == 0 {
+		fmt.Println("✓ No folders are excluded.")
+		return
+	}
+
+	for _, courseId := range sortedKeys(courses) {
+		fmt.Printf("Course %d:\n", courseId)
+		for _, folderId := range sortedKeys(config.excludedFolders[courseId]) {
+			fmt.Printf("  %s (folder %d)\n", config.excludedFolders[courseId][folderId], folderId)
+		}
+		for _, folderId := range config.ExcludedFolders[courseId] {
+			fmt.Printf("  folder %d (excluded_folders in config)\n", folderId)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+// Directories inside a course directory where quizzes and rubrics are exported to.
+const (
+	quizzesDirectory = "Quizzes"
+	rubricsDirectory = "Rubrics"
+)
+
+type Quiz struct {
+	Id              uint64     `json:"id"`
+	Title           string     `json:"title"`
+	Description     string     `json:"description"`
+	QuizType        string     `json:"quiz_type"`
+	PointsPossible  float64    `json:"points_possible"`
+	QuestionCount   int        `json:"question_count"`
+	TimeLimit       int        `json:"time_limit"`
+	AllowedAttempts int        `json:"allowed_attempts"`
+	DueAt           *time.Time `json:"due_at"`
+	UnlockAt        *time.Time `json:"unlock_at"`
+	LockAt          *time.Time `json:"lock_at"`
+}
+
+type RubricCriterion struct {
+	Description     string         `json:"description"`
+	LongDescription string         `json:"long_description"`
+	Points          float64        `json:"points"`
+	Ratings         []RubricRating `json:"ratings"`
+}
+
+type RubricRating struct {
+	Description     string  `json:"description"`
+	LongDescription string  `json:"long_description"`
+	Points          float64 `json:"points"`
+}
+
+// writeFileIfChanged atomically replaces the file at path with content, unless it already has
+// exactly that content, so that exports that have not changed keep their modification times.
+func writeFileIfChanged(path string, content []byte) error {
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return atomicFile.WriteFile(path, bytes.NewReader(content))
+}
+
+// exportQuizzes writes the quizzes in a course to the directory quizzesPath: every quiz as
+// returned by Canvas to quizzes.json and a Markdown description of each.
+func exportQuizzes(ctx context.Context, api *CanvasApi, courseId uint64, quizzesPath string) error {
+	ctx = withCourse(ctx, courseId)
+
+	raw, err := listAll(ctx, api.MakeQuizzesInCourseUrl(courseId), api.QuizzesInCourse)
+	if errors.Is(err, errForbidden) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+
+	content, err := marshalExport(raw)
+	if err != nil {
+		return err
+	}
+	if err := writeFileIfChanged(filepath.Join(quizzesPath, "quizzes.json"), content); err != nil {
+		return err
+	}
+
+	for _, r := range raw {
+		var quiz Quiz
+		if err := json.Unmarshal(r, &quiz); err != nil {
+			return fmt.Errorf("invalid quiz in course %d: %w", courseId, err)
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s\n\n", quiz.Title)
+		fmt.Fprintf(&b, "* Points: %g\n", quiz.PointsPossible)
+		fmt.Fprintf(&b, "* Questions: %d\n", quiz.QuestionCount)
+		if quiz.TimeLimit > 0 {
+			fmt.Fprintf(&b, "* Time limit: %d minutes\n", quiz.TimeLimit)
+		}
+		if quiz.AllowedAttempts < 0 {
+			b.WriteString("* Attempts: unlimited\n")
+		} else if quiz.AllowedAttempts > 0 {
+			fmt.Fprintf(&b, "* Attempts: %d\n", quiz.AllowedAttempts)
+		}
+		writeExportTime(&b, "Available from", quiz.UnlockAt)
+		writeExportTime(&b, "Due", quiz.DueAt)
+		writeExportTime(&b, "Available until", quiz.LockAt)
+		if quiz.Description != "" {
+			b.WriteString("\n" + htmlToMarkdown(quiz.Description))
+		}
+
+		name := exportFileName(quiz.Title, "Quiz", quiz.Id)
+		if err := writeFileIfChanged(filepath.Join(quizzesPath, name), []byte(b.String())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportRubrics writes the rubrics of the assignments in a course to the directory rubricsPath:
+// every rubric, keyed by assignment ID, to rubrics.json and a Markdown table of each.
+func exportRubrics(ctx context.Context, api *CanvasApi, courseId uint64, rubricsPath string) error {
+	ctx = withCourse(ctx, courseId)
+
+	assignments, err := listAll(ctx, api.MakeAssignmentsInCourseUrl(courseId), api.AssignmentsInCourse)
+	if errors.Is(err, errForbidden) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rubrics := make(map[uint64][]RubricCriterion)
+	for _, assignment := range assignments {
+		if len(assignment.Rubric) == 0 {
+			continue
+		}
+		rubrics[assignment.Id] = assignment.Rubric
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s\n\n", assignment.Name)
+		b.WriteString("| Criterion | Ratings | Points |\n| --- | --- | --- |\n")
+		for _, criterion := range assignment.Rubric {
+			description := criterion.Description
+			if criterion.LongDescription != "" {
+				description += "<br>" + criterion.LongDescription
+			}
+
+			ratings := make([]string, 0, len(criterion.Ratings))
+			for _, rating := range criterion.Ratings {
+				r := fmt.Sprintf("**%g**: %s", rating.Points, rating.Description)
+				if rating.LongDescription != "" {
+					r += " (" + rating.LongDescription + ")"
+				}
+				ratings = append(ratings, r)
+			}
+
+			fmt.Fprintf(&b, "| %s | %s | %g |\n", tableCell(description), tableCell(strings.Join(ratings, "<br>")), criterion.Points)
+		}
+
+		name := exportFileName(assignment.Name, "Assignment", assignment.Id)
+		if err := writeFileIfChanged(filepath.Join(rubricsPath, name), []byte(b.String())); err != nil {
+			return err
+		}
+	}
+
+	if len(rubrics) == 0 {
+		return nil
+	}
+
+	content, err := marshalExport(rubrics)
+	if err != nil {
+		return err
+	}
+	return writeFileIfChanged(filepath.Join(rubricsPath, "rubrics.json"), content)
+}
+
+// marshalExport encodes v as indented JSON, leaving any HTML in it readable.
+func marshalExport(v any) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func exportFileName(title string, kind string, id uint64) string {
+	name := safeFileName(title)
+	if name == "" {
+		name = fmt.Sprintf("%s %d", kind, id)
+	}
+	return name + ".md"
+}
+
+func writeExportTime(b *strings.Builder, label string, t *time.Time) {
+	if t != nil {
+		fmt.Fprintf(b, "* %s: %s\n", label, t.Local().Format("2 January 2006 15:04"))
+	}
+}
+
+// tableCell escapes text to go in a cell of a Markdown table.
+func tableCell(s string) string {
+	s = strings.ReplaceAll(s, "|", "\\|")
+	return strings.Join(strings.Fields(s), " ")
+}
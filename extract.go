@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Extraction records the files extracted from a downloaded zip file, so that they can be replaced
+// when the zip file changes on Canvas rather than extracted again on every sync.
+type Extraction struct {
+	Dir string `json:"dir"`
+	// The extracted files, relative to Dir.
+	Files []string `json:"files"`
+}
+
+// isZipFile reports whether a file from Canvas is a zip file.
+func isZipFile(file FileToSync) bool {
+	switch file.File.ContentType {
+	case "application/zip", "application/x-zip-compressed":
+		return true
+	}
+	return strings.EqualFold(filepath.Ext(file.Path), ".zip")
+}
+
+// extractDirectory returns the directory that the zip file at path is extracted into, next to it
+// and named after it without the extension.
+func extractDirectory(path string) string {
+	ext := filepath.Ext(path)
+	if ext == "" || ext == path {
+		return path + " (extracted)"
+	}
+	return strings.TrimSuffix(path, ext)
+}
+
+// extract extracts a zip file that has just been downloaded and records what was extracted in the
+// manifest. The download has succeeded even if the zip file cannot be extracted.
+func (d *Downloader) extract(file FileToSync) {
+	entry, _ := d.manifest.Get(file.File.Id)
+	extraction, err := d.extractZip(file, entry.Extracted)
+	if err != nil {
+		logErrorf("cannot extract %s: %s", file.Path, err)
+	}
+	if extraction != nil {
+		entry.Extracted = extraction
+		d.manifest.Put(file.File.Id, entry)
+	}
+}
+
+// moveExtracted moves the files extracted from a zip file that has been moved to dir, next to
+// where it is now, if nothing is there already.
+func moveExtracted(extraction *Extraction, dir string) *Extraction {
+	if extraction.Dir == dir {
+		return extraction
+	}
+	if _, err := os.Lstat(dir); !errors.Is(err, os.ErrNotExist) {
+		return extraction
+	}
+	if err := os.Rename(longPath(extraction.Dir), longPath(dir)); err != nil {
+		logDebugf("Cannot move %s to %s: %s", extraction.Dir, dir, err)
+		return extraction
+	}
+	return &Extraction{Dir: dir, Files: extraction.Files}
+}
+
+// extractZip extracts the zip file that has been downloaded for file into the directory next to
+// it, replacing the files extracted from a previous version of it, which are kept in the trash.
+// Entries whose names would lead outside the directory are skipped.
+func (d *Downloader) extractZip(file FileToSync, previous *Extraction) (*Extraction, error) {
+	dir := extractDirectory(file.Path)
+
+	if previous != nil {
+		if err := d.removeExtracted(previous); err != nil {
+			return nil, err
+		}
+	}
+	// Do not extract into a directory that canvas-sync did not create, such as a folder on Canvas
+	// with the same name.
+	if previous == nil || previous.Dir != dir {
+		if _, err := os.Lstat(dir); err == nil {
+			return nil, fmt.Errorf("%s already exists", dir)
+		}
+	}
+
+	r, err := zip.OpenReader(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	extraction := &Extraction{Dir: dir}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !f.Mode().IsRegular() {
+			continue
+		}
+
+		rel, ok := zipEntryPath(f.Name)
+		if !ok {
+			logInfof("Not extracting %s from %s: its name leads outside %s", f.Name, file.Path, dir)
+			continue
+		}
+
+		path := filepath.Join(dir, rel)
+		if err := extractZipEntry(f, path); err != nil {
+			return extraction, err
+		}
+		extraction.Files = append(extraction.Files, rel)
+	}
+
+	return extraction, nil
+}
+
+// zipEntryPath makes the name of an entry in a zip file into a path relative to the directory it
+// is extracted into, and reports whether it stays inside it. Names are made safe in the same way
+// as the names of files on Canvas.
+func zipEntryPath(name string) (string, bool) {
+	name = path.Clean(strings.TrimLeft(strings.ReplaceAll(name, `\`, "/"), "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+
+	var elems []string
+	for _, elem := range strings.Split(name, "/") {
+		elems = append(elems, localName(elem))
+	}
+
+	rel := filepath.Join(elems...)
+	_, ok := pathWithin(".", rel)
+	return rel, ok
+}
+
+func extractZipEntry(f *zip.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.OpenFile(longPath(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if !f.Modified.IsZero() {
+		return os.Chtimes(path, f.Modified, f.Modified)
+	}
+	return nil
+}
+
+// removeExtracted moves the files extracted from a zip file to the trash, and removes the
+// directories they were in if that leaves them empty.
+func (d *Downloader) removeExtracted(extraction *Extraction) error {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, rel := range extraction.Files {
+		path := filepath.Join(extraction.Dir, rel)
+		if err := d.trash.Keep(path); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for dir := filepath.Dir(path); dir != extraction.Dir && !seen[dir]; dir = filepath.Dir(dir) {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	// Remove the deepest directories first, and the directory the zip file was extracted into last.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range append(dirs, extraction.Dir) {
+		os.Remove(dir)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestZipEntryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"notes/week1.pdf", "notes/week1.pdf", true},
+		{"./notes/week1.pdf", "notes/week1.pdf", true},
+		{"../x", "", false},
+		{"..", "", false},
+		{"a/../../x", "", false},
+		{"a/../x", "x", true},
+		// Absolute names are extracted inside the directory.
+		{"/etc/passwd", "etc/passwd", true},
+		{"//server/share/x", "server/share/x", true},
+		// Zip files made on Windows can use backslashes, on any system.
+		{`notes\week1.pdf`, "notes/week1.pdf", true},
+		{`..\x`, "", false},
+		{`a\..\..\x`, "", false},
+		{`\Windows\x`, "Windows/x", true},
+	}
+	for _, test := range tests {
+		got, ok := zipEntryPath(test.name)
+		if ok != test.ok || (ok && got != filepath.FromSlash(test.want)) {
+			t.Errorf("zipEntryPath(%q) = %q, %v, want %q, %v", test.name, got, ok, filepath.FromSlash(test.want), test.ok)
+		}
+	}
+
+	// A drive letter must not make the path absolute on Windows.
+	for _, name := range []string{`C:\Windows\x`, "C:/Windows/x", "C:x"} {
+		got, ok := zipEntryPath(name)
+		if ok && (filepath.IsAbs(got) || filepath.VolumeName(got) != "") {
+			t.Errorf("zipEntryPath(%q) = %q, which is outside the directory", name, got)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	fileHooksStateFile = "file_hooks.json"
+
+	defaultMaxConcurrentHooks = 2
+
+	// Replaced with the path of the file in the arguments of a file hook.
+	fileHookPlaceholder = "{}"
+)
+
+// FileHook is a command run on each downloaded file whose name matches a pattern, such as one
+// that converts slides to PDF.
+type FileHook struct {
+	// Match is a pattern, such as "*.pptx", for the names of the files to run the command on.
+	Match string `json:"match"`
+	// Command is an external program and its arguments, in which {} is replaced with the path of
+	// the file. If there is no {}, the path is added as the last argument.
+	Command []string `json:"command"`
+}
+
+func (hook *FileHook) validate() error {
+	if hook.Match == "" || len(hook.Command) == 0 {
+		return fmt.Errorf("match and command must be set")
+	}
+	if _, err := filepath.Match(hook.Match, ""); err != nil {
+		return fmt.Errorf("invalid match %q: %w", hook.Match, err)
+	}
+	return nil
+}
+
+// key identifies a hook in the state file, so that changing its command runs it again.
+func (hook *FileHook) key() string {
+	return hook.Match + " " + strings.Join(hook.Command, " ")
+}
+
+// args returns the arguments to run the hook on the file at path with.
+func (hook *FileHook) args(path string) []string {
+	args := make([]string, 0, len(hook.Command)+1)
+	replaced := false
+	for _, arg := range hook.Command {
+		if strings.Contains(arg, fileHookPlaceholder) {
+			arg = strings.ReplaceAll(arg, fileHookPlaceholder, path)
+			replaced = true
+		}
+		args = append(args, arg)
+	}
+	if !replaced {
+		args = append(args, path)
+	}
+	return args
+}
+
+// FileHooks runs the file_hooks in the config file on files once they have been downloaded, a few
+// at a time. Each hook runs once on each version of a file: which versions of which files each
+// hook has run on is recorded in the state directory, so a hook is not run again on a file that
+// has not changed, and a hook that failed, or was added after the file was downloaded, runs on
+// the next sync. The methods of a nil FileHooks do nothing.
+type FileHooks struct {
+	hooks []FileHook
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// The version of each file, by ID, that each hook, by key, last ran on successfully.
+	done    map[uint64]map[string]string
+	running map[uint64]map[string]bool
+	changed bool
+}
+
+// LoadFileHooks returns the file hooks in the config file with the files they have run on, or nil
+// if there are none.
+func LoadFileHooks(config *Config) (*FileHooks, error) {
+	if len(config.FileHooks) == 0 {
+		return nil, nil
+	}
+
+	n := config.MaxConcurrentHooks
+	if n <= 0 {
+		n = defaultMaxConcurrentHooks
+	}
+	h := &FileHooks{
+		hooks:   config.FileHooks,
+		slots:   make(chan struct{}, n),
+		done:    make(map[uint64]map[string]string),
+		running: make(map[uint64]map[string]bool),
+	}
+	if err := loadState(fileHooksStateFile, &h.done); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Run starts the hooks that match a downloaded file and have not already run on this version of
+// it, without waiting for them to finish.
+func (h *FileHooks) Run(ctx context.Context, fileId uint64, entry ManifestEntry) {
+	if h == nil {
+		return
+	}
+
+	version := fileVersion(entry)
+	for i := range h.hooks {
+		hook := &h.hooks[i]
+		if ok, _ := filepath.Match(hook.Match, filepath.Base(entry.Path)); !ok {
+			continue
+		}
+
+		key := hook.key()
+		h.mu.Lock()
+		if h.done[fileId][key] == version || h.running[fileId][key] {
+			h.mu.Unlock()
+			continue
+		}
+		if h.running[fileId] == nil {
+			h.running[fileId] = make(map[string]bool)
+		}
+		h.running[fileId][key] = true
+		h.mu.Unlock()
+
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			err := h.run(ctx, hook, entry.Path)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.running[fileId], key)
+			if err != nil {
+				// Hooks stopped because the sync was interrupted run again on the next sync.
+				if ctx.Err() == nil {
+					logErrorf("%s", err)
+				}
+				return
+			}
+			if h.done[fileId] == nil {
+				h.done[fileId] = make(map[string]string)
+			}
+			h.done[fileId][key] = version
+			h.changed = true
+		}()
+	}
+}
+
+// RunPending starts the hooks on every downloaded file they have not yet run on successfully,
+// except those skip returns true for.
+func (h *FileHooks) RunPending(ctx context.Context, entries map[uint64]ManifestEntry, skip func(ManifestEntry) bool) {
+	if h == nil {
+		return
+	}
+
+	for fileId, entry := range entries {
+		if !skip(entry) {
+			h.Run(ctx, fileId, entry)
+		}
+	}
+}
+
+func (h *FileHooks) run(ctx context.Context, hook *FileHook, path string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case h.slots <- struct{}{}:
+	}
+	defer func() { <-h.slots }()
+
+	args := hook.args(path)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Programs that convert files, such as LibreOffice, write their output to the working directory.
+	cmd.Dir = filepath.Dir(path)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	logDebugf("Running %s on %s", args[0], path)
+	if err := cmd.Run(); err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return fmt.Errorf("file hook %s on %s: %w", args[0], path, err)
+	}
+	return nil
+}
+
+// Wait waits for the hooks that have been started to finish.
+func (h *FileHooks) Wait() {
+	if h == nil {
+		return
+	}
+	h.wg.Wait()
+}
+
+// Save records which versions of which files each hook has run on, forgetting hooks that are no
+// longer in the config file.
+func (h *FileHooks) Save() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	known := make(map[string]bool, len(h.hooks))
+	for i := range h.hooks {
+		known[h.hooks[i].key()] = true
+	}
+	for fileId, done := range h.done {
+		for key := range done {
+			if !known[key] {
+				delete(done, key)
+				h.changed = true
+			}
+		}
+		if len(done) == 0 {
+			delete(h.done, fileId)
+		}
+	}
+
+	if !h.changed {
+		return nil
+	}
+	if err := saveState(fileHooksStateFile, h.done); err != nil {
+		return err
+	}
+	h.changed = false
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+const (
+	finalizedStateFile = "finalized.json"
+	signingKeyFile     = "signing.key"
+
+	// Name of the signed list of contents written to the directory of a finalized course.
+	finalManifestName = "canvas-course-final.json"
+)
+
+// FinalizedCourse records a course that has been closed out with the finalize command. Finalized
+// courses are no longer synced.
+type FinalizedCourse struct {
+	Name        string    `json:"name"`
+	Directory   string    `json:"directory"`
+	FinalizedAt time.Time `json:"finalized_at"`
+}
+
+func loadFinalizedCourses() (map[uint64]FinalizedCourse, error) {
+	finalized := make(map[uint64]FinalizedCourse)
+	if err := loadState(finalizedStateFile, &finalized); err != nil {
+		return nil, err
+	}
+
+	return finalized, nil
+}
+
+// FinalManifest lists the verified contents of a finalized course.
+type FinalManifest struct {
+	CourseId    uint64      `json:"course_id"`
+	CourseName  string      `json:"course_name"`
+	CanvasUrl   string      `json:"canvas_url"`
+	FinalizedAt time.Time   `json:"finalized_at"`
+	Files       []FinalFile `json:"files"`
+	// Base64 encoded Ed25519 public key that signed the manifest.
+	PublicKey string `json:"public_key"`
+}
+
+type FinalFile struct {
+	// Slash separated path relative to the course directory, or for files that
+	// content_type_rules save under another directory, to the course directory within it.
+	Path string `json:"path"`
+	// The directory from content_type_rules that the file is saved under, if it is not saved
+	// in the sync directory.
+	Directory string    `json:"directory,omitempty"`
+	FileId    uint64    `json:"file_id"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// runFinalize implements the finalize subcommand, which closes out a course: every file is checked
+// against Canvas and the manifest (and downloaded again if it does not match), a signed list of
+// contents is written to the course directory, the directory is made read-only and the course is
+// excluded from future syncs.
+func runFinalize(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("finalize", flag.ExitOnError)
+	courseId := flags.Uint64("course", 0, "ID of the course to finalize")
+	flags.Parse(args)
+
+	if *courseId == 0 || flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync finalize --course <course id>")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// Finalizing moves files about in the sync directory, so must not overlap a sync.
+	if !opts.IgnoreLock {
+		lock, err := AcquireSyncLock(ctx, opts.Wait)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	finalized, err := loadFinalizedCourses()
+	if err != nil {
+		return err
+	}
+	if f, ok := finalized[*courseId]; ok {
+		return fmt.Errorf("course %d was already finalized on %s", *courseId, f.FinalizedAt.Format("2 January 2006"))
+	}
+
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+
+	course, err := api.Course(ctx, *courseId)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+
+	api.Usage, err = LoadUsage()
+	if err != nil {
+		return err
+	}
+
+	retries, err := LoadRetryQueue()
+	if err != nil {
+		return err
+	}
+
+	journal, err := OpenJournal()
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	now := time.Now()
+	downloader := &Downloader{
+		api:          api,
+		trash:        NewTrash(config.SyncRoots(), now),
+		retries:      retries,
+		manifest:     manifest,
+		pipeline:     NewPipeline(),
+		journal:      journal,
+		keepVersions: config.KeepVersions,
+		force:        true,
+	}
+
+	var mu sync.Mutex
+	var files []FinalFile
+	var repaired int
+
+	// Files are checked where a sync would have saved them, and those that content_type_rules
+	// skip are left out.
+	rules := NewContentRules(config)
+	tree, err := BuildTree(ctx, api, course, config.SkipFoldersFor(course.Id), func(tree *CourseTree, folder *TreeFolder, parents []*TreeFolder) error {
+		folderPath := tree.LocalPath(config.Directory, folder, parents)
+
+		for _, file := range folder.files {
+			filePath, ok := rules.Route(file.File, filepath.Join(folderPath, localName(file.FileName)))
+			if !ok {
+				continue
+			}
+			fileToSync := FileToSync{File: file.File, CourseId: course.Id, Path: filePath}
+
+			hash, err := verifyFile(manifest, fileToSync)
+			if err != nil {
+				if err := downloader.DownloadAndWriteFile(ctx, fileToSync); err != nil {
+					return err
+				}
+				if hash, err = verifyFile(manifest, fileToSync); err != nil {
+					return err
+				}
+
+				mu.Lock()
+				repaired++
+				mu.Unlock()
+			}
+
+			mu.Lock()
+			files = append(files, FinalFile{
+				FileId:    file.Id,
+				Size:      file.Size,
+				SHA256:    hash,
+				UpdatedAt: file.UpdatedAt,
+				Path:      fileToSync.Path,
+			})
+			mu.Unlock()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if tree.FoldersForbidden || len(tree.ForbiddenFolders) > 0 {
+		return fmt.Errorf("cannot finalize course %d: not all of its folders can be listed", course.Id)
+	}
+
+	if err := manifest.Save(); err != nil {
+		return err
+	}
+	if err := api.Usage.Save(); err != nil {
+		return err
+	}
+
+	// The course directory, and its counterparts under the directories of content_type_rules
+	// that hold any of its files.
+	courseDirectory := tree.LocalPath(config.Directory, tree.root, nil)
+	courseRel, _ := pathWithin(config.Directory, courseDirectory)
+	courseDirectories := []string{courseDirectory}
+	routed := make(map[string]bool)
+	roots := config.SyncRoots()
+	for i := range files {
+		root := syncRootOf(roots, files[i].Path)
+		dir := courseDirectory
+		if root != "" && root != config.Directory {
+			files[i].Directory = root
+			dir = filepath.Join(root, courseRel)
+			if !routed[dir] {
+				routed[dir] = true
+				courseDirectories = append(courseDirectories, dir)
+			}
+		}
+
+		rel, err := filepath.Rel(dir, files[i].Path)
+		if err != nil {
+			return err
+		}
+		files[i].Path = filepath.ToSlash(rel)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Directory != files[j].Directory {
+			return files[i].Directory < files[j].Directory
+		}
+		return files[i].Path < files[j].Path
+	})
+
+	key, err := loadSigningKey()
+	if err != nil {
+		return err
+	}
+
+	final := FinalManifest{
+		CourseId:    course.Id,
+		CourseName:  course.Name,
+		CanvasUrl:   config.Url,
+		FinalizedAt: now,
+		Files:       files,
+		PublicKey:   base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}
+	if err := writeSignedManifest(courseDirectory, key, &final); err != nil {
+		return err
+	}
+
+	for _, dir := range courseDirectories {
+		if err := makeReadOnly(dir); err != nil {
+			return err
+		}
+	}
+
+	finalized[course.Id] = FinalizedCourse{Name: course.Name, Directory: courseDirectory, FinalizedAt: now}
+	if err := saveState(finalizedStateFile, finalized); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Finalized %s: verified %d files (%d downloaded again) in %s.\n", course.Name, len(files), repaired, courseDirectory)
+	return nil
+}
+
+// verifyFile checks that the local copy of a file has the size given by Canvas and, if the manifest
+// has a hash for it, the same content as when it was downloaded. It returns the hash of the local
+// copy, recording it in the manifest if it was not there already.
+func verifyFile(manifest *Manifest, file FileToSync) (string, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	if n != file.File.Size {
+		return "", fmt.Errorf("%s is %d bytes but should be %d", file.Path, n, file.File.Size)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	entry, ok := manifest.Get(file.File.Id)
+	if ok && entry.Path == file.Path && entry.SHA256 != "" {
+		if entry.SHA256 != sum {
+			return "", fmt.Errorf("%s has changed since it was downloaded", file.Path)
+		}
+		return sum, nil
+	}
+
+	manifest.Put(file.File.Id, ManifestEntry{
+		CourseId:     file.CourseId,
+		Path:         file.Path,
+		Size:         file.File.Size,
+		UpdatedAt:    file.File.UpdatedAt,
+		SHA256:       sum,
+		ETag:         entry.ETag,
+		LastModified: entry.LastModified,
+	})
+
+	return sum, nil
+}
+
+// loadSigningKey returns the key used to sign the manifests of finalized courses, creating it the
+// first time it is needed.
+func loadSigningKey() (ed25519.PrivateKey, error) {
+	var seed []byte
+	if err := loadState(signingKeyFile, &seed); err != nil {
+		return nil, err
+	}
+
+	if len(seed) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if len(seed) != 0 {
+		return nil, errors.New("invalid signing key")
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveState(signingKeyFile, key.Seed()); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// writeSignedManifest writes the manifest to the course directory, along with a detached,
+// base64 encoded Ed25519 signature of its exact contents in a .sig file.
+func writeSignedManifest(courseDirectory string, key ed25519.PrivateKey, final *FinalManifest) error {
+	content, err := json.MarshalIndent(final, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(courseDirectory, finalManifestName)
+	if err := atomicFile.WriteFile(path, bytes.NewReader(content)); err != nil {
+		return err
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, content))
+	return atomicFile.WriteFile(path+".sig", strings.NewReader(signature+"\n"))
+}
+
+// makeReadOnly removes write permission from every file and directory under dir.
+func makeReadOnly(dir string) error {
+	// Directories are made read-only after their contents, by walking in reverse order.
+	var paths []string
+	var modes []fs.FileMode
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		paths = append(paths, path)
+		modes = append(modes, info.Mode().Perm()&^0222)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := os.Chmod(paths[i], modes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sync/errgroup"
+)
+
+// runGet implements the get subcommand, which downloads one file, or every file in a folder, from
+// Canvas to the current directory, or elsewhere with -O, without syncing. The path is a course
+// directory, or a path within one, as for ls.
+func runGet(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	output := flags.String("O", "", "save to this path rather than to the current directory, or write a file to standard output with -")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: canvas-sync get [-O <path>|-] <course>/<path>")
+	}
+	if opts.Offline {
+		return fmt.Errorf("--offline only works with diff, digest, quota and archive, as get needs Canvas")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+	defer api.Listings.Save()
+	view := NewCanvasView(api, config, nil, "", 0)
+
+	remotePath, err := resolveRemotePath(ctx, view, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	node, err := view.lookup(ctx, remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("there is nothing at %s on Canvas", flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	if node.course == nil {
+		return fmt.Errorf("give a course directory, or a path within one, to download: %s holds courses", flags.Arg(0))
+	}
+
+	if !node.IsDir() {
+		if *output == "-" {
+			_, err := api.DownloadFile(withCourse(ctx, node.course.Id), nopWriteCloser{os.Stdout}, node.file.File, Validators{})
+			return err
+		}
+		dest := node.name
+		if *output != "" {
+			dest = *output
+			if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+				dest = filepath.Join(dest, node.name)
+			}
+		}
+		if err := downloadRemoteFile(ctx, api, node.course.Id, node.file.File, dest); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Downloaded %s (%s).\n", dest, humanize.Bytes(uint64(node.file.Size)))
+		return nil
+	}
+
+	if *output == "-" {
+		return fmt.Errorf("%s is a folder, which cannot be written to standard output", flags.Arg(0))
+	}
+	dir := *output
+	if dir == "" {
+		dir = node.name
+	}
+
+	// Find every file first, so that nothing is downloaded if the folder cannot be listed.
+	type remoteFile struct {
+		rel  string
+		node *viewNode
+	}
+	var files []remoteFile
+	if err := view.walk(ctx, remotePath, node, "", 0, 0, func(rel string, file *viewNode) {
+		files = append(files, remoteFile{rel, file})
+	}); err != nil {
+		return err
+	}
+
+	var downloaded, skipped, bytes atomic.Int64
+	errgrp, ctx := errgroup.WithContext(ctx)
+	errgrp.SetLimit(numDownloaders)
+	for _, f := range files {
+		f := f
+		errgrp.Go(func() error {
+			dest := filepath.Join(dir, filepath.FromSlash(f.rel))
+			// Files already there from an earlier get are not downloaded again.
+			if needsSync, err := fileNeedsSync(f.node.file, dest); err == nil && !needsSync {
+				skipped.Add(1)
+				return nil
+			}
+			if err := downloadRemoteFile(ctx, api, f.node.course.Id, f.node.file.File, dest); err != nil {
+				return err
+			}
+			downloaded.Add(1)
+			bytes.Add(f.node.file.Size)
+			return nil
+		})
+	}
+	if err := errgrp.Wait(); err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		fmt.Printf("✓ There are no files in %s.\n", flags.Arg(0))
+	}
+	if n := downloaded.Load(); n > 0 {
+		fmt.Printf("✓ Downloaded %d files (%s) to %s.\n", n, humanize.Bytes(uint64(bytes.Load())), dir)
+	}
+	if n := skipped.Load(); n > 0 {
+		fmt.Printf("✓ %d files in %s were already up to date.\n", n, dir)
+	}
+	return nil
+}
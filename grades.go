@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory inside a course directory where grade reports are written to.
+const gradesDirectory = "Grades"
+
+type Enrollment struct {
+	Type   string            `json:"type"`
+	Grades *EnrollmentGrades `json:"grades"`
+}
+
+type EnrollmentGrades struct {
+	CurrentScore *float64 `json:"current_score"`
+	FinalScore   *float64 `json:"final_score"`
+	CurrentGrade *string  `json:"current_grade"`
+	FinalGrade   *string  `json:"final_grade"`
+}
+
+type Submission struct {
+	AssignmentId  uint64     `json:"assignment_id"`
+	Score         *float64   `json:"score"`
+	Grade         *string    `json:"grade"`
+	WorkflowState string     `json:"workflow_state"`
+	SubmittedAt   *time.Time `json:"submitted_at"`
+	GradedAt      *time.Time `json:"graded_at"`
+	Late          bool       `json:"late"`
+	Missing       bool       `json:"missing"`
+	Attempt       int        `json:"attempt"`
+	Assignment    *struct {
+		Name           string     `json:"name"`
+		PointsPossible *float64   `json:"points_possible"`
+		DueAt          *time.Time `json:"due_at"`
+		// Whether the assignment is graded anonymously.
+		AnonymizeStudents bool `json:"anonymize_students"`
+	} `json:"assignment"`
+
+	// Who submitted, which is only known to teachers. For anonymously graded assignments, only
+	// AnonymousId is given.
+	UserId      uint64 `json:"user_id"`
+	AnonymousId string `json:"anonymous_id"`
+	User        *struct {
+		SortableName string `json:"sortable_name"`
+	} `json:"user"`
+	Attachments []File `json:"attachments"`
+}
+
+// GradeReport is a snapshot of the user's grades in a course.
+type GradeReport struct {
+	CourseId     uint64           `json:"course_id"`
+	CourseName   string           `json:"course_name"`
+	TakenAt      time.Time        `json:"taken_at"`
+	CurrentScore *float64         `json:"current_score"`
+	FinalScore   *float64         `json:"final_score"`
+	CurrentGrade *string          `json:"current_grade"`
+	FinalGrade   *string          `json:"final_grade"`
+	Assignments  []GradeReportRow `json:"assignments"`
+}
+
+type GradeReportRow struct {
+	AssignmentId   uint64     `json:"assignment_id"`
+	Name           string     `json:"name"`
+	PointsPossible *float64   `json:"points_possible"`
+	DueAt          *time.Time `json:"due_at"`
+	Score          *float64   `json:"score"`
+	Grade          *string    `json:"grade"`
+	State          string     `json:"state"`
+	SubmittedAt    *time.Time `json:"submitted_at"`
+	GradedAt       *time.Time `json:"graded_at"`
+	Late           bool       `json:"late"`
+	Missing        bool       `json:"missing"`
+}
+
+// FetchGradeReport gets the user's grades in a course. It returns errForbidden if the user is not
+// a student in the course.
+func FetchGradeReport(ctx context.Context, api *CanvasApi, course Course) (*GradeReport, error) {
+	ctx = withCourse(ctx, course.Id)
+
+	report := &GradeReport{CourseId: course.Id, CourseName: course.Name, TakenAt: time.Now()}
+
+	enrollments, err := listAll(ctx, api.MakeOwnEnrollmentsInCourseUrl(course.Id), api.Enrollments)
+	if err != nil {
+		return nil, err
+	}
+
+	student := false
+	for _, enrollment := range enrollments {
+		if enrollment.Type != "StudentEnrollment" {
+			continue
+		}
+		student = true
+		if enrollment.Grades != nil {
+			report.CurrentScore = enrollment.Grades.CurrentScore
+			report.FinalScore = enrollment.Grades.FinalScore
+			report.CurrentGrade = enrollment.Grades.CurrentGrade
+			report.FinalGrade = enrollment.Grades.FinalGrade
+		}
+	}
+	if !student {
+		return nil, errForbidden
+	}
+
+	submissions, err := listAll(ctx, api.MakeOwnSubmissionsInCourseUrl(course.Id), api.Submissions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range submissions {
+		row := GradeReportRow{
+			AssignmentId: s.AssignmentId,
+			Score:        s.Score,
+			Grade:        s.Grade,
+			State:        s.WorkflowState,
+			SubmittedAt:  s.SubmittedAt,
+			GradedAt:     s.GradedAt,
+			Late:         s.Late,
+			Missing:      s.Missing,
+		}
+		if s.Assignment != nil {
+			row.Name = s.Assignment.Name
+			row.PointsPossible = s.Assignment.PointsPossible
+			row.DueAt = s.Assignment.DueAt
+		}
+		report.Assignments = append(report.Assignments, row)
+	}
+	sort.Slice(report.Assignments, func(i, j int) bool {
+		return report.Assignments[i].AssignmentId < report.Assignments[j].AssignmentId
+	})
+
+	return report, nil
+}
+
+// sameGrades reports whether two reports have the same grades, whenever they were taken.
+func sameGrades(a, b *GradeReport) bool {
+	a2, b2 := *a, *b
+	a2.TakenAt, b2.TakenAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a2, b2)
+}
+
+// latestGradeReport returns the most recent report written to gradesPath, or nil if there is none.
+func latestGradeReport(gradesPath string) (*GradeReport, error) {
+	names, err := filepath.Glob(filepath.Join(gradesPath, "grades-*.json"))
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	// The names contain the time the report was taken, so sort in time order.
+	sort.Strings(names)
+
+	content, err := os.ReadFile(names[len(names)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	var report GradeReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		return nil, fmt.Errorf("invalid grade report %s: %w", names[len(names)-1], err)
+	}
+	return &report, nil
+}
+
+// WriteGradeReport writes the report to gradesPath as JSON and CSV files named after the time it
+// was taken. If onlyIfChanged is set, nothing is written when the grades are the same as in the
+// latest report. Reports whether the files were written.
+func WriteGradeReport(report *GradeReport, gradesPath string, onlyIfChanged bool) (bool, error) {
+	if onlyIfChanged {
+		latest, err := latestGradeReport(gradesPath)
+		if err != nil {
+			return false, err
+		}
+		if latest != nil && sameGrades(latest, report) {
+			return false, nil
+		}
+	}
+
+	name := "grades-" + report.TakenAt.Format("2006-01-02T150405")
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := writeFileIfChanged(filepath.Join(gradesPath, name+".json"), content); err != nil {
+		return false, err
+	}
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"assignment_id", "name", "points_possible", "score", "grade", "state", "due_at", "submitted_at", "graded_at", "late", "missing"})
+	for _, row := range report.Assignments {
+		w.Write([]string{
+			strconv.FormatUint(row.AssignmentId, 10),
+			row.Name,
+			formatOptionalFloat(row.PointsPossible),
+			formatOptionalFloat(row.Score),
+			formatOptionalString(row.Grade),
+			row.State,
+			formatOptionalTime(row.DueAt),
+			formatOptionalTime(row.SubmittedAt),
+			formatOptionalTime(row.GradedAt),
+			strconv.FormatBool(row.Late),
+			strconv.FormatBool(row.Missing),
+		})
+	}
+	w.Write([]string{"", "Total", "", formatOptionalFloat(report.CurrentScore), formatOptionalString(report.CurrentGrade), "", "", "", "", "", ""})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return false, err
+	}
+	if err := writeFileIfChanged(filepath.Join(gradesPath, name+".csv"), b.Bytes()); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func formatOptionalFloat(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
+
+func formatOptionalString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// snapshotGrades writes a grade report for a course during a sync, if the grades have changed
+// since the last one. Courses in which the user is not a student are skipped.
+func snapshotGrades(ctx context.Context, api *CanvasApi, course Course, gradesPath string) error {
+	report, err := FetchGradeReport(ctx, api, course)
+	if errors.Is(err, errForbidden) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = WriteGradeReport(report, gradesPath, true)
+	return err
+}
+
+// runGrades implements the grades subcommand, which writes a report of the user's current grades
+// in every course, or just one, and prints a summary.
+func runGrades(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("grades", flag.ExitOnError)
+	courseId := flags.Uint64("course", 0, "only report the grades in the course with this ID")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync grades [--course <course id>]")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+
+	finalized, err := loadFinalizedCourses()
+	if err != nil {
+		return err
+	}
+
+	var courses []Course
+	if *courseId != 0 {
+		course, err := api.Course(ctx, *courseId)
+		if err != nil {
+			return err
+		}
+		courses = append(courses, course)
+	} else {
+		courses, err = api.AllCourses(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+CourseLoop:
+	for _, course := range courses {
+		for _, ignoredCourseId := range config.IgnoredCourses {
+			if course.Id == ignoredCourseId && *courseId == 0 {
+				continue CourseLoop
+			}
+		}
+
+		report, err := FetchGradeReport(ctx, api, course)
+		if errors.Is(err, errForbidden) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var grade []string
+		if report.CurrentScore != nil {
+			grade = append(grade, formatOptionalFloat(report.CurrentScore)+"%")
+		}
+		if report.CurrentGrade != nil {
+			grade = append(grade, *report.CurrentGrade)
+		}
+		if len(grade) == 0 {
+			grade = append(grade, "no grade yet")
+		}
+		fmt.Printf("%s: %s\n", course.Name, strings.Join(grade, ", "))
+
+		// The directory of a finalized course is read-only.
+		if _, ok := finalized[course.Id]; ok {
+			continue
+		}
+		if _, err := WriteGradeReport(report, filepath.Join(config.CourseDirectory(course), gradesDirectory), false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errGraphQL = errors.New("GraphQL error")
+
+// graphQL makes a query to the Canvas GraphQL API, decoding the data in the response into data.
+func (canvas *CanvasApi) graphQL(ctx context.Context, query string, data any) error {
+	if canvas.Limiter != nil {
+		if err := canvas.Limiter.Acquire(ctx, courseFromContext(ctx)); err != nil {
+			return err
+		}
+		defer canvas.Limiter.Release()
+	}
+
+	reqCtx := ctx
+	if canvas.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, canvas.Timeout)
+		defer cancel()
+	}
+
+	apiCall := canvas.masquerade(fmt.Sprintf("%s/api/graphql", canvas.RootUrl))
+	body, err := json.Marshal(map[string]string{"query": query})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, "POST", apiCall, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request error for %s: %w", apiCall, err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", canvas.Token))
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	res, err := canvas.Client.Do(req)
+	if err != nil {
+		logDebugf("POST %s: %v", apiCall, err)
+		return fmt.Errorf("client error for %s: %w", apiCall, err)
+	}
+	defer res.Body.Close()
+	logDebugf("POST %s: %s in %s", apiCall, res.Status, time.Since(start).Round(time.Millisecond))
+	metrics.APIRequest(isRateLimited(res))
+	canvas.Limiter.Observe(res, time.Since(start))
+
+	if res.StatusCode != http.StatusOK {
+		httpErr := apiError(apiCall, res)
+		if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") != "" {
+			return &TokenError{httpErr}
+		}
+		if isInsufficientScope(httpErr) {
+			return &ScopeError{httpErr}
+		}
+		return httpErr
+	}
+
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	counted := &countingReader{r: res.Body}
+	err = json.NewDecoder(counted).Decode(&response)
+	canvas.Usage.AddRequest(courseFromContext(ctx), counted.n)
+	if err != nil {
+		return fmt.Errorf("cannot decode the response from %s: %w", apiCall, err)
+	}
+
+	if len(response.Errors) > 0 {
+		messages := make([]string, len(response.Errors))
+		for i, e := range response.Errors {
+			messages[i] = e.Message
+		}
+		return fmt.Errorf("%w: %s", errGraphQL, strings.Join(messages, "; "))
+	}
+
+	return json.Unmarshal(response.Data, data)
+}
+
+type graphQLTerm struct {
+	Id      string     `json:"_id"`
+	Name    string     `json:"name"`
+	StartAt *time.Time `json:"startAt"`
+}
+
+type graphQLCourse struct {
+	Id         string       `json:"_id"`
+	Name       string       `json:"name"`
+	CourseCode string       `json:"courseCode"`
+	StartAt    *time.Time   `json:"startAt"`
+	Term       *graphQLTerm `json:"term"`
+}
+
+// coursesGraphQL lists the user's courses with a single GraphQL query, rather than page by page.
+func (canvas *CanvasApi) coursesGraphQL(ctx context.Context) ([]Course, error) {
+	// Only ask for the start of courses when they are needed, in case the server does not have
+	// it: an unknown field makes the whole query fail.
+	startAt := ""
+	if canvas.Layout == layoutYear {
+		startAt = "startAt"
+	}
+	query := fmt.Sprintf("query { allCourses { _id name courseCode %s term { _id name startAt } } }", startAt)
+
+	var data struct {
+		AllCourses []graphQLCourse `json:"allCourses"`
+	}
+	if err := canvas.graphQL(ctx, query, &data); err != nil {
+		return nil, err
+	}
+
+	courses := make([]Course, 0, len(data.AllCourses))
+	for _, c := range data.AllCourses {
+		id, err := strconv.ParseUint(c.Id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid course ID %q", errGraphQL, c.Id)
+		}
+		course := Course{Id: id, Name: c.Name, CourseCode: c.CourseCode, StartAt: c.StartAt}
+		if c.Term != nil {
+			termId, err := strconv.ParseUint(c.Term.Id, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid term ID %q", errGraphQL, c.Term.Id)
+			}
+			course.Term = &Term{Id: termId, Name: c.Term.Name, StartAt: c.Term.StartAt}
+		}
+
+		if err := canvas.prepareCourse(ctx, &course); err != nil {
+			return nil, err
+		}
+		courses = append(courses, course)
+	}
+	return courses, nil
+}
+
+// useGraphQL reports whether to try the GraphQL API. It is not used once it has failed, nor when
+// listings are taken from the cache, which only has the responses of the REST API, nor for the
+// courses of an account, which it cannot list.
+func (canvas *CanvasApi) useGraphQL() bool {
+	if !canvas.UseGraphQL || canvas.graphQLFailed.Load() || canvas.Account != nil {
+		return false
+	}
+	return canvas.Listings == nil || (!canvas.Listings.Offline && canvas.Listings.TTL == 0)
+}
+
+// AllCourses lists the courses to sync, the user's own or those of the account in admin mode, with
+// GraphQL if it is turned on and works, and otherwise with the REST API.
+func (canvas *CanvasApi) AllCourses(ctx context.Context) ([]Course, error) {
+	if canvas.useGraphQL() {
+		courses, err := canvas.coursesGraphQL(ctx)
+		if err == nil {
+			return courses, nil
+		}
+		if ctx.Err() != nil || isTokenRejected(err) {
+			return nil, err
+		}
+
+		canvas.graphQLFailed.Store(true)
+		logInfof("Cannot list courses with GraphQL, so using the REST API: %s", err)
+	}
+
+	var courses []Course
+	for _, url := range canvas.coursesUrls() {
+		c, err := listAll(ctx, url, canvas.Courses)
+		if err != nil {
+			return nil, err
+		}
+		courses = append(courses, c...)
+	}
+	return courses, nil
+}
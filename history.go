@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const historyStateFile = "history.json"
+
+// Number of runs kept in the history.
+const maxHistoryRuns = 100
+
+// HistoryRun records what a sync did, for the log command.
+type HistoryRun struct {
+	Id               uint64       `json:"id"`
+	Url              string       `json:"url"`
+	StartedAt        time.Time    `json:"started_at"`
+	FinishedAt       time.Time    `json:"finished_at"`
+	FilesSynced      uint64       `json:"files_synced"`
+	BytesTransferred uint64       `json:"bytes_transferred"`
+	Files            []SyncedFile `json:"files"`
+	Failed           []FailedFile `json:"failed,omitempty"`
+	// The error that stopped the sync, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// FailedFile is a file that could not be downloaded in a run.
+type FailedFile struct {
+	Id    uint64 `json:"id"`
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+func loadHistory() ([]HistoryRun, error) {
+	var runs []HistoryRun
+	if err := loadState(historyStateFile, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// AddHistoryRun adds a run to the history, numbering it after the last one and dropping the oldest
+// runs if there are too many.
+func AddHistoryRun(run HistoryRun) error {
+	runs, err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	run.Id = 1
+	if len(runs) > 0 {
+		run.Id = runs[len(runs)-1].Id + 1
+	}
+	runs = append(runs, run)
+	if len(runs) > maxHistoryRuns {
+		runs = runs[len(runs)-maxHistoryRuns:]
+	}
+
+	return saveState(historyStateFile, runs)
+}
+
+// runLog implements the log subcommand, which lists recent syncs, or with show, the files that a
+// sync downloaded or failed to download.
+func runLog(args []string) error {
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	count := flags.Int("n", 20, "number of runs to show")
+	flags.Parse(args)
+
+	usage := fmt.Errorf("usage: canvas-sync log [-n <count>] | canvas-sync log show <run id>")
+
+	runs, err := loadHistory()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case flags.NArg() == 0:
+		if len(runs) == 0 {
+			fmt.Println("No syncs have been recorded yet.")
+			return nil
+		}
+
+		// Newest first, like git log.
+		for i := len(runs) - 1; i >= 0 && i >= len(runs)-*count; i-- {
+			printHistoryRun(runs[i])
+		}
+		return nil
+	case flags.NArg() == 2 && flags.Arg(0) == "show":
+		id, err := strconv.ParseUint(flags.Arg(1), 10, 64)
+		if err != nil {
+			return usage
+		}
+		for _, run := range runs {
+			if run.Id == id {
+				return showHistoryRun(run)
+			}
+		}
+		return fmt.Errorf("no run %d in the history, which keeps the last %d runs", id, maxHistoryRuns)
+	default:
+		return usage
+	}
+}
+
+func printHistoryRun(run HistoryRun) {
+	fmt.Printf("%4d  %s  %6s  ", run.Id, run.StartedAt.Local().Format("2006-01-02 15:04"), run.FinishedAt.Sub(run.StartedAt).Round(time.Second))
+	switch run.FilesSynced {
+	case 0:
+		fmt.Print("up to date")
+	case 1:
+		fmt.Printf("1 file (%s)", humanize.Bytes(run.BytesTransferred))
+	default:
+		fmt.Printf("%d files (%s)", run.FilesSynced, humanize.Bytes(run.BytesTransferred))
+	}
+	if len(run.Failed) > 0 {
+		fmt.Printf(", %d failed", len(run.Failed))
+	}
+	if run.Error != "" {
+		fmt.Printf(", stopped: %s", run.Error)
+	}
+	fmt.Println()
+}
+
+func showHistoryRun(run HistoryRun) error {
+	// Show paths relative to the sync directory when it is known.
+	relPath := func(path string) string { return path }
+	if config, err := loadConfig(); err == nil {
+		relPath = func(path string) string {
+			if rel, err := filepath.Rel(config.Directory, path); err == nil {
+				return rel
+			}
+			return path
+		}
+	}
+
+	fmt.Printf("Run %d synced %s\n", run.Id, run.Url)
+	fmt.Printf("Started:  %s\n", run.StartedAt.Local().Format(time.RFC1123))
+	fmt.Printf("Finished: %s\n", run.FinishedAt.Local().Format(time.RFC1123))
+	if run.Error != "" {
+		fmt.Printf("Stopped:  %s\n", run.Error)
+	}
+
+	if len(run.Files) == 0 && len(run.Failed) == 0 {
+		fmt.Println("\nNothing changed.")
+	}
+
+	sort.Slice(run.Files, func(i, j int) bool { return run.Files[i].Path < run.Files[j].Path })
+	sort.Slice(run.Failed, func(i, j int) bool { return run.Failed[i].Path < run.Failed[j].Path })
+
+	if len(run.Files) > 0 {
+		files := "files"
+		if run.FilesSynced == 1 {
+			files = "file"
+		}
+		fmt.Printf("\nDownloaded %d %s (%s):\n", run.FilesSynced, files, humanize.Bytes(run.BytesTransferred))
+		for _, file := range run.Files {
+			change := "A"
+			if file.Updated {
+				change = "M"
+			}
+			fmt.Printf("  %s %s\n", change, relPath(file.Path))
+		}
+	}
+
+	if len(run.Failed) > 0 {
+		fmt.Printf("\nFailed to download %d files:\n", len(run.Failed))
+		for _, file := range run.Failed {
+			fmt.Printf("  ! %s: %s\n", relPath(file.Path), file.Error)
+		}
+	}
+
+	return nil
+}
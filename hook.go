@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// PostSyncHook is run after a sync that transferred at least one file. Either or both of Command
+// and Url may be set.
+type PostSyncHook struct {
+	// Command is an external program and its arguments. The sync report is written to its
+	// standard input as JSON.
+	Command []string `json:"command"`
+	// Url receives the sync report as the body of a JSON POST request.
+	Url string `json:"url"`
+}
+
+type SyncedFile struct {
+	Id       uint64 `json:"id"`
+	CourseId uint64 `json:"course_id"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	// Whether the file replaced an older copy, rather than being new.
+	Updated bool `json:"updated"`
+}
+
+type SyncReport struct {
+	Url              string       `json:"url"`
+	StartedAt        time.Time    `json:"started_at"`
+	FinishedAt       time.Time    `json:"finished_at"`
+	FilesSynced      uint64       `json:"files_synced"`
+	BytesTransferred uint64       `json:"bytes_transferred"`
+	Files            []SyncedFile `json:"files"`
+}
+
+func runPostSyncHook(ctx context.Context, client *http.Client, hook *PostSyncHook, report *SyncReport) error {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	if len(hook.Command) > 0 {
+		cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("post sync hook %s: %w", hook.Command[0], err)
+		}
+	}
+
+	if hook.Url != "" {
+		req, err := http.NewRequestWithContext(ctx, "POST", hook.Url, bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("post sync hook %s: %w", hook.Url, err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("post sync hook %s: %w", hook.Url, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("post sync hook %s: HTTP error %d", hook.Url, resp.StatusCode)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const journalStateFile = "journal.log"
+
+// Journal records the temporary files that downloads are written to, so that any left behind by
+// a run that was killed can be removed by the next one. Each line of the journal file is "+" or
+// "-" followed by the quoted path of a temporary file that was created or removed. The file is
+// removed when a run finishes normally.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenJournal removes the temporary files recorded in the journal of an earlier run that did not
+// finish, and then starts a new journal.
+func OpenJournal() (*Journal, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, journalStateFile)
+
+	removed, err := recoverJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	if removed > 0 {
+		logInfof("Removed %d incomplete downloads left by an earlier run", removed)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{path: path, f: f}, nil
+}
+
+func recoverJournal(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	inFlight := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue
+		}
+		// The last line may be cut off if the run was killed while writing it.
+		tempPath, err := strconv.Unquote(line[1:])
+		if err != nil {
+			continue
+		}
+		switch line[0] {
+		case '+':
+			inFlight[tempPath] = true
+		case '-':
+			delete(inFlight, tempPath)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("cannot read %s: %w", journalStateFile, err)
+	}
+
+	removed := 0
+	for tempPath := range inFlight {
+		// Be sure not to remove anything but a temporary download.
+		if !strings.HasPrefix(filepath.Base(tempPath), tempFilePrefix) {
+			continue
+		}
+		err := os.Remove(tempPath)
+		if err == nil {
+			removed++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+func (j *Journal) write(op byte, tempPath string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err := fmt.Fprintf(j.f, "%c%s\n", op, strconv.Quote(tempPath))
+	return err
+}
+
+// Begin records that a temporary file has been created.
+func (j *Journal) Begin(tempPath string) error {
+	return j.write('+', tempPath)
+}
+
+// End records that a temporary file has been removed, or renamed to replace the file it was
+// downloaded for.
+func (j *Journal) End(tempPath string) error {
+	return j.write('-', tempPath)
+}
+
+// Close removes the journal, once every temporary file it records has been dealt with.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.path)
+}
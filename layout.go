@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Values of the layout setting, which decides the directories that courses are synced into.
+const (
+	// Every course directory is directly inside the sync directory.
+	layoutFlat = "flat"
+	// Course directories are inside a directory for their enrollment term, such as "2024 Fall".
+	layoutTerm = "term"
+	// Course directories are inside a directory for the year that their term started.
+	layoutYear = "year"
+)
+
+type Term struct {
+	Id      uint64     `json:"id"`
+	Name    string     `json:"name"`
+	StartAt *time.Time `json:"start_at"`
+}
+
+// courseParent returns the directory, relative to the sync directory, that a course directory is
+// nested in under layout, or "" if it is directly inside the sync directory.
+func courseParent(course Course, layout string) string {
+	switch layout {
+	case layoutTerm:
+		if course.Term != nil {
+			return course.Term.Name
+		}
+	case layoutYear:
+		switch {
+		case course.Term != nil && course.Term.StartAt != nil:
+			return strconv.Itoa(course.Term.StartAt.Year())
+		case course.StartAt != nil:
+			return strconv.Itoa(course.StartAt.Year())
+		}
+	}
+	return ""
+}
+
+// localDirectory returns the path, relative to the directory that it is synced into, of the
+// directory that a course is synced to.
+func (course Course) localDirectory() string {
+	name := course.Name
+	if course.DirName != "" {
+		name = course.DirName
+	}
+
+	if course.Parent == "" {
+		return localName(name)
+	}
+	return filepath.Join(localName(course.Parent), localName(name))
+}
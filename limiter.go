@@ -0,0 +1,219 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestLimiter bounds the number of simultaneous API requests. When requests have to wait for a
+// free slot, the course that has made the fewest requests so far goes first: small courses finish
+// quickly and so results start to appear sooner, rather than every course progressing slowly at
+// the same time.
+//
+// The number of slots adapts to how the server is coping, like TCP congestion control: it is halved
+// when the server rate limits requests, when its rate limit is close to running out, or when
+// responses take much longer than usual, and otherwise grows by one for every full set of
+// requests that goes well, up to a maximum.
+type RequestLimiter struct {
+	mu      sync.Mutex
+	inUse   int
+	waiting waiterQueue
+	issued  map[uint64]uint64
+	seq     uint64
+
+	// The number of slots, between min and max. It is fractional so that it can grow gradually.
+	limit float64
+	min   int
+	max   int
+	// Name of what is limited, for logging changes to the limit.
+	name string
+
+	// The most of its rate limit that the server has said is remaining.
+	maxRemaining float64
+	// Smoothed time taken for the server to respond, and the least it has been.
+	latency     time.Duration
+	baseLatency time.Duration
+	// When the limit was last cut, so that the responses to requests made before then do not cut
+	// it again.
+	lastCut time.Time
+}
+
+// NewRequestLimiter returns a limiter that allows n simultaneous requests.
+func NewRequestLimiter(n int) *RequestLimiter {
+	return NewAdaptiveLimiter("API requests", n, n)
+}
+
+// NewAdaptiveLimiter returns a limiter that starts by allowing n simultaneous requests and adapts
+// between one and max.
+func NewAdaptiveLimiter(name string, n, max int) *RequestLimiter {
+	return &RequestLimiter{
+		issued: make(map[uint64]uint64),
+		limit:  float64(n),
+		min:    1,
+		max:    max,
+		name:   name,
+	}
+}
+
+// Limit returns the number of requests that may currently be made at once.
+func (l *RequestLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
+
+type waiter struct {
+	priority uint64
+	seq      uint64
+	index    int
+	granted  bool
+	ready    chan struct{}
+}
+
+// Acquire blocks until a request for the course may be made. Each successful call to Acquire must
+// be followed by a call to Release.
+func (l *RequestLimiter) Acquire(ctx context.Context, courseId uint64) error {
+	l.mu.Lock()
+	priority := l.issued[courseId]
+	l.issued[courseId]++
+
+	if l.inUse < int(l.limit) && len(l.waiting) == 0 {
+		l.inUse++
+		l.mu.Unlock()
+		return nil
+	}
+
+	w := &waiter{priority: priority, seq: l.seq, ready: make(chan struct{})}
+	l.seq++
+	heap.Push(&l.waiting, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		granted := w.granted
+		if !granted {
+			heap.Remove(&l.waiting, w.index)
+		}
+		l.mu.Unlock()
+
+		if granted {
+			// Lost the race: the slot was handed over just as the context was cancelled.
+			l.Release()
+		}
+		return ctx.Err()
+	}
+}
+
+func (l *RequestLimiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inUse--
+	l.grant()
+}
+
+// grant hands out free slots to the requests waiting for them.
+func (l *RequestLimiter) grant() {
+	for len(l.waiting) > 0 && l.inUse < int(l.limit) {
+		w := heap.Pop(&l.waiting).(*waiter)
+		w.granted = true
+		l.inUse++
+		close(w.ready)
+	}
+}
+
+// Observe adapts the limit to a response from the server, which took latency to arrive.
+func (l *RequestLimiter) Observe(res *http.Response, latency time.Duration) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	congested := isRateLimited(res)
+
+	// Canvas refills the rate limit of each user over time, so it only runs low when requests are
+	// being made faster than it refills.
+	if remaining, err := strconv.ParseFloat(res.Header.Get("X-Rate-Limit-Remaining"), 64); err == nil {
+		if remaining > l.maxRemaining {
+			l.maxRemaining = remaining
+		}
+		if remaining < l.maxRemaining/4 {
+			congested = true
+		}
+	}
+
+	if l.latency == 0 {
+		l.latency = latency
+	} else {
+		l.latency = (4*l.latency + latency) / 5
+	}
+	if l.baseLatency == 0 || l.latency < l.baseLatency {
+		l.baseLatency = l.latency
+	}
+	if l.latency > 4*l.baseLatency && l.latency > time.Second {
+		congested = true
+	}
+
+	old := int(l.limit)
+	switch {
+	case congested:
+		now := time.Now()
+		if now.Sub(l.lastCut) < l.latency+time.Second {
+			return
+		}
+		l.lastCut = now
+		l.limit = math.Max(float64(l.min), l.limit/2)
+	case l.inUse >= old:
+		// Only grow the limit when all of it is being used.
+		l.limit = math.Min(float64(l.max), l.limit+1/l.limit)
+		l.grant()
+	}
+
+	if int(l.limit) != old {
+		logDebugf("Making up to %d %s at once", int(l.limit), l.name)
+	}
+}
+
+// waiterQueue implements heap.Interface, ordered by priority and then by arrival.
+type waiterQueue []*waiter
+
+func (q waiterQueue) Len() int { return len(q) }
+
+func (q waiterQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q waiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waiterQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waiterQueue) Pop() any {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return w
+}
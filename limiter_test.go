@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiterObserve(t *testing.T) {
+	response := func(status int, remaining string) *http.Response {
+		res := &http.Response{StatusCode: status, Header: make(http.Header)}
+		if remaining != "" {
+			res.Header.Set("X-Rate-Limit-Remaining", remaining)
+		}
+		return res
+	}
+	const latency = 100 * time.Millisecond
+
+	l := NewAdaptiveLimiter("test requests", 8, 16)
+	for i := 0; i < 8; i++ {
+		if err := l.Acquire(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(step string, want int) {
+		t.Helper()
+		if got := l.Limit(); got != want {
+			t.Errorf("%s: limit is %d, want %d", step, got, want)
+		}
+	}
+
+	l.Observe(response(http.StatusTooManyRequests, ""), latency)
+	expect("after 429", 4)
+
+	// Responses to requests made before the cut do not cut the limit again.
+	l.Observe(response(http.StatusTooManyRequests, ""), latency)
+	expect("after another 429 straight away", 4)
+
+	l.lastCut = time.Time{}
+	l.Observe(response(http.StatusForbidden, "0"), latency)
+	expect("after a throttled 403", 2)
+
+	// A 403 with rate limit left is about permissions, not load. With every slot in use, the limit
+	// grows by about one for each full set of requests that goes well: from 2 to 2.5, 2.9 and 3.2.
+	l.lastCut = time.Time{}
+	l.Observe(response(http.StatusForbidden, "700"), latency)
+	expect("after a 403 with rate limit left", 2)
+	l.Observe(response(http.StatusOK, "700"), latency)
+	expect("after 2 responses", 2)
+	l.Observe(response(http.StatusOK, "700"), latency)
+	expect("after 3 responses", 3)
+
+	// It does not grow while slots are free.
+	for i := 0; i < 8; i++ {
+		l.Release()
+	}
+	for i := 0; i < 10; i++ {
+		l.Observe(response(http.StatusOK, "700"), latency)
+	}
+	expect("with free slots", 3)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Directory inside a course directory where files that are linked to, but not in any folder that
+// can be listed, are downloaded to.
+const linkedFilesDirectory = "Linked Files"
+
+type Page struct {
+	Url   string `json:"url"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type Assignment struct {
+	Id          uint64            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Rubric      []RubricCriterion `json:"rubric"`
+	// How the assignment can be handed in, such as "online_upload".
+	SubmissionTypes []string   `json:"submission_types"`
+	DueAt           *time.Time `json:"due_at"`
+}
+
+// fileLinkRegexp matches links to files in courses, such as
+// https://canvas.example.edu/courses/123/files/456/download?wrap=1, and their API equivalents.
+var fileLinkRegexp = regexp.MustCompile(`/courses/(\d+)/files/(\d+)`)
+
+// FileLink is a reference to a file in a course.
+type FileLink struct {
+	CourseId uint64
+	FileId   uint64
+}
+
+// extractFileLinks finds the links to course files in the attributes of the elements in a piece
+// of HTML, which covers links, images and embedded documents.
+func extractFileLinks(s string, links map[FileLink]bool) {
+	tokenizer := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			for _, a := range tokenizer.Token().Attr {
+				for _, m := range fileLinkRegexp.FindAllStringSubmatch(a.Val, -1) {
+					courseId, err1 := strconv.ParseUint(m[1], 10, 64)
+					fileId, err2 := strconv.ParseUint(m[2], 10, 64)
+					if err1 == nil && err2 == nil {
+						links[FileLink{CourseId: courseId, FileId: fileId}] = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// linkedFilesToSync looks through the pages, assignments and announcements in a course for links
+// to files that are not in the course tree, which happens when they are in a hidden folder, and
+// sends them to the fileToSyncC channel to be downloaded into the directory linkedPath.
+// This does NOT close the fileToSyncC channel after exiting.
+func linkedFilesToSync(ctx context.Context, api *CanvasApi, fileToSyncC chan<- FileToSync, tree *CourseTree, linkedPath string) error {
+	ctx = withCourse(ctx, tree.Course.Id)
+
+	links := make(map[FileLink]bool)
+
+	pages, err := listAll(ctx, api.MakePagesInCourseUrl(tree.Course.Id), api.PagesInCourse)
+	if err != nil && !errors.Is(err, errForbidden) {
+		return err
+	}
+	for _, page := range pages {
+		extractFileLinks(page.Body, links)
+	}
+
+	assignments, err := listAll(ctx, api.MakeAssignmentsInCourseUrl(tree.Course.Id), api.AssignmentsInCourse)
+	if err != nil && !errors.Is(err, errForbidden) {
+		return err
+	}
+	for _, assignment := range assignments {
+		extractFileLinks(assignment.Description, links)
+	}
+
+	announcements, err := listAll(ctx, api.MakeAnnouncementsInCourseUrl(tree.Course.Id), api.DiscussionTopicsInCourse)
+	if err != nil && !errors.Is(err, errForbidden) {
+		return err
+	}
+	for _, announcement := range announcements {
+		extractFileLinks(announcement.Message, links)
+	}
+
+	inTree := make(map[uint64]bool)
+	tree.Traverse(func(folder *TreeFolder, level int) error {
+		for _, file := range folder.files {
+			inTree[file.Id] = true
+		}
+		return nil
+	})
+
+	// Sort so that, when two linked files have the same name, the same one gets to keep it on
+	// every run.
+	sorted := make([]FileLink, 0, len(links))
+	for link := range links {
+		if link.CourseId == tree.Course.Id && inTree[link.FileId] {
+			continue
+		}
+		sorted = append(sorted, link)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].FileId < sorted[j].FileId })
+
+	folder := &TreeFolder{}
+	names := make(map[string]bool)
+	for _, link := range sorted {
+		file, err := api.CourseFile(ctx, link.CourseId, link.FileId)
+		// Links to files that have since been deleted, or that the user cannot see, are common.
+		var httpErr *HTTPError
+		if errors.Is(err, errForbidden) || (errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if names[file.FileName] {
+			ext := filepath.Ext(file.FileName)
+			file.FileName = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(file.FileName, ext), file.Id, ext)
+		}
+		names[file.FileName] = true
+
+		folder.files = append(folder.files, &TreeFile{File: file})
+	}
+
+	return folderFilesToSync(ctx, fileToSyncC, tree.Course.Id, folder, linkedPath)
+}
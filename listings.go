@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const listingsStateFile = "listings.json"
+
+// Listings not fetched again within this long of the latest are dropped from the cache, as the
+// course or folder they list has probably gone.
+const listingsMaxAge = 30 * 24 * time.Hour
+
+var errOffline = errors.New("not available offline")
+
+// CachedListing is a page of an API response kept in the listings cache.
+type CachedListing struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Body      json.RawMessage `json:"body"`
+	Next      string          `json:"next,omitempty"`
+}
+
+// ListingCache keeps the responses to API calls, such as the lists of courses, folders and files,
+// between runs, so that commands can work from them without a network connection, and so that
+// syncs shortly after one another can skip listing. Its methods do nothing on a nil ListingCache.
+type ListingCache struct {
+	// Use the cached responses however old they are, and never make API calls.
+	Offline bool
+	// If not zero, use cached responses fetched within this long rather than making API calls.
+	TTL time.Duration
+
+	mu       sync.Mutex
+	listings map[string]CachedListing
+	changed  bool
+}
+
+type listingCacheContextKey struct{}
+type noListingCacheContextKey struct{}
+
+// withListingCache makes API calls with the context use the listings cache. Only the lists of
+// courses, folders and files that commands need offline are cached, not responses such as grades
+// and submissions, which go out of date quickly and should not be kept around. The fields named in
+// omit are left out of the cached responses.
+func withListingCache(ctx context.Context, omit ...string) context.Context {
+	return context.WithValue(ctx, listingCacheContextKey{}, omit)
+}
+
+// withoutListingCache makes API calls with the context go to Canvas rather than the listings
+// cache, and leaves their responses out of it, even for the lists that are usually cached.
+func withoutListingCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noListingCacheContextKey{}, true)
+}
+
+// listingCacheFor returns the listings cache to use for an API call with the context, or nil if
+// its response is not to be cached, and the fields to leave out of the cached response.
+func (canvas *CanvasApi) listingCacheFor(ctx context.Context) (*ListingCache, []string) {
+	if skip, _ := ctx.Value(noListingCacheContextKey{}).(bool); skip {
+		return nil, nil
+	}
+	omit, ok := ctx.Value(listingCacheContextKey{}).([]string)
+	if !ok {
+		return nil, nil
+	}
+	return canvas.Listings, omit
+}
+
+// omitFields removes the fields named in omit from a JSON object, or from each object in a JSON
+// array. It returns nil if body is neither.
+func omitFields(body []byte, omit []string) []byte {
+	if len(omit) == 0 {
+		return body
+	}
+
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &objects); err != nil {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(body, &object); err != nil {
+			return nil
+		}
+		for _, field := range omit {
+			delete(object, field)
+		}
+		body, _ = json.Marshal(object)
+		return body
+	}
+	for _, object := range objects {
+		for _, field := range omit {
+			delete(object, field)
+		}
+	}
+	body, _ = json.Marshal(objects)
+	return body
+}
+
+// LoadListingCache reads the listings cache, to be used as opts say.
+func LoadListingCache(opts *Options) (*ListingCache, error) {
+	cache := &ListingCache{
+		Offline:  opts.Offline,
+		TTL:      opts.CacheTTL,
+		listings: make(map[string]CachedListing),
+	}
+	if err := loadState(listingsStateFile, &cache.listings); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// Get returns the cached response to apiCall, if it can be used instead of calling the API. In
+// offline mode, it returns errOffline if there is none.
+func (c *ListingCache) Get(apiCall string) (CachedListing, bool, error) {
+	if c == nil {
+		return CachedListing{}, false, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	listing, ok := c.listings[apiCall]
+	switch {
+	case c.Offline && !ok:
+		return CachedListing{}, false, fmt.Errorf("%w: %s has not been fetched before", errOffline, redactUrl(apiCall))
+	case c.Offline:
+		return listing, true, nil
+	case ok && c.TTL > 0 && time.Since(listing.FetchedAt) < c.TTL:
+		return listing, true, nil
+	}
+	return CachedListing{}, false, nil
+}
+
+// Put caches the response to apiCall.
+func (c *ListingCache) Put(apiCall string, body []byte, next string) {
+	if c == nil || !json.Valid(body) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.listings[apiCall] = CachedListing{FetchedAt: time.Now(), Body: body, Next: next}
+	c.changed = true
+}
+
+// Save writes the cache, if anything has been added to it, dropping listings that have not been
+// fetched for a long time.
+func (c *ListingCache) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.changed {
+		return nil
+	}
+
+	var latest time.Time
+	for _, listing := range c.listings {
+		if listing.FetchedAt.After(latest) {
+			latest = listing.FetchedAt
+		}
+	}
+	for apiCall, listing := range c.listings {
+		if latest.Sub(listing.FetchedAt) > listingsMaxAge {
+			delete(c.listings, apiCall)
+		}
+	}
+
+	if err := saveState(listingsStateFile, c.listings); err != nil {
+		return err
+	}
+	c.changed = false
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lockStateFile = "sync.lock"
+
+var errLocked = errors.New("another canvas-sync is already syncing")
+
+// SyncLock is an advisory lock held for the whole of a sync, so that two runs, such as overlapping
+// cron jobs, do not race on the same temporary and state files. The operating system releases it
+// if canvas-sync dies, so it can never be left behind.
+type SyncLock struct {
+	f *os.File
+}
+
+// AcquireSyncLock takes the lock on the state directory. If another process holds it, it returns
+// an error saying which, or with wait, waits for the other process to finish.
+func AcquireSyncLock(ctx context.Context, wait bool) (*SyncLock, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, lockStateFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	for waiting := false; ; waiting = true {
+		err := lockFile(f)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLocked) {
+			f.Close()
+			return nil, fmt.Errorf("cannot lock %s: %w", f.Name(), err)
+		}
+		if !wait {
+			holder := lockHolder(f)
+			f.Close()
+			return nil, fmt.Errorf("%w%s: wait for it to finish, or run with --wait", errLocked, holder)
+		}
+		if !waiting {
+			logInfof("Waiting for the canvas-sync%s that is already syncing to finish...", lockHolder(f))
+		}
+		if err := sleepContext(ctx, time.Second); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	// Record the process holding the lock, for the error message of any other run.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &SyncLock{f: f}, nil
+}
+
+// lockHolder describes the process that holds the lock on f, if it is known.
+func lockHolder(f *os.File) string {
+	content, err := io.ReadAll(io.NewSectionReader(f, 0, 32))
+	if err != nil {
+		return ""
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf(" (process %d)", pid)
+}
+
+// Release releases the lock. It is safe to call on a nil SyncLock.
+func (l *SyncLock) Release() error {
+	if l == nil {
+		return nil
+	}
+
+	unlockFile(l.f)
+	return l.f.Close()
+}
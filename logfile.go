@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Size the log file grows to before it is rotated, if log_file_max_size is not set.
+	defaultLogFileMaxSize = 10 * 1000 * 1000
+	// Number of rotated log files kept, as log_file.1 to log_file.3, the most recent first.
+	logFileBackups = 3
+)
+
+// LogFile is a log file that is rotated once it grows past a size. Its methods do nothing on a nil
+// LogFile.
+type LogFile struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// logFile, if not nil, is where everything is logged, whatever the log level.
+var logFile *LogFile
+
+// OpenLogFile opens the log file at path to append to, creating it and its directory if they do
+// not exist.
+func OpenLogFile(path string, maxSize int64) (*LogFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultLogFileMaxSize
+	}
+	l := &LogFile{path: path, maxSize: maxSize}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate moves the log file to path.1, and each older one to the next number, keeping
+// logFileBackups of them, and starts a new log file.
+func (l *LogFile) rotate() error {
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		return err
+	}
+	for i := logFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Printf writes a line to the log file, with the time and the process ID, which tells apart the
+// runs that log to the same file.
+func (l *LogFile) Printf(format string, args ...any) {
+	if l == nil {
+		return
+	}
+	line := fmt.Sprintf("%s [%d] %s\n", time.Now().Format("2006/01/02 15:04:05.000"), os.Getpid(), fmt.Sprintf(format, args...))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// Another canvas-sync may have the file open, which stops it being renamed on
+			// Windows. Keep writing to it, and try again once it has grown as much again.
+			if l.f == nil && l.open() != nil {
+				return
+			}
+			l.size = 0
+		}
+	}
+	n, _ := l.f.WriteString(line)
+	l.size += int64(n)
+}
+
+// Close closes the log file.
+func (l *LogFile) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// setUpLogFile starts logging to the file at path, from --log-file, or else to the file in the
+// log_file setting of config, if either is given. Config is nil if it could not be loaded.
+func setUpLogFile(path string, config *Config) error {
+	var maxSize int64
+	if config != nil {
+		if path == "" {
+			path = config.LogFile
+		}
+		maxSize = config.logFileMaxSize
+	}
+	if path == "" {
+		return nil
+	}
+
+	l, err := OpenLogFile(path, maxSize)
+	if err != nil {
+		return fmt.Errorf("cannot open the log file: %w", err)
+	}
+	logFile = l
+	return nil
+}
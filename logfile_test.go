@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "canvas-sync.log")
+	// Two lines fit in each file.
+	lineSize := len(fmt.Sprintf("2006/01/02 15:04:05.000 [%d] line 01\n", os.Getpid()))
+	l, err := OpenLogFile(path, int64(2*lineSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		l.Printf("line %02d", i)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := func(name string) []string {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var numbers []string
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			numbers = append(numbers, line[strings.LastIndex(line, " ")+1:])
+		}
+		return numbers
+	}
+
+	// The most recent lines are in the log file, and the older ones in the rotated files, the most
+	// recent first. The oldest have been dropped.
+	want := map[string]string{
+		path:        "09 10",
+		path + ".1": "07 08",
+		path + ".2": "05 06",
+		path + ".3": "03 04",
+	}
+	for name, want := range want {
+		if got := strings.Join(lines(name), " "); got != want {
+			t.Errorf("%s has lines %s, want %s", filepath.Base(name), got, want)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", path, logFileBackups+1)); !os.IsNotExist(err) {
+		t.Errorf("more than %d rotated log files were kept", logFileBackups)
+	}
+
+	// Opening the log file again appends to it, and rotates it once it is full.
+	l, err = OpenLogFile(path, int64(2*lineSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Printf("line 11")
+	l.Close()
+	if got := strings.Join(lines(path), " "); got != "11" {
+		t.Errorf("after opening it again, the log file has lines %s, want 11", got)
+	}
+	if got := strings.Join(lines(path+".1"), " "); got != "09 10" {
+		t.Errorf("after opening it again, %s.1 has lines %s, want 09 10", filepath.Base(path), got)
+	}
+}
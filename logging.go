@@ -0,0 +1,41 @@
+package main
+
+import "log"
+
+// LogLevel says how much canvas-sync writes to the log on standard error. The log file, if there
+// is one, gets everything.
+type LogLevel int
+
+const (
+	// Only errors.
+	LogQuiet LogLevel = iota
+	// Errors and warnings, and what a sync is doing.
+	LogNormal
+	// Also every request, and why files are retried or skipped.
+	LogVerbose
+)
+
+// logLevel is set from the command line flags before anything is logged.
+var logLevel = LogNormal
+
+// logErrorf logs an error, whatever the log level.
+func logErrorf(format string, args ...any) {
+	log.Printf(format, args...)
+	logFile.Printf(format, args...)
+}
+
+// logInfof logs a warning or something that the user would usually want to know about.
+func logInfof(format string, args ...any) {
+	if logLevel >= LogNormal {
+		log.Printf(format, args...)
+	}
+	logFile.Printf(format, args...)
+}
+
+// logDebugf logs details that are only useful for working out what canvas-sync is doing.
+func logDebugf(format string, args ...any) {
+	if logLevel >= LogVerbose {
+		log.Printf(format, args...)
+	}
+	logFile.Printf(format, args...)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemoteFile is a file on Canvas as the ls and lsl subcommands write it with --json.
+type RemoteFile struct {
+	// The path of the file, relative to the directory listed.
+	Path        string    `json:"path"`
+	Id          uint64    `json:"id"`
+	CourseId    uint64    `json:"course_id"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	ContentType string    `json:"content_type,omitempty"`
+}
+
+// resolveRemotePath makes the argument of ls, a course directory, or a path within one, as the
+// course would be synced, into a path in a CanvasView. The course can also be given by its ID.
+func resolveRemotePath(ctx context.Context, view *CanvasView, arg string) (string, error) {
+	arg = strings.Trim(path.Clean("/"+strings.ReplaceAll(arg, `\`, "/")), "/")
+	first, rest, _ := strings.Cut(arg, "/")
+	id, err := strconv.ParseUint(first, 10, 64)
+	if err != nil {
+		return arg, nil
+	}
+
+	courses, err := view.Courses(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, course := range courses {
+		if course.Id == id {
+			return path.Join(strings.ReplaceAll(course.localDirectory(), `\`, "/"), rest), nil
+		}
+	}
+	return arg, nil
+}
+
+// walk calls visit with every file under the directory at dirPath in the view, and its path
+// relative to it, going at most maxDepth directories deep if maxDepth is positive.
+func (v *CanvasView) walk(ctx context.Context, dirPath string, dir *viewNode, rel string, depth, maxDepth int, visit func(rel string, file *viewNode)) error {
+	children, err := v.children(ctx, dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+
+	for _, child := range children {
+		node := child.(viewFileInfo).node
+		childRel := path.Join(rel, node.name)
+		if !node.IsDir() {
+			visit(childRel, node)
+			continue
+		}
+		if maxDepth > 0 && depth+1 >= maxDepth {
+			continue
+		}
+
+		childPath := path.Join(dirPath, node.name)
+		// The directories that hold course directories only know their names.
+		if node.course == nil {
+			if node, err = v.lookup(ctx, childPath); err != nil {
+				return err
+			}
+		}
+		if err := v.walk(ctx, childPath, node, childRel, depth+1, maxDepth, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runLs implements the ls and lsl subcommands, which list the files on Canvas under a course
+// directory, or a path within one, as it would be synced, without syncing them. With long set, as
+// for lsl, the size and time of each file are listed too.
+func runLs(ctx context.Context, args []string, opts *Options, long bool) error {
+	name := "ls"
+	if long {
+		name = "lsl"
+	}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	maxDepth := flags.Int("max-depth", 0, "only list files this many directories deep, 1 for those directly in the directory")
+	jsonOut := flags.Bool("json", opts.JSON, "write each file as a JSON object on a line of its own")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: canvas-sync %s [--max-depth <n>] [--json] [<course>[/<path>]]", name)
+	}
+	if opts.Offline {
+		return fmt.Errorf("--offline only works with diff, digest, quota and archive, as %s needs Canvas", name)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+	view := NewCanvasView(api, config, nil, "", 0)
+
+	dirPath, err := resolveRemotePath(ctx, view, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	node, err := view.lookup(ctx, dirPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("there is nothing at %s on Canvas", flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	visit := func(rel string, file *viewNode) {
+		switch {
+		case *jsonOut:
+			enc.Encode(RemoteFile{
+				Path:        rel,
+				Id:          file.file.Id,
+				CourseId:    file.course.Id,
+				Size:        file.file.Size,
+				ModTime:     file.modTime,
+				ContentType: file.file.ContentType,
+			})
+		case long:
+			fmt.Printf("%12d %s %s\n", file.file.Size, file.modTime.Local().Format("2006-01-02 15:04:05"), rel)
+		default:
+			fmt.Println(rel)
+		}
+	}
+
+	if !node.IsDir() {
+		visit(node.name, node)
+		return nil
+	}
+	if err := view.walk(ctx, dirPath, node, "", 0, *maxDepth, visit); err != nil {
+		return err
+	}
+	return api.Listings.Save()
+}
@@ -2,28 +2,25 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/schollz/progressbar/v3"
 	"golang.org/x/sync/errgroup"
 )
 
 func listCourses(ctx context.Context, api *CanvasApi, coursesC chan<- []Course) error {
-	errgrp, ctx := errgroup.WithContext(ctx)
-
-	var worker func(url string) error
-	worker = func(url string) error {
-		courses, next, err := api.Courses(ctx, url)
+	// GraphQL lists every course at once, and AllCourses falls back to the REST API.
+	if api.useGraphQL() {
+		courses, err := api.AllCourses(ctx)
 		if err != nil {
 			return err
 		}
@@ -34,34 +31,15 @@ func listCourses(ctx context.Context, api *CanvasApi, coursesC chan<- []Course)
 		case coursesC <- courses:
 		}
 
-		if next != "" {
-			// Spawn another worker for next page
-			errgrp.Go(func() error { return worker(next) })
-		}
-
+		close(coursesC)
 		return nil
 	}
 
-	// Spawn worker for first page
-	errgrp.Go(func() error { return worker(api.MakeCoursesUrl()) })
-
-	if err := errgrp.Wait(); err != nil {
-		return err
-	}
-
-	close(coursesC)
-	return nil
-}
-
-func listFoldersInCourse(ctx context.Context, api *CanvasApi, foldersC chan<- []Folder, courseId uint64) error {
 	errgrp, ctx := errgroup.WithContext(ctx)
 
 	var worker func(url string) error
 	worker = func(url string) error {
-		folders, next, err := api.FoldersInCourse(ctx, url)
-		if err == errForbidden {
-			return nil
-		}
+		courses, next, err := api.Courses(ctx, url)
 		if err != nil {
 			return err
 		}
@@ -69,7 +47,7 @@ func listFoldersInCourse(ctx context.Context, api *CanvasApi, foldersC chan<- []
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case foldersC <- folders:
+		case coursesC <- courses:
 		}
 
 		if next != "" {
@@ -80,149 +58,248 @@ func listFoldersInCourse(ctx context.Context, api *CanvasApi, foldersC chan<- []
 		return nil
 	}
 
-	// Spawn worker for first page
-	errgrp.Go(func() error { return worker(api.MakeFoldersInCourseUrl(courseId)) })
+	// Spawn worker for first page, of each term when listing the courses of an account. The pages
+	// of each are listed one after another, each only once the courses on the page before have been
+	// taken to sync, so that listing thousands of courses does not get far ahead of syncing them.
+	for _, url := range api.coursesUrls() {
+		url := url
+		errgrp.Go(func() error { return worker(url) })
+	}
 
 	if err := errgrp.Wait(); err != nil {
 		return err
 	}
 
-	close(foldersC)
+	close(coursesC)
 	return nil
 }
 
-func listFilesInFolders(ctx context.Context, api *CanvasApi, folderC <-chan uint64, filesC chan<- []File) error {
-	errgrp, ctx := errgroup.WithContext(ctx)
+// listAll calls an API method for the first page at url and then for every following page,
+// returning all the results.
+func listAll[T any](ctx context.Context, url string, method func(context.Context, string) ([]T, string, error)) ([]T, error) {
+	var all []T
 
-	var worker func(url string) error
-	worker = func(url string) error {
-		files, next, err := api.FilesInFolder(ctx, url)
-		if err == errForbidden {
-			return nil
-		}
+	for url != "" {
+		results, next, err := method(ctx, url)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case filesC <- files:
-		}
-
-		if next != "" {
-			errgrp.Go(func() error { return worker(next) })
-		}
-		return nil
+		all = append(all, results...)
+		url = next
 	}
 
-Loop:
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case folderId, more := <-folderC:
-			if !more {
-				break Loop
-			}
-			errgrp.Go(func() error { return worker(api.MakeFilesInFolderUrl(folderId)) })
-		}
-	}
+	return all, nil
+}
 
-	if err := errgrp.Wait(); err != nil {
-		return err
-	}
+// FolderListedFunc is called by BuildTree with each folder whose files have been listed, together
+// with its parents starting with the root folder.
+type FolderListedFunc func(tree *CourseTree, folder *TreeFolder, parents []*TreeFolder) error
 
-	close(filesC)
-	return nil
+// BuildTree lists the folders and files in a course, leaving out the folders in skip. As soon as
+// all the files in a folder have been listed, folderListed is called with the folder and its
+// parents, so that the files can be synced while the rest of the course is still being listed.
+func BuildTree(ctx context.Context, api *CanvasApi, course Course, skip FolderSkip, folderListed FolderListedFunc) (*CourseTree, error) {
+	return buildTree(ctx, api, course, api.MakeFoldersInCourseUrl(course.Id), skip, folderListed)
 }
 
-func BuildTree(ctx context.Context, api *CanvasApi, course Course) (*CourseTree, error) {
-	errgrp, ctx := errgroup.WithContext(ctx)
-
-	n := 10
-	foldersC := make(chan []Folder, n)
-	filesC := make(chan []File, n)
-	folderC := make(chan uint64, n)
+// BuildGroupTree is like BuildTree but for the files shared in a group. The tree is named after
+// the group and belongs to the group's course.
+func BuildGroupTree(ctx context.Context, api *CanvasApi, group Group, skip FolderSkip, folderListed FolderListedFunc) (*CourseTree, error) {
+	course := Course{Id: group.CourseId, Name: group.Name}
+	return buildTree(ctx, api, course, api.MakeFoldersInGroupUrl(group.Id), skip, folderListed)
+}
 
-	// As Canvas does not necessarily return the folders and files in order, collect them in a flat
-	// slice first; and then create the tree structure.
-	var flatFolders []Folder
-	var flatFiles []File
+// BuildPersonalTree is like BuildTree but for the user's own files. The tree is named after the
+// Personal directory that the files are synced to and does not belong to any course.
+func BuildPersonalTree(ctx context.Context, api *CanvasApi, skip FolderSkip, folderListed FolderListedFunc) (*CourseTree, error) {
+	course := Course{Name: personalDirectory}
+	return buildTree(ctx, api, course, api.MakeFoldersOfUserUrl(), skip, folderListed)
+}
 
-	// Goroutine to construct the tree
-	errgrp.Go(func() error {
-	Loop:
-		for {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
+func buildTree(ctx context.Context, api *CanvasApi, course Course, foldersUrl string, skip FolderSkip, folderListed FolderListedFunc) (*CourseTree, error) {
+	ctx = withCourse(ctx, course.Id)
 
-			case folders, more := <-foldersC:
-				if !more {
-					close(folderC)
-					foldersC = nil
-				}
+	// As Canvas does not necessarily return the folders in order, collect them in a flat slice
+	// first; and then create the tree structure. There are far fewer folders than files, so this
+	// does not hold up the file listings for long.
+	flatFolders, err := listAll(ctx, foldersUrl, api.FoldersInCourse)
+	if errors.Is(err, errForbidden) {
+		return &CourseTree{Course: course, FoldersForbidden: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-				for _, folder := range folders {
-					flatFolders = append(flatFolders, folder)
+	tree, err := NewCourseTree(course, skipFolders(flatFolders, skip), nil)
+	if err != nil {
+		return nil, err
+	}
 
-					if folder.FilesCount > 0 {
-						// Get information about the files in the folder
-						select {
-						case <-ctx.Done():
-							return ctx.Err()
-						case folderC <- folder.Id:
-						}
-					}
-				}
+	errgrp, ctx := errgroup.WithContext(ctx)
+	var mu sync.Mutex
 
-			case files, more := <-filesC:
-				if !more {
-					break Loop
-				}
+	// Only list the files in folders that are reachable from the root folder of the course.
+	tree.TraverseWithParents(func(folder *TreeFolder, parents []*TreeFolder) error {
+		if folder.FilesCount == 0 {
+			return nil
+		}
 
-				flatFiles = append(flatFiles, files...)
+		parents = append([]*TreeFolder(nil), parents...)
+		errgrp.Go(func() error {
+			files, err := listAll(ctx, api.MakeFilesInFolderUrl(folder.Id), api.FilesInFolder)
+			if errors.Is(err, errForbidden) {
+				mu.Lock()
+				tree.ForbiddenFolders = append(tree.ForbiddenFolders, folder.Id)
+				mu.Unlock()
+				return nil
+			}
+			if err != nil {
+				return err
 			}
-		}
 
-		return nil
-	})
+			for _, file := range files {
+				folder.files = append(folder.files, &TreeFile{File: file})
+			}
+			uniqueFileNames(folder.files)
 
-	errgrp.Go(func() error {
-		return listFoldersInCourse(ctx, api, foldersC, course.Id)
-	})
+			return folderListed(tree, folder, parents)
+		})
 
-	errgrp.Go(func() error {
-		return listFilesInFolders(ctx, api, folderC, filesC)
+		return nil
 	})
 
 	if err := errgrp.Wait(); err != nil {
 		return nil, err
 	}
 
-	// Now create the tree structure
-	tree, err := NewCourseTree(course, flatFolders, flatFiles)
-	if err != nil {
-		return nil, err
-	}
-
 	return tree, nil
 }
 
-type Config struct {
-	Url            string   `json:"url"`
-	Token          string   `json:"token"`
-	Directory      string   `json:"directory"`
-	IgnoredCourses []uint64 `json:"ignored_courses"`
+// Options are set by command line flags.
+type Options struct {
+	// Only sync courses with at least one of these tags.
+	Tags stringList
+	// If non-zero, keep running and sync this often.
+	Watch time.Duration
+	// Write events and the summary as JSON lines to stdout instead of showing progress.
+	JSON bool
+	// Do not download files onto a different file system to the sync directory.
+	OneFilesystem bool
+	// Whether to draw a progress bar: "auto", "always" or "never".
+	Progress string
+	// After syncing, link files with the same content so that it is only stored once.
+	Dedupe bool
+	// If non-zero, give up on API calls that take longer than this.
+	Timeout time.Duration
+	// If non-zero, stop listing and starting downloads this long after the sync started.
+	MaxDuration time.Duration
+	// List every course and find every file to download before starting any download, so that
+	// the progress bar starts with the total.
+	PlanFirst bool
+	// If another canvas-sync is syncing, wait for it to finish rather than failing.
+	Wait bool
+	// Sync even if another canvas-sync is syncing.
+	IgnoreLock bool
+	// In watch mode, serve Prometheus metrics on this address.
+	MetricsAddr string
+	// Download every file again, or those in these courses or under these paths, even if the
+	// local copies look up-to-date.
+	Force        bool
+	Refresh      courseIdList
+	RefreshPaths stringList
+	// Write the summary of the sync as JSON to stdout rather than as text.
+	StatsJSON bool
+	// Work only from the listings cached by earlier syncs, without calling the Canvas API.
+	Offline bool
+	// If non-zero, use listings cached within this long rather than calling the Canvas API.
+	CacheTTL time.Duration
 }
 
 type Statistics struct {
 	FilesSynced      atomic.Uint64
 	BytesTransferred atomic.Uint64
+	FilesFailed      atomic.Uint64
+	FilesOverBudget  atomic.Uint64
+	FilesRemaining   atomic.Uint64
+	// Files renamed or moved on Canvas whose local copies were moved rather than downloaded again.
+	FilesMoved atomic.Uint64
+
+	mu     sync.Mutex
+	files  []SyncedFile
+	failed []FailedFile
+}
+
+// Add counts a file that was downloaded, replacing an older copy if updated is set.
+func (stats *Statistics) Add(file FileToSync, updated bool) {
+	stats.FilesSynced.Add(1)
+	stats.BytesTransferred.Add(uint64(file.File.Size))
+
+	stats.mu.Lock()
+	stats.files = append(stats.files, SyncedFile{Id: file.File.Id, CourseId: file.CourseId, Path: file.Path, Size: file.File.Size, Updated: updated})
+	stats.mu.Unlock()
+}
+
+// Fail records a file that could not be downloaded.
+func (stats *Statistics) Fail(file FileToSync, err error) {
+	var parked *parkedError
+	if errors.As(err, &parked) {
+		err = parked.err
+	}
+
+	stats.mu.Lock()
+	stats.failed = append(stats.failed, FailedFile{Id: file.File.Id, Path: file.Path, Error: err.Error()})
+	stats.mu.Unlock()
 }
 
 func main() {
+	var opts Options
+	flag.Var(&opts.Tags, "tag", "only sync courses with this tag (may be repeated)")
+	flag.DurationVar(&opts.Watch, "watch", 0, "keep running and sync at this interval, e.g. 1h")
+	flag.BoolVar(&opts.JSON, "json", false, "write errors and the summary as JSON lines to stdout")
+	flag.BoolVar(&opts.StatsJSON, "stats-json", false, "write the summary of the sync as JSON to stdout rather than as text")
+	flag.StringVar(&opts.MetricsAddr, "metrics-addr", "", "with --watch or serve, serve Prometheus metrics at /metrics on this address, e.g. localhost:9464")
+	flag.StringVar(&opts.Progress, "progress", progressAuto, "draw a progress bar: auto (if standard error is a terminal), always or never")
+	var quiet, verbose bool
+	var logFilePath string
+	flag.BoolVar(&quiet, "q", false, "only write errors, for running from cron (shorthand for --quiet)")
+	flag.BoolVar(&quiet, "quiet", false, "only write errors, for running from cron")
+	flag.BoolVar(&verbose, "v", false, "log every request and why files are retried or skipped (shorthand for --verbose)")
+	flag.BoolVar(&verbose, "verbose", false, "log every request and why files are retried or skipped")
+	flag.BoolVar(&opts.Dedupe, "dedupe", false, "link files with the same content in different courses so that they are only stored once")
+	flag.DurationVar(&opts.Timeout, "timeout", 0, "give up on an API call that takes longer than this, e.g. 30s")
+	flag.DurationVar(&opts.MaxDuration, "max-duration", 0, "stop starting downloads after this long, e.g. 50m, and finish the ones in progress")
+	flag.BoolVar(&opts.PlanFirst, "plan-first", false, "find every file to download before starting any download, so that the progress bar shows the total and the time remaining from the start")
+	flag.BoolVar(&opts.Wait, "wait", false, "if another canvas-sync is already syncing, wait for it to finish")
+	flag.BoolVar(&opts.IgnoreLock, "ignore-lock", false, "sync even if another canvas-sync is already syncing")
+	flag.BoolVar(&opts.Force, "force", false, "download every file again, even if the local copy looks up-to-date")
+	flag.Var(&opts.Refresh, "refresh", "download the files in this course again (may be repeated)")
+	flag.Var(&opts.RefreshPaths, "refresh-path", "download the files under this path, relative to the sync directory, again (may be repeated)")
+	flag.BoolVar(&opts.Offline, "offline", false, "work without connecting to Canvas: diff, digest and quota use the listings cached by the last sync, and archive the synced files")
+	flag.DurationVar(&opts.CacheTTL, "cache-ttl", 0, "use course, folder and file listings cached within this long, e.g. 10m, rather than fetching them again")
+	flag.StringVar(&logFilePath, "log-file", "", "log everything, including every request, to this file as well, rotating it as it grows")
+	flag.StringVar(&asUser, "as-user", "", "as a Canvas administrator, make every API call on behalf of the user with this ID")
+	flag.BoolVar(&opts.OneFilesystem, "one-filesystem", false, "do not download files onto a different file system to the sync directory")
+	flag.Parse()
+
+	if quiet {
+		logLevel = LogQuiet
+	} else if verbose {
+		logLevel = LogVerbose
+	}
+
+	// Other commands load the config themselves, and report any problem with it.
+	config, configErr := loadConfig()
+	if err := setUpLogFile(logFilePath, config); err != nil {
+		logErrorf("%s", err)
+	}
+	defer logFile.Close()
+	command := flag.Arg(0)
+	if command == "" {
+		command = "sync"
+	}
+	logFile.Printf("canvas-sync %s started", command)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt)
@@ -236,7 +313,7 @@ func main() {
 		// First signal
 		select {
 		case <-signalChan:
-			log.Print("Exiting...")
+			logInfof("Exiting...")
 			cancel()
 		case <-ctx.Done():
 			return
@@ -245,54 +322,354 @@ func main() {
 		// Second signal
 		select {
 		case <-signalChan:
-			os.Exit(1)
+			os.Exit(exitFatal)
 		case <-ctx.Done():
 			return
 		}
 	}()
 
-	if err := sync(ctx); err != nil && !errors.Is(err, context.Canceled) {
-		log.Print(err)
+	var err error
+	// The pipeline of a single sync, whose summary decides the exit code.
+	var pipeline *Pipeline
+	switch flag.Arg(0) {
+	case "":
+		if opts.MetricsAddr != "" && opts.Watch == 0 {
+			err = fmt.Errorf("--metrics-addr only works with --watch")
+		} else if opts.Offline {
+			err = fmt.Errorf("--offline only works with diff, digest, quota and archive, as syncing needs Canvas")
+		} else if opts.Watch > 0 {
+			err = runDaemon(ctx, &opts)
+		} else if configErr != nil {
+			err = configErr
+		} else {
+			pipeline = NewPipeline()
+			err = runSync(ctx, config, &opts, pipeline)
+		}
+	case "digest":
+		err = runDigest(ctx, flag.Args()[1:], &opts)
+	case "diff":
+		err = runDiff(ctx, flag.Args()[1:], &opts)
+	case "get":
+		err = runGet(ctx, flag.Args()[1:], &opts)
+	case "ls":
+		err = runLs(ctx, flag.Args()[1:], &opts, false)
+	case "lsl":
+		err = runLs(ctx, flag.Args()[1:], &opts, true)
+	case "mount":
+		err = runMount(ctx, flag.Args()[1:], &opts)
+	case "open":
+		err = runOpen(flag.Args()[1:])
+	case "browse":
+		err = runBrowse(flag.Args()[1:])
+	case "search":
+		err = runSearch(ctx, flag.Args()[1:], &opts)
+	case "select":
+		err = runSelect(ctx, flag.Args()[1:], &opts)
+	case "state":
+		err = runState(ctx, flag.Args()[1:], &opts)
+	case "push":
+		err = runPush(ctx, flag.Args()[1:], &opts)
+	case "put":
+		err = runPut(ctx, flag.Args()[1:], &opts)
+	case "submit":
+		err = runSubmit(ctx, flag.Args()[1:], &opts)
+	case "quota":
+		err = runQuota(ctx, flag.Args()[1:], &opts)
+	case "grades":
+		err = runGrades(ctx, flag.Args()[1:])
+	case "finalize":
+		err = runFinalize(ctx, flag.Args()[1:], &opts)
+	case "doctor":
+		err = runDoctor(ctx, flag.Args()[1:])
+	case "serve":
+		err = runServe(ctx, flag.Args()[1:], &opts)
+	case "service":
+		err = runService(ctx, flag.Args()[1:])
+	case "exclude":
+		err = runExclude(ctx, flag.Args()[1:])
+	case "archive":
+		err = runArchive(ctx, flag.Args()[1:], &opts)
+	case "log":
+		err = runLog(flag.Args()[1:])
+	case "status":
+		err = runStatus(flag.Args()[1:])
+	case "stats":
+		err = runStats(flag.Args()[1:])
+	case "trash":
+		err = runTrash(flag.Args()[1:])
+	case "completion":
+		err = runCompletion(flag.Args()[1:])
+	case "__complete":
+		err = runCompleteCourses(flag.Args()[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		if opts.JSON {
+			NewJSONOutput(os.Stdout).Error(ErrorEvent{Fatal: true}, err)
+			logFile.Printf("%s", err)
+		} else {
+			logErrorf("%s", err)
+		}
+	}
+	code := exitCode(err, pipeline)
+	logFile.Printf("canvas-sync %s finished with exit code %d", command, code)
+	if code != exitSuccess {
+		logFile.Close()
+		os.Exit(code)
 	}
 }
 
-func sync(ctx context.Context) error {
-	configdir, err := os.UserConfigDir()
+// Exit codes, so that scripts and cron jobs can tell what a sync did.
+const (
+	// The command succeeded, and a sync found everything up to date.
+	exitSuccess = 0
+	// A sync downloaded or moved files.
+	exitSynced = 3
+	// A sync finished, but some files could not be downloaded.
+	exitFileErrors = 4
+	// The command failed or was interrupted.
+	exitFatal = 5
+)
+
+// exitCode returns the exit code for the error a command returned, and for the summary of the
+// sync it ran, if it ran one.
+func exitCode(err error, pipeline *Pipeline) int {
 	if err != nil {
-		return fmt.Errorf("cannot find config directory: %w", err)
+		return exitFatal
+	}
+	if pipeline == nil || pipeline.Summary == nil {
+		return exitSuccess
 	}
+	summary := pipeline.Summary
+	switch {
+	case summary.FilesFailed > 0:
+		return exitFileErrors
+	case summary.FilesSynced > 0 || summary.FilesMoved > 0:
+		return exitSynced
+	default:
+		return exitSuccess
+	}
+}
 
-	content, err := os.ReadFile(filepath.Join(configdir, "canvas-sync", "config.json"))
+func runSync(ctx context.Context, config *Config, opts *Options, pipeline *Pipeline) error {
+	startedAt := time.Now()
+
+	if !opts.IgnoreLock {
+		lock, err := AcquireSyncLock(ctx, opts.Wait)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	api, err := newCanvasApi(config)
 	if err != nil {
-		return fmt.Errorf("cannot open config file: %w", err)
+		return err
+	}
+	api.Timeout = opts.Timeout
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+	if err := checkTokenScopes(ctx, api); err != nil {
+		return err
+	}
+
+	var jsonOut *JSONOutput
+	progressOut := io.Writer(os.Stderr)
+	if opts.JSON {
+		jsonOut = NewJSONOutput(os.Stdout)
+		progressOut = io.Discard
+	}
+	if logLevel == LogQuiet {
+		progressOut = io.Discard
+	}
+	progressBar, err := useProgressBar(opts.Progress)
+	if err != nil {
+		return err
+	}
+
+	retries, err := LoadRetryQueue()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+
+	courseDirs, err := loadCourseDirectories()
+	if err != nil {
+		return err
+	}
+
+	api.Usage, err = LoadUsage()
+	if err != nil {
+		return err
 	}
 
-	var config Config
-	if err := json.Unmarshal(content, &config); err != nil {
-		return fmt.Errorf("invalid config file: %w", err)
+	finalized, err := loadFinalizedCourses()
+	if err != nil {
+		return err
 	}
 
-	api := &CanvasApi{
-		Client:  http.DefaultClient,
-		RootUrl: config.Url,
-		Token:   config.Token,
+	journal, err := OpenJournal()
+	if err != nil {
+		return err
 	}
+	defer journal.Close()
+
+	// The errgroup's context is cancelled as soon as Wait returns, so keep hold of the parent
+	// context for anything that runs after the sync has finished.
+	parentCtx := ctx
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watchdog := NewWatchdog(pipeline, config.WatchdogTimeout())
+	if config.WatchdogTimeout() > 0 {
+		go watchdog.Run(ctx, cancel)
+	}
+
+	progress := NewSyncProgress(progressOut, fmt.Sprintf("Syncing %s", config.Url), pipeline, progressBar)
+	defer progress.Stop()
 
+	subscribers := []func(SyncEvent){progress.HandleEvent, logEvent, metrics.HandleEvent, controlEvents.HandleEvent}
+	if jsonOut != nil {
+		subscribers = append(subscribers, jsonOut.HandleEvent)
+	}
+	bus := NewEventBus(subscribers...)
+	defer bus.Close()
+
+	ctx = withRefresh(ctx, NewRefresh(opts, config))
+	ctx = withContentRules(ctx, NewContentRules(config))
 	errgrp, ctx := errgroup.WithContext(ctx)
 
+	// With --max-duration, listing and queueing files stops at the deadline, but the downloads in
+	// progress carry on until they finish.
+	listCtx := ctx
+	if opts.MaxDuration > 0 {
+		var cancelList context.CancelFunc
+		listCtx, cancelList = context.WithDeadline(ctx, startedAt.Add(opts.MaxDuration))
+		defer cancelList()
+	}
+	deadlineReached := func() bool {
+		return errors.Is(listCtx.Err(), context.DeadlineExceeded)
+	}
+	// Errors from listing after the deadline come from it being cut short.
+	listed := func(err error) error {
+		if err != nil && deadlineReached() {
+			return nil
+		}
+		return err
+	}
+
 	coursesC := make(chan []Course)
 
 	errgrp.Go(func() error {
-		return listCourses(ctx, api, coursesC)
+		return listed(listCourses(listCtx, api, coursesC))
 	})
 
-	treeC := make(chan *CourseTree)
+	fileToSyncC := make(chan FileToSync)
 
-	// Goroutine to loop through all the courses received on the coursesC channel and start
-	// child goroutines to build course trees, and then send them to the treeC channel. When
-	// finished, closes the treeC channel.
-	errgrp.Go(func() error {
-		errgrp, ctx := errgroup.WithContext(ctx)
+	// Skips courses that are ignored, untagged or finalized.
+	syncCourse := func(courseId uint64) bool {
+		for _, ignoredCourseId := range config.IgnoredCourses {
+			if courseId == ignoredCourseId {
+				return false
+			}
+		}
+
+		if !config.HasAnyTag(courseId, opts.Tags) {
+			return false
+		}
+
+		_, ok := finalized[courseId]
+		return !ok
+	}
+
+	// The trees whose files are synced, so that the times of their folders can be set once all
+	// the files have been downloaded into them.
+	var syncedTreesMu sync.Mutex
+	var syncedTrees []syncedTree
+
+	// Goroutine to loop through all the courses received on the coursesC channel, and then the
+	// user's personal files and groups, and start child goroutines to build their trees. Files
+	// that need syncing are sent to the fileToSyncC channel as soon as their folder has been
+	// listed. When finished, closes the fileToSyncC channel.
+	errgrp.Go(func() (err error) {
+		defer func() { err = listed(err) }()
+		errgrp, ctx := errgroup.WithContext(listCtx)
+
+		// With max_course_size, the whole of a course has to be listed before any of it is synced,
+		// to know whether it is too big.
+		maxCourseSize := config.MaxCourseSize()
+
+		syncTree := func(courseId uint64, directory string, build func(folderListed FolderListedFunc) (*CourseTree, error)) {
+			errgrp.Go(func() error {
+				var mu sync.Mutex
+				var listed []func() error
+
+				tree, err := build(func(tree *CourseTree, folder *TreeFolder, parents []*TreeFolder) error {
+					pipeline.Progress()
+					folderPath := tree.LocalPath(directory, folder, parents)
+					if maxCourseSize > 0 {
+						mu.Lock()
+						listed = append(listed, func() error {
+							return folderFilesToSync(ctx, fileToSyncC, courseId, folder, folderPath)
+						})
+						mu.Unlock()
+						return nil
+					}
+					return folderFilesToSync(ctx, fileToSyncC, courseId, folder, folderPath)
+				})
+				if err != nil {
+					return err
+				}
+
+				synced := true
+				if maxCourseSize > 0 {
+					if size := tree.Size(); size > maxCourseSize {
+						logInfof("Not syncing %s: its files take up %s, more than max_course_size", tree.Name, humanize.Bytes(uint64(size)))
+						synced = false
+					} else {
+						for _, folderListed := range listed {
+							if err := folderListed(); err != nil {
+								return err
+							}
+						}
+					}
+				}
+
+				if tree.FoldersForbidden {
+					bus.Publish(ErrorReported{ErrorEvent{Code: ErrCodeForbiddenCourse, CourseId: courseId}, errForbidden})
+				}
+				for _, folderId := range tree.ForbiddenFolders {
+					bus.Publish(ErrorReported{ErrorEvent{Code: ErrCodeForbiddenFolder, CourseId: courseId, FolderId: folderId}, errForbidden})
+				}
+
+				if synced {
+					syncedTreesMu.Lock()
+					syncedTrees = append(syncedTrees, syncedTree{tree, directory})
+					syncedTreesMu.Unlock()
+				}
+
+				pipeline.TreesBuilt.Add(1)
+				bus.Publish(CourseComplete{tree})
+				return nil
+			})
+		}
+
+		var syncedCourses []Course
+
+		// With max_concurrent_courses, a course is only started once the files of one of those
+		// before it have all been listed.
+		var courseSlots chan struct{}
+		if n := config.MaxConcurrentCourses(); n > 0 {
+			courseSlots = make(chan struct{}, n)
+		}
 
 	Loop:
 		for {
@@ -303,122 +680,464 @@ func sync(ctx context.Context) error {
 				if !more {
 					break Loop
 				}
-			CourseLoop:
+				pipeline.CoursesListed.Add(int64(len(courses)))
+				pipeline.Progress()
+
 				for _, course := range courses {
-					// Skip ignored courses
-					for _, ignoredCourseId := range config.IgnoredCourses {
-						if course.Id == ignoredCourseId {
-							continue CourseLoop
+					if !syncCourse(course.Id) {
+						continue
+					}
+
+					if courseSlots != nil {
+						select {
+						case <-ctx.Done():
+							return ctx.Err()
+						case courseSlots <- struct{}{}:
 						}
 					}
 
 					course := course
-					errgrp.Go(func() error {
-						tree, err := BuildTree(ctx, api, course)
-						if err != nil {
-							return err
+					syncedCourses = append(syncedCourses, course)
+					if err := moveCourseDirectory(config, manifest, courseDirs, course); err != nil {
+						logErrorf("%s", err)
+					}
+					if config.CourseInfo {
+						if err := writeCourseInfo(config.Url, course, config.CourseDirectory(course)); err != nil {
+							logErrorf("cannot write the details of %s: %s", course.Name, err)
+						}
+					}
+					syncTree(course.Id, config.Directory, func(folderListed FolderListedFunc) (*CourseTree, error) {
+						if courseSlots != nil {
+							defer func() { <-courseSlots }()
 						}
 
-						select {
-						case <-ctx.Done():
-							return ctx.Err()
-						case treeC <- tree:
-							return nil
+						tree, err := BuildTree(ctx, api, course, config.SkipFoldersFor(course.Id), folderListed)
+						if err != nil || !config.SyncLinkedFiles {
+							return tree, err
 						}
+
+						linkedPath := filepath.Join(config.CourseDirectory(course), linkedFilesDirectory)
+						return tree, linkedFilesToSync(ctx, api, fileToSyncC, tree, linkedPath)
 					})
+
+					if config.SyncDiscussions {
+						errgrp.Go(func() error {
+							discussionsPath := filepath.Join(config.CourseDirectory(course), discussionsDirectory)
+							return discussionsToSync(ctx, api, fileToSyncC, course.Id, discussionsPath)
+						})
+					}
+
+					if config.SyncSubmissions {
+						errgrp.Go(func() error {
+							submissionsPath := filepath.Join(config.CourseDirectory(course), submissionsDirectory)
+							return submissionsToSync(ctx, api, fileToSyncC, course.Id, submissionsPath, config.AnonymizeSubmissions)
+						})
+					}
+
+					if config.SyncQuizzes {
+						errgrp.Go(func() error {
+							return exportQuizzes(ctx, api, course.Id, filepath.Join(config.CourseDirectory(course), quizzesDirectory))
+						})
+					}
+
+					if config.SyncRubrics {
+						errgrp.Go(func() error {
+							return exportRubrics(ctx, api, course.Id, filepath.Join(config.CourseDirectory(course), rubricsDirectory))
+						})
+					}
+
+					if config.GradesSnapshot {
+						errgrp.Go(func() error {
+							return snapshotGrades(ctx, api, course, filepath.Join(config.CourseDirectory(course), gradesDirectory))
+						})
+					}
+
+					if config.SyncMedia {
+						errgrp.Go(func() error {
+							mediaPath := filepath.Join(config.CourseDirectory(course), mediaDirectory)
+							return mediaToSync(ctx, api, fileToSyncC, course.Id, mediaPath, config.MediaMaxSizeMB*1024*1024)
+						})
+					}
 				}
 			}
 		}
 
+		if config.SyncCalendar {
+			errgrp.Go(func() error {
+				return writeCalendar(ctx, api, syncedCourses, config.CalendarPath())
+			})
+		}
+
+		// Like groups that are not part of a course, personal files are only synced when not
+		// syncing by tag.
+		if config.SyncPersonalFiles && len(opts.Tags) == 0 {
+			syncTree(0, config.Directory, func(folderListed FolderListedFunc) (*CourseTree, error) {
+				return BuildPersonalTree(ctx, api, FolderSkip{Kinds: config.SkipFolders}, folderListed)
+			})
+		}
+
+		groups, err := listAll(ctx, api.MakeGroupsUrl(), api.Groups)
+		if err != nil && !errors.Is(err, errForbidden) {
+			return err
+		}
+
+	GroupLoop:
+		for _, group := range groups {
+			for _, ignoredGroupId := range config.IgnoredGroups {
+				if group.Id == ignoredGroupId {
+					continue GroupLoop
+				}
+			}
+
+			// Groups that are not part of a course are only synced when not syncing by tag.
+			if !syncCourse(group.CourseId) {
+				continue
+			}
+
+			group := group
+			syncTree(group.CourseId, config.GroupsDirectory(), func(folderListed FolderListedFunc) (*CourseTree, error) {
+				return BuildGroupTree(ctx, api, group, config.SkipFoldersFor(group.CourseId), folderListed)
+			})
+		}
+
 		if err := errgrp.Wait(); err != nil {
 			return err
 		}
 
-		close(treeC)
+		close(fileToSyncC)
 		return nil
 	})
 
-	fileToSyncC := make(chan FileToSync)
+	var stats Statistics
 
+	spaces, err := NewSpaceChecks(config.SyncRoots())
+	if err != nil {
+		return err
+	}
+
+	// Queue the files found to sync as they come in, so that the progress bar can show how much
+	// there is to download before the downloaders get to it, and so that the downloaders can be
+	// handed the most useful files first.
+	queue := NewDownloadQueue()
+	// Closed once every file to sync has been found, or listing has stopped.
+	allFound := make(chan struct{})
 	errgrp.Go(func() error {
-		errgrp, ctx := errgroup.WithContext(ctx)
+		defer close(allFound)
+		defer queue.Close()
 
-	Loop:
+		// With --plan-first, whether all the files will fit on the disk is checked before any is
+		// downloaded.
+		needed := make(SpaceNeeded)
 		for {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case tree, more := <-treeC:
+			case <-listCtx.Done():
+				if !deadlineReached() {
+					return listCtx.Err()
+				}
+				stats.FilesRemaining.Add(uint64(queue.Drain()))
+				return nil
+			case file, more := <-fileToSyncC:
 				if !more {
-					break Loop
+					if !opts.PlanFirst {
+						return nil
+					}
+					if err := spaces.Preflight(needed); err != nil {
+						queue.Drain()
+						return err
+					}
+					return nil
 				}
-				errgrp.Go(func() error { return filesToSync(ctx, config.Directory, fileToSyncC, tree) })
+				bus.Publish(FileDiscovered{file})
+				spaces.Add(needed, file)
+				queue.Push(file)
 			}
 		}
+	})
 
-		if err := errgrp.Wait(); err != nil {
+	downloader := &Downloader{
+		api:          api,
+		trash:        NewTrash(config.SyncRoots(), startedAt),
+		retries:      retries,
+		manifest:     manifest,
+		pipeline:     pipeline,
+		journal:      journal,
+		keepVersions: config.KeepVersions,
+		checkHash:    config.CheckMode == checkModeHash,
+		metadata:     NewMetadataWriter(config.Url, config.FileMetadata),
+		extractZips:  config.ExtractZips,
+		spaces:       spaces,
+	}
+
+	budget := NewDiskBudget(config.MaxTotalSize(), manifest)
+
+	roots := config.SyncRoots()
+
+	fileHooks, err := LoadFileHooks(config)
+	if err != nil {
+		return err
+	}
+
+	guard, err := NewPathGuard(roots, config.Symlinks, opts.OneFilesystem)
+	if err != nil {
+		return err
+	}
+
+	// syncFile downloads a file found to sync, unless it is skipped.
+	syncFile := func(file FileToSync) error {
+		var result error
+		defer func() { bus.Publish(DownloadFinished{file, result}) }()
+
+		if err := guard.Check(file.Path); errors.Is(err, errPathSkipped) {
+			logInfof("%s", err)
+			result = err
+			return nil
+		} else if err != nil {
+			result = err
 			return err
 		}
 
-		close(fileToSyncC)
-		return nil
-	})
+		if err := budget.Reserve(file); err != nil {
+			logDebugf("Not downloading %s: %v", file.Path, err)
+			stats.FilesOverBudget.Add(1)
+			result = err
+			return nil
+		}
 
-	progress := progressbar.NewOptions64(
-		-1,
-		progressbar.OptionSpinnerType(14),
-		progressbar.OptionSetDescription(fmt.Sprintf("Syncing %s", config.Url)),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionThrottle(20*time.Millisecond),
-		progressbar.OptionShowCount(),
-		progressbar.OptionShowIts(),
-		progressbar.OptionSetItsString("files"),
-		progressbar.OptionFullWidth(),
-		progressbar.OptionUseANSICodes(true),
-	)
-	progress.RenderBlank()
+		_, statErr := os.Stat(file.Path)
+		updated := statErr == nil
 
-	var stats Statistics
+		bus.Publish(DownloadStarted{file})
+		pipeline.StartDownload(file.Path)
+		err := downloader.Sync(ctx, file)
+		pipeline.FinishDownload(file.Path, err)
+		result = err
 
-	const numDownloaders = 10
+		if errors.Is(err, errMoved) {
+			stats.FilesMoved.Add(1)
+			return nil
+		}
+		if errors.Is(err, errNotModified) {
+			return nil
+		}
+		if errors.Is(err, errParked) || errors.Is(err, errDeferred) {
+			stats.FilesFailed.Add(1)
+			if errors.Is(err, errParked) {
+				stats.Fail(file, err)
+				bus.Publish(ErrorReported{ErrorEvent{CourseId: file.CourseId, FileId: file.File.Id, UrlRedacted: redactUrl(file.File.DownloadUrl)}, err})
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-	for i := 0; i < numDownloaders; i++ {
+		stats.Add(file, updated)
+		if entry, ok := manifest.Get(file.File.Id); ok {
+			fileHooks.Run(parentCtx, file.File.Id, entry)
+		}
+		return nil
+	}
+
+	// There are enough downloaders for the most files that may be downloaded at once. Each waits
+	// for the download limiter, and while downloads are paused, before it takes a file from the
+	// queue, so that files stay in the queue, in order of priority, until they can start
+	// downloading.
+	for i := 0; i < maxDownloaders; i++ {
 		errgrp.Go(func() error {
-			for {
+			// With --plan-first, nothing is downloaded until everything has been listed.
+			if opts.PlanFirst {
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				case file, more := <-fileToSyncC:
-					if !more {
-						return nil
-					}
+				case <-allFound:
+				}
+			}
 
-					if err := downloadAndWriteFile(ctx, api, file); err != nil {
-						return err
-					}
+			for {
+				if err := api.DownloadLimiter.Acquire(ctx, 0); err != nil {
+					return err
+				}
+				if err := pipeline.Pauser.Wait(ctx); err != nil {
+					api.DownloadLimiter.Release()
+					return err
+				}
+
+				file, more, err := queue.Next(ctx)
+				if err != nil || !more {
+					api.DownloadLimiter.Release()
+					return err
+				}
 
-					progress.Add(1)
-					stats.FilesSynced.Add(1)
-					stats.BytesTransferred.Add(uint64(file.File.Size))
+				// Do not start downloads that waited past --max-duration.
+				if deadlineReached() {
+					queue.Done(file)
+					api.DownloadLimiter.Release()
+					stats.FilesRemaining.Add(1)
+					continue
+				}
+				err = syncFile(file)
+				queue.Done(file)
+				api.DownloadLimiter.Release()
+				if err != nil {
+					return err
 				}
 			}
 		})
 	}
 
-	if err := errgrp.Wait(); err != nil {
+	err = errgrp.Wait()
+	if stallErr := watchdog.Err(); stallErr != nil {
+		err = stallErr
+	}
+	if err == nil {
+		fileHooks.RunPending(parentCtx, manifest.EntriesById(), func(entry ManifestEntry) bool {
+			// Finalized courses are read-only.
+			_, ok := finalized[entry.CourseId]
+			return ok
+		})
+	}
+	fileHooks.Wait()
+	if saveErr := fileHooks.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if saveErr := retries.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if saveErr := manifest.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if config.SearchIndex {
+		if _, indexErr := updateSearchIndex(manifest); indexErr != nil && err == nil {
+			err = indexErr
+		}
+	}
+	if saveErr := saveState(courseDirectoriesStateFile, courseDirs); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if saveErr := api.Usage.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if saveErr := api.Listings.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if saveErr := api.CourseTokens.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	api.TransportStats.LogSummary()
+
+	run := HistoryRun{
+		Url:              config.Url,
+		StartedAt:        startedAt,
+		FinishedAt:       time.Now(),
+		FilesSynced:      stats.FilesSynced.Load(),
+		BytesTransferred: stats.BytesTransferred.Load(),
+		Files:            stats.files,
+		Failed:           stats.failed,
+	}
+	if errors.Is(err, context.Canceled) {
+		run.Error = "interrupted"
+	} else if err != nil {
+		run.Error = err.Error()
+	}
+	if saveErr := AddHistoryRun(run); saveErr != nil && err == nil {
+		err = saveErr
+	}
+
+	if err != nil {
 		return err
 	}
 
+	bus.Close()
 	if err := progress.Finish(); err != nil {
 		return err
 	}
 
-	if stats.FilesSynced.Load() == 0 {
-		fmt.Printf("✓ Up to date with %s.\n", config.Url)
-	} else if stats.FilesSynced.Load() == 1 {
-		fmt.Printf("✓ Transferred 1 file (%s) from %s.\n", humanize.Bytes(stats.BytesTransferred.Load()), config.Url)
-	} else {
-		fmt.Printf("✓ Transferred %d files (%s) from %s.\n", stats.FilesSynced.Load(), humanize.Bytes(stats.BytesTransferred.Load()), config.Url)
+	summary := SummaryEvent{
+		Url:              config.Url,
+		FilesSynced:      stats.FilesSynced.Load(),
+		BytesTransferred: stats.BytesTransferred.Load(),
+		FilesFailed:      stats.FilesFailed.Load(),
+		FilesOverBudget:  stats.FilesOverBudget.Load(),
+		DeadlineReached:  deadlineReached(),
+		FilesRemaining:   stats.FilesRemaining.Load(),
+		FilesMoved:       stats.FilesMoved.Load(),
+	}
+	pipeline.Summary = &summary
+
+	// With --stats-json, the summary is written as it is with --json, and nothing else is.
+	if jsonOut == nil && opts.StatsJSON {
+		jsonOut = NewJSONOutput(os.Stdout)
+	}
+	if jsonOut != nil {
+		jsonOut.Summary(summary)
+	} else if logLevel > LogQuiet {
+		if stats.FilesSynced.Load() == 0 {
+			fmt.Printf("✓ Up to date with %s.\n", config.Url)
+		} else if stats.FilesSynced.Load() == 1 {
+			fmt.Printf("✓ Transferred 1 file (%s) from %s.\n", humanize.Bytes(stats.BytesTransferred.Load()), config.Url)
+		} else {
+			fmt.Printf("✓ Transferred %d files (%s) from %s.\n", stats.FilesSynced.Load(), humanize.Bytes(stats.BytesTransferred.Load()), config.Url)
+		}
+		switch moved := stats.FilesMoved.Load(); moved {
+		case 0:
+		case 1:
+			fmt.Println("✓ Moved 1 file that was renamed or moved on Canvas.")
+		default:
+			fmt.Printf("✓ Moved %d files that were renamed or moved on Canvas.\n", moved)
+		}
+		printTagSummary(config, stats.files)
+	}
+	if jsonOut == nil {
+		if failed := stats.FilesFailed.Load(); failed > 0 {
+			fmt.Printf("! %d files could not be downloaded and will be retried later; run canvas-sync status for details.\n", failed)
+		}
+		if overBudget := stats.FilesOverBudget.Load(); overBudget > 0 {
+			fmt.Printf("! %d files were not downloaded because the synced files would take up more than max_total_size.\n", overBudget)
+		}
+		if deadlineReached() {
+			fmt.Printf("! Stopped after --max-duration of %s with %d files found but not downloaded, and perhaps more not yet found; they will be synced on the next run.\n", opts.MaxDuration, stats.FilesRemaining.Load())
+		}
+	}
+
+	if opts.Dedupe {
+		report, err := Dedupe(manifest.Entries(), config.DedupeMethod(), func(entry ManifestEntry) bool {
+			// Finalized courses are read-only.
+			_, ok := finalized[entry.CourseId]
+			return ok
+		})
+		if err != nil {
+			return fmt.Errorf("cannot dedupe files: %w", err)
+		}
+		if jsonOut == nil && logLevel > LogQuiet && report.Linked > 0 {
+			fmt.Printf("✓ Saved %s by linking %d duplicate files.\n", humanize.Bytes(uint64(report.Saved)), report.Linked)
+		}
+	}
+
+	// Set the times of folders last, as writing files into a directory changes its time.
+	for _, synced := range syncedTrees {
+		synced.tree.SetFolderTimes(synced.directory)
+	}
+
+	for _, root := range config.SyncRoots() {
+		if _, err := PruneTrash(root, config.TrashRetention(), time.Now()); err != nil {
+			return fmt.Errorf("cannot prune trash: %w", err)
+		}
+	}
+
+	if config.PostSyncHook != nil && stats.FilesSynced.Load() > 0 {
+		report := &SyncReport{
+			Url:              config.Url,
+			StartedAt:        startedAt,
+			FinishedAt:       time.Now(),
+			FilesSynced:      stats.FilesSynced.Load(),
+			BytesTransferred: stats.BytesTransferred.Load(),
+			Files:            stats.files,
+		}
+		if err := runPostSyncHook(parentCtx, api.Client, config.PostSyncHook, report); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		summary *SummaryEvent
+		want    int
+	}{
+		{"error", errors.New("cannot list courses"), nil, exitFatal},
+		{"error after summary", errors.New("cannot save state"), &SummaryEvent{FilesSynced: 1}, exitFatal},
+		{"no sync", nil, nil, exitSuccess},
+		{"up to date", nil, &SummaryEvent{}, exitSuccess},
+		{"synced", nil, &SummaryEvent{FilesSynced: 2}, exitSynced},
+		{"moved", nil, &SummaryEvent{FilesMoved: 1}, exitSynced},
+		{"failed", nil, &SummaryEvent{FilesFailed: 1}, exitFileErrors},
+		{"failed and synced", nil, &SummaryEvent{FilesSynced: 2, FilesFailed: 1}, exitFileErrors},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pipeline *Pipeline
+			if test.summary != nil {
+				pipeline = &Pipeline{Summary: test.summary}
+			}
+			if got := exitCode(test.err, pipeline); got != test.want {
+				t.Errorf("exitCode returned %d, want %d", got, test.want)
+			}
+		})
+	}
+}
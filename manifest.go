@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const manifestStateFile = "manifest.json"
+
+// ManifestEntry records what was downloaded for a Canvas file.
+type ManifestEntry struct {
+	CourseId  uint64    `json:"course_id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Hex encoded SHA-256 hash of the content, if known.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Cache validators from the response to the download, used to make conditional requests.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// The files extracted from a zip file, with extract_zips.
+	Extracted *Extraction `json:"extracted,omitempty"`
+}
+
+// fileVersion identifies the content of a downloaded file, so that work done on it, such as running
+// file hooks or indexing it for searching, is not done again until it changes.
+func fileVersion(entry ManifestEntry) string {
+	if entry.SHA256 != "" {
+		return entry.SHA256
+	}
+	return fmt.Sprintf("%d@%s", entry.Size, entry.UpdatedAt.UTC().Format("2006-01-02T15:04:05Z"))
+}
+
+// Manifest records every file that canvas-sync has downloaded, keyed by Canvas file ID. It is
+// kept in the state directory between runs.
+type Manifest struct {
+	mu    sync.Mutex
+	files map[uint64]*ManifestEntry
+}
+
+func LoadManifest() (*Manifest, error) {
+	files := make(map[uint64]*ManifestEntry)
+	if err := loadState(manifestStateFile, &files); err != nil {
+		return nil, err
+	}
+
+	return &Manifest{files: files}, nil
+}
+
+func (m *Manifest) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return saveState(manifestStateFile, m.files)
+}
+
+func (m *Manifest) Get(fileId uint64) (ManifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.files[fileId]
+	if !ok {
+		return ManifestEntry{}, false
+	}
+
+	return *entry, true
+}
+
+func (m *Manifest) Put(fileId uint64, entry ManifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[fileId] = &entry
+}
+
+// Entries returns a copy of every entry in the manifest.
+func (m *Manifest) Entries() []ManifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]ManifestEntry, 0, len(m.files))
+	for _, entry := range m.files {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// EntriesById returns a copy of every entry in the manifest, keyed by file ID.
+func (m *Manifest) EntriesById() map[uint64]ManifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make(map[uint64]ManifestEntry, len(m.files))
+	for fileId, entry := range m.files {
+		entries[fileId] = *entry
+	}
+	return entries
+}
+
+// Move changes the paths of the files that were downloaded into the directory oldDir, which has
+// been moved to newDir.
+func (m *Manifest) Move(oldDir, newDir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range m.files {
+		rel, err := filepath.Rel(oldDir, entry.Path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		entry.Path = filepath.Join(newDir, rel)
+		if entry.Extracted != nil {
+			if rel, err := filepath.Rel(oldDir, entry.Extracted.Dir); err == nil {
+				entry.Extracted.Dir = filepath.Join(newDir, rel)
+			}
+		}
+	}
+}
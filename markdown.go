@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlToMarkdown converts the HTML that Canvas stores for discussions, pages and so on into
+// Markdown. It only knows about the elements that the Canvas rich content editor produces; the
+// text of anything else is kept without its formatting.
+func htmlToMarkdown(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		// The HTML parser accepts anything, so this cannot really happen.
+		return s
+	}
+
+	var w markdownWriter
+	w.node(doc)
+	return strings.TrimSpace(collapseBlankLines(w.String())) + "\n"
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+type markdownWriter struct {
+	strings.Builder
+	// Prefix for each line, for quotes and list items.
+	prefix string
+	pre    bool
+}
+
+func (w *markdownWriter) newline() {
+	w.WriteString("\n" + w.prefix)
+}
+
+func (w *markdownWriter) blankLine() {
+	w.WriteString("\n" + strings.TrimRight(w.prefix, " ") + "\n" + w.prefix)
+}
+
+func (w *markdownWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *markdownWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if w.pre {
+			w.WriteString(strings.ReplaceAll(n.Data, "\n", "\n"+w.prefix))
+		} else {
+			text := whitespace.ReplaceAllString(n.Data, " ")
+			// Leading space at the start of a line would be taken as indentation.
+			if current := w.String(); current == "" || strings.HasSuffix(current, "\n"+w.prefix) {
+				text = strings.TrimLeft(text, " ")
+			}
+			w.WriteString(text)
+		}
+		return
+	case html.DocumentNode:
+		w.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.Data {
+	case "script", "style", "head":
+	case "br":
+		w.newline()
+	case "hr":
+		w.blankLine()
+		w.WriteString("---")
+		w.blankLine()
+	case "p", "div", "section", "article", "table", "figure":
+		w.blankLine()
+		w.children(n)
+		w.blankLine()
+	case "tr":
+		w.newline()
+		w.children(n)
+	case "td", "th":
+		w.children(n)
+		w.WriteString(" ")
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		w.blankLine()
+		w.WriteString(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		w.children(n)
+		w.blankLine()
+	case "strong", "b":
+		w.WriteString("**")
+		w.children(n)
+		w.WriteString("**")
+	case "em", "i":
+		w.WriteString("*")
+		w.children(n)
+		w.WriteString("*")
+	case "code":
+		if w.pre {
+			w.children(n)
+		} else {
+			w.WriteString("`")
+			w.children(n)
+			w.WriteString("`")
+		}
+	case "pre":
+		w.blankLine()
+		w.WriteString("```")
+		w.newline()
+		w.pre = true
+		w.children(n)
+		w.pre = false
+		w.newline()
+		w.WriteString("```")
+		w.blankLine()
+	case "blockquote":
+		prefix := w.prefix
+		w.prefix += "> "
+		w.blankLine()
+		w.children(n)
+		w.prefix = prefix
+		w.blankLine()
+	case "ul", "ol":
+		w.blankLine()
+		for i, c := 1, n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.Data != "li" {
+				continue
+			}
+			marker := "* "
+			if n.Data == "ol" {
+				marker = fmt.Sprintf("%d. ", i)
+			}
+			i++
+
+			w.WriteString(marker)
+			prefix := w.prefix
+			w.prefix += strings.Repeat(" ", len(marker))
+			w.children(c)
+			w.prefix = prefix
+			w.newline()
+		}
+		w.blankLine()
+	case "a":
+		href := attr(n, "href")
+		if href == "" {
+			w.children(n)
+			return
+		}
+		w.WriteString("[")
+		w.children(n)
+		w.WriteString("](" + href + ")")
+	case "img":
+		w.WriteString("![" + attr(n, "alt") + "](" + attr(n, "src") + ")")
+	default:
+		w.children(n)
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// collapseBlankLines removes trailing spaces and runs of more than one blank line.
+func collapseBlankLines(s string) string {
+	lines := strings.Split(s, "\n")
+	out := lines[:0]
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " ")
+		if strings.Trim(line, "> ") == "" {
+			if blank {
+				// The end of a quote.
+				if line == "" {
+					out[len(out)-1] = ""
+				}
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// asUser, if not empty, is the Canvas user that API calls are made on behalf of, which Canvas
+// allows administrators to do. It is set from the command line flags.
+var asUser string
+
+// masquerade adds as_user_id to an API call if it is being made on behalf of another user and does
+// not already have it, as the links to further pages of results usually do.
+func (canvas *CanvasApi) masquerade(apiCall string) string {
+	if canvas.AsUser == "" {
+		return apiCall
+	}
+
+	u, err := url.Parse(apiCall)
+	if err != nil || u.Query().Has("as_user_id") {
+		return apiCall
+	}
+
+	param := "as_user_id=" + url.QueryEscape(canvas.AsUser)
+	if u.RawQuery == "" {
+		u.RawQuery = param
+	} else {
+		u.RawQuery = strings.TrimSuffix(u.RawQuery, "&") + "&" + param
+	}
+	return u.String()
+}
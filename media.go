@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Directory inside a course directory where media recordings are synced to.
+const mediaDirectory = "Media"
+
+// MediaObject is an audio or video recording, such as a lecture recorded with Canvas Studio or
+// Kaltura. Unlike files, media objects are not in a folder and are identified by a string.
+type MediaObject struct {
+	MediaId          string        `json:"media_id"`
+	Title            string        `json:"title"`
+	UserEnteredTitle string        `json:"user_entered_title"`
+	MediaType        string        `json:"media_type"`
+	Sources          []MediaSource `json:"media_sources"`
+}
+
+// MediaSource is one rendition of a media object. Canvas returns the numbers as strings.
+type MediaSource struct {
+	Url         string `json:"url"`
+	ContentType string `json:"content_type"`
+	FileExt     string `json:"fileExt"`
+	Height      string `json:"height"`
+	Width       string `json:"width"`
+	Bitrate     string `json:"bitrate"`
+	// Approximate size in kilobytes.
+	Size string `json:"size"`
+}
+
+func (source MediaSource) pixels() int {
+	height, _ := strconv.Atoi(source.Height)
+	width, _ := strconv.Atoi(source.Width)
+	return height * width
+}
+
+func (source MediaSource) bitrate() int {
+	bitrate, _ := strconv.Atoi(source.Bitrate)
+	return bitrate
+}
+
+func (source MediaSource) size() int64 {
+	size, _ := strconv.ParseInt(source.Size, 10, 64)
+	return size * 1024
+}
+
+// bestSource returns the highest quality rendition that is no bigger than maxSize bytes, or any
+// size if maxSize is zero.
+func (media MediaObject) bestSource(maxSize int64) (MediaSource, bool) {
+	var best MediaSource
+	var found bool
+
+	for _, source := range media.Sources {
+		if source.Url == "" || (maxSize > 0 && source.size() > maxSize) {
+			continue
+		}
+
+		if !found || source.pixels() > best.pixels() || (source.pixels() == best.pixels() && source.bitrate() > best.bitrate()) {
+			best = source
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+func (media MediaObject) fileName(source MediaSource) string {
+	title := media.UserEnteredTitle
+	if title == "" {
+		title = media.Title
+	}
+	if title == "" {
+		title = media.MediaId
+	}
+
+	title = safeFileName(title)
+
+	if source.FileExt != "" && !strings.HasSuffix(strings.ToLower(title), "."+strings.ToLower(source.FileExt)) {
+		title += "." + source.FileExt
+	}
+
+	return title
+}
+
+// contentType returns the content type of a rendition, which Canvas gives for most, or else one
+// made from the kind of recording and the extension of the rendition, such as video/mp4.
+func (media MediaObject) contentType(source MediaSource) string {
+	if source.ContentType != "" {
+		return source.ContentType
+	}
+	if source.FileExt == "" || (media.MediaType != "video" && media.MediaType != "audio") {
+		return ""
+	}
+	return media.MediaType + "/" + strings.ToLower(source.FileExt)
+}
+
+// mediaFileId turns the ID of a media object into an ID for the retry queue and manifest that
+// does not clash with the IDs of Canvas files, which are far below 2^63.
+func mediaFileId(mediaId string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(mediaId))
+	return h.Sum64() | 1<<63
+}
+
+// mediaToSync lists the media objects in a course and sends the best rendition of those that are
+// not on the local disk in the directory mediaPath, or where content_type_rules send them, to the
+// fileToSyncC channel. Recordings do not change once made, so any that are already on disk are not
+// downloaded again.
+// This does NOT close the fileToSyncC channel after exiting.
+func mediaToSync(ctx context.Context, api *CanvasApi, fileToSyncC chan<- FileToSync, courseId uint64, mediaPath string, maxSize int64) error {
+	ctx = withCourse(ctx, courseId)
+	rules := contentRulesFromContext(ctx)
+
+	media, err := listAll(ctx, api.MakeMediaObjectsInCourseUrl(courseId), api.MediaObjectsInCourse)
+	if errors.Is(err, errForbidden) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, m := range media {
+		source, ok := m.bestSource(maxSize)
+		if !ok {
+			continue
+		}
+
+		file := File{
+			Id:          mediaFileId(m.MediaId),
+			FileName:    m.fileName(source),
+			Size:        source.size(),
+			DownloadUrl: source.Url,
+			ContentType: m.contentType(source),
+		}
+		filePath, ok := rules.Route(file, filepath.Join(mediaPath, file.FileName))
+		if !ok {
+			logDebugf("Not downloading %s: content_type_rules skip %s files", file.FileName, file.ContentType)
+			continue
+		}
+
+		force := refreshFromContext(ctx).Wants(courseId, filePath)
+		if !force {
+			_, err := os.Stat(longPath(filePath))
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case fileToSyncC <- FileToSync{File: file, CourseId: courseId, Path: filePath, Force: force}:
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+// Values of the file_metadata setting, which decides where the Canvas IDs of downloaded files are
+// recorded next to them.
+const (
+	// In the user.canvas.file_id, user.canvas.course_id and user.canvas.url extended attributes of
+	// each file.
+	fileMetadataXattr = "xattr"
+	// In a sidecar file in each directory, keyed by file name.
+	fileMetadataSidecar = "sidecar"
+)
+
+// Name of the sidecar file in each directory with file_metadata set to sidecar.
+const sidecarFileName = ".canvas-sync.json"
+
+// FileMetadata maps a local file back to the file on Canvas it was downloaded from.
+type FileMetadata struct {
+	FileId   uint64 `json:"file_id"`
+	CourseId uint64 `json:"course_id"`
+	// Address of the page for the file on Canvas. The download URL is not recorded as it expires.
+	Url string `json:"url"`
+}
+
+// MetadataWriter records the Canvas IDs of downloaded files next to them, as the file_metadata
+// setting asks. Its methods do nothing on a nil MetadataWriter.
+type MetadataWriter struct {
+	canvasUrl string
+	mode      string
+
+	// Sidecar files are rewritten whole, so downloads into the same directory take turns.
+	mu sync.Mutex
+}
+
+// NewMetadataWriter returns a MetadataWriter for the file_metadata setting mode, or nil if it is
+// not set.
+func NewMetadataWriter(canvasUrl, mode string) *MetadataWriter {
+	if mode == "" {
+		return nil
+	}
+	return &MetadataWriter{canvasUrl: strings.TrimSuffix(canvasUrl, "/"), mode: mode}
+}
+
+// Write records where the file at file.Path came from.
+func (w *MetadataWriter) Write(file FileToSync) error {
+	if w == nil {
+		return nil
+	}
+
+	metadata := FileMetadata{
+		FileId:   file.File.Id,
+		CourseId: file.CourseId,
+		Url:      fmt.Sprintf("%s/files/%d", w.canvasUrl, file.File.Id),
+	}
+
+	if w.mode == fileMetadataXattr {
+		attrs := []struct{ name, value string }{
+			{"user.canvas.file_id", strconv.FormatUint(metadata.FileId, 10)},
+			{"user.canvas.course_id", strconv.FormatUint(metadata.CourseId, 10)},
+			{"user.canvas.url", metadata.Url},
+		}
+		for _, attr := range attrs {
+			if err := setXattr(longPath(file.Path), attr.name, attr.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return w.updateSidecar(filepath.Dir(file.Path), func(files map[string]FileMetadata) {
+		files[filepath.Base(file.Path)] = metadata
+	})
+}
+
+// Move records that a file was moved from oldPath to its current path. Extended attributes move
+// with the file, but its entry in a sidecar file has to be moved to the sidecar file of the new
+// directory.
+func (w *MetadataWriter) Move(oldPath string, file FileToSync) error {
+	if w == nil {
+		return nil
+	}
+
+	if w.mode == fileMetadataSidecar {
+		err := w.updateSidecar(filepath.Dir(oldPath), func(files map[string]FileMetadata) {
+			delete(files, filepath.Base(oldPath))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return w.Write(file)
+}
+
+// updateSidecar changes the sidecar file in dir with update, removing it if it ends up empty.
+func (w *MetadataWriter) updateSidecar(dir string, update func(files map[string]FileMetadata)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	path := filepath.Join(dir, sidecarFileName)
+	files := make(map[string]FileMetadata)
+
+	content, err := os.ReadFile(longPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &files); err != nil {
+			return fmt.Errorf("invalid %s: %w", path, err)
+		}
+	}
+
+	update(files)
+
+	if len(files) == 0 {
+		if err := os.Remove(longPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	content, err = json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicFile.WriteFile(longPath(path), strings.NewReader(string(content)))
+}
+
+// ReadFileMetadata returns the Canvas file that the file at path was downloaded from, if it was
+// recorded in its extended attributes or a sidecar file.
+func ReadFileMetadata(path string) (FileMetadata, bool) {
+	if url, err := getXattr(longPath(path), "user.canvas.url"); err == nil {
+		metadata := FileMetadata{Url: url}
+		if id, err := getXattr(longPath(path), "user.canvas.file_id"); err == nil {
+			metadata.FileId, _ = strconv.ParseUint(id, 10, 64)
+		}
+		if id, err := getXattr(longPath(path), "user.canvas.course_id"); err == nil {
+			metadata.CourseId, _ = strconv.ParseUint(id, 10, 64)
+		}
+		return metadata, true
+	}
+
+	content, err := os.ReadFile(longPath(filepath.Join(filepath.Dir(path), sidecarFileName)))
+	if err != nil {
+		return FileMetadata{}, false
+	}
+	var files map[string]FileMetadata
+	if err := json.Unmarshal(content, &files); err != nil {
+		return FileMetadata{}, false
+	}
+	metadata, ok := files[filepath.Base(path)]
+	return metadata, ok
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics, if not nil, counts what syncs do for the Prometheus metrics served in watch mode.
+var metrics *Metrics
+
+// Metrics accumulates counters across all the syncs made by a long-running canvas-sync. Its
+// methods do nothing on a nil Metrics.
+type Metrics struct {
+	apiRequests atomic.Uint64
+	rateLimited atomic.Uint64
+
+	mu          sync.Mutex
+	files       map[uint64]uint64
+	bytes       map[uint64]uint64
+	errors      map[metricsErrorKey]uint64
+	syncs       map[string]uint64
+	lastSuccess time.Time
+	lastRun     time.Duration
+}
+
+type metricsErrorKey struct {
+	courseId uint64
+	code     ErrorCode
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		files:  make(map[uint64]uint64),
+		bytes:  make(map[uint64]uint64),
+		errors: make(map[metricsErrorKey]uint64),
+		syncs:  make(map[string]uint64),
+	}
+}
+
+// APIRequest counts a response to an API request.
+func (m *Metrics) APIRequest(rateLimited bool) {
+	if m == nil {
+		return
+	}
+	m.apiRequests.Add(1)
+	if rateLimited {
+		m.rateLimited.Add(1)
+	}
+}
+
+// HandleEvent is the subscriber that counts the files synced and the errors in each course.
+func (m *Metrics) HandleEvent(event SyncEvent) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e := event.(type) {
+	case DownloadFinished:
+		if e.Err == nil {
+			m.files[e.File.CourseId]++
+			m.bytes[e.File.CourseId] += uint64(e.File.File.Size)
+		}
+	case ErrorReported:
+		code := e.Event.Code
+		if code == "" {
+			code = errorCode(e.Err)
+		}
+		m.errors[metricsErrorKey{e.Event.CourseId, code}]++
+	}
+}
+
+// SyncFinished records the outcome of a sync that started at startedAt.
+func (m *Metrics) SyncFinished(startedAt time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.lastRun = now.Sub(startedAt)
+	if err != nil {
+		m.syncs["error"]++
+		return
+	}
+	m.syncs["success"]++
+	m.lastSuccess = now
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("canvas_sync_api_requests_total", "counter", "API requests made to Canvas.")
+	fmt.Fprintf(w, "canvas_sync_api_requests_total %d\n", m.apiRequests.Load())
+
+	metric("canvas_sync_api_rate_limited_total", "counter", "API requests refused by the Canvas rate limit.")
+	fmt.Fprintf(w, "canvas_sync_api_rate_limited_total %d\n", m.rateLimited.Load())
+
+	metric("canvas_sync_files_synced_total", "counter", "Files downloaded, by course.")
+	for _, courseId := range sortedKeys(m.files) {
+		fmt.Fprintf(w, "canvas_sync_files_synced_total{course_id=\"%d\"} %d\n", courseId, m.files[courseId])
+	}
+
+	metric("canvas_sync_bytes_transferred_total", "counter", "Bytes of files downloaded, by course.")
+	for _, courseId := range sortedKeys(m.bytes) {
+		fmt.Fprintf(w, "canvas_sync_bytes_transferred_total{course_id=\"%d\"} %d\n", courseId, m.bytes[courseId])
+	}
+
+	metric("canvas_sync_errors_total", "counter", "Errors reported during syncs, by course and error code.")
+	keys := make([]metricsErrorKey, 0, len(m.errors))
+	for key := range m.errors {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].courseId != keys[j].courseId {
+			return keys[i].courseId < keys[j].courseId
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "canvas_sync_errors_total{course_id=\"%d\",code=\"%s\"} %d\n", key.courseId, key.code, m.errors[key])
+	}
+
+	metric("canvas_sync_syncs_total", "counter", "Syncs finished, by result.")
+	for _, result := range []string{"success", "error"} {
+		fmt.Fprintf(w, "canvas_sync_syncs_total{result=\"%s\"} %d\n", result, m.syncs[result])
+	}
+
+	metric("canvas_sync_last_success_timestamp_seconds", "gauge", "When the last successful sync finished, as a Unix time, or 0 if none has.")
+	var lastSuccess int64
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = m.lastSuccess.Unix()
+	}
+	fmt.Fprintf(w, "canvas_sync_last_success_timestamp_seconds %d\n", lastSuccess)
+
+	metric("canvas_sync_last_duration_seconds", "gauge", "How long the last sync took.")
+	fmt.Fprintf(w, "canvas_sync_last_duration_seconds %g\n", m.lastRun.Seconds())
+}
+
+// ServeMetrics serves the metrics at /metrics on addr until ctx is cancelled. It returns once the
+// address is being listened on.
+func ServeMetrics(ctx context.Context, addr string, m *Metrics) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot serve metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.Write(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logErrorf("cannot serve metrics: %s", err)
+		}
+	}()
+
+	logInfof("Serving metrics at http://%s/metrics", listener.Addr())
+	return nil
+}
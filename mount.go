@@ -0,0 +1,684 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	defaultMountAddr = "localhost:7824"
+
+	// How long listings of courses, folders and files are used for before they are fetched again.
+	mountListingTTL = time.Minute
+
+	mountCacheDirectory = "mount_cache"
+	// Default of --cache-size.
+	defaultMountCacheSize = "2 GB"
+)
+
+// CanvasView is a read-only file system of the user's courses, folders and files on Canvas, laid
+// out as they are synced, for the mount subcommand to serve over WebDAV. Listings are fetched
+// when they are first needed and files are downloaded when they are opened, into a cache of
+// limited size. Files that have been synced and are up to date are read from the sync directory
+// instead.
+type CanvasView struct {
+	api      *CanvasApi
+	config   *Config
+	manifest *Manifest
+	// When the view was created, which is the time given to directories that are not on Canvas.
+	started time.Time
+
+	cacheDir  string
+	cacheSize int64
+
+	courses cachedListing[[]Course]
+
+	mu      sync.Mutex
+	trees   map[uint64]*cachedListing[*CourseTree]
+	files   map[uint64]*cachedListing[[]*TreeFile]
+	fetches map[uint64]*sync.Mutex
+	// When each file in the cache was last opened, so that those opened longest ago are removed
+	// first when the cache is full.
+	lastUsed map[string]time.Time
+}
+
+// cachedListing is a listing from Canvas, kept for mountListingTTL.
+type cachedListing[T any] struct {
+	mu        sync.Mutex
+	value     T
+	fetchedAt time.Time
+}
+
+func (c *cachedListing[T]) get(fetch func() (T, error)) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < mountListingTTL {
+		return c.value, nil
+	}
+	value, err := fetch()
+	if err != nil {
+		return value, err
+	}
+	c.value, c.fetchedAt = value, time.Now()
+	return value, nil
+}
+
+func NewCanvasView(api *CanvasApi, config *Config, manifest *Manifest, cacheDir string, cacheSize int64) *CanvasView {
+	return &CanvasView{
+		api:       api,
+		config:    config,
+		manifest:  manifest,
+		started:   time.Now(),
+		cacheDir:  cacheDir,
+		cacheSize: cacheSize,
+		trees:     make(map[uint64]*cachedListing[*CourseTree]),
+		files:     make(map[uint64]*cachedListing[[]*TreeFile]),
+		fetches:   make(map[uint64]*sync.Mutex),
+		lastUsed:  make(map[string]time.Time),
+	}
+}
+
+// Courses returns the courses that are synced, that is those not in ignored_courses.
+func (v *CanvasView) Courses(ctx context.Context) ([]Course, error) {
+	return v.courses.get(func() ([]Course, error) {
+		courses, err := v.api.AllCourses(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		ignored := make(map[uint64]bool)
+		for _, id := range v.config.IgnoredCourses {
+			ignored[id] = true
+		}
+		var synced []Course
+		for _, course := range courses {
+			if !ignored[course.Id] {
+				synced = append(synced, course)
+			}
+		}
+		return synced, nil
+	})
+}
+
+// Tree returns the folders of a course, without their files.
+func (v *CanvasView) Tree(ctx context.Context, course Course) (*CourseTree, error) {
+	v.mu.Lock()
+	listing, ok := v.trees[course.Id]
+	if !ok {
+		listing = &cachedListing[*CourseTree]{}
+		v.trees[course.Id] = listing
+	}
+	v.mu.Unlock()
+
+	return listing.get(func() (*CourseTree, error) {
+		folders, err := listAll(withCourse(ctx, course.Id), v.api.MakeFoldersInCourseUrl(course.Id), v.api.FoldersInCourse)
+		if errors.Is(err, errForbidden) {
+			return &CourseTree{Course: course, FoldersForbidden: true}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return NewCourseTree(course, folders, nil)
+	})
+}
+
+// Files returns the files in a folder of a course.
+func (v *CanvasView) Files(ctx context.Context, courseId uint64, folder *TreeFolder) ([]*TreeFile, error) {
+	v.mu.Lock()
+	listing, ok := v.files[folder.Id]
+	if !ok {
+		listing = &cachedListing[[]*TreeFile]{}
+		v.files[folder.Id] = listing
+	}
+	v.mu.Unlock()
+
+	return listing.get(func() ([]*TreeFile, error) {
+		if folder.FilesCount == 0 {
+			return nil, nil
+		}
+		files, err := listAll(withCourse(ctx, courseId), v.api.MakeFilesInFolderUrl(folder.Id), v.api.FilesInFolder)
+		if errors.Is(err, errForbidden) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		treeFiles := make([]*TreeFile, 0, len(files))
+		for _, file := range files {
+			treeFiles = append(treeFiles, &TreeFile{File: file})
+		}
+		uniqueFileNames(treeFiles)
+		return treeFiles, nil
+	})
+}
+
+// viewNode is a directory or file in a CanvasView.
+type viewNode struct {
+	name    string
+	modTime time.Time
+
+	// The elements of the path of the directory, for directories that hold course directories.
+	prefix []string
+	// The course and folder, for the directories of courses and their folders.
+	course *Course
+	folder *TreeFolder
+	// The file, for files.
+	file *TreeFile
+}
+
+func (n *viewNode) IsDir() bool {
+	return n.file == nil
+}
+
+// lookup finds the directory or file at name, a slash-separated path from the root of the view.
+func (v *CanvasView) lookup(ctx context.Context, name string) (*viewNode, error) {
+	var elems []string
+	if name = strings.Trim(path.Clean("/"+name), "/"); name != "" {
+		elems = strings.Split(name, "/")
+	}
+
+	courses, err := v.Courses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The directory of a course may be nested in others by the layout setting.
+	var course *Course
+	isParent := len(elems) == 0
+	for i := range courses {
+		dir := strings.Split(filepath.ToSlash(courses[i].localDirectory()), "/")
+		if len(elems) < len(dir) {
+			isParent = isParent || hasPathPrefix(dir, elems)
+		} else if hasPathPrefix(elems, dir) {
+			course = &courses[i]
+			elems = elems[len(dir):]
+			break
+		}
+	}
+	if course == nil {
+		if !isParent {
+			return nil, fs.ErrNotExist
+		}
+		return &viewNode{name: path.Base("/" + name), modTime: v.started, prefix: elems}, nil
+	}
+
+	tree, err := v.Tree(ctx, *course)
+	if err != nil {
+		return nil, err
+	}
+	node := &viewNode{name: filepath.Base(course.localDirectory()), modTime: v.started, course: course, folder: tree.root}
+	if tree.root != nil {
+		node.modTime = tree.root.UpdatedAt
+	}
+
+	for i, elem := range elems {
+		if node.folder == nil {
+			return nil, fs.ErrNotExist
+		}
+
+		var next *viewNode
+		for _, sub := range node.folder.folders {
+			if localName(sub.Name) == elem {
+				next = &viewNode{name: elem, modTime: sub.UpdatedAt, course: course, folder: sub}
+				break
+			}
+		}
+		// Only the last element can be a file.
+		if next == nil && i == len(elems)-1 {
+			files, err := v.Files(ctx, course.Id, node.folder)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if localName(file.FileName) == elem {
+					next = &viewNode{name: elem, modTime: file.UpdatedAt, course: course, file: file}
+					break
+				}
+			}
+		}
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+		node = next
+	}
+	return node, nil
+}
+
+func hasPathPrefix(elems []string, prefix []string) bool {
+	if len(prefix) > len(elems) {
+		return false
+	}
+	for i := range prefix {
+		if elems[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// children lists the directories and files in a directory.
+func (v *CanvasView) children(ctx context.Context, dir *viewNode) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+
+	if dir.course == nil {
+		courses, err := v.Courses(ctx)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, course := range courses {
+			elems := strings.Split(filepath.ToSlash(course.localDirectory()), "/")
+			if len(elems) <= len(dir.prefix) || !hasPathPrefix(elems, dir.prefix) {
+				continue
+			}
+			name := elems[len(dir.prefix)]
+			if !seen[name] {
+				seen[name] = true
+				infos = append(infos, viewFileInfo{&viewNode{name: name, modTime: v.started}})
+			}
+		}
+		return infos, nil
+	}
+
+	if dir.folder == nil {
+		return nil, nil
+	}
+	for _, sub := range dir.folder.folders {
+		infos = append(infos, viewFileInfo{&viewNode{name: localName(sub.Name), modTime: sub.UpdatedAt, course: dir.course, folder: sub}})
+	}
+	files, err := v.Files(ctx, dir.course.Id, dir.folder)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		infos = append(infos, viewFileInfo{&viewNode{name: localName(file.FileName), modTime: file.UpdatedAt, course: dir.course, file: file}})
+	}
+	return infos, nil
+}
+
+// open returns the local copy of a file, downloading it into the cache if there is no up to date
+// copy in the sync directory or the cache.
+func (v *CanvasView) open(ctx context.Context, node *viewNode) (*os.File, error) {
+	file := node.file
+	if entry, ok := v.manifest.Get(file.Id); ok {
+		if needsSync, err := fileNeedsSync(file, entry.Path); err == nil && !needsSync {
+			return os.Open(longPath(entry.Path))
+		}
+	}
+
+	// Only download each file once at a time.
+	v.mu.Lock()
+	fetch, ok := v.fetches[file.Id]
+	if !ok {
+		fetch = &sync.Mutex{}
+		v.fetches[file.Id] = fetch
+	}
+	v.mu.Unlock()
+	fetch.Lock()
+	defer fetch.Unlock()
+
+	cachePath := filepath.Join(v.cacheDir, fmt.Sprintf("%d%s", file.Id, path.Ext(node.name)))
+	needsSync, err := fileNeedsSync(file, cachePath)
+	if err != nil {
+		return nil, err
+	}
+	if needsSync {
+		if err := downloadRemoteFile(ctx, v.api, node.course.Id, file.File, cachePath); err != nil {
+			return nil, err
+		}
+	}
+
+	v.mu.Lock()
+	v.lastUsed[cachePath] = time.Now()
+	v.mu.Unlock()
+	if needsSync {
+		v.trimCache(cachePath)
+	}
+	return os.Open(longPath(cachePath))
+}
+
+// downloadRemoteFile downloads a file from Canvas to dest, replacing anything there, and gives it
+// the time it was updated on Canvas, as the sync does.
+func downloadRemoteFile(ctx context.Context, api *CanvasApi, courseId uint64, file File, dest string) error {
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	logDebugf("Downloading %s", file.FileName)
+	if _, err := api.DownloadFile(withCourse(ctx, courseId), tmp, file, Validators{}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot download %s: %w", file.FileName, err)
+	}
+	if err := os.Chtimes(tmp.Name(), file.UpdatedAt, file.UpdatedAt); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), longPath(dest))
+}
+
+// trimCache removes the files opened longest ago from the cache until it is no bigger than
+// --cache-size, keeping the file just downloaded to keep.
+func (v *CanvasView) trimCache(keep string) {
+	entries, err := os.ReadDir(v.cacheDir)
+	if err != nil {
+		return
+	}
+
+	type cached struct {
+		path     string
+		size     int64
+		lastUsed time.Time
+	}
+	var files []cached
+	var total int64
+	v.mu.Lock()
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(v.cacheDir, entry.Name())
+		files = append(files, cached{path, info.Size(), v.lastUsed[path]})
+		total += info.Size()
+	}
+	v.mu.Unlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].lastUsed.Before(files[j].lastUsed) })
+	for _, f := range files {
+		if total <= v.cacheSize {
+			break
+		}
+		if f.path == keep {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			logDebugf("Cannot remove %s from the cache: %s", f.path, err)
+			continue
+		}
+		total -= f.size
+		v.mu.Lock()
+		delete(v.lastUsed, f.path)
+		v.mu.Unlock()
+	}
+}
+
+// The methods that make a CanvasView a webdav.FileSystem. Anything that would change it fails.
+
+func (v *CanvasView) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (v *CanvasView) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (v *CanvasView) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (v *CanvasView) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	node, err := v.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return viewFileInfo{node}, nil
+}
+
+func (v *CanvasView) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	node, err := v.lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if node.IsDir() {
+		children, err := v.children(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		return &viewDir{info: viewFileInfo{node}, children: children}, nil
+	}
+
+	f, err := v.open(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	return viewFile{File: f, info: viewFileInfo{node}}, nil
+}
+
+// viewFileInfo describes a directory or file in a CanvasView.
+type viewFileInfo struct {
+	node *viewNode
+}
+
+func (fi viewFileInfo) Name() string       { return fi.node.name }
+func (fi viewFileInfo) ModTime() time.Time { return fi.node.modTime }
+func (fi viewFileInfo) IsDir() bool        { return fi.node.IsDir() }
+func (fi viewFileInfo) Sys() any           { return nil }
+
+func (fi viewFileInfo) Size() int64 {
+	if fi.node.file == nil {
+		return 0
+	}
+	return fi.node.file.Size
+}
+
+func (fi viewFileInfo) Mode() fs.FileMode {
+	if fi.IsDir() {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// ContentType gives the content type of a file from Canvas, so that the file is not downloaded
+// just to list it.
+func (fi viewFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.node.file != nil && fi.node.file.ContentType != "" {
+		return fi.node.file.ContentType, nil
+	}
+	if t := mime.TypeByExtension(path.Ext(fi.node.name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// viewFile is a file in a CanvasView, read from its local copy.
+type viewFile struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (f viewFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f viewFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// viewDir is a directory in a CanvasView.
+type viewDir struct {
+	info     os.FileInfo
+	children []os.FileInfo
+	pos      int
+}
+
+func (d *viewDir) Close() error {
+	return nil
+}
+
+func (d *viewDir) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is a directory", d.info.Name())
+}
+
+func (d *viewDir) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *viewDir) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		d.pos = 0
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%s is a directory", d.info.Name())
+}
+
+func (d *viewDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.children[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.pos += count
+	return rest[:count], nil
+}
+
+func (d *viewDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+// readOnlyWebDAV only lets through the WebDAV requests that read, so that clients mount the view
+// read-only, and only requests addressed to the loopback interface, so that web pages cannot reach
+// it by pointing their own domain at it.
+func readOnlyWebDAV(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, err := net.SplitHostPort(r.Host); err != nil || !isLoopback(host) {
+			http.Error(w, "canvas-sync mount only answers requests to localhost", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND":
+			handler.ServeHTTP(w, r)
+		default:
+			http.Error(w, "the files on Canvas are read-only", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// mountInstructions says how to mount the view served at url on this system.
+func mountInstructions(url string) string {
+	switch runtime.GOOS {
+	case "darwin":
+		return fmt.Sprintf("In Finder, choose Go > Connect to Server and enter %s, or run: mkdir -p ~/Canvas && mount_webdav -S %s ~/Canvas", url, url)
+	case "windows":
+		return fmt.Sprintf("In File Explorer, choose Map network drive and enter %s, or run: net use Z: %s", url, url)
+	default:
+		return fmt.Sprintf("Open %s in your file manager, or run: gio mount %s, or with davfs2: sudo mount -t davfs %s /mnt/canvas", strings.Replace(url, "http:", "dav:", 1), strings.Replace(url, "http:", "dav:", 1), url)
+	}
+}
+
+// runMount implements the mount subcommand, which serves the user's courses on Canvas as a
+// read-only WebDAV share, for the file manager to mount so that files can be opened without
+// syncing everything first.
+func runMount(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	addr := flags.String("listen", defaultMountAddr, "serve the files on this address, which must be a loopback address")
+	cacheSizeSetting := flags.String("cache-size", defaultMountCacheSize, "keep at most this much of the files opened, e.g. 500 MB")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync mount [--listen <address>] [--cache-size <size>]")
+	}
+	if opts.Offline {
+		return fmt.Errorf("--offline only works with diff, digest, quota and archive, as mount needs Canvas")
+	}
+
+	cacheSize, err := parseSize(*cacheSizeSetting)
+	if err != nil {
+		return fmt.Errorf("invalid --cache-size: %w", err)
+	}
+	if host, _, err := net.SplitHostPort(*addr); err != nil || !isLoopback(host) {
+		return fmt.Errorf("--listen must be a loopback address, such as %s, as the files are served without a password", defaultMountAddr)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	view := NewCanvasView(api, config, manifest, filepath.Join(dir, mountCacheDirectory), cacheSize)
+	handler := &webdav.Handler{
+		FileSystem: view,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, os.ErrPermission) {
+				logErrorf("%s %s: %s", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("cannot serve the files: %w", err)
+	}
+	server := &http.Server{Handler: readOnlyWebDAV(handler), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	url := fmt.Sprintf("http://%s/", listener.Addr())
+	fmt.Printf("✓ Serving your courses on Canvas at %s until interrupted.\n", url)
+	fmt.Println(mountInstructions(url))
+
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// OfflineFile is a file that canvas-sync has downloaded, as recorded in the manifest, for working
+// without Canvas.
+type OfflineFile struct {
+	Id uint64
+	ManifestEntry
+	// Whether the downloaded copy is still in the sync directory. If not, the file is only
+	// available on Canvas.
+	Local bool
+}
+
+// offlineFiles returns the files downloaded from a course, or from every course if courseId is
+// zero, in order of path.
+func offlineFiles(manifest *Manifest, courseId uint64) ([]OfflineFile, error) {
+	var files []OfflineFile
+	for fileId, entry := range manifest.EntriesById() {
+		if courseId != 0 && entry.CourseId != courseId {
+			continue
+		}
+
+		fi, err := os.Stat(longPath(entry.Path))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		files = append(files, OfflineFile{Id: fileId, ManifestEntry: entry, Local: err == nil && fi.Mode().IsRegular()})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// runBrowse implements the browse subcommand, which lists the files that canvas-sync has
+// downloaded, by course, without connecting to Canvas, and says which are no longer in the sync
+// directory and so are only available on Canvas.
+func runBrowse(args []string) error {
+	flags := flag.NewFlagSet("browse", flag.ExitOnError)
+	courseId := flags.Uint64("course", 0, "only list the files of the course with this ID")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync browse [--course <course id>]")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	canvasUrl := strings.TrimSuffix(config.Url, "/")
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+	files, err := offlineFiles(manifest, *courseId)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Println("No files have been synced.")
+		return nil
+	}
+
+	courseDirs, err := loadCourseDirectories()
+	if err != nil {
+		return err
+	}
+
+	byCourse := make(map[uint64][]OfflineFile)
+	for _, file := range files {
+		byCourse[file.CourseId] = append(byCourse[file.CourseId], file)
+	}
+	courseIds := sortedKeys(byCourse)
+	sort.Slice(courseIds, func(i, j int) bool {
+		return courseName(courseDirs, byCourse[courseIds[i]]) < courseName(courseDirs, byCourse[courseIds[j]])
+	})
+
+	var local, remote int
+	for _, id := range courseIds {
+		fmt.Printf("%s (%s/courses/%d)\n", courseName(courseDirs, byCourse[id]), canvasUrl, id)
+		for _, file := range byCourse[id] {
+			name := config.displayPath(file.Path)
+			if file.Local {
+				local++
+				fmt.Printf("  %s (%s)\n", name, humanize.Bytes(uint64(file.Size)))
+			} else {
+				remote++
+				fmt.Printf("  ! %s (%s) is only on Canvas: %s/files/%d\n", name, humanize.Bytes(uint64(file.Size)), canvasUrl, file.Id)
+			}
+		}
+	}
+
+	fmt.Printf("%d files in the sync directory", local)
+	if remote > 0 {
+		fmt.Printf(", %d only on Canvas", remote)
+	}
+	fmt.Println(".")
+	return nil
+}
+
+// courseName names a course by the directory it was last synced to, or else by the directory its
+// files are in.
+func courseName(courseDirs map[uint64]string, files []OfflineFile) string {
+	if dir, ok := courseDirs[files[0].CourseId]; ok {
+		return filepath.Base(dir)
+	}
+	return filepath.Base(filepath.Dir(files[0].Path))
+}
+
+// archiveOffline writes the files downloaded from a course that are still in the sync directory to
+// archive, returning the files that are only on Canvas and so were left out.
+func archiveOffline(archive ArchiveWriter, config *Config, files []OfflineFile) (archived int, size int64, remote []OfflineFile, err error) {
+	roots := config.SyncRoots()
+	names := make(map[uint64]string)
+	// The directories in the archive, and where they are on disk.
+	dirs := make(map[string]string)
+	for _, file := range files {
+		if !file.Local {
+			remote = append(remote, file)
+			continue
+		}
+
+		names[file.Id] = archiveName(config, roots, file.Path)
+		diskDir := filepath.Dir(file.Path)
+		for dir := path.Dir(names[file.Id]); dir != "." && dirs[dir] == ""; dir = path.Dir(dir) {
+			dirs[dir] = diskDir
+			diskDir = filepath.Dir(diskDir)
+		}
+	}
+
+	// Add the folders, with their times as far as the sync directory still has them, and then the
+	// files in them.
+	dirNames := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		dirNames = append(dirNames, dir)
+	}
+	sort.Strings(dirNames)
+	for _, dir := range dirNames {
+		fi, err := os.Stat(longPath(dirs[dir]))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if err := archive.Mkdir(dir, fi.ModTime()); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	for _, file := range files {
+		name, ok := names[file.Id]
+		if !ok {
+			continue
+		}
+		if err := archiveFile(archive, name, file.Path); err != nil {
+			return 0, 0, nil, fmt.Errorf("cannot archive %s: %w", name, err)
+		}
+		archived++
+		size += file.Size
+	}
+
+	return archived, size, remote, nil
+}
+
+// archiveName returns the name in an archive of a synced file: its path within the sync directory,
+// or for a file that content_type_rules saved under another directory, its path within that
+// directory after the name of the directory, so that the two are kept apart. A file in neither,
+// such as one saved under a directory no longer in content_type_rules, keeps its full path, less
+// any volume name and leading separator.
+func archiveName(config *Config, roots []string, filePath string) string {
+	root := syncRootOf(roots, filePath)
+	rel, ok := pathWithin(root, filePath)
+	switch {
+	case root == "" || !ok:
+		rel = strings.TrimLeft(filePath[len(filepath.VolumeName(filePath)):], `/\`)
+	case root != config.Directory:
+		rel = filepath.Join(filepath.Base(root), rel)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// displayPath returns how to show the path of a synced file: relative to the sync directory if it
+// is in it, or else, such as for a file that content_type_rules saved under another directory, in
+// full.
+func (config *Config) displayPath(filePath string) string {
+	if rel, ok := pathWithin(config.Directory, filePath); ok {
+		return rel
+	}
+	return filePath
+}
+
+func archiveFile(archive ArchiveWriter, name string, filePath string) error {
+	f, err := os.Open(longPath(filePath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w, err := archive.Create(name, fi.Size(), fi.ModTime())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// runOpen implements the open subcommand, which opens the page on Canvas for a synced file or
+// course directory in the web browser.
+func runOpen(args []string) error {
+	flags := flag.NewFlagSet("open", flag.ExitOnError)
+	printOnly := flags.Bool("print", false, "print the address of the page rather than opening it")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: canvas-sync open [--print] <path>")
+	}
+
+	path, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	url, err := canvasUrlForPath(path)
+	if err != nil {
+		return err
+	}
+
+	if *printOnly {
+		fmt.Println(url)
+		return nil
+	}
+	if err := openBrowser(url); err != nil {
+		return fmt.Errorf("cannot open %s in the web browser: %w", url, err)
+	}
+	return nil
+}
+
+// canvasUrlForPath returns the address of the page on Canvas for the file or course directory at
+// path, from the metadata recorded with the file or else what canvas-sync has recorded about what
+// it synced.
+func canvasUrlForPath(path string) (string, error) {
+	if metadata, ok := ReadFileMetadata(path); ok && metadata.Url != "" {
+		return metadata.Url, nil
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	canvasUrl := strings.TrimSuffix(config.Url, "/")
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		return "", err
+	}
+	for fileId, entry := range manifest.EntriesById() {
+		if entry.Path == path {
+			return fmt.Sprintf("%s/files/%d", canvasUrl, fileId), nil
+		}
+	}
+
+	courseDirs, err := loadCourseDirectories()
+	if err != nil {
+		return "", err
+	}
+	for courseId, dir := range courseDirs {
+		if dir == path {
+			return fmt.Sprintf("%s/courses/%d", canvasUrl, courseId), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s was not synced from Canvas by canvas-sync", path)
+}
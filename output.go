@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONOutput writes events as JSON, one object per line, for programs that wrap canvas-sync.
+type JSONOutput struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONOutput(w io.Writer) *JSONOutput {
+	return &JSONOutput{enc: json.NewEncoder(w)}
+}
+
+type ErrorEvent struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Code        ErrorCode `json:"code"`
+	Message     string    `json:"message"`
+	Fatal       bool      `json:"fatal"`
+	CourseId    uint64    `json:"course_id,omitempty"`
+	FolderId    uint64    `json:"folder_id,omitempty"`
+	FileId      uint64    `json:"file_id,omitempty"`
+	UrlRedacted string    `json:"url_redacted,omitempty"`
+}
+
+type SummaryEvent struct {
+	Type             string `json:"type"`
+	Url              string `json:"url"`
+	FilesSynced      uint64 `json:"files_synced"`
+	BytesTransferred uint64 `json:"bytes_transferred"`
+	FilesFailed      uint64 `json:"files_failed"`
+	// Files not downloaded because of max_total_size.
+	FilesOverBudget uint64 `json:"files_over_budget"`
+	// Whether the sync was stopped by --max-duration, and the files found that it did not get to.
+	DeadlineReached bool   `json:"deadline_reached"`
+	FilesRemaining  uint64 `json:"files_remaining"`
+	// Files renamed or moved on Canvas whose local copies were moved rather than downloaded again.
+	FilesMoved uint64 `json:"files_moved"`
+}
+
+func (o *JSONOutput) write(v any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// There is nowhere else to report a failure to write the output.
+	_ = o.enc.Encode(v)
+}
+
+// Error writes an error event. The error is classified with errorCode unless code is given.
+func (o *JSONOutput) Error(event ErrorEvent, err error) {
+	event.Type = "error"
+	event.Time = time.Now()
+	if event.Code == "" {
+		event.Code = errorCode(err)
+	}
+	event.Message = err.Error()
+
+	var httpErr *HTTPError
+	if event.UrlRedacted == "" && errors.As(err, &httpErr) {
+		event.UrlRedacted = redactUrl(httpErr.Url)
+	}
+
+	o.write(event)
+}
+
+// HandleEvent is the subscriber that writes error events.
+func (o *JSONOutput) HandleEvent(event SyncEvent) {
+	if e, ok := event.(ErrorReported); ok {
+		o.Error(e.Event, e.Err)
+	}
+}
+
+func (o *JSONOutput) Summary(event SummaryEvent) {
+	event.Type = "summary"
+	o.write(event)
+}
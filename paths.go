@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// nameNormalization converts names to the Unicode normalization form chosen in the config, or is
+// nil to leave them as they are. It is set when the config is loaded, before any paths are built.
+var nameNormalization func(string) string
+
+// normalizeName converts the name of a file or folder on Canvas to the Unicode normalization form
+// chosen in the config. Canvas sends names in NFC but macOS has traditionally stored them in NFD,
+// so without this a name can be spelt differently on disk to how it is on Canvas, and the file is
+// downloaded again on every sync.
+func normalizeName(name string) string {
+	if nameNormalization == nil {
+		return name
+	}
+	return nameNormalization(name)
+}
+
+// pathWithin returns path relative to dir, and reports whether it is inside it.
+func pathWithin(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// cleanName stops the name of a file or folder on Canvas from leading outside the directory it
+// belongs in, as a folder called ".." or a name with a slash in it would.
+func cleanName(name string) string {
+	switch name {
+	case "":
+		return "_"
+	case ".", "..":
+		return strings.Repeat("_", len(name))
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Names that Windows reserves for devices, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true,
+	"COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"COM¹": true, "COM²": true, "COM³": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// Longest path that Windows allows without the \\?\ prefix. It is the limit for directories,
+// which is a little shorter than the limit for files.
+const windowsMaxPath = 248
+
+// windowsName makes the name of a file or folder on Canvas into one that can be created on
+// Windows. Characters that are not allowed are replaced with underscores, as are the trailing dots
+// and spaces that Windows would drop, and an underscore is added to reserved names such as "CON"
+// or "aux.txt" to make "CON_" and "aux_.txt".
+func windowsName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	trimmed := strings.TrimRight(name, ". ")
+	name = trimmed + strings.Repeat("_", len(name)-len(trimmed))
+
+	stem, ext := name, ""
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		stem, ext = name[:i], name[i:]
+	}
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		return stem + "_" + ext
+	}
+
+	return name
+}
+
+// windowsLongPath returns the extended-length form of a path, starting with \\?\, if it is too
+// long for Windows to accept otherwise. The path must be a Windows path.
+func windowsLongPath(path string) string {
+	if len(path) < windowsMaxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+
+	abs := path
+	if !isWindowsAbs(path) {
+		var err error
+		if abs, err = filepath.Abs(path); err != nil {
+			return path
+		}
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
+
+// isWindowsAbs reports whether a Windows path is absolute: whether it starts with a drive letter
+// and a separator, or is a UNC path.
+func isWindowsAbs(path string) bool {
+	if strings.HasPrefix(path, `\\`) {
+		return true
+	}
+	return len(path) >= 3 && path[1] == ':' && (path[2] == '\\' || path[2] == '/') &&
+		('a' <= path[0]|0x20 && path[0]|0x20 <= 'z')
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Lecture 1.pdf", "Lecture 1.pdf"},
+		{"", "_"},
+		{".", "_"},
+		{"..", "__"},
+		{"...", "..."},
+		{"Week 1/2", "Week 1_2"},
+		{"../etc/passwd", ".._etc_passwd"},
+		{"a\x00b", "a_b"},
+	}
+	for _, test := range tests {
+		if got := cleanName(test.name); got != test.want {
+			t.Errorf("cleanName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWindowsName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Lecture 1.pdf", "Lecture 1.pdf"},
+		// Reserved names, whatever their case and extension.
+		{"CON", "CON_"},
+		{"con", "con_"},
+		{"aux.txt", "aux_.txt"},
+		{"LPT1", "LPT1_"},
+		{"lpt1.tar.gz", "lpt1_.tar.gz"},
+		{"COM¹", "COM¹_"},
+		{"CONSOLE", "CONSOLE"},
+		{"LPT10", "LPT10"},
+		{"my aux.txt", "my aux.txt"},
+		// Trailing dots and spaces, which Windows would drop.
+		{"Notes.", "Notes_"},
+		{"Notes ", "Notes_"},
+		{"Notes. .", "Notes___"},
+		{"CON.", "CON_"},
+		// Characters that are not allowed.
+		{`Q1: what?`, "Q1_ what_"},
+		{`a<b>c"d|e*f`, "a_b_c_d_e_f"},
+		{`dir\file`, "dir_file"},
+		{"tab\there", "tab_here"},
+	}
+	for _, test := range tests {
+		if got := windowsName(test.name); got != test.want {
+			t.Errorf("windowsName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWindowsLongPath(t *testing.T) {
+	long := strings.Repeat(`abcdefghij\`, 25) + "file.pdf"
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{`C:\Canvas\Course\file.pdf`, `C:\Canvas\Course\file.pdf`},
+		{`\\server\share\file.pdf`, `\\server\share\file.pdf`},
+		{`C:\` + long, `\\?\C:\` + long},
+		{`d:/` + long, `\\?\d:/` + long},
+		{`\\server\share\` + long, `\\?\UNC\server\share\` + long},
+		// Paths that already have the prefix are left alone.
+		{`\\?\C:\` + long, `\\?\C:\` + long},
+		{`\\?\UNC\server\share\` + long, `\\?\UNC\server\share\` + long},
+	}
+	for _, test := range tests {
+		if got := windowsLongPath(test.path); got != test.want {
+			t.Errorf("windowsLongPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestIsWindowsAbs(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{`C:\Canvas`, true},
+		{`c:/Canvas`, true},
+		{`\\server\share`, true},
+		{`C:Canvas`, false},
+		{`Canvas\Course`, false},
+		{`1:\Canvas`, false},
+		{``, false},
+	}
+	for _, test := range tests {
+		if got := isWindowsAbs(test.path); got != test.want {
+			t.Errorf("isWindowsAbs(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	course := Course{Id: 1, Name: "Course One"}
+	tree, err := NewCourseTree(course, []Folder{
+		{Id: 100, Name: "course files"},
+		{Id: 101, ParentId: 100, Name: "Lectures"},
+		{Id: 102, ParentId: 101, Name: "Week 1/2"},
+		{Id: 103, ParentId: 102, Name: ".."},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join("sync", "Canvas")
+	tests := []struct {
+		folder  uint64
+		parents []uint64
+		want    string
+	}{
+		{100, nil, filepath.Join(root, "Course One")},
+		{101, []uint64{100}, filepath.Join(root, "Course One", "Lectures")},
+		{102, []uint64{100, 101}, filepath.Join(root, "Course One", "Lectures", "Week 1_2")},
+		{103, []uint64{100, 101, 102}, filepath.Join(root, "Course One", "Lectures", "Week 1_2", "__")},
+	}
+	for _, test := range tests {
+		var parents []*TreeFolder
+		for _, id := range test.parents {
+			parents = append(parents, tree.lookup[id])
+		}
+		if got := tree.LocalPath(root, tree.lookup[test.folder], parents); got != test.want {
+			t.Errorf("LocalPath of folder %d = %q, want %q", test.folder, got, test.want)
+		}
+	}
+
+	// Courses nested by the layout setting are synced under their parent directory.
+	course.Parent = "2024 Fall"
+	nested, err := NewCourseTree(course, []Folder{{Id: 100, Name: "course files"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(root, "2024 Fall", "Course One")
+	if got := nested.LocalPath(root, nested.root, nil); got != want {
+		t.Errorf("LocalPath of nested course = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// localName returns the name that a file or folder on Canvas is given on the local file system.
+func localName(name string) string {
+	return cleanName(normalizeName(name))
+}
+
+// longPath returns a path that can be passed to system calls that do not accept long paths.
+func longPath(path string) string {
+	return path
+}
+
+// fileSystemId identifies the file system that path, following symbolic links, is on.
+func fileSystemId(path string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return "", &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	return strconv.FormatUint(uint64(stat.Dev), 10), nil
+}
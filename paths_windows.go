@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// localName returns the name that a file or folder on Canvas is given on the local file system.
+func localName(name string) string {
+	return windowsName(cleanName(normalizeName(name)))
+}
+
+// longPath returns a path that can be passed to system calls that do not accept long paths. The
+// os package does this itself, but other packages that make system calls directly do not.
+func longPath(path string) string {
+	return windowsLongPath(path)
+}
+
+// fileSystemId identifies the volume that path, following symbolic links and junctions, is on.
+func fileSystemId(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(filepath.VolumeName(resolved)), nil
+}
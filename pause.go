@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Pauser pauses and resumes downloads. While it is paused, downloaders do not start new downloads
+// and those in flight stop reading from the server, and the files still to download stay queued
+// until it is resumed. Its methods do nothing on a nil Pauser, which is never paused.
+type Pauser struct {
+	mu sync.Mutex
+	// Closed when resumed, or nil if not paused.
+	resumed chan struct{}
+}
+
+func NewPauser() *Pauser {
+	return &Pauser{}
+}
+
+// Toggle pauses if running and resumes if paused, and reports whether it is now paused.
+func (p *Pauser) Toggle() bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// Paused reports whether downloads are paused.
+func (p *Pauser) Paused() bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.resumed != nil
+}
+
+// Wait blocks while downloads are paused.
+func (p *Pauser) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pauseWriter is an io.Writer that blocks while downloads are paused, so that a download in
+// flight stops reading from the server.
+type pauseWriter struct {
+	ctx    context.Context
+	pauser *Pauser
+}
+
+func (w pauseWriter) Write(b []byte) (int, error) {
+	if err := w.pauser.Wait(w.ctx); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
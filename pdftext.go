@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Most bytes of a single PDF stream that are inflated to look for text.
+const maxPDFStreamSize = 16 * 1024 * 1024
+
+// Most levels of /Parent followed to find the resources a page inherits.
+const maxPDFPageDepth = 32
+
+var (
+	pdfObjectStart = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfStreamStart = regexp.MustCompile(`stream\r?\n`)
+	pdfReference   = regexp.MustCompile(`(\d+)\s+\d+\s+R\b`)
+	pdfPageType    = regexp.MustCompile(`/Type\s*/Page[\s/>]`)
+	pdfFormType    = regexp.MustCompile(`/Subtype\s*/Form\b`)
+	pdfObjStmType  = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	// The fonts in a font resource dictionary, by their resource names.
+	pdfFontEntry = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+\d+\s+R\b`)
+	// The Tf operator, which chooses the font, and the Tj, ', " and TJ operators, which show a
+	// string or an array of strings, in the order they appear in a content stream.
+	pdfTextOperator = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+[-0-9.]+\s+Tf\b|(\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>|\[(?:\((?:\\.|[^\\)])*\)|[^\]\(])*\])\s*(Tj|TJ|'|")`)
+	// The strings in a text operator, and the adjustments between them in a TJ array.
+	pdfTextPart  = regexp.MustCompile(`\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>|-?[0-9.]+`)
+	pdfCMapChars = regexp.MustCompile(`(?s)beginbfchar(.*?)endbfchar`)
+	pdfCMapRange = regexp.MustCompile(`(?s)beginbfrange(.*?)endbfrange`)
+	pdfHexString = regexp.MustCompile(`<([0-9A-Fa-f\s]*)>`)
+	// An entry of a bfrange: a range of codes and the text of the first, or of each, of them.
+	pdfCMapRangeEntry = regexp.MustCompile(`<([0-9A-Fa-f\s]*)>\s*<([0-9A-Fa-f\s]*)>\s*(<[0-9A-Fa-f\s]*>|\[[^\]]*\])`)
+)
+
+// Adjustments in a TJ array, in thousandths of the font size, that move the text on by more than
+// this are taken to be spaces between words.
+const pdfSpaceAdjustment = 200
+
+// pdfObject is an object in a PDF file: its dictionary, or other value, and its stream, if it has
+// one, as it is stored in the file.
+type pdfObject struct {
+	num    int
+	offset int
+	value  []byte
+	stream []byte
+}
+
+// pdfDocument holds the objects of a PDF file, by their object numbers, as far as they can be found
+// without reading its cross-reference table, which is often wrong.
+type pdfDocument struct {
+	objects map[int]*pdfObject
+	// The font resources already read, by object number.
+	fonts map[int]*pdfCMap
+}
+
+// pdfText returns the text of a PDF, as far as it can be read without a full PDF parser: the
+// strings shown by the text operators in the content streams of its pages and Form XObjects,
+// uncompressed or Flate compressed, decoded with their fonts' ToUnicode maps when they have them,
+// as the CID fonts of PDFs made from slides usually do. Text in fonts with their own encodings and
+// no ToUnicode map comes out as gibberish or not at all, as does text in streams with other
+// filters, such as LZW, and text that is only an image, as in scanned PDFs.
+func pdfText(content []byte) string {
+	doc := readPDF(content)
+
+	var b strings.Builder
+	pages := doc.pages()
+	if len(pages) == 0 {
+		// The pages could not be found, so look for text in every stream, without fonts.
+		for _, obj := range doc.sorted() {
+			if data, ok := pdfStreamData(obj); ok {
+				pdfContentText(&b, data, nil)
+			}
+		}
+		return b.String()
+	}
+	for _, page := range pages {
+		fonts := doc.resourceFonts(page)
+		for _, obj := range doc.contents(page.value) {
+			if data, ok := pdfStreamData(obj); ok {
+				pdfContentText(&b, data, fonts)
+			}
+		}
+	}
+	// Form XObjects, which pages draw like images, hold the text of some PDFs.
+	for _, obj := range doc.sorted() {
+		if pdfFormType.Match(obj.value) {
+			if data, ok := pdfStreamData(obj); ok {
+				pdfContentText(&b, data, doc.resourceFonts(obj))
+			}
+		}
+	}
+	return b.String()
+}
+
+// readPDF finds the objects in a PDF file, including those in object streams.
+func readPDF(content []byte) *pdfDocument {
+	doc := &pdfDocument{objects: make(map[int]*pdfObject), fonts: make(map[int]*pdfCMap)}
+	starts := pdfObjectStart.FindAllSubmatchIndex(content, -1)
+	for i, loc := range starts {
+		num, err := strconv.Atoi(string(content[loc[2]:loc[3]]))
+		if err != nil {
+			continue
+		}
+		end := len(content)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		body := content[loc[1]:end]
+
+		obj := &pdfObject{num: num, offset: loc[0], value: body}
+		if s := pdfStreamStart.FindIndex(body); s != nil && !bytes.Contains(body[:s[0]], []byte("endobj")) {
+			obj.value = body[:s[0]]
+			if e := bytes.Index(body[s[1]:], []byte("endstream")); e >= 0 {
+				obj.stream = body[s[1] : s[1]+e]
+			}
+		} else if e := bytes.Index(body, []byte("endobj")); e >= 0 {
+			obj.value = body[:e]
+		}
+		// Objects updated later in the file replace the earlier ones.
+		doc.objects[num] = obj
+	}
+
+	for _, obj := range doc.sorted() {
+		if pdfObjStmType.Match(obj.value) {
+			doc.readObjectStream(obj)
+		}
+	}
+	return doc
+}
+
+// readObjectStream adds the objects stored in an object stream, which modern PDFs keep most of
+// their dictionaries in, to those in the file.
+func (doc *pdfDocument) readObjectStream(stream *pdfObject) {
+	data, ok := pdfStreamData(stream)
+	if !ok {
+		return
+	}
+	n, err1 := strconv.Atoi(string(pdfDictValue(stream.value, "N")))
+	first, err2 := strconv.Atoi(string(pdfDictValue(stream.value, "First")))
+	if err1 != nil || err2 != nil || first < 0 || first > len(data) {
+		return
+	}
+	header := strings.Fields(string(data[:first]))
+	for i := 0; i < n && 2*i+1 < len(header); i++ {
+		num, err1 := strconv.Atoi(header[2*i])
+		start, err2 := strconv.Atoi(header[2*i+1])
+		if err1 != nil || err2 != nil || start < 0 || first+start > len(data) {
+			continue
+		}
+		end := len(data)
+		if 2*i+3 < len(header) {
+			if next, err := strconv.Atoi(header[2*i+3]); err == nil && first+next <= len(data) && next >= start {
+				end = first + next
+			}
+		}
+		if _, ok := doc.objects[num]; !ok {
+			doc.objects[num] = &pdfObject{num: num, offset: stream.offset, value: data[first+start : end]}
+		}
+	}
+}
+
+// sorted returns the objects in the order they appear in the file, those in an object stream by
+// their numbers.
+func (doc *pdfDocument) sorted() []*pdfObject {
+	objects := make([]*pdfObject, 0, len(doc.objects))
+	for _, obj := range doc.objects {
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].offset != objects[j].offset {
+			return objects[i].offset < objects[j].offset
+		}
+		return objects[i].num < objects[j].num
+	})
+	return objects
+}
+
+// object returns the object with a number, or nil if there is none.
+func (doc *pdfDocument) object(num []byte) *pdfObject {
+	n, err := strconv.Atoi(string(num))
+	if err != nil {
+		return nil
+	}
+	return doc.objects[n]
+}
+
+// resolve returns the value that a value refers to, if it is a reference to another object.
+func (doc *pdfDocument) resolve(value []byte) []byte {
+	if m := pdfReference.FindSubmatch(value); m != nil && bytes.HasPrefix(bytes.TrimSpace(value), m[0]) {
+		if obj := doc.object(m[1]); obj != nil {
+			return obj.value
+		}
+		return nil
+	}
+	return value
+}
+
+// pages returns the page objects, in the order they appear in the file, which is usually the order
+// of the pages.
+func (doc *pdfDocument) pages() []*pdfObject {
+	var pages []*pdfObject
+	for _, obj := range doc.sorted() {
+		if pdfPageType.Match(obj.value) {
+			pages = append(pages, obj)
+		}
+	}
+	return pages
+}
+
+// contents returns the content streams of a page, which its /Contents gives as a stream or an
+// array of them, which may itself be another object.
+func (doc *pdfDocument) contents(page []byte) []*pdfObject {
+	var streams []*pdfObject
+	for _, ref := range pdfReference.FindAllSubmatch(pdfDictValue(page, "Contents"), -1) {
+		obj := doc.object(ref[1])
+		switch {
+		case obj == nil:
+		case obj.stream != nil:
+			streams = append(streams, obj)
+		default:
+			for _, ref := range pdfReference.FindAllSubmatch(obj.value, -1) {
+				if obj := doc.object(ref[1]); obj != nil && obj.stream != nil {
+					streams = append(streams, obj)
+				}
+			}
+		}
+	}
+	return streams
+}
+
+// resourceFonts returns the ToUnicode maps of the fonts a page or Form XObject uses, by their
+// resource names, from its resources or those a page inherits from its parents.
+func (doc *pdfDocument) resourceFonts(page *pdfObject) map[string]*pdfCMap {
+	value := page.value
+	var resources []byte
+	for i := 0; i < maxPDFPageDepth && value != nil; i++ {
+		if resources = doc.resolve(pdfDictValue(value, "Resources")); resources != nil {
+			break
+		}
+		value = doc.resolve(pdfDictValue(value, "Parent"))
+	}
+
+	fonts := make(map[string]*pdfCMap)
+	for _, entry := range pdfFontEntry.FindAllSubmatch(doc.resolve(pdfDictValue(resources, "Font")), -1) {
+		num, err := strconv.Atoi(string(entry[2]))
+		if err != nil {
+			continue
+		}
+		cmap, ok := doc.fonts[num]
+		if !ok {
+			if font := doc.objects[num]; font != nil {
+				if m := pdfReference.FindSubmatch(pdfDictValue(font.value, "ToUnicode")); m != nil {
+					if obj := doc.object(m[1]); obj != nil {
+						if data, ok := pdfStreamData(obj); ok {
+							cmap = parsePDFCMap(data)
+						}
+					}
+				}
+			}
+			doc.fonts[num] = cmap
+		}
+		if cmap != nil {
+			fonts[string(entry[1])] = cmap
+		}
+	}
+	return fonts
+}
+
+// pdfStreamData returns the content of the stream of an object, inflated if it is Flate
+// compressed. It reports false for objects without streams and streams with other filters, such as
+// images.
+func pdfStreamData(obj *pdfObject) ([]byte, bool) {
+	if obj.stream == nil {
+		return nil, false
+	}
+	switch {
+	case bytes.Contains(obj.value, []byte("/FlateDecode")):
+		r, err := zlib.NewReader(bytes.NewReader(obj.stream))
+		if err != nil {
+			return nil, false
+		}
+		// Streams are often cut short of their checksum, so take what inflates.
+		data, _ := io.ReadAll(io.LimitReader(r, maxPDFStreamSize))
+		return data, true
+	case bytes.Contains(obj.value, []byte("/Filter")):
+		return nil, false
+	}
+	return obj.stream, true
+}
+
+// pdfContentText writes the text shown by the text operators in a content stream to b, decoded
+// with the ToUnicode maps of the fonts the page uses.
+func pdfContentText(b *strings.Builder, data []byte, fonts map[string]*pdfCMap) {
+	if !bytes.Contains(data, []byte("BT")) {
+		return
+	}
+	var font *pdfCMap
+	for _, m := range pdfTextOperator.FindAllSubmatch(data, -1) {
+		if m[1] != nil {
+			font = fonts[string(m[1])]
+			continue
+		}
+		for _, part := range pdfTextPart.FindAll(m[2], -1) {
+			switch part[0] {
+			case '(':
+				b.WriteString(font.decode(pdfUnescape(part[1 : len(part)-1])))
+			case '<':
+				b.WriteString(font.decode(pdfHex(part[1 : len(part)-1])))
+			default:
+				if n, err := strconv.ParseFloat(string(part), 64); err == nil && n < -pdfSpaceAdjustment {
+					b.WriteByte(' ')
+				}
+			}
+		}
+		b.WriteByte(' ')
+	}
+	b.WriteByte('\n')
+}
+
+// pdfDictValue returns the value of a key in a PDF dictionary, or nil if it has none: a nested
+// dictionary or array with its delimiters, a reference such as "12 0 R", or a single token.
+func pdfDictValue(dict []byte, key string) []byte {
+	name := []byte("/" + key)
+	for i := 0; ; {
+		j := bytes.Index(dict[i:], name)
+		if j < 0 {
+			return nil
+		}
+		i += j + len(name)
+		// Make sure this is the whole name, not the start of a longer one.
+		if i < len(dict) && !bytes.ContainsAny(dict[i:i+1], " \t\r\n/<[(") {
+			continue
+		}
+		value := bytes.TrimLeft(dict[i:], " \t\r\n")
+		if len(value) == 0 {
+			return nil
+		}
+		switch {
+		case bytes.HasPrefix(value, []byte("<<")):
+			return pdfBalanced(value, "<<", ">>")
+		case bytes.HasPrefix(value, []byte("[")):
+			return pdfBalanced(value, "[", "]")
+		}
+		if m := pdfReference.Find(value); m != nil && bytes.HasPrefix(value, m) {
+			return m
+		}
+		end := 1
+		for end < len(value) && !bytes.ContainsAny(value[end:end+1], " \t\r\n/<>[]()") {
+			end++
+		}
+		return value[:end]
+	}
+}
+
+// pdfBalanced returns the start of value up to the close that matches the open it starts with.
+func pdfBalanced(value []byte, open, close string) []byte {
+	depth := 0
+	for i := 0; i < len(value); {
+		switch {
+		case bytes.HasPrefix(value[i:], []byte(open)):
+			depth++
+			i += len(open)
+		case bytes.HasPrefix(value[i:], []byte(close)):
+			depth--
+			i += len(close)
+			if depth == 0 {
+				return value[:i]
+			}
+		default:
+			i++
+		}
+	}
+	return value
+}
+
+// pdfCMap is a ToUnicode map, from the codes of a font to the text they show.
+type pdfCMap struct {
+	// Bytes in each code: 1 for simple fonts and usually 2 for CID fonts.
+	codeLen int
+	text    map[uint32]string
+}
+
+// parsePDFCMap reads the bfchar and bfrange mappings of a ToUnicode CMap.
+func parsePDFCMap(data []byte) *pdfCMap {
+	cmap := &pdfCMap{text: make(map[uint32]string)}
+	code := func(hex []byte) uint32 {
+		c := pdfHex(hex)
+		if cmap.codeLen == 0 {
+			cmap.codeLen = len(c)
+		}
+		var n uint32
+		for _, b := range c {
+			n = n<<8 | uint32(b)
+		}
+		return n
+	}
+
+	for _, section := range pdfCMapChars.FindAllSubmatch(data, -1) {
+		hex := pdfHexString.FindAllSubmatch(section[1], -1)
+		for i := 0; i+1 < len(hex); i += 2 {
+			cmap.text[code(hex[i][1])] = pdfUTF16(pdfHex(hex[i+1][1]))
+		}
+	}
+	for _, section := range pdfCMapRange.FindAllSubmatch(data, -1) {
+		for _, entry := range pdfCMapRangeEntry.FindAllSubmatch(section[1], -1) {
+			lo, hi := code(entry[1]), code(entry[2])
+			if hi < lo || hi-lo > 0xffff {
+				continue
+			}
+			if entry[3][0] == '[' {
+				for i, hex := range pdfHexString.FindAllSubmatch(entry[3], -1) {
+					if c := lo + uint32(i); c <= hi {
+						cmap.text[c] = pdfUTF16(pdfHex(hex[1]))
+					}
+				}
+				continue
+			}
+			// The text of each code after the first is that of the one before with its last
+			// character moved on by one.
+			units := pdfUTF16Units(pdfHex(entry[3][1 : len(entry[3])-1]))
+			if len(units) == 0 {
+				continue
+			}
+			for c := lo; ; c++ {
+				cmap.text[c] = string(utf16.Decode(units))
+				units[len(units)-1]++
+				if c == hi {
+					break
+				}
+			}
+		}
+	}
+
+	if len(cmap.text) == 0 {
+		return nil
+	}
+	if cmap.codeLen == 0 {
+		cmap.codeLen = 1
+	}
+	return cmap
+}
+
+// decode returns the text of a string shown in a font with the ToUnicode map cmap. Without one,
+// the bytes of the string are taken to be Latin-1, which is close enough to the encodings of most
+// simple fonts.
+func (cmap *pdfCMap) decode(s []byte) string {
+	var b strings.Builder
+	if cmap == nil {
+		for _, c := range s {
+			if c < ' ' {
+				c = ' '
+			}
+			b.WriteRune(rune(c))
+		}
+		return b.String()
+	}
+	for i := 0; i+cmap.codeLen <= len(s); i += cmap.codeLen {
+		var code uint32
+		for _, c := range s[i : i+cmap.codeLen] {
+			code = code<<8 | uint32(c)
+		}
+		b.WriteString(cmap.text[code])
+	}
+	return b.String()
+}
+
+// pdfHex decodes the digits of a PDF hexadecimal string, ignoring white space. A missing last
+// digit is taken to be 0.
+func pdfHex(digits []byte) []byte {
+	var s []byte
+	var hi byte
+	half := false
+	for _, d := range digits {
+		var v byte
+		switch {
+		case '0' <= d && d <= '9':
+			v = d - '0'
+		case 'a' <= d && d <= 'f':
+			v = d - 'a' + 10
+		case 'A' <= d && d <= 'F':
+			v = d - 'A' + 10
+		default:
+			continue
+		}
+		if half {
+			s = append(s, hi<<4|v)
+		} else {
+			hi = v
+		}
+		half = !half
+	}
+	if half {
+		s = append(s, hi<<4)
+	}
+	return s
+}
+
+func pdfUTF16Units(s []byte) []uint16 {
+	units := make([]uint16, 0, len(s)/2)
+	for i := 0; i+1 < len(s); i += 2 {
+		units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+	}
+	return units
+}
+
+// pdfUTF16 decodes the big-endian UTF-16 text that ToUnicode maps give.
+func pdfUTF16(s []byte) string {
+	return string(utf16.Decode(pdfUTF16Units(s)))
+}
+
+// pdfUnescape decodes the escapes in a PDF literal string.
+func pdfUnescape(s []byte) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b = append(b, c)
+			continue
+		}
+		i++
+		switch c = s[i]; c {
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := 0
+			for j := 0; j < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; j++ {
+				n = n*8 + int(s[i]-'0')
+				i++
+			}
+			i--
+			b = append(b, byte(n))
+		case '\r', '\n':
+			// A line continuation.
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// pdfStream returns a stream object, Flate compressed if compress is set.
+func pdfStream(num int, dict string, data string, compress bool) string {
+	if compress {
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		w.Write([]byte(data))
+		w.Close()
+		data = b.String()
+		dict += " /Filter /FlateDecode"
+	}
+	return fmt.Sprintf("%d 0 obj\n<< %s /Length %d >>\nstream\n%s\nendstream\nendobj\n", num, dict, len(data), data)
+}
+
+func pdfObj(num int, value string) string {
+	return fmt.Sprintf("%d 0 obj\n%s\nendobj\n", num, value)
+}
+
+const testCMap = `/CIDInit /ProcSet findresource begin
+begincmap
+1 begincodespacerange <0000> <FFFF> endcodespacerange
+2 beginbfchar
+<0001> <0048>
+<0002> <0069>
+endbfchar
+2 beginbfrange
+<0003> <0004> <00E9>
+<0010> <0011> [<0074> <0077>]
+endbfrange
+endcmap`
+
+func TestPDFText(t *testing.T) {
+	tests := []struct {
+		name string
+		pdf  string
+		want string
+	}{
+		{
+			"literal strings",
+			pdfObj(1, "<< /Type /Page /Contents 2 0 R >>") +
+				pdfStream(2, "", `BT /F1 12 Tf (Problem Set 3 \(hints\)) Tj 0 -14 Td [(Due) -250 (Fri)16(day)] TJ ET`, false),
+			"Problem Set 3 (hints) Due Friday",
+		},
+		{
+			"compressed content in several streams",
+			pdfObj(1, "<< /Type /Page /Contents [2 0 R 3 0 R] >>") +
+				pdfStream(2, "", `BT (Lecture) Tj ET`, true) +
+				pdfStream(3, "", `BT <4E6F74657320> Tj ET`, true),
+			"Lecture Notes",
+		},
+		{
+			// A CID font, defined in an object stream and inherited from the page tree, whose
+			// codes are two bytes long and only its ToUnicode map says what they are.
+			"CID font with a ToUnicode map",
+			pdfObj(1, "<< /Type /Pages /Kids [2 0 R] /Count 1 /Resources << /Font << /F1 4 0 R >> >> >>") +
+				pdfObj(2, "<< /Type /Page /Parent 1 0 R /Contents 3 0 R >>") +
+				pdfStream(3, "", `BT /F1 12 Tf [<00010002> -300 <0003 0004>] TJ <00100011> Tj ET`, true) +
+				pdfStream(5, "", testCMap, true) +
+				pdfStream(6, "/Type /ObjStm /N 1 /First 4",
+					"4 0 << /Type /Font /Subtype /Type0 /BaseFont /ABCDEF+Calibri /Encoding /Identity-H /ToUnicode 5 0 R >>", true),
+			"Hi éê tw",
+		},
+		{
+			"text in a Form XObject",
+			pdfObj(1, "<< /Type /Page /Contents 2 0 R >>") +
+				pdfStream(2, "", `q /Fm1 Do Q`, false) +
+				pdfStream(3, "/Type /XObject /Subtype /Form /Resources << /Font << /F1 4 0 R >> >>", `BT /F1 10 Tf <0001 0002> Tj ET`, false) +
+				pdfObj(4, "<< /Type /Font /Subtype /Type0 /ToUnicode 5 0 R >>") +
+				pdfStream(5, "", testCMap, false),
+			"Hi",
+		},
+		{
+			"no pages",
+			pdfStream(1, "", `BT (Syllabus) Tj ET`, true),
+			"Syllabus",
+		},
+		{
+			"images are skipped",
+			pdfObj(1, "<< /Type /Page /Contents 2 0 R >>") +
+				pdfStream(2, "/Filter /DCTDecode", `BT (not text) Tj ET`, false),
+			"",
+		},
+	}
+	for _, test := range tests {
+		text := pdfText([]byte("%PDF-1.7\n" + test.pdf + "trailer\n<< /Root 1 0 R >>\n%%EOF\n"))
+		if got := strings.Join(strings.Fields(text), " "); got != test.want {
+			t.Errorf("%s: got text %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// TestPDFTextMalformed checks that damaged PDFs give what text can be read rather than a panic.
+func TestPDFTextMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		pdf  string
+	}{
+		{
+			"negative /First in an object stream",
+			pdfObj(1, "<< /Type /Page /Contents 2 0 R >>") +
+				pdfStream(3, "/Type /ObjStm /N 1 /First -4", "4 0 << /Type /Font >>", true),
+		},
+		{
+			"negative offset in an object stream",
+			pdfObj(1, "<< /Type /Page /Contents 2 0 R >>") +
+				pdfStream(3, "/Type /ObjStm /N 2 /First 10", "4 -3 5 -9 << /Type /Font >>", true),
+		},
+		{
+			"key at the end of a dictionary",
+			pdfObj(1, "<< /Type /Page /Contents"),
+		},
+		{
+			"ToUnicode range ending at the last code",
+			pdfObj(1, "<< /Type /Page /Resources << /Font << /F1 2 0 R >> >> /Contents 4 0 R >>") +
+				pdfObj(2, "<< /Type /Font /ToUnicode 3 0 R >>") +
+				pdfStream(3, "", "1 beginbfrange <FFFFFFFE> <FFFFFFFF> <0041> endbfrange", false) +
+				pdfStream(4, "", "BT /F1 12 Tf <FFFFFFFF> Tj ET", false),
+		},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: pdfText panicked: %v", test.name, r)
+				}
+			}()
+			pdfText([]byte("%PDF-1.7\n" + test.pdf + "%%EOF\n"))
+		}()
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Number of recent errors kept by a Pipeline for debugging.
+const pipelineErrorHistory = 10
+
+// Pipeline records what a sync is doing so that its state can be dumped when diagnosing a hang.
+type Pipeline struct {
+	StartedAt time.Time
+	// Pauser, if not nil, pauses the downloads of the sync.
+	Pauser *Pauser
+
+	CoursesListed atomic.Int64
+	TreesBuilt    atomic.Int64
+	FilesDone     atomic.Int64
+	// Summary of the sync, set once it has finished without a fatal error.
+	Summary *SummaryEvent
+
+	// Time of the last sign of progress, in Unix nanoseconds.
+	lastProgress atomic.Int64
+
+	mu         sync.Mutex
+	inFlight   map[string]*inFlightDownload
+	lastErrors []pipelineError
+}
+
+type inFlightDownload struct {
+	startedAt time.Time
+	// Bytes downloaded so far.
+	bytes int64
+}
+
+type pipelineError struct {
+	at  time.Time
+	err error
+}
+
+func NewPipeline() *Pipeline {
+	p := &Pipeline{
+		StartedAt: time.Now(),
+		inFlight:  make(map[string]*inFlightDownload),
+	}
+	p.Progress()
+	return p
+}
+
+// Progress records that the sync is still getting somewhere.
+func (p *Pipeline) Progress() {
+	p.lastProgress.Store(time.Now().UnixNano())
+}
+
+// LastProgress returns when Progress was last called.
+func (p *Pipeline) LastProgress() time.Time {
+	return time.Unix(0, p.lastProgress.Load())
+}
+
+// progressWriter is an io.Writer that records progress on a pipeline for every write to the file
+// being downloaded to path.
+type progressWriter struct {
+	pipeline *Pipeline
+	path     string
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.pipeline.Progress()
+
+	w.pipeline.mu.Lock()
+	if download, ok := w.pipeline.inFlight[w.path]; ok {
+		download.bytes += int64(len(b))
+	}
+	w.pipeline.mu.Unlock()
+
+	return len(b), nil
+}
+
+func (p *Pipeline) StartDownload(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight[path] = &inFlightDownload{startedAt: time.Now()}
+}
+
+// InFlightBytes returns the number of bytes downloaded so far by the downloads in flight.
+func (p *Pipeline) InFlightBytes() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var bytes int64
+	for _, download := range p.inFlight {
+		bytes += download.bytes
+	}
+	return bytes
+}
+
+// FinishDownload records that the download of the file at path has ended, successfully if err is
+// nil.
+func (p *Pipeline) FinishDownload(path string, err error) {
+	p.FilesDone.Add(1)
+	p.Progress()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inFlight, path)
+	if err != nil && !errors.Is(err, errNotModified) {
+		p.lastErrors = append(p.lastErrors, pipelineError{at: time.Now(), err: err})
+		if len(p.lastErrors) > pipelineErrorHistory {
+			p.lastErrors = p.lastErrors[1:]
+		}
+	}
+}
+
+// InFlight returns the paths of the files being downloaded, in the order they started.
+func (p *Pipeline) InFlight() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.inFlightPaths()
+}
+
+func (p *Pipeline) inFlightPaths() []string {
+	paths := make([]string, 0, len(p.inFlight))
+	for path := range p.inFlight {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return p.inFlight[paths[i]].startedAt.Before(p.inFlight[paths[j]].startedAt) })
+	return paths
+}
+
+// Dump writes a human readable description of the state of the pipeline.
+func (p *Pipeline) Dump(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintf(w, "sync running for %s, last progress %s ago\n", time.Since(p.StartedAt).Round(time.Second), time.Since(p.LastProgress()).Round(time.Second))
+	fmt.Fprintf(w, "  courses: %d listed, %d trees built\n", p.CoursesListed.Load(), p.TreesBuilt.Load())
+	fmt.Fprintf(w, "  files: %d done, %d in flight\n", p.FilesDone.Load(), len(p.inFlight))
+	if p.Pauser.Paused() {
+		fmt.Fprintf(w, "  downloads paused\n")
+	}
+
+	for _, path := range p.inFlightPaths() {
+		download := p.inFlight[path]
+		fmt.Fprintf(w, "    %s (%s, %s)\n", path, time.Since(download.startedAt).Round(time.Second), humanize.Bytes(uint64(download.bytes)))
+	}
+
+	if len(p.lastErrors) > 0 {
+		fmt.Fprintf(w, "  last errors:\n")
+		for _, e := range p.lastErrors {
+			fmt.Fprintf(w, "    %s %s\n", e.at.Format("15:04:05"), e.err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/term"
+)
+
+// How often the progress bar is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// How often a line of progress is written when the progress bar is not drawn.
+const plainProgressInterval = 30 * time.Second
+
+// Values of the --progress flag.
+const (
+	progressAuto   = "auto"
+	progressAlways = "always"
+	progressNever  = "never"
+)
+
+// useProgressBar reports whether to draw a progress bar, rather than lines of plain text, for the
+// --progress flag. By default the bar is only drawn if standard error is a terminal, as its
+// escape codes make a mess of logs.
+func useProgressBar(mode string) (bool, error) {
+	switch mode {
+	case "", progressAuto:
+		return term.IsTerminal(int(os.Stderr.Fd())), nil
+	case progressAlways:
+		return true, nil
+	case progressNever:
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid --progress %q: must be %q, %q or %q", mode, progressAuto, progressAlways, progressNever)
+	}
+}
+
+// SyncProgress shows how many bytes a sync has downloaded out of the total size of the files it
+// has found to download so far, together with the throughput, the time remaining and the number
+// of files. The total grows as courses are listed.
+//
+// The progress bar is only ever touched by one goroutine, which redraws it from the counts. If
+// there is no bar, the same information is written as a line of plain text every so often instead.
+type SyncProgress struct {
+	bar         *progressbar.ProgressBar
+	plain       io.Writer
+	pipeline    *Pipeline
+	description string
+
+	filesFound atomic.Int64
+	filesDone  atomic.Int64
+	bytesFound atomic.Int64
+	// Total size of the files that have been dealt with, whether or not they were downloaded.
+	bytesDone atomic.Int64
+
+	lastDescription string
+
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSyncProgress starts drawing a progress bar to w, or if bar is false, writing lines of
+// progress to it. Stop must be called once the sync is over.
+func NewSyncProgress(w io.Writer, description string, pipeline *Pipeline, bar bool) *SyncProgress {
+	if !bar {
+		p := &SyncProgress{
+			plain:       w,
+			pipeline:    pipeline,
+			description: description,
+			stop:        make(chan struct{}),
+			stopped:     make(chan struct{}),
+		}
+		go p.run()
+		return p
+	}
+
+	p := &SyncProgress{
+		bar: progressbar.NewOptions64(
+			1,
+			progressbar.OptionSetDescription(description),
+			progressbar.OptionSetWriter(w),
+			progressbar.OptionThrottle(20*time.Millisecond),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionShowCount(),
+			progressbar.OptionSetPredictTime(true),
+			progressbar.OptionFullWidth(),
+			progressbar.OptionUseANSICodes(true),
+		),
+		pipeline:    pipeline,
+		description: description,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	p.bar.RenderBlank()
+
+	go p.run()
+	return p
+}
+
+// HandleEvent is the subscriber that counts the files found and dealt with.
+func (p *SyncProgress) HandleEvent(event SyncEvent) {
+	switch e := event.(type) {
+	case FileDiscovered:
+		p.Found(e.File)
+	case DownloadFinished:
+		p.Done(e.File)
+	}
+}
+
+// Found records that a file has been found that needs to be downloaded.
+func (p *SyncProgress) Found(file FileToSync) {
+	p.filesFound.Add(1)
+	p.bytesFound.Add(file.File.Size)
+}
+
+// Done records that a file that was found has been dealt with.
+func (p *SyncProgress) Done(file FileToSync) {
+	p.filesDone.Add(1)
+	p.bytesDone.Add(file.File.Size)
+}
+
+func (p *SyncProgress) run() {
+	defer close(p.stopped)
+
+	interval := progressInterval
+	if p.plain != nil {
+		interval = plainProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if p.plain != nil {
+				p.writeLine()
+			} else {
+				p.update()
+			}
+		}
+	}
+}
+
+func (p *SyncProgress) writeLine() {
+	done := p.bytesDone.Load() + p.pipeline.InFlightBytes()
+	total := p.bytesFound.Load()
+	if done > total {
+		done = total
+	}
+
+	line := fmt.Sprintf("%s: %d/%d files, %s/%s", p.description, p.filesDone.Load(), p.filesFound.Load(), humanize.Bytes(uint64(done)), humanize.Bytes(uint64(total)))
+	if line == p.lastDescription {
+		return
+	}
+	p.lastDescription = line
+
+	fmt.Fprintln(p.plain, time.Now().Format("2006/01/02 15:04:05"), line)
+}
+
+func (p *SyncProgress) update() {
+	// The bar needs a maximum above zero.
+	total := p.bytesFound.Load()
+	if total < 1 {
+		total = 1
+	}
+	if total != p.bar.GetMax64() {
+		p.bar.ChangeMax64(total)
+	}
+
+	if description := fmt.Sprintf("%s (%d/%d files)", p.description, p.filesDone.Load(), p.filesFound.Load()); description != p.lastDescription {
+		p.lastDescription = description
+		p.bar.Describe(description)
+	}
+
+	done := p.bytesDone.Load() + p.pipeline.InFlightBytes()
+	if done > total {
+		done = total
+	}
+	p.bar.Set64(done)
+}
+
+// Stop stops redrawing the progress bar. It may be called more than once.
+func (p *SyncProgress) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.stopped
+}
+
+// Finish stops redrawing the progress bar and shows it as complete.
+func (p *SyncProgress) Finish() error {
+	p.Stop()
+
+	if p.plain != nil {
+		return nil
+	}
+	p.update()
+	return p.bar.Finish()
+}
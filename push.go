@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func (api *CanvasApi) MakeFoldersInFolderUrl(folderId uint64) string {
+	return fmt.Sprintf("%s/api/v1/folders/%d/folders", api.RootUrl, folderId)
+}
+
+func (api *CanvasApi) MakeFileUrl(fileId uint64) string {
+	return fmt.Sprintf("%s/api/v1/files/%d", api.RootUrl, fileId)
+}
+
+func (api *CanvasApi) MakeFolderUrl(folderId uint64) string {
+	return fmt.Sprintf("%s/api/v1/folders/%d", api.RootUrl, folderId)
+}
+
+// CreateFolder creates a folder called name in the folder parentId.
+func (canvas *CanvasApi) CreateFolder(ctx context.Context, parentId uint64, name string) (Folder, error) {
+	var folder Folder
+	err := canvas.post(ctx, canvas.MakeFoldersInFolderUrl(parentId), url.Values{"name": {name}}, &folder)
+	return folder, err
+}
+
+// DeleteFile deletes a file, which goes to the trash on Canvas.
+func (canvas *CanvasApi) DeleteFile(ctx context.Context, fileId uint64) error {
+	var file File
+	return canvas.delete(ctx, canvas.MakeFileUrl(fileId), &file)
+}
+
+// DeleteFolder deletes a folder and everything in it.
+func (canvas *CanvasApi) DeleteFolder(ctx context.Context, folderId uint64) error {
+	var folder Folder
+	return canvas.delete(ctx, canvas.MakeFolderUrl(folderId)+"?force=true", &folder)
+}
+
+// pusher makes a folder on Canvas match a local directory, for the push subcommand.
+type pusher struct {
+	api    *CanvasApi
+	view   *CanvasView
+	course *Course
+	// Delete the files and folders on Canvas that are not in the local directory.
+	delete bool
+	// Only say what would change.
+	dryRun bool
+
+	changes int
+}
+
+// change reports a change to the folder on Canvas: A for a file or folder added, M for a file
+// replaced and D for a file or folder deleted.
+func (p *pusher) change(kind byte, remotePath string) {
+	p.changes++
+	fmt.Printf("  %c %s\n", kind, remotePath)
+}
+
+// fileChanged is whether a local file differs from the file on Canvas. Canvas does not say what
+// the content of a file is, so a file has changed if its size is different or it was modified
+// after the file on Canvas was.
+func fileChanged(fi os.FileInfo, file *TreeFile) bool {
+	remoteTime := file.UpdatedAt
+	if file.ModifiedAt != nil {
+		remoteTime = *file.ModifiedAt
+	}
+	return fi.Size() != file.Size || fi.ModTime().After(remoteTime)
+}
+
+// push makes the folder on Canvas at remotePath match the local directory localDir. The folder is
+// nil if it does not exist yet, which is only the case when dryRun is set.
+func (p *pusher) push(ctx context.Context, localDir string, folder *TreeFolder, remotePath string) error {
+	entries, err := os.ReadDir(longPath(localDir))
+	if err != nil {
+		return err
+	}
+
+	var subfolders []*TreeFolder
+	var files []*TreeFile
+	if folder != nil {
+		subfolders = folder.folders
+		if files, err = p.view.Files(ctx, p.course.Id, folder); err != nil {
+			return err
+		}
+	}
+
+	local := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		// Hidden files, such as the .git directory, are not course content.
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		local[name] = true
+		localPath := filepath.Join(localDir, name)
+		entryPath := path.Join(remotePath, name)
+
+		if entry.IsDir() {
+			var sub *TreeFolder
+			for _, f := range subfolders {
+				if localName(f.Name) == name {
+					sub = f
+					break
+				}
+			}
+			if sub == nil {
+				p.change('A', entryPath+"/")
+				if !p.dryRun {
+					created, err := p.api.CreateFolder(ctx, folder.Id, name)
+					if err != nil {
+						return fmt.Errorf("cannot create %s: %w", entryPath, err)
+					}
+					sub = &TreeFolder{Folder: created}
+				}
+			}
+			if err := p.push(ctx, localPath, sub, entryPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fi, err := os.Stat(longPath(localPath))
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		var remote *TreeFile
+		for _, f := range files {
+			if localName(f.FileName) == name {
+				remote = f
+				break
+			}
+		}
+		switch {
+		case remote == nil:
+			p.change('A', entryPath)
+		case fileChanged(fi, remote):
+			p.change('M', entryPath)
+		default:
+			continue
+		}
+		if p.dryRun {
+			continue
+		}
+		dest := uploadDestination{apiCall: p.api.MakeUploadToFolderUrl(folder.Id), courseId: p.course.Id, name: remotePath}
+		if _, err := uploadLocalFile(ctx, p.api, dest, localPath, "overwrite"); err != nil {
+			return err
+		}
+	}
+
+	if !p.delete {
+		return nil
+	}
+	for _, f := range subfolders {
+		if name := localName(f.Name); !local[name] && !strings.HasPrefix(name, ".") {
+			p.change('D', path.Join(remotePath, name)+"/")
+			if !p.dryRun {
+				if err := p.api.DeleteFolder(ctx, f.Id); err != nil {
+					return fmt.Errorf("cannot delete %s: %w", path.Join(remotePath, name), err)
+				}
+			}
+		}
+	}
+	for _, f := range files {
+		if name := localName(f.FileName); !local[name] && !strings.HasPrefix(name, ".") {
+			p.change('D', path.Join(remotePath, name))
+			if !p.dryRun {
+				if err := p.api.DeleteFile(ctx, f.Id); err != nil {
+					return fmt.Errorf("cannot delete %s: %w", path.Join(remotePath, name), err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// runPush implements the push subcommand, which uploads the files in a local directory that are
+// new or have changed to a folder in a course on Canvas, creating the folders that do not exist,
+// for teachers who keep the files of a course elsewhere, such as in git.
+func runPush(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only list what would be uploaded, created and deleted")
+	del := flags.Bool("delete", false, "delete the files and folders on Canvas that are not in the local directory")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: canvas-sync push [--dry-run] [--delete] <directory> <course>[/<folder>]")
+	}
+	if opts.Offline {
+		return fmt.Errorf("--offline only works with diff, digest, quota and archive, as push needs Canvas")
+	}
+	localDir := flags.Arg(0)
+	if fi, err := os.Stat(localDir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory: use put to upload files", localDir)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+	// Pushing compares against the files on Canvas as they are now, not as they were cached.
+	ctx = withoutListingCache(ctx)
+	view := NewCanvasView(api, config, nil, "", 0)
+
+	remotePath, err := resolveRemotePath(ctx, view, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	node, err := view.lookup(ctx, remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("there is no folder at %s on Canvas: create it on Canvas first", flags.Arg(1))
+	}
+	if err != nil {
+		return err
+	}
+	if node.course == nil || node.folder == nil {
+		return fmt.Errorf("%s is not a folder in a course on Canvas", flags.Arg(1))
+	}
+
+	p := &pusher{api: api, view: view, course: node.course, delete: *del, dryRun: *dryRun}
+	if err := p.push(withCourse(ctx, node.course.Id), localDir, node.folder, remotePath); err != nil {
+		return err
+	}
+
+	switch {
+	case p.changes == 0:
+		fmt.Printf("✓ %s is already up to date with %s.\n", remotePath, localDir)
+	case *dryRun:
+		fmt.Printf("✓ %d changes would be made to %s; run again without --dry-run to make them.\n", p.changes, remotePath)
+	default:
+		fmt.Printf("✓ Made %d changes to %s.\n", p.changes, remotePath)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// uploadDestination is the folder on Canvas that put uploads files to.
+type uploadDestination struct {
+	apiCall  string
+	courseId uint64
+	// The path of the folder within the user's files, for uploads there, which creates the
+	// folders that do not exist.
+	folderPath string
+	// What the folder is called, for messages.
+	name string
+}
+
+// resolveUploadDestination finds the folder on Canvas given to put: a course directory, or a path
+// within one, as for ls, or a path within the Personal directory for the user's own files.
+func resolveUploadDestination(ctx context.Context, api *CanvasApi, view *CanvasView, arg string) (uploadDestination, error) {
+	remotePath, err := resolveRemotePath(ctx, view, arg)
+	if err != nil {
+		return uploadDestination{}, err
+	}
+
+	if first, rest, _ := strings.Cut(remotePath, "/"); first == personalDirectory {
+		return uploadDestination{apiCall: api.MakeUploadToUserUrl(), folderPath: rest, name: remotePath}, nil
+	}
+
+	node, err := view.lookup(ctx, remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return uploadDestination{}, fmt.Errorf("there is no folder at %s on Canvas: create it on Canvas first", arg)
+	}
+	if err != nil {
+		return uploadDestination{}, err
+	}
+	if node.course == nil || node.folder == nil {
+		return uploadDestination{}, fmt.Errorf("%s is not a folder in a course on Canvas", arg)
+	}
+	return uploadDestination{apiCall: api.MakeUploadToFolderUrl(node.folder.Id), courseId: node.course.Id, name: remotePath}, nil
+}
+
+// uploadLocalFile uploads the file at localPath to a folder on Canvas.
+func uploadLocalFile(ctx context.Context, api *CanvasApi, dest uploadDestination, localPath string, onDuplicate string) (File, error) {
+	f, err := os.Open(longPath(localPath))
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return File{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return File{}, fmt.Errorf("%s is not a file", localPath)
+	}
+
+	name := filepath.Base(localPath)
+	params := url.Values{"name": {name}, "on_duplicate": {onDuplicate}}
+	if contentType, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name))); err == nil {
+		params.Set("content_type", contentType)
+	}
+	if dest.folderPath != "" {
+		params.Set("parent_folder_path", dest.folderPath)
+	}
+
+	file, err := api.UploadFile(withCourse(ctx, dest.courseId), dest.apiCall, params, f, fi.Size())
+	if err != nil {
+		return File{}, fmt.Errorf("cannot upload %s: %w", localPath, err)
+	}
+	return file, nil
+}
+
+// runPut implements the put subcommand, which uploads files to a folder in a course on Canvas, or
+// to the user's own files. Files with the same name as one already in the folder replace it,
+// unless --rename is given.
+func runPut(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	rename := flags.Bool("rename", false, "if a file with the same name is already in the folder, upload under a new name rather than replacing it")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		return fmt.Errorf("usage: canvas-sync put [--rename] <file>... <course>/<folder>|%s/<folder>", personalDirectory)
+	}
+	if opts.Offline {
+		return fmt.Errorf("--offline only works with diff, digest, quota and archive, as put needs Canvas")
+	}
+	localPaths := flags.Args()[:flags.NArg()-1]
+	onDuplicate := "overwrite"
+	if *rename {
+		onDuplicate = "rename"
+	}
+
+	// Check every file before uploading any.
+	for _, localPath := range localPaths {
+		fi, err := os.Stat(localPath)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a file: only files can be uploaded", localPath)
+		}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+	view := NewCanvasView(api, config, nil, "", 0)
+
+	dest, err := resolveUploadDestination(ctx, api, view, flags.Arg(flags.NArg()-1))
+	if err != nil {
+		return err
+	}
+
+	for _, localPath := range localPaths {
+		file, err := uploadLocalFile(ctx, api, dest, localPath, onDuplicate)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Uploaded %s to %s as %s (%s).\n", localPath, dest.name, file.FileName, humanize.Bytes(uint64(file.Size)))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+)
+
+var errOverBudget = errors.New("max_total_size reached")
+
+type CourseQuota struct {
+	Quota     int64 `json:"quota"`
+	QuotaUsed int64 `json:"quota_used"`
+}
+
+// DiskBudget stops the files synced by canvas-sync from taking up more than max_total_size. It
+// starts with the size of every file in the manifest and grows as files are downloaded.
+type DiskBudget struct {
+	mu       sync.Mutex
+	max      int64
+	used     int64
+	manifest *Manifest
+}
+
+func NewDiskBudget(max int64, manifest *Manifest) *DiskBudget {
+	budget := &DiskBudget{max: max, manifest: manifest}
+	for _, entry := range manifest.Entries() {
+		budget.used += entry.Size
+	}
+	return budget
+}
+
+// Reserve makes room for a file to be downloaded, returning errOverBudget if there is not enough.
+// A file that replaces an older version only needs room for the difference in size.
+func (b *DiskBudget) Reserve(file FileToSync) error {
+	if b == nil || b.max <= 0 {
+		return nil
+	}
+
+	grow := file.File.Size
+	if entry, ok := b.manifest.Get(file.File.Id); ok {
+		grow -= entry.Size
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used+grow > b.max {
+		return errOverBudget
+	}
+	b.used += grow
+	return nil
+}
+
+// runQuota implements the quota subcommand, which lists the files in every course that would be
+// synced and reports how much they take up, how much would be downloaded and, if Canvas allows the
+// user to see it, the course's file quota.
+func runQuota(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("quota", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync quota")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+
+	finalized, err := loadFinalizedCourses()
+	if err != nil {
+		return err
+	}
+
+	courses, err := api.AllCourses(ctx)
+	if err != nil {
+		return err
+	}
+
+	rules := NewContentRules(config)
+	var totalSize, totalToDownload int64
+
+CourseLoop:
+	for _, course := range courses {
+		for _, ignoredCourseId := range config.IgnoredCourses {
+			if course.Id == ignoredCourseId {
+				continue CourseLoop
+			}
+		}
+		if _, ok := finalized[course.Id]; ok || !config.HasAnyTag(course.Id, opts.Tags) {
+			continue
+		}
+
+		var files atomic.Int64
+		var toDownload atomic.Int64
+		tree, err := BuildTree(ctx, api, course, config.SkipFoldersFor(course.Id), func(tree *CourseTree, folder *TreeFolder, parents []*TreeFolder) error {
+			folderPath := tree.LocalPath(config.Directory, folder, parents)
+			for _, file := range folder.files {
+				files.Add(1)
+				filePath, ok := rules.Route(file.File, filepath.Join(folderPath, localName(file.FileName)))
+				if !ok {
+					continue
+				}
+				needsSync, err := fileNeedsSync(file, filePath)
+				if err != nil {
+					return err
+				}
+				if needsSync {
+					toDownload.Add(file.Size)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		size := tree.Size()
+		totalSize += size
+		totalToDownload += toDownload.Load()
+
+		fmt.Printf("%s: %d files (%s), %s to download", course.Name, files.Load(), humanize.Bytes(uint64(size)), humanize.Bytes(uint64(toDownload.Load())))
+
+		quota, err := api.CourseQuota(ctx, course.Id)
+		if err == nil && quota.Quota > 0 {
+			fmt.Printf(", %s of the course's %s quota used", humanize.Bytes(uint64(quota.QuotaUsed)), humanize.Bytes(uint64(quota.Quota)))
+		} else if err != nil && !errors.Is(err, errForbidden) && !errors.Is(err, errOffline) && (!isHTTPStatus(err, 401) || isTokenRejected(err)) {
+			return err
+		}
+		fmt.Println()
+
+		if max := config.MaxCourseSize(); max > 0 && size > max {
+			fmt.Printf("  ! more than max_course_size (%s), so this course is not synced\n", humanize.Bytes(uint64(max)))
+		}
+	}
+
+	fmt.Printf("Total: %s, %s to download\n", humanize.Bytes(uint64(totalSize)), humanize.Bytes(uint64(totalToDownload)))
+	if max := config.MaxTotalSize(); max > 0 {
+		fmt.Printf("max_total_size: %s\n", humanize.Bytes(uint64(max)))
+	}
+
+	return nil
+}
+
+func isHTTPStatus(err error, statusCode int) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == statusCode
+}
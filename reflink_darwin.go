@@ -0,0 +1,17 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink creates dst as a copy of src that shares its blocks on disk, on APFS.
+func reflink(src, dst string) error {
+	if err := unix.Clonefile(src, dst, 0); err != nil {
+		return &os.PathError{Op: "clonefile", Path: dst, Err: err}
+	}
+	return nil
+}
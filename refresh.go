@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// courseIdList is a flag.Value that collects the course IDs given to a repeatable flag.
+type courseIdList []uint64
+
+func (l *courseIdList) String() string {
+	ids := make([]string, len(*l))
+	for i, id := range *l {
+		ids[i] = strconv.FormatUint(id, 10)
+	}
+	return strings.Join(ids, ",")
+}
+
+func (l *courseIdList) Set(value string) error {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid course ID %q", value)
+	}
+	*l = append(*l, id)
+	return nil
+}
+
+// Refresh decides which files are downloaded again even though the local copies look up-to-date,
+// for when they have been corrupted or changed locally. The methods of a nil Refresh report that
+// no files are.
+type Refresh struct {
+	// Download every file again.
+	All bool
+	// Download the files in these courses again.
+	Courses []uint64
+	// Download the files at or under these paths again.
+	Paths []string
+}
+
+// NewRefresh makes a Refresh from the command line options, with paths relative to the sync
+// directory. It returns nil if nothing is to be downloaded again.
+func NewRefresh(opts *Options, config *Config) *Refresh {
+	if !opts.Force && len(opts.Refresh) == 0 && len(opts.RefreshPaths) == 0 {
+		return nil
+	}
+
+	refresh := &Refresh{All: opts.Force, Courses: opts.Refresh}
+	for _, path := range opts.RefreshPaths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.Directory, path)
+		}
+		refresh.Paths = append(refresh.Paths, filepath.Clean(path))
+	}
+	return refresh
+}
+
+// Wants reports whether the file at path in a course is to be downloaded again.
+func (r *Refresh) Wants(courseId uint64, path string) bool {
+	if r == nil {
+		return false
+	}
+	if r.All {
+		return true
+	}
+
+	for _, id := range r.Courses {
+		if id == courseId {
+			return true
+		}
+	}
+	for _, p := range r.Paths {
+		if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+type refreshContextKey struct{}
+
+// withRefresh records in the context the files that the sync downloads again.
+func withRefresh(ctx context.Context, refresh *Refresh) context.Context {
+	return context.WithValue(ctx, refreshContextKey{}, refresh)
+}
+
+func refreshFromContext(ctx context.Context) *Refresh {
+	refresh, _ := ctx.Value(refreshContextKey{}).(*Refresh)
+	return refresh
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	retryStateFile = "retry.json"
+
+	// Number of times to try downloading a file in a single run before giving up on it until a
+	// later run.
+	downloadAttempts = 3
+
+	retryBackoff    = 15 * time.Minute
+	maxRetryBackoff = 24 * time.Hour
+)
+
+var (
+	// The file failed to download and has been added to the retry queue.
+	errParked = errors.New("download failed, will retry on a later run")
+	// The file is in the retry queue and is not due to be tried again yet.
+	errDeferred = errors.New("download deferred until a later run")
+)
+
+// parkedError is returned for a file that failed to download and has been added to the retry
+// queue. It matches errParked and wraps the error from the last attempt.
+type parkedError struct {
+	err error
+}
+
+func (e *parkedError) Error() string {
+	return fmt.Sprintf("%s: %s", errParked, e.err)
+}
+
+func (e *parkedError) Is(target error) bool {
+	return target == errParked
+}
+
+func (e *parkedError) Unwrap() error {
+	return e.err
+}
+
+type RetryEntry struct {
+	File      FileToSync `json:"file"`
+	Attempts  int        `json:"attempts"`
+	NextTry   time.Time  `json:"next_try"`
+	LastError string     `json:"last_error"`
+}
+
+// RetryQueue records files that repeatedly failed to download so that they are retried on later
+// runs, backing off exponentially, instead of failing every sync.
+type RetryQueue struct {
+	mu      sync.Mutex
+	entries map[uint64]*RetryEntry
+}
+
+func LoadRetryQueue() (*RetryQueue, error) {
+	entries := make(map[uint64]*RetryEntry)
+	if err := loadState(retryStateFile, &entries); err != nil {
+		return nil, err
+	}
+
+	return &RetryQueue{entries: entries}, nil
+}
+
+func (q *RetryQueue) Save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return saveState(retryStateFile, q.entries)
+}
+
+// Deferred reports whether the file is in the queue and not yet due to be retried.
+func (q *RetryQueue) Deferred(fileId uint64, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, ok := q.entries[fileId]
+	return ok && now.Before(entry.NextTry)
+}
+
+// Park adds a file that failed to download to the queue, or updates it if it is already there.
+func (q *RetryQueue) Park(file FileToSync, err error, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, ok := q.entries[file.File.Id]
+	if !ok {
+		entry = &RetryEntry{}
+		q.entries[file.File.Id] = entry
+	}
+
+	entry.File = file
+	entry.Attempts++
+	entry.LastError = err.Error()
+
+	backoff := retryBackoff << (entry.Attempts - 1)
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	entry.NextTry = now.Add(backoff)
+}
+
+func (q *RetryQueue) Remove(fileId uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.entries, fileId)
+}
+
+// Entries returns the files in the queue, ordered by when they are next due to be retried.
+func (q *RetryQueue) Entries() []RetryEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := make([]RetryEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].NextTry.Before(entries[j].NextTry) })
+	return entries
+}
+
+// sleepContext pauses for the duration or until the context is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// runStatus implements the status subcommand.
+func runStatus(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: canvas-sync status")
+	}
+
+	retries, err := LoadRetryQueue()
+	if err != nil {
+		return err
+	}
+
+	entries := retries.Entries()
+	if len(entries) == 0 {
+		fmt.Println("✓ No downloads waiting to be retried.")
+		return nil
+	}
+
+	fmt.Printf("%d downloads waiting to be retried:\n", len(entries))
+	now := time.Now()
+	for _, entry := range entries {
+		next := "next sync"
+		if now.Before(entry.NextTry) {
+			next = humanize.Time(entry.NextTry)
+		}
+		fmt.Printf("  %s\n    failed on %d runs, retry %s: %s\n", entry.File.Path, entry.Attempts, next, entry.LastError)
+	}
+
+	return nil
+}
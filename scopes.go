@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The scopes, as named on Canvas, that an access token needs to sync files. Institutions can give
+// out tokens limited to some scopes, and a token without these can do little more than look up its
+// own user.
+var requiredScopes = []string{
+	"url:GET|/api/v1/users/:id",
+	"url:GET|/api/v1/courses",
+	"url:GET|/api/v1/courses/:course_id/folders",
+	"url:GET|/api/v1/folders/:id/files",
+	"url:GET|/api/v1/users/:user_id/groups",
+}
+
+// ScopeError is returned when Canvas accepts the access token but it is not allowed to make an
+// API call because it is limited to some scopes.
+type ScopeError struct {
+	*HTTPError
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("the access token is limited to scopes that do not allow %s: ask for a token, or a developer key, with at least the scopes %s",
+		redactUrl(e.Url), strings.Join(requiredScopes, ", "))
+}
+
+func (e *ScopeError) Unwrap() error {
+	return e.HTTPError
+}
+
+// isInsufficientScope reports whether Canvas refused an API call because of the scopes of the
+// access token, which it says with a 401 response rather than a 403.
+func isInsufficientScope(httpErr *HTTPError) bool {
+	return httpErr.StatusCode == http.StatusUnauthorized && strings.Contains(strings.ToLower(httpErr.Message), "insufficient scopes")
+}
+
+// checkTokenScopes checks that the access token can make the API calls needed to sync, so that a
+// token limited to other scopes stops the sync at once rather than causing errors for every
+// course. Canvas does not say which scopes a token has, so each is tried with a small API call.
+func checkTokenScopes(ctx context.Context, api *CanvasApi) error {
+	if _, err := api.Self(ctx); err != nil {
+		return scopeCheckError(err)
+	}
+
+	courses, _, err := api.Courses(ctx, firstItem(api.coursesUrls()[0]))
+	if err != nil || len(courses) == 0 {
+		return scopeCheckError(err)
+	}
+
+	folders, _, err := api.FoldersInCourse(ctx, firstItem(api.MakeFoldersInCourseUrl(courses[0].Id)))
+	if err != nil || len(folders) == 0 {
+		return scopeCheckError(err)
+	}
+
+	_, _, err = api.FilesInFolder(ctx, firstItem(api.MakeFilesInFolderUrl(folders[0].Id)))
+	return scopeCheckError(err)
+}
+
+// scopeCheckError returns the error from an API call made by checkTokenScopes if it shows that the
+// token is missing a scope or has been rejected. Other errors, such as not being allowed to see
+// the files of a course, are left for the sync to deal with.
+func scopeCheckError(err error) error {
+	var scopeErr *ScopeError
+	if errors.As(err, &scopeErr) || isTokenRejected(err) {
+		return err
+	}
+	return nil
+}
+
+// firstItem changes a listing API call to list only its first item.
+func firstItem(apiCall string) string {
+	u, err := url.Parse(apiCall)
+	if err != nil {
+		return apiCall
+	}
+	query := u.Query()
+	query.Set("per_page", "1")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+const (
+	searchIndexStateFile = "search_index.log"
+
+	// Most of a file that is read to index its text.
+	maxIndexedFileSize = 64 * 1024 * 1024
+	// Most distinct words indexed from the text of one file.
+	maxIndexedTerms = 20000
+	// Longest line of the index log, which holds the words of one file.
+	maxSearchIndexLine = 16 * 1024 * 1024
+	// Records superseded by later ones that the index log may hold, beyond as many as there are
+	// files, before it is rewritten with only the latest record of each file.
+	searchIndexSlack = 100
+)
+
+// SearchIndex records the words in the files that have been synced, so that they can be searched
+// without reading them all again. It is updated incrementally: only files that have changed since
+// they were indexed are read again.
+//
+// It is kept in a log in the state directory, each line of which is the JSON record of a file that
+// was indexed, or that was forgotten when it was no longer synced. Save appends the records of the
+// files that changed, rather than writing the words of every file again, and rewrites the log with
+// only the latest record of each file once most of its records have been superseded.
+type SearchIndex struct {
+	Files map[uint64]*IndexedFile
+
+	// The files indexed or forgotten since the index was loaded or last saved.
+	pending map[uint64]bool
+	// The number of records in the log, including those that have been superseded.
+	records int
+	// Whether the log has to be rewritten, because its last record was cut off.
+	rewrite bool
+}
+
+// IndexedFile records the words in the text of one file.
+type IndexedFile struct {
+	Path string `json:"path"`
+	// The version of the file that was indexed, as recorded in the manifest.
+	Version string `json:"version"`
+	// How many times each word appears in the text of the file.
+	Terms map[string]int `json:"terms,omitempty"`
+}
+
+// searchIndexRecord is a line of the index log.
+type searchIndexRecord struct {
+	Id uint64 `json:"id"`
+	*IndexedFile
+	// The file is no longer synced.
+	Forgotten bool `json:"forgotten,omitempty"`
+}
+
+func LoadSearchIndex() (*SearchIndex, error) {
+	index := &SearchIndex{Files: make(map[uint64]*IndexedFile), pending: make(map[uint64]bool)}
+
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, searchIndexStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxSearchIndexLine)
+	for scanner.Scan() {
+		var record searchIndexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// The last line may be cut off if canvas-sync was killed while writing it.
+			index.rewrite = true
+			continue
+		}
+		index.records++
+		if record.Forgotten || record.IndexedFile == nil {
+			delete(index.Files, record.Id)
+		} else {
+			index.Files[record.Id] = record.IndexedFile
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", searchIndexStateFile, err)
+	}
+	return index, nil
+}
+
+// Update indexes the files in the manifest that are new or have changed since they were last
+// indexed, and forgets those no longer in it. It returns how many files were indexed.
+func (index *SearchIndex) Update(entries map[uint64]ManifestEntry) int {
+	for fileId := range index.Files {
+		if _, ok := entries[fileId]; !ok {
+			delete(index.Files, fileId)
+			index.pending[fileId] = true
+		}
+	}
+
+	indexed := 0
+	for fileId, entry := range entries {
+		version := fileVersion(entry)
+		if f, ok := index.Files[fileId]; ok && f.Path == entry.Path && f.Version == version {
+			continue
+		}
+
+		text, err := fileText(entry.Path)
+		if err != nil {
+			logDebugf("Cannot index the text of %s: %s", entry.Path, err)
+		}
+		index.Files[fileId] = &IndexedFile{Path: entry.Path, Version: version, Terms: countTerms(text)}
+		index.pending[fileId] = true
+		indexed++
+	}
+	return indexed
+}
+
+// Save appends the records of the files indexed or forgotten since the index was loaded to the
+// index log, or rewrites the log if it holds too many records that have been superseded.
+func (index *SearchIndex) Save() error {
+	if index == nil || (len(index.pending) == 0 && !index.rewrite) {
+		return nil
+	}
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, searchIndexStateFile)
+
+	rewrite := index.rewrite || index.records+len(index.pending) > 2*len(index.Files)+searchIndexSlack
+	ids := make([]uint64, 0, len(index.pending))
+	if rewrite {
+		for fileId := range index.Files {
+			ids = append(ids, fileId)
+		}
+	} else {
+		for fileId := range index.pending {
+			ids = append(ids, fileId)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var b bytes.Buffer
+	for _, fileId := range ids {
+		record := searchIndexRecord{Id: fileId, IndexedFile: index.Files[fileId]}
+		record.Forgotten = record.IndexedFile == nil
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+
+	if rewrite {
+		if err := atomicFile.WriteFile(path, &b); err != nil {
+			return fmt.Errorf("cannot write %s: %w", searchIndexStateFile, err)
+		}
+		index.records = len(ids)
+	} else {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		// The records are written at once, so that those of a search running at the same time as
+		// a sync are not mixed up with the sync's.
+		_, err = f.Write(b.Bytes())
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write %s: %w", searchIndexStateFile, err)
+		}
+		index.records += len(ids)
+	}
+
+	index.pending = make(map[uint64]bool)
+	index.rewrite = false
+	return nil
+}
+
+type SearchResult struct {
+	Path  string
+	Score float64
+}
+
+// Search returns the files that contain every word of query, in their name, path within root or
+// text, best matches first. Words in the name or path of a file count for more than those in its
+// text.
+func (index *SearchIndex) Search(query string, root string) []SearchResult {
+	words := searchTerms(query)
+	if len(words) == 0 {
+		return nil
+	}
+
+	// Words that few files contain count for more.
+	docFreq := make(map[string]int, len(words))
+	pathTerms := make(map[uint64]map[string]int, len(index.Files))
+	for fileId, f := range index.Files {
+		path, ok := pathWithin(root, f.Path)
+		if !ok {
+			path = filepath.Base(f.Path)
+		}
+		pathTerms[fileId] = countTerms(path)
+		for _, word := range words {
+			if f.Terms[word] > 0 || pathTerms[fileId][word] > 0 {
+				docFreq[word]++
+			}
+		}
+	}
+
+	var results []SearchResult
+	for fileId, f := range index.Files {
+		score := 0.0
+		for _, word := range words {
+			inPath, inText := pathTerms[fileId][word], f.Terms[word]
+			if inPath == 0 && inText == 0 {
+				score = 0
+				break
+			}
+			idf := math.Log(1 + float64(len(index.Files))/float64(docFreq[word]))
+			score += (3*float64(inPath) + math.Log(1+float64(inText))) * idf
+		}
+		if score > 0 {
+			results = append(results, SearchResult{Path: f.Path, Score: score})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path < results[j].Path
+	})
+	return results
+}
+
+// searchTerms splits text into lower case words, the same way for files and queries.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// countTerms counts the words in text, keeping only the first maxIndexedTerms different words.
+func countTerms(text string) map[string]int {
+	terms := make(map[string]int)
+	for _, term := range searchTerms(text) {
+		if _, ok := terms[term]; ok || len(terms) < maxIndexedTerms {
+			terms[term]++
+		}
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	return terms
+}
+
+// fileText returns the text of a file that can be searched: the text of PDFs, HTML and plain text
+// files. Other files can only be found by their names. A file whose text cannot be read, such as
+// a PDF that is damaged in a way that the extractor does not expect, gives an error rather than
+// stopping the sync that indexes it.
+func fileText(path string) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("cannot read its text: %v", r)
+		}
+	}()
+
+	kind := strings.ToLower(filepath.Ext(path))
+	switch kind {
+	case ".pdf", ".html", ".htm", ".txt", ".md", ".csv", ".tex", ".rtf":
+	default:
+		return "", nil
+	}
+
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(io.LimitReader(f, maxIndexedFileSize))
+	if err != nil {
+		return "", err
+	}
+
+	switch kind {
+	case ".pdf":
+		return pdfText(content), nil
+	case ".html", ".htm":
+		return htmlToMarkdown(string(content)), nil
+	default:
+		if !utf8.Valid(content) {
+			return "", nil
+		}
+		return string(content), nil
+	}
+}
+
+// searchSnippet returns the first line of the text of a file with a word of query in it.
+func searchSnippet(path string, query string) string {
+	text, err := fileText(path)
+	if err != nil {
+		return ""
+	}
+
+	words := searchTerms(query)
+	for _, line := range strings.Split(text, "\n") {
+		lineTerms := countTerms(line)
+		for _, word := range words {
+			if lineTerms[word] > 0 {
+				line = strings.Join(strings.Fields(line), " ")
+				if utf8.RuneCountInString(line) > 100 {
+					line = string([]rune(line)[:100]) + "…"
+				}
+				return line
+			}
+		}
+	}
+	return ""
+}
+
+// updateSearchIndex brings the search index up to date with the files that have been synced.
+func updateSearchIndex(manifest *Manifest) (*SearchIndex, error) {
+	index, err := LoadSearchIndex()
+	if err != nil {
+		return nil, err
+	}
+	if n := index.Update(manifest.EntriesById()); n > 0 {
+		logDebugf("Indexed %d files for searching", n)
+	}
+	return index, index.Save()
+}
+
+// runSearch implements the search subcommand, which finds synced files by the words in their
+// names, paths and text. The search index is brought up to date first, which takes a while the
+// first time unless search_index is set, when each sync keeps it up to date.
+func runSearch(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	limit := flags.Int("limit", 20, "show at most this many files")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: canvas-sync search [--limit <n>] <words>...")
+	}
+	query := strings.Join(flags.Args(), " ")
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+
+	// A sync updates the index too, so only update it while no sync is running, and otherwise
+	// search it as it is.
+	var index *SearchIndex
+	if opts.IgnoreLock {
+		index, err = updateSearchIndex(manifest)
+	} else if lock, lockErr := AcquireSyncLock(ctx, opts.Wait); errors.Is(lockErr, errLocked) {
+		logInfof("Another canvas-sync is syncing, so files changed since the search index was last updated may be missing")
+		index, err = LoadSearchIndex()
+	} else if lockErr != nil {
+		return lockErr
+	} else {
+		defer lock.Release()
+		index, err = updateSearchIndex(manifest)
+	}
+	if err != nil {
+		return err
+	}
+
+	results := index.Search(query, config.Directory)
+	if len(results) == 0 {
+		fmt.Printf("No synced files match %q.\n", query)
+		return nil
+	}
+
+	for i, result := range results {
+		if i == *limit {
+			fmt.Printf("… and %d more files.\n", len(results)-*limit)
+			break
+		}
+		fmt.Println(config.displayPath(result.Path))
+		if snippet := searchSnippet(result.Path, query); snippet != "" {
+			fmt.Printf("    %s\n", snippet)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTempConfigDir points the config directory, and so the state directory, at a new temporary
+// directory for the rest of a test.
+func useTempConfigDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+	state, err := stateDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestSearchIndexLog(t *testing.T) {
+	state := useTempConfigDir(t)
+	dir := t.TempDir()
+	entries := make(map[uint64]ManifestEntry)
+	write := func(fileId uint64, name, text string) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries[fileId] = ManifestEntry{Path: path, Size: int64(len(text)), SHA256: text}
+	}
+	load := func() *SearchIndex {
+		index, err := LoadSearchIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index
+	}
+	search := func(index *SearchIndex, query string) []string {
+		var names []string
+		for _, result := range index.Search(query, dir) {
+			names = append(names, filepath.Base(result.Path))
+		}
+		return names
+	}
+	logLines := func() int {
+		content, err := os.ReadFile(filepath.Join(state, searchIndexStateFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(content), "\n")
+	}
+
+	write(1, "syllabus.txt", "office hours on tuesday")
+	write(2, "notes.txt", "lecture on regression")
+	index := load()
+	if n := index.Update(entries); n != 2 {
+		t.Errorf("indexed %d files, want 2", n)
+	}
+	if err := index.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing one file appends its record, and forgetting one appends a record that it is gone.
+	write(2, "notes.txt", "lecture on clustering")
+	index = load()
+	if n := index.Update(entries); n != 1 {
+		t.Errorf("indexed %d files, want 1", n)
+	}
+	delete(entries, 1)
+	index.Update(entries)
+	if err := index.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if n := logLines(); n != 4 {
+		t.Errorf("the index log has %d records, want 4", n)
+	}
+
+	index = load()
+	if got := search(index, "clustering"); len(got) != 1 || got[0] != "notes.txt" {
+		t.Errorf("search for clustering found %v, want notes.txt", got)
+	}
+	if got := search(index, "regression"); len(got) != 0 {
+		t.Errorf("search for regression found %v, which has changed", got)
+	}
+	if got := search(index, "tuesday"); len(got) != 0 {
+		t.Errorf("search for tuesday found %v, which is no longer synced", got)
+	}
+
+	// A record cut off when canvas-sync was killed is ignored, and the log is rewritten.
+	f, err := os.OpenFile(filepath.Join(state, searchIndexStateFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":3,"path":"`)
+	f.Close()
+	index = load()
+	if len(index.Files) != 1 {
+		t.Errorf("the index has %d files, want 1", len(index.Files))
+	}
+	if err := index.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if n := logLines(); n != 1 {
+		t.Errorf("the rewritten index log has %d records, want 1", n)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// runSelect implements the select subcommand, which lists the user's courses with a checkbox for
+// each, and writes the courses that are not ticked to ignored_courses in the config file.
+func runSelect(ctx context.Context, args []string, opts *Options) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: canvas-sync select")
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("select needs a terminal to choose courses in: otherwise, list the IDs of the courses not to sync in ignored_courses in the config file")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	if api.Listings, err = LoadListingCache(opts); err != nil {
+		return err
+	}
+
+	courses, err := api.AllCourses(ctx)
+	if err != nil {
+		return err
+	}
+	if len(courses) == 0 {
+		fmt.Println("You have no courses on Canvas.")
+		return nil
+	}
+	sort.Slice(courses, func(i, j int) bool { return courses[i].Name < courses[j].Name })
+
+	ignored := make(map[uint64]bool)
+	for _, id := range config.IgnoredCourses {
+		ignored[id] = true
+	}
+	selected := make([]bool, len(courses))
+	for i, course := range courses {
+		selected[i] = !ignored[course.Id]
+	}
+
+	save, err := chooseCourses(courses, selected)
+	if err != nil {
+		return err
+	}
+	if !save {
+		fmt.Println("Nothing changed.")
+		return nil
+	}
+
+	ignoredCourses, synced := ignoredCoursesFor(config, courses, selected)
+	if err := setConfigSetting("ignored_courses", ignoredCourses); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Syncing %d of %d courses.\n", synced, len(courses))
+	return nil
+}
+
+// ignoredCoursesFor returns the ignored_courses that sync only the courses selected, and how many
+// courses that is. Courses that are no longer listed, such as ones that have been deleted, stay
+// ignored.
+func ignoredCoursesFor(config *Config, courses []Course, selected []bool) ([]uint64, int) {
+	listed := make(map[uint64]bool, len(courses))
+	for _, course := range courses {
+		listed[course.Id] = true
+	}
+	ignoredCourses := []uint64{}
+	for _, id := range config.IgnoredCourses {
+		if !listed[id] {
+			ignoredCourses = append(ignoredCourses, id)
+		}
+	}
+	synced := 0
+	for i, course := range courses {
+		if selected[i] {
+			synced++
+		} else {
+			ignoredCourses = append(ignoredCourses, course.Id)
+		}
+	}
+	return ignoredCourses, synced
+}
+
+// chooseCourses shows a list of courses with a checkbox for each, ticked for those selected, for the
+// user to tick and untick with the keyboard. It reports whether the user chose to save the
+// selection rather than cancel.
+func chooseCourses(courses []Course, selected []bool) (bool, error) {
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return false, err
+	}
+	defer term.Restore(int(os.Stdin.Fd()), state)
+
+	cursor, top, drawn := 0, 0, 0
+	buf := make([]byte, 8)
+	for {
+		// Show as many courses as fit on the screen, scrolling to keep the cursor in view.
+		height := len(courses)
+		if _, rows, err := term.GetSize(int(os.Stdout.Fd())); err == nil && rows > 0 && rows-3 < height {
+			height = rows - 3
+			if height < 1 {
+				height = 1
+			}
+		}
+		if cursor < top {
+			top = cursor
+		} else if cursor >= top+height {
+			top = cursor - height + 1
+		}
+		drawn = drawCourseList(os.Stdout, courses, selected, cursor, top, height, drawn)
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return false, err
+		}
+		switch key := string(buf[:n]); key {
+		case "k", "\x1b[A", "\x1bOA":
+			if cursor > 0 {
+				cursor--
+			}
+		case "j", "\x1b[B", "\x1bOB":
+			if cursor < len(courses)-1 {
+				cursor++
+			}
+		case " ", "x":
+			selected[cursor] = !selected[cursor]
+		case "a":
+			// Tick every course, or untick them all if they already are.
+			all := true
+			for _, s := range selected {
+				all = all && s
+			}
+			for i := range selected {
+				selected[i] = !all
+			}
+		case "\r", "\n":
+			return true, nil
+		case "q", "\x1b", "\x03":
+			return false, nil
+		}
+	}
+}
+
+// drawCourseList draws the courses from top, height of them, over the lines drawn the time before,
+// and returns how many lines it drew. The terminal is in raw mode, so lines end in "\r\n".
+func drawCourseList(w io.Writer, courses []Course, selected []bool, cursor, top, height, drawn int) int {
+	var b strings.Builder
+	if drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", drawn)
+	}
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, "\r\x1b[2K"+format+"\r\n", args...)
+	}
+
+	line("Choose the courses to sync: ↑/↓ to move, space to tick, a for all, enter to save, q to cancel")
+	for i := top; i < top+height && i < len(courses); i++ {
+		pointer, box := " ", "[ ]"
+		if i == cursor {
+			pointer = ">"
+		}
+		if selected[i] {
+			box = "[x]"
+		}
+		name := courses[i].Name
+		if courses[i].Term != nil && courses[i].Term.Name != "" {
+			name += " (" + courses[i].Term.Name + ")"
+		}
+		line("%s %s %s", pointer, box, name)
+	}
+
+	count := 0
+	for _, s := range selected {
+		if s {
+			count++
+		}
+	}
+	line("%d of %d courses ticked", count, len(courses))
+	// Clear anything left below from a taller list, if the terminal has been resized.
+	b.WriteString("\x1b[J")
+
+	io.WriteString(w, b.String())
+	return height + 2
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serveTokenStateFile = "serve_token.json"
+
+	defaultServeAddr = "localhost:7823"
+
+	// Number of events a client of the event stream can fall behind by before it misses some.
+	controlEventBuffer = 256
+	// How often a comment is sent to clients of the event stream while there are no events, so that
+	// proxies do not close the connection.
+	controlKeepAlive = 30 * time.Second
+)
+
+// controlEvents, if not nil, passes the events of each sync on to the clients of the control API.
+var controlEvents *EventStream
+
+// ControlEvent is an event of a sync as it is sent to the clients of the control API.
+type ControlEvent struct {
+	// One of sync_started, sync_finished, file_discovered, download_started, download_finished,
+	// course_complete and error.
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	CourseId uint64    `json:"course_id,omitempty"`
+	FileId   uint64    `json:"file_id,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Code     ErrorCode `json:"code,omitempty"`
+	// Why a sync failed, or a file was not downloaded: it may have been skipped, been up to date or
+	// have failed.
+	Error string `json:"error,omitempty"`
+}
+
+// EventStream sends the events of syncs to the clients of the control API that are listening for
+// them. Clients that fall behind miss events rather than hold up the sync. The methods of a nil
+// EventStream do nothing.
+type EventStream struct {
+	mu      sync.Mutex
+	clients map[chan ControlEvent]bool
+}
+
+func NewEventStream() *EventStream {
+	return &EventStream{clients: make(map[chan ControlEvent]bool)}
+}
+
+func (s *EventStream) Subscribe() chan ControlEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan ControlEvent, controlEventBuffer)
+	s.clients[ch] = true
+	return ch
+}
+
+func (s *EventStream) Unsubscribe(ch chan ControlEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, ch)
+	close(ch)
+}
+
+// Send sends an event to every client.
+func (s *EventStream) Send(event ControlEvent) {
+	if s == nil {
+		return
+	}
+	event.Time = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.clients {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// HandleEvent is the subscriber that sends the events of a sync to the clients.
+func (s *EventStream) HandleEvent(event SyncEvent) {
+	if s == nil {
+		return
+	}
+
+	switch e := event.(type) {
+	case FileDiscovered:
+		s.Send(fileEvent("file_discovered", e.File))
+	case DownloadStarted:
+		s.Send(fileEvent("download_started", e.File))
+	case DownloadFinished:
+		event := fileEvent("download_finished", e.File)
+		if e.Err != nil {
+			event.Error = e.Err.Error()
+		}
+		s.Send(event)
+	case CourseComplete:
+		s.Send(ControlEvent{Type: "course_complete", CourseId: e.Tree.Id})
+	case ErrorReported:
+		code := e.Event.Code
+		if code == "" {
+			code = errorCode(e.Err)
+		}
+		s.Send(ControlEvent{Type: "error", CourseId: e.Event.CourseId, FileId: e.Event.FileId, Code: code, Error: e.Err.Error()})
+	}
+}
+
+func fileEvent(eventType string, file FileToSync) ControlEvent {
+	return ControlEvent{Type: eventType, CourseId: file.CourseId, FileId: file.File.Id, Path: file.Path, Size: file.File.Size}
+}
+
+// SyncResult is the outcome of a sync run through the control API.
+type SyncResult struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// syncController runs the syncs asked for through the control API, one at a time.
+type syncController struct {
+	opts   *Options
+	pauser *Pauser
+	events *EventStream
+
+	mu       sync.Mutex
+	pipeline *Pipeline
+	cancel   context.CancelFunc
+	last     *SyncResult
+	wg       sync.WaitGroup
+}
+
+// Start starts a sync unless one is already running, and reports whether it did.
+func (c *syncController) Start(ctx context.Context) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pipeline != nil {
+		return false
+	}
+	pipeline := NewPipeline()
+	pipeline.Pauser = c.pauser
+	ctx, cancel := context.WithCancel(ctx)
+	c.pipeline, c.cancel = pipeline, cancel
+	c.events.Send(ControlEvent{Type: "sync_started"})
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer cancel()
+
+		config, err := loadConfig()
+		if err == nil {
+			err = runSync(ctx, config, c.opts, pipeline)
+		}
+		metrics.SyncFinished(pipeline.StartedAt, err)
+
+		result := &SyncResult{StartedAt: pipeline.StartedAt, FinishedAt: time.Now()}
+		if errors.Is(err, context.Canceled) {
+			result.Error = "interrupted"
+		} else if err != nil {
+			result.Error = err.Error()
+			logErrorf("%s", err)
+		}
+
+		c.mu.Lock()
+		c.pipeline, c.cancel, c.last = nil, nil, result
+		// --force and --refresh only download files again once, not on every sync.
+		if err == nil {
+			c.opts.Force, c.opts.Refresh, c.opts.RefreshPaths = false, nil, nil
+		}
+		c.mu.Unlock()
+
+		c.events.Send(ControlEvent{Type: "sync_finished", Error: result.Error})
+	}()
+	return true
+}
+
+// Cancel stops the running sync, and reports whether there was one.
+func (c *syncController) Cancel() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel == nil {
+		return false
+	}
+	c.cancel()
+	return true
+}
+
+// SetPaused pauses or resumes the downloads of the running sync and of those after it.
+func (c *syncController) SetPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pauser.Paused() != paused {
+		c.pauser.Toggle()
+	}
+}
+
+// Wait waits for the running sync to finish.
+func (c *syncController) Wait() {
+	c.wg.Wait()
+}
+
+type syncStatus struct {
+	Syncing bool `json:"syncing"`
+	Paused  bool `json:"paused"`
+
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	CoursesListed int64      `json:"courses_listed"`
+	TreesBuilt    int64      `json:"trees_built"`
+	FilesDone     int64      `json:"files_done"`
+	InFlight      []string   `json:"in_flight"`
+
+	LastSync *SyncResult `json:"last_sync"`
+}
+
+func (c *syncController) Status() syncStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := syncStatus{Paused: c.pauser.Paused(), InFlight: []string{}, LastSync: c.last}
+	if p := c.pipeline; p != nil {
+		status.Syncing = true
+		status.StartedAt = &p.StartedAt
+		status.CoursesListed = p.CoursesListed.Load()
+		status.TreesBuilt = p.TreesBuilt.Load()
+		status.FilesDone = p.FilesDone.Load()
+		status.InFlight = p.InFlight()
+	}
+	return status
+}
+
+// loadServeToken returns the token that clients of the control API must send, creating it the
+// first time.
+func loadServeToken() (string, error) {
+	var token string
+	if err := loadState(serveTokenStateFile, &token); err != nil {
+		return "", err
+	}
+	if token != "" {
+		return token, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(b)
+	if err := saveState(serveTokenStateFile, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// controlServer serves the control API.
+type controlServer struct {
+	ctx        context.Context
+	opts       *Options
+	token      string
+	controller *syncController
+	events     *EventStream
+}
+
+func (s *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleStatusPage)
+	mux.HandleFunc("/api/status", s.method(http.MethodGet, s.handleStatus))
+	mux.HandleFunc("/api/sync", s.method(http.MethodPost, s.handleSync))
+	mux.HandleFunc("/api/sync/cancel", s.method(http.MethodPost, s.handleCancel))
+	mux.HandleFunc("/api/pause", s.method(http.MethodPost, s.handlePause(true)))
+	mux.HandleFunc("/api/resume", s.method(http.MethodPost, s.handlePause(false)))
+	mux.HandleFunc("/api/events", s.method(http.MethodGet, s.handleEvents))
+	mux.HandleFunc("/api/files", s.method(http.MethodGet, s.handleFiles))
+	mux.HandleFunc("/api/courses", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			s.method(http.MethodPut, s.handleSelectCourses)(w, r)
+		} else {
+			s.method(http.MethodGet, s.handleCourses)(w, r)
+		}
+	})
+	return mux
+}
+
+// method only lets through requests with the method given and the token, which is sent in the
+// Authorization header, or in the token parameter by clients that cannot set headers.
+func (s *controlServer) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("use %s", method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// There is nowhere to report a failure to write the response.
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *controlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.controller.Status())
+}
+
+func (s *controlServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	if !s.controller.Start(s.ctx) {
+		writeJSONError(w, http.StatusConflict, "a sync is already running")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, s.controller.Status())
+}
+
+func (s *controlServer) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if !s.controller.Cancel() {
+		writeJSONError(w, http.StatusConflict, "no sync is running")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, s.controller.Status())
+}
+
+func (s *controlServer) handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.controller.SetPaused(paused)
+		writeJSON(w, http.StatusOK, s.controller.Status())
+	}
+}
+
+// handleEvents streams the events of syncs to the client as server-sent events, until it
+// disconnects.
+func (s *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	events := s.events.Subscribe()
+	defer s.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(controlKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+type manifestFile struct {
+	Id uint64 `json:"id"`
+	ManifestEntry
+}
+
+// handleFiles lists the files that have been synced, or those in one course with the course
+// parameter.
+func (s *controlServer) handleFiles(w http.ResponseWriter, r *http.Request) {
+	var courseId uint64
+	if course := r.URL.Query().Get("course"); course != "" {
+		var err error
+		if courseId, err = strconv.ParseUint(course, 10, 64); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid course ID %q", course))
+			return
+		}
+	}
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	files := []manifestFile{}
+	for fileId, entry := range manifest.EntriesById() {
+		if courseId == 0 || entry.CourseId == courseId {
+			files = append(files, manifestFile{Id: fileId, ManifestEntry: entry})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	writeJSON(w, http.StatusOK, files)
+}
+
+type selectableCourse struct {
+	Course
+	Synced bool `json:"synced"`
+}
+
+// listCourses returns the user's courses, sorted by name, and the config file.
+func (s *controlServer) listCourses() ([]Course, *Config, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if api.Listings, err = LoadListingCache(s.opts); err != nil {
+		return nil, nil, err
+	}
+
+	courses, err := api.AllCourses(s.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(courses, func(i, j int) bool { return courses[i].Name < courses[j].Name })
+	return courses, config, nil
+}
+
+// handleCourses lists the user's courses and whether each is synced.
+func (s *controlServer) handleCourses(w http.ResponseWriter, r *http.Request) {
+	courses, config, err := s.listCourses()
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	ignored := make(map[uint64]bool)
+	for _, id := range config.IgnoredCourses {
+		ignored[id] = true
+	}
+	list := make([]selectableCourse, 0, len(courses))
+	for _, course := range courses {
+		list = append(list, selectableCourse{Course: course, Synced: !ignored[course.Id]})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+type courseSelection struct {
+	// The IDs of the courses to sync. The rest are written to ignored_courses.
+	Synced []uint64 `json:"synced"`
+}
+
+// handleSelectCourses chooses the courses to sync, like the select subcommand. The choice applies
+// from the next sync.
+func (s *controlServer) handleSelectCourses(w http.ResponseWriter, r *http.Request) {
+	var selection courseSelection
+	if err := json.NewDecoder(r.Body).Decode(&selection); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid course selection: %s", err))
+		return
+	}
+
+	courses, config, err := s.listCourses()
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	index := make(map[uint64]int, len(courses))
+	for i, course := range courses {
+		index[course.Id] = i
+	}
+	selected := make([]bool, len(courses))
+	for _, id := range selection.Synced {
+		i, ok := index[id]
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("you have no course with ID %d", id))
+			return
+		}
+		selected[i] = true
+	}
+
+	ignoredCourses, synced := ignoredCoursesFor(config, courses, selected)
+	if err := setConfigSetting("ignored_courses", ignoredCourses); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	logInfof("Syncing %d of %d courses", synced, len(courses))
+	writeJSON(w, http.StatusOK, map[string]int{"synced": synced, "courses": len(courses)})
+}
+
+// runServe implements the serve subcommand, which keeps running and syncs when asked to through an
+// HTTP API, so that other programs, such as a desktop app, can drive canvas-sync, or through the
+// status page it serves alongside. With --watch, it also syncs at that interval.
+func runServe(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("listen", defaultServeAddr, "serve the API on this address")
+	open := flags.Bool("open", false, "open the status page in the web browser")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync serve [--listen <address>] [--open]")
+	}
+	if opts.Offline {
+		return fmt.Errorf("--offline only works with diff, digest, quota and archive, as syncing needs Canvas")
+	}
+
+	// Check the config file before waiting to be asked to sync.
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	token, err := loadServeToken()
+	if err != nil {
+		return err
+	}
+
+	if opts.MetricsAddr != "" {
+		metrics = NewMetrics()
+		if err := ServeMetrics(ctx, opts.MetricsAddr, metrics); err != nil {
+			return err
+		}
+	}
+
+	controlEvents = NewEventStream()
+	controller := &syncController{opts: opts, pauser: NewPauser(), events: controlEvents}
+	server := &controlServer{ctx: ctx, opts: opts, token: token, controller: controller, events: controlEvents}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("cannot serve the control API: %w", err)
+	}
+	httpServer := &http.Server{Handler: server.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+
+	if opts.Watch > 0 {
+		go func() {
+			ticker := time.NewTicker(opts.Watch)
+			defer ticker.Stop()
+			for {
+				controller.Start(ctx)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	logInfof("Serving the control API at http://%s/api/, with the token in %s", listener.Addr(), filepath.Join(dir, serveTokenStateFile))
+	if *open {
+		if err := openBrowser(statusPageUrl(listener.Addr().String(), token)); err != nil {
+			logErrorf("cannot open the status page: %s", err)
+		}
+	}
+
+	err = httpServer.Serve(listener)
+	controller.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Name of the installed service, and of the files describing it.
+const serviceName = "canvas-sync"
+
+const defaultServiceInterval = time.Hour
+
+// The shortest interval between scheduled syncs, to be kind to the Canvas server.
+const minServiceInterval = 5 * time.Minute
+
+// runService implements the service subcommand, which installs, uninstalls or shows the status of
+// a systemd user timer (on Linux) or launchd agent (on macOS) that syncs on a schedule.
+func runService(ctx context.Context, args []string) error {
+	usage := fmt.Errorf("usage: canvas-sync service install [--interval 1h] | uninstall | status")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "install":
+		flags := flag.NewFlagSet("service install", flag.ExitOnError)
+		interval := flags.Duration("interval", defaultServiceInterval, "how often to sync, e.g. 30m")
+		flags.Parse(args[1:])
+
+		if flags.NArg() != 0 {
+			return usage
+		}
+		if *interval < minServiceInterval {
+			return fmt.Errorf("the interval must be at least %s", minServiceInterval)
+		}
+
+		// Check that there is something to sync before scheduling it.
+		if _, err := loadConfig(); err != nil {
+			return err
+		}
+
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("cannot find the canvas-sync executable: %w", err)
+		}
+		exe, err = filepath.EvalSymlinks(exe)
+		if err != nil {
+			return fmt.Errorf("cannot find the canvas-sync executable: %w", err)
+		}
+
+		if err := installService(ctx, exe, *interval); err != nil {
+			return err
+		}
+		fmt.Printf("✓ canvas-sync will sync every %s.\n", *interval)
+		return nil
+	case "uninstall":
+		if len(args) != 1 {
+			return usage
+		}
+		if err := uninstallService(ctx); err != nil {
+			return err
+		}
+		fmt.Println("✓ canvas-sync will no longer sync on a schedule.")
+		return nil
+	case "status":
+		if len(args) != 1 {
+			return usage
+		}
+		return serviceStatus(ctx)
+	default:
+		return usage
+	}
+}
+
+// runServiceCommand runs a command that manages services, such as systemctl, passing its output
+// through.
+func runServiceCommand(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+// writeServiceFile writes one of the files describing the service, creating its directory.
+func writeServiceFile(path string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
@@ -0,0 +1,92 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Label of the launchd agent, which launchd wants in reverse domain name form.
+const launchdLabel = "io.github.james-atkins." + serviceName
+
+// launchdPaths returns the path of the agent's property list, and of the log it writes to.
+func launchdPaths() (plistPath string, logPath string, err error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist"),
+		filepath.Join(home, "Library", "Logs", serviceName+".log"), nil
+}
+
+// installService writes a launchd agent that syncs at the interval, and loads it.
+func installService(ctx context.Context, exe string, interval time.Duration) error {
+	plistPath, logPath, err := launchdPaths()
+	if err != nil {
+		return err
+	}
+
+	var plist strings.Builder
+	plist.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	plist.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	plist.WriteString(`<plist version="1.0">` + "\n<dict>\n")
+	fmt.Fprintf(&plist, "\t<key>Label</key>\n\t<string>%s</string>\n", launchdLabel)
+	fmt.Fprintf(&plist, "\t<key>ProgramArguments</key>\n\t<array>\n\t\t<string>%s</string>\n\t\t<string>--quiet</string>\n\t</array>\n", html.EscapeString(exe))
+	fmt.Fprintf(&plist, "\t<key>StartInterval</key>\n\t<integer>%d</integer>\n", int64(interval/time.Second))
+	plist.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	fmt.Fprintf(&plist, "\t<key>StandardOutPath</key>\n\t<string>%s</string>\n", html.EscapeString(logPath))
+	fmt.Fprintf(&plist, "\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", html.EscapeString(logPath))
+	plist.WriteString("</dict>\n</plist>\n")
+
+	// Unload the agent in case it was already installed with a different interval.
+	if _, err := os.Stat(plistPath); err == nil {
+		runServiceCommand(ctx, "launchctl", "unload", plistPath)
+	}
+
+	if err := writeServiceFile(plistPath, plist.String()); err != nil {
+		return err
+	}
+	return runServiceCommand(ctx, "launchctl", "load", "-w", plistPath)
+}
+
+func uninstallService(ctx context.Context) error {
+	plistPath, _, err := launchdPaths()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(plistPath); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("canvas-sync is not installed as a service")
+	}
+
+	if err := runServiceCommand(ctx, "launchctl", "unload", "-w", plistPath); err != nil {
+		return err
+	}
+	return os.Remove(plistPath)
+}
+
+// serviceStatus shows whether the agent is loaded and how the last sync went.
+func serviceStatus(ctx context.Context) error {
+	plistPath, logPath, err := launchdPaths()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(plistPath); errors.Is(err, os.ErrNotExist) {
+		fmt.Println("canvas-sync is not installed as a service.")
+		return nil
+	}
+
+	if err := runServiceCommand(ctx, "launchctl", "list", launchdLabel); err != nil {
+		return err
+	}
+	fmt.Printf("\nErrors are logged to %s.\n", logPath)
+	return nil
+}
@@ -0,0 +1,120 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// systemdUnitDir returns the directory that systemd reads the user's own units from.
+func systemdUnitDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find config directory: %w", err)
+	}
+	return filepath.Join(dir, "systemd", "user"), nil
+}
+
+// systemdQuote quotes a word of a command line in a unit file.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	return `"` + s + `"`
+}
+
+// installService writes a systemd user service that syncs once, and a timer that starts it at the
+// interval, and then enables the timer.
+func installService(ctx context.Context, exe string, interval time.Duration) error {
+	dir, err := systemdUnitDir()
+	if err != nil {
+		return err
+	}
+
+	var service strings.Builder
+	service.WriteString("[Unit]\n")
+	service.WriteString("Description=Sync files from Canvas\n")
+	service.WriteString("Wants=network-online.target\n")
+	service.WriteString("After=network-online.target\n\n")
+	service.WriteString("[Service]\n")
+	service.WriteString("Type=oneshot\n")
+	// The config is found through XDG_CONFIG_HOME, which systemd does not pass on.
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		fmt.Fprintf(&service, "Environment=%s\n", systemdQuote("XDG_CONFIG_HOME="+xdg))
+	}
+	fmt.Fprintf(&service, "ExecStart=%s --quiet\n", systemdQuote(exe))
+	// A sync that downloaded files exits with exitSynced.
+	fmt.Fprintf(&service, "SuccessExitStatus=%d\n", exitSynced)
+
+	var timer strings.Builder
+	timer.WriteString("[Unit]\n")
+	fmt.Fprintf(&timer, "Description=Sync files from Canvas every %s\n\n", interval)
+	timer.WriteString("[Timer]\n")
+	// Sync soon after the timer is started, at boot or when it is installed, and then at the
+	// interval after each sync.
+	timer.WriteString("OnActiveSec=1min\n")
+	fmt.Fprintf(&timer, "OnUnitActiveSec=%ds\n\n", int64(interval/time.Second))
+	timer.WriteString("[Install]\n")
+	timer.WriteString("WantedBy=timers.target\n")
+
+	if err := writeServiceFile(filepath.Join(dir, serviceName+".service"), service.String()); err != nil {
+		return err
+	}
+	if err := writeServiceFile(filepath.Join(dir, serviceName+".timer"), timer.String()); err != nil {
+		return err
+	}
+
+	if err := runServiceCommand(ctx, "systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	if err := runServiceCommand(ctx, "systemctl", "--user", "enable", serviceName+".timer"); err != nil {
+		return err
+	}
+	// Restart the timer in case it was already installed with a different interval.
+	return runServiceCommand(ctx, "systemctl", "--user", "restart", serviceName+".timer")
+}
+
+func uninstallService(ctx context.Context) error {
+	dir, err := systemdUnitDir()
+	if err != nil {
+		return err
+	}
+
+	timerPath := filepath.Join(dir, serviceName+".timer")
+	if _, err := os.Stat(timerPath); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("canvas-sync is not installed as a service")
+	}
+
+	if err := runServiceCommand(ctx, "systemctl", "--user", "disable", "--now", serviceName+".timer"); err != nil {
+		return err
+	}
+	for _, name := range []string{timerPath, filepath.Join(dir, serviceName+".service")} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return runServiceCommand(ctx, "systemctl", "--user", "daemon-reload")
+}
+
+// serviceStatus shows when the timer next fires, and how the last sync went.
+func serviceStatus(ctx context.Context) error {
+	if err := runServiceCommand(ctx, "systemctl", "--user", "list-timers", "--all", serviceName+".timer"); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	// systemctl status exits with 3 when the service is not running, which is normal between syncs.
+	err := runServiceCommand(ctx, "systemctl", "--user", "status", "--no-pager", serviceName+".service")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errServiceUnsupported = errors.New("services are only supported with systemd on Linux and launchd on macOS: schedule canvas-sync --quiet with your system's scheduler instead")
+
+func installService(ctx context.Context, exe string, interval time.Duration) error {
+	return errServiceUnsupported
+}
+
+func uninstallService(ctx context.Context) error {
+	return errServiceUnsupported
+}
+
+func serviceStatus(ctx context.Context) error {
+	return errServiceUnsupported
+}
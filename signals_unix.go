@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyDaemonSignals(syncNow chan<- os.Signal, dumpState chan<- os.Signal, togglePause chan<- os.Signal) {
+	signal.Notify(syncNow, syscall.SIGHUP)
+	signal.Notify(dumpState, syscall.SIGUSR1)
+	signal.Notify(togglePause, syscall.SIGUSR2)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// Windows has no equivalent of SIGHUP, SIGUSR1 or SIGUSR2.
+func notifyDaemonSignals(syncNow chan<- os.Signal, dumpState chan<- os.Signal, togglePause chan<- os.Signal) {
+}
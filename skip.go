@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// Well-known folders that can be left out of a sync with the skip_folders setting.
+const (
+	// Files uploaded outside of the course files, for example as attachments to discussions.
+	skipUnfiled = "unfiled"
+	// The image shown on the course card in the dashboard.
+	skipCourseImage = "course_image"
+	// Folders hidden from students, and everything inside them.
+	skipHidden = "hidden"
+)
+
+func validateSkipFolders(skip []string) error {
+	for _, s := range skip {
+		switch s {
+		case skipUnfiled, skipCourseImage, skipHidden:
+		default:
+			return fmt.Errorf("unknown folder to skip %q, must be one of %q, %q or %q", s, skipUnfiled, skipCourseImage, skipHidden)
+		}
+	}
+	return nil
+}
+
+// FolderSkip says which folders to leave out of a tree, together with everything inside them.
+type FolderSkip struct {
+	// Well-known folders, from skip_folders.
+	Kinds []string
+	// Folders excluded by ID, with the exclude command or excluded_folders.
+	Ids map[uint64]bool
+}
+
+// SkipFoldersFor returns the folders to skip in a course. A course listed in course_skip_folders
+// uses its own list of well-known folders instead of the global one.
+func (config *Config) SkipFoldersFor(courseId uint64) FolderSkip {
+	skip := FolderSkip{Kinds: config.SkipFolders}
+	if kinds, ok := config.CourseSkipFolders[courseId]; ok {
+		skip.Kinds = kinds
+	}
+
+	for _, folderId := range config.ExcludedFolders[courseId] {
+		if skip.Ids == nil {
+			skip.Ids = make(map[uint64]bool)
+		}
+		skip.Ids[folderId] = true
+	}
+	for folderId := range config.excludedFolders[courseId] {
+		if skip.Ids == nil {
+			skip.Ids = make(map[uint64]bool)
+		}
+		skip.Ids[folderId] = true
+	}
+
+	return skip
+}
+
+// skipFolders removes the folders to skip from a flat list of the folders in a course. The
+// subfolders of a skipped folder are left in the list but, without their parent, they are no longer
+// reachable from the root of the course tree, and so their files are never listed.
+func skipFolders(folders []Folder, skip FolderSkip) []Folder {
+	if len(skip.Kinds) == 0 && len(skip.Ids) == 0 {
+		return folders
+	}
+
+	var rootId uint64
+	for _, folder := range folders {
+		if folder.ParentId == 0 {
+			rootId = folder.Id
+		}
+	}
+
+	kept := folders[:0:0]
+	for _, folder := range folders {
+		if shouldSkipFolder(folder, rootId, skip) {
+			logDebugf("Skipping folder %s", folder.Path)
+		} else {
+			kept = append(kept, folder)
+		}
+	}
+	return kept
+}
+
+func shouldSkipFolder(folder Folder, rootId uint64, skip FolderSkip) bool {
+	if skip.Ids[folder.Id] {
+		return true
+	}
+
+	for _, s := range skip.Kinds {
+		switch s {
+		case skipUnfiled, skipCourseImage:
+			// These are created by Canvas directly under the root folder of the course.
+			if folder.ParentId == rootId && path.Base(folder.Path) == s {
+				return true
+			}
+		case skipHidden:
+			if folder.Hidden || folder.HiddenForUser {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+// stateDir returns the directory where canvas-sync keeps information between runs.
+func stateDir() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "state"), nil
+}
+
+// loadState reads the JSON state file called name into v. It is not an error for the file not to
+// exist, in which case v is left untouched.
+func loadState(name string, v any) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", name, err)
+	}
+
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("invalid state file %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// saveState atomically replaces the JSON state file called name with the contents of v.
+func saveState(name string, v any) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := atomicFile.WriteFile(filepath.Join(dir, name), bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("cannot write %s: %w", name, err)
+	}
+
+	return nil
+}
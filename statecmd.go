@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	atomicFile "github.com/natefinch/atomic"
+)
+
+// Name of the file in an exported state archive that describes the export.
+const stateExportHeaderFile = "canvas-sync-state.json"
+
+// State files that are exported. The lock, the journal of downloads in progress and diagnostics
+// only matter on the computer they were written on.
+var exportedStateFiles = []string{
+	manifestStateFile,
+	courseDirectoriesStateFile,
+	excludedStateFile,
+	finalizedStateFile,
+	signingKeyFile,
+	historyStateFile,
+	retryStateFile,
+	usageStateFile,
+	listingsStateFile,
+	courseTokensStateFile,
+	fileHooksStateFile,
+}
+
+// StateExportHeader records where the exported state came from, so that the paths in it can be
+// moved to the sync directory of the computer it is imported on.
+type StateExportHeader struct {
+	Url        string    `json:"url"`
+	Directory  string    `json:"directory"`
+	Separator  string    `json:"separator"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// runState implements the state subcommand, which exports the state kept between syncs to a tar
+// file, and imports it on another computer, so that a copy of the sync directory moved there is
+// not downloaded again.
+func runState(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("state", flag.ExitOnError)
+	force := flags.Bool("force", false, "with import, replace the state already on this computer")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || (flags.Arg(0) != "export" && flags.Arg(0) != "import") {
+		return fmt.Errorf("usage: canvas-sync state export <file.tar> | canvas-sync state import [--force] <file.tar>")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// The state must not change while it is being exported or imported.
+	if !opts.IgnoreLock {
+		lock, err := AcquireSyncLock(ctx, opts.Wait)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	if flags.Arg(0) == "export" {
+		return exportState(config, flags.Arg(1))
+	}
+	return importState(config, flags.Arg(1), *force)
+}
+
+func exportState(config *Config, path string) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := tar.NewWriter(f)
+	now := time.Now()
+	add := func(name string, content []byte) error {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: now}
+		if err := w.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := w.Write(content)
+		return err
+	}
+
+	header, err := json.MarshalIndent(StateExportHeader{
+		Url:        config.Url,
+		Directory:  config.Directory,
+		Separator:  string(filepath.Separator),
+		ExportedAt: now,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := add(stateExportHeaderFile, header); err != nil {
+		return err
+	}
+
+	for _, name := range exportedStateFiles {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := add(name, content); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Exported the state to %s. It includes the key that signs finalized courses, so keep it private.\n", path)
+	return nil
+}
+
+func importState(config *Config, path string, force bool) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		if _, err := os.Stat(filepath.Join(dir, manifestStateFile)); err == nil {
+			return fmt.Errorf("canvas-sync has already synced on this computer: use --force to replace its state with the imported one")
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var header *StateExportHeader
+	files := make(map[string][]byte)
+	r := tar.NewReader(f)
+	for {
+		h, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid state export %s: %w", path, err)
+		}
+
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if h.Name == stateExportHeaderFile {
+			header = new(StateExportHeader)
+			if err := json.Unmarshal(content, header); err != nil {
+				return fmt.Errorf("invalid state export %s: %w", path, err)
+			}
+			continue
+		}
+		for _, name := range exportedStateFiles {
+			if h.Name == name {
+				files[name] = content
+			}
+		}
+	}
+	if header == nil {
+		return fmt.Errorf("%s is not a state export from canvas-sync", path)
+	}
+
+	if strings.TrimSuffix(header.Url, "/") != strings.TrimSuffix(config.Url, "/") {
+		return fmt.Errorf("the state was exported from %s, not %s", header.Url, config.Url)
+	}
+
+	rebase := func(p string) string {
+		return rebasePath(p, header.Directory, header.Separator, config.Directory)
+	}
+	for name, content := range files {
+		content, err := rebaseStateFile(name, content, rebase)
+		if err != nil {
+			return fmt.Errorf("invalid %s in the state export: %w", name, err)
+		}
+		files[name] = content
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, content := range files {
+		if err := atomicFile.WriteFile(filepath.Join(dir, name), bytes.NewReader(content)); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("✓ Imported the state exported from %s on %s, with the sync directory moved to %s.\n", header.Directory, header.ExportedAt.Local().Format("2 Jan 2006"), config.Directory)
+	return nil
+}
+
+// rebasePath moves a path under the directory oldDir, which used separator between its elements,
+// to the same place under newDir. Other paths are left as they are.
+func rebasePath(path, oldDir, separator, newDir string) string {
+	oldDir = strings.TrimSuffix(oldDir, separator)
+	if path == oldDir {
+		return newDir
+	}
+	if !strings.HasPrefix(path, oldDir+separator) {
+		return path
+	}
+
+	rel := strings.Split(strings.TrimPrefix(path, oldDir+separator), separator)
+	return filepath.Join(append([]string{newDir}, rel...)...)
+}
+
+// rebaseStateFile changes the paths in the contents of the state file called name with rebase.
+// Files without paths in them are returned as they are.
+func rebaseStateFile(name string, content []byte, rebase func(string) string) ([]byte, error) {
+	var v any
+	switch name {
+	case manifestStateFile:
+		files := make(map[uint64]*ManifestEntry)
+		if err := json.Unmarshal(content, &files); err != nil {
+			return nil, err
+		}
+		for _, entry := range files {
+			entry.Path = rebase(entry.Path)
+			if entry.Extracted != nil {
+				entry.Extracted.Dir = rebase(entry.Extracted.Dir)
+			}
+		}
+		v = files
+	case courseDirectoriesStateFile:
+		dirs := make(map[uint64]string)
+		if err := json.Unmarshal(content, &dirs); err != nil {
+			return nil, err
+		}
+		for courseId, dir := range dirs {
+			dirs[courseId] = rebase(dir)
+		}
+		v = dirs
+	case finalizedStateFile:
+		finalized := make(map[uint64]FinalizedCourse)
+		if err := json.Unmarshal(content, &finalized); err != nil {
+			return nil, err
+		}
+		for courseId, course := range finalized {
+			course.Directory = rebase(course.Directory)
+			finalized[courseId] = course
+		}
+		v = finalized
+	case retryStateFile:
+		entries := make(map[uint64]*RetryEntry)
+		if err := json.Unmarshal(content, &entries); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			entry.File.Path = rebase(entry.File.Path)
+		}
+		v = entries
+	case historyStateFile:
+		var runs []HistoryRun
+		if err := json.Unmarshal(content, &runs); err != nil {
+			return nil, err
+		}
+		for i := range runs {
+			for j := range runs[i].Files {
+				runs[i].Files[j].Path = rebase(runs[i].Files[j].Path)
+			}
+			for j := range runs[i].Failed {
+				runs[i].Failed[j].Path = rebase(runs[i].Failed[j].Path)
+			}
+		}
+		v = runs
+	default:
+		return content, nil
+	}
+
+	return json.MarshalIndent(v, "", "  ")
+}
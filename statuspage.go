@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// statusPageUrl returns the address of the status page of the control API served at addr, with
+// the token for it to call the API with.
+func statusPageUrl(addr string, token string) string {
+	return (&url.URL{Scheme: "http", Host: addr, Path: "/", RawQuery: url.Values{"token": {token}}.Encode()}).String()
+}
+
+// handleStatusPage serves the status page, which shows how syncing is going and has buttons to sync
+// now and to pause downloads, for those who would rather not use a terminal. It needs no token to
+// load, as it shows nothing until it calls the API with the one in its address.
+func (s *controlServer) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write([]byte(statusPage))
+}
+
+const statusPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>canvas-sync</title>
+<style>
+  body { font-family: system-ui, sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+  h1 { font-size: 1.4em; }
+  #state { font-size: 1.2em; font-weight: bold; }
+  .error { color: #b00; }
+  button { font-size: 1em; padding: 0.4em 1em; margin-right: 0.5em; }
+  ul { padding-left: 1.2em; }
+  li { overflow-wrap: anywhere; }
+  #log { font-size: 0.9em; color: #555; }
+</style>
+</head>
+<body>
+<h1>canvas-sync</h1>
+<p id="state">Connecting…</p>
+<p id="progress"></p>
+<p id="last"></p>
+<p>
+  <button id="sync">Sync now</button>
+  <button id="pause">Pause downloads</button>
+  <button id="cancel">Stop sync</button>
+</p>
+<h2>Downloading</h2>
+<ul id="inflight"></ul>
+<h2>Recent activity</h2>
+<ul id="log"></ul>
+<script>
+"use strict";
+const token = new URLSearchParams(location.search).get("token") || "";
+const $ = (id) => document.getElementById(id);
+let paused = false;
+
+async function call(method, path) {
+  const response = await fetch(path, { method, headers: { Authorization: "Bearer " + token } });
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error || response.statusText);
+  }
+  return body;
+}
+
+function show(status) {
+  paused = status.paused;
+  $("state").textContent = status.syncing ? (paused ? "Syncing, downloads paused" : "Syncing…") : (paused ? "Idle, downloads paused" : "Idle");
+  $("progress").textContent = status.syncing ? status.courses_listed + " courses listed, " + status.files_done + " files done" : "";
+  const last = status.last_sync;
+  $("last").textContent = last ? "Last sync finished " + new Date(last.finished_at).toLocaleString() + (last.error ? ": " + last.error : " without errors") : "No sync yet since canvas-sync was started.";
+  $("last").className = last && last.error ? "error" : "";
+  $("sync").disabled = status.syncing;
+  $("cancel").disabled = !status.syncing;
+  $("pause").textContent = paused ? "Resume downloads" : "Pause downloads";
+  $("inflight").replaceChildren(...status.in_flight.map((path) => {
+    const li = document.createElement("li");
+    li.textContent = path;
+    return li;
+  }));
+}
+
+function report(err) {
+  $("state").textContent = err.message;
+  $("state").className = "error";
+}
+
+async function refresh() {
+  try {
+    show(await call("GET", "/api/status"));
+    $("state").className = "";
+  } catch (err) {
+    report(err);
+  }
+}
+
+function act(method, path) {
+  return () => call(method, path).then(show).catch(report);
+}
+$("sync").onclick = act("POST", "/api/sync");
+$("cancel").onclick = act("POST", "/api/sync/cancel");
+$("pause").onclick = () => act("POST", paused ? "/api/resume" : "/api/pause")();
+
+const descriptions = {
+  sync_started: () => "Sync started",
+  sync_finished: (e) => e.error ? "Sync failed: " + e.error : "Sync finished",
+  download_finished: (e) => e.error ? null : "Downloaded " + e.path,
+  error: (e) => e.error,
+};
+function log(event) {
+  const describe = descriptions[event.type];
+  const text = describe && describe(event);
+  if (!text) {
+    return;
+  }
+  const li = document.createElement("li");
+  li.textContent = new Date(event.time).toLocaleTimeString() + " " + text;
+  $("log").prepend(li);
+  while ($("log").children.length > 50) {
+    $("log").lastChild.remove();
+  }
+}
+
+// Refresh the status as events arrive, but not more than once a second.
+let pending = false;
+const events = new EventSource("/api/events?token=" + encodeURIComponent(token));
+for (const type of ["sync_started", "sync_finished", "download_started", "download_finished", "course_complete", "error"]) {
+  events.addEventListener(type, (message) => {
+    log(JSON.parse(message.data));
+    if (!pending) {
+      pending = true;
+      setTimeout(() => { pending = false; refresh(); }, 1000);
+    }
+  });
+}
+events.onopen = refresh;
+setInterval(refresh, 30000);
+refresh();
+</script>
+</body>
+</html>
+`
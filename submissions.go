@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+)
+
+// Directory inside a course directory where the submissions of students are downloaded to.
+const submissionsDirectory = "Submissions"
+
+// submissionsToSync downloads the files that students have submitted for the assignments in a
+// course, from every section, into Submissions/<assignment>/<student>. Only teachers can list the
+// submissions of other students, so for anyone else there is nothing to download.
+func submissionsToSync(ctx context.Context, api *CanvasApi, fileToSyncC chan<- FileToSync, courseId uint64, submissionsPath string, anonymize bool) error {
+	ctx = withCourse(ctx, courseId)
+
+	submissions, err := listAll(ctx, api.MakeStudentSubmissionsInCourseUrl(courseId), api.Submissions)
+	if errors.Is(err, errForbidden) || (isHTTPStatus(err, 401) && !isTokenRejected(err)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Submissions with nothing to download are left out, so that there is no empty folder for
+	// every student who has not handed anything in.
+	byAssignment := make(map[uint64][]Submission)
+	assignmentNames := make(map[uint64]string)
+	for _, s := range submissions {
+		if len(s.Attachments) == 0 {
+			continue
+		}
+		byAssignment[s.AssignmentId] = append(byAssignment[s.AssignmentId], s)
+		if s.Assignment != nil {
+			assignmentNames[s.AssignmentId] = s.Assignment.Name
+		}
+	}
+
+	assignmentIds := sortedKeys(byAssignment)
+	assignmentDirs := uniqueNames(assignmentIds, func(id uint64) string {
+		if name := safeFileName(assignmentNames[id]); name != "" {
+			return name
+		}
+		return fmt.Sprintf("Assignment %d", id)
+	})
+
+	for _, assignmentId := range assignmentIds {
+		assignmentSubmissions := byAssignment[assignmentId]
+		anonymous := anonymize
+		if a := assignmentSubmissions[0].Assignment; a != nil && a.AnonymizeStudents {
+			anonymous = true
+		}
+
+		students := make(map[uint64]Submission)
+		for _, s := range assignmentSubmissions {
+			students[s.UserId] = s
+		}
+		studentIds := sortedKeys(students)
+		studentDirs := uniqueNames(studentIds, func(id uint64) string {
+			return submissionFolderName(students[id], anonymous)
+		})
+
+		for _, studentId := range studentIds {
+			folder := &TreeFolder{}
+			for _, file := range students[studentId].Attachments {
+				api.prepareFile(&file)
+				folder.files = append(folder.files, &TreeFile{File: file})
+			}
+
+			studentPath := filepath.Join(submissionsPath, assignmentDirs[assignmentId], studentDirs[studentId])
+			if err := folderFilesToSync(ctx, fileToSyncC, courseId, folder, studentPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// submissionFolderName names the folder of a student's submission after the student, or if
+// anonymous, after the anonymous ID that Canvas gives them for the assignment, so that it does not
+// say who they are.
+func submissionFolderName(s Submission, anonymous bool) string {
+	if anonymous {
+		if s.AnonymousId != "" {
+			return "Anonymous " + safeFileName(s.AnonymousId)
+		}
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%d", s.UserId)
+		return fmt.Sprintf("Anonymous %08x", h.Sum32())
+	}
+
+	if s.User != nil {
+		if name := safeFileName(s.User.SortableName); name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("Student %d", s.UserId)
+}
+
+// uniqueNames names each ID with name, adding the ID to any name shared by several, so that each
+// gets a folder of its own however the IDs are ordered.
+func uniqueNames(ids []uint64, name func(uint64) string) map[uint64]string {
+	count := make(map[string]int)
+	names := make(map[uint64]string, len(ids))
+	for _, id := range ids {
+		names[id] = name(id)
+		count[names[id]]++
+	}
+	for _, id := range ids {
+		if count[names[id]] > 1 {
+			names[id] = fmt.Sprintf("%s (%d)", names[id], id)
+		}
+	}
+	return names
+}
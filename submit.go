@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (api *CanvasApi) MakeAssignmentUrl(courseId uint64, assignmentId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/assignments/%d", api.RootUrl, courseId, assignmentId)
+}
+
+func (api *CanvasApi) MakeSubmissionsUrl(courseId uint64, assignmentId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/assignments/%d/submissions", api.RootUrl, courseId, assignmentId)
+}
+
+// MakeUploadForSubmissionUrl is where files to hand in for an assignment are uploaded to, with
+// UploadFile.
+func (api *CanvasApi) MakeUploadForSubmissionUrl(courseId uint64, assignmentId uint64) string {
+	return fmt.Sprintf("%s/api/v1/courses/%d/assignments/%d/submissions/self/files", api.RootUrl, courseId, assignmentId)
+}
+
+// Submit hands in files that have been uploaded for an assignment, with a comment if it is not
+// empty, and returns the submission as Canvas recorded it.
+func (canvas *CanvasApi) Submit(ctx context.Context, courseId uint64, assignmentId uint64, fileIds []uint64, comment string) (Submission, error) {
+	form := url.Values{"submission[submission_type]": {"online_upload"}}
+	for _, id := range fileIds {
+		form.Add("submission[file_ids][]", strconv.FormatUint(id, 10))
+	}
+	if comment != "" {
+		form.Set("comment[text_comment]", comment)
+	}
+
+	var submission Submission
+	err := canvas.post(withCourse(ctx, courseId), canvas.MakeSubmissionsUrl(courseId, assignmentId), form, &submission)
+	return submission, err
+}
+
+// runSubmit implements the submit subcommand, which hands in files for an assignment: it uploads
+// them and submits them, and reports when Canvas received the submission.
+func runSubmit(ctx context.Context, args []string, opts *Options) error {
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	courseId := flags.Uint64("course", 0, "ID of the course the assignment is in")
+	assignmentId := flags.Uint64("assignment", 0, "ID of the assignment to hand in")
+	comment := flags.String("comment", "", "add this comment to the submission")
+	flags.Parse(args)
+	if *courseId == 0 || *assignmentId == 0 || flags.NArg() == 0 {
+		return fmt.Errorf("usage: canvas-sync submit --course <id> --assignment <id> [--comment <text>] <file>...")
+	}
+	if opts.Offline {
+		return fmt.Errorf("--offline only works with diff, digest, quota and archive, as submit needs Canvas")
+	}
+
+	for _, localPath := range flags.Args() {
+		fi, err := os.Stat(localPath)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a file: only files can be handed in", localPath)
+		}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	api, err := newCanvasApi(config)
+	if err != nil {
+		return err
+	}
+	api.Timeout = opts.Timeout
+
+	// Check that the assignment takes files before uploading anything.
+	ctx = withoutListingCache(withCourse(ctx, *courseId))
+	assignment, err := getAPI[Assignment](ctx, api, api.MakeAssignmentUrl(*courseId, *assignmentId))
+	if err != nil {
+		return fmt.Errorf("cannot find assignment %d in course %d: %w", *assignmentId, *courseId, err)
+	}
+	takesFiles := false
+	for _, t := range assignment.SubmissionTypes {
+		takesFiles = takesFiles || t == "online_upload"
+	}
+	if !takesFiles {
+		return fmt.Errorf("%s cannot be handed in by uploading files: it takes %s", assignment.Name, strings.Join(assignment.SubmissionTypes, ", "))
+	}
+
+	dest := uploadDestination{apiCall: api.MakeUploadForSubmissionUrl(*courseId, *assignmentId), courseId: *courseId, name: assignment.Name}
+	var fileIds []uint64
+	for _, localPath := range flags.Args() {
+		file, err := uploadLocalFile(ctx, api, dest, localPath, "rename")
+		if err != nil {
+			return err
+		}
+		logInfof("Uploaded %s", localPath)
+		fileIds = append(fileIds, file.Id)
+	}
+
+	submission, err := api.Submit(ctx, *courseId, *assignmentId, fileIds, *comment)
+	if err != nil {
+		return fmt.Errorf("uploaded the files but cannot hand them in for %s: %w", assignment.Name, err)
+	}
+	if submission.SubmittedAt == nil {
+		return fmt.Errorf("Canvas did not record when %s was handed in: check it on Canvas", assignment.Name)
+	}
+
+	if opts.JSON {
+		return json.NewEncoder(os.Stdout).Encode(submission)
+	}
+
+	names := make([]string, len(flags.Args()))
+	for i, localPath := range flags.Args() {
+		names[i] = filepath.Base(localPath)
+	}
+	fmt.Printf("✓ Handed in %s for %s; Canvas received it at %s (attempt %d).\n", strings.Join(names, ", "), assignment.Name, submission.SubmittedAt.Local().Format(time.RFC1123), submission.Attempt)
+	if submission.Late && assignment.DueAt != nil {
+		fmt.Printf("! Canvas marked it late: it was due at %s.\n", assignment.DueAt.Local().Format(time.RFC1123))
+	} else if submission.Late {
+		fmt.Println("! Canvas marked it late.")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Values of the symlinks setting.
+const (
+	symlinksFollow = "follow"
+	symlinksSkip   = "skip"
+	symlinksError  = "error"
+)
+
+// errPathSkipped is returned by PathGuard.Check for files that are left out of the sync.
+var errPathSkipped = errors.New("not downloaded")
+
+// PathGuard checks that a file is only downloaded to a path inside the sync directory, or another
+// directory that content_type_rules save files under, following the symlinks setting for any
+// symbolic links along the way and, if asked, refusing to cross onto another file system from the
+// directory the file is in.
+type PathGuard struct {
+	roots         []string
+	symlinks      string
+	oneFilesystem bool
+	rootIds       map[string]string
+}
+
+func NewPathGuard(roots []string, symlinks string, oneFilesystem bool) (*PathGuard, error) {
+	guard := &PathGuard{symlinks: symlinks, oneFilesystem: oneFilesystem, rootIds: make(map[string]string)}
+	if symlinks == "" {
+		guard.symlinks = symlinksFollow
+	}
+
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		guard.roots = append(guard.roots, root)
+		if !oneFilesystem {
+			continue
+		}
+
+		// On the first sync, the directory may not exist yet.
+		dir := root
+		for {
+			id, err := fileSystemId(dir)
+			if err == nil {
+				guard.rootIds[root] = id
+				break
+			}
+			parent := filepath.Dir(dir)
+			if !errors.Is(err, os.ErrNotExist) || parent == dir {
+				return nil, err
+			}
+			dir = parent
+		}
+	}
+
+	return guard, nil
+}
+
+// Check returns an error wrapping errPathSkipped if a file should not be downloaded to path, or
+// another error if the sync should stop.
+func (guard *PathGuard) Check(path string) error {
+	root := syncRootOf(guard.roots, path)
+	if root == "" {
+		return fmt.Errorf("%s is outside %s: %w", path, guard.roots[0], errPathSkipped)
+	}
+	rel, _ := pathWithin(root, path)
+
+	current := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, elem)
+
+		fi, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			// Everything from here on will be created by canvas-sync.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Windows reports junctions as irregular files rather than symbolic links.
+		if fi.Mode()&(os.ModeSymlink|os.ModeIrregular) != 0 {
+			switch guard.symlinks {
+			case symlinksSkip:
+				return fmt.Errorf("%s is reached through the symbolic link %s: %w", path, current, errPathSkipped)
+			case symlinksError:
+				return fmt.Errorf("%s is reached through the symbolic link %s, which the symlinks setting does not allow", path, current)
+			}
+		}
+
+		if guard.oneFilesystem {
+			id, err := fileSystemId(current)
+			if err != nil {
+				return err
+			}
+			if id != guard.rootIds[root] {
+				return fmt.Errorf("%s is on a different file system to %s: %w", path, root, errPathSkipped)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// stringList is a flag.Value that collects every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// CourseTags returns the tags given to a course in the config file, sorted by name.
+func (config *Config) CourseTags(courseId uint64) []string {
+	var tags []string
+	for tag, courseIds := range config.Tags {
+		for _, id := range courseIds {
+			if id == courseId {
+				tags = append(tags, tag)
+				break
+			}
+		}
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+// HasAnyTag reports whether a course has been given at least one of the tags. An empty list of
+// tags matches every course.
+func (config *Config) HasAnyTag(courseId uint64, tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+
+	for _, tag := range tags {
+		for _, id := range config.Tags[tag] {
+			if id == courseId {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// printTagSummary prints the number of files and bytes transferred for each tag. A course with
+// several tags counts towards each of them. Nothing is printed if no tags are configured.
+func printTagSummary(config *Config, files []SyncedFile) {
+	if len(config.Tags) == 0 || len(files) == 0 {
+		return
+	}
+
+	type total struct {
+		files uint64
+		bytes uint64
+	}
+	totals := make(map[string]*total)
+
+	for _, file := range files {
+		tags := config.CourseTags(file.CourseId)
+		if len(tags) == 0 {
+			tags = []string{"untagged"}
+		}
+
+		for _, tag := range tags {
+			t, ok := totals[tag]
+			if !ok {
+				t = &total{}
+				totals[tag] = t
+			}
+			t.files++
+			t.bytes += uint64(file.Size)
+		}
+	}
+
+	tags := make([]string, 0, len(totals))
+	for tag := range totals {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		t := totals[tag]
+		if t.files == 1 {
+			fmt.Printf("  %s: 1 file (%s)\n", tag, humanize.Bytes(t.bytes))
+		} else {
+			fmt.Printf("  %s: %d files (%s)\n", tag, t.files, humanize.Bytes(t.bytes))
+		}
+	}
+}
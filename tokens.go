@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+const courseTokensStateFile = "course_tokens.json"
+
+// CourseTokens chooses which of several access tokens, such as a student's own and one from their
+// TA account, to make API calls about each course with. The token that last worked for a course is
+// tried first, and the others in turn if Canvas does not let it see the course. Tokens are recorded
+// in the state directory by fingerprint, never in full.
+type CourseTokens struct {
+	tokens []string
+
+	mu sync.Mutex
+	// Fingerprint of the token that last worked for each course.
+	courses map[uint64]string
+	changed bool
+}
+
+// LoadCourseTokens reads which of tokens worked for each course last time.
+func LoadCourseTokens(tokens []string) (*CourseTokens, error) {
+	t := &CourseTokens{tokens: tokens, courses: make(map[uint64]string)}
+	if err := loadState(courseTokensStateFile, &t.courses); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// For returns the tokens to try, in turn, for API calls about a course.
+func (t *CourseTokens) For(courseId uint64) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fingerprint, ok := t.courses[courseId]
+	if !ok {
+		return t.tokens
+	}
+
+	ordered := make([]string, 0, len(t.tokens))
+	for _, token := range t.tokens {
+		if tokenFingerprint(token) == fingerprint {
+			ordered = append(ordered, token)
+		}
+	}
+	for _, token := range t.tokens {
+		if tokenFingerprint(token) != fingerprint {
+			ordered = append(ordered, token)
+		}
+	}
+	return ordered
+}
+
+// Worked records that token could make an API call about a course.
+func (t *CourseTokens) Worked(courseId uint64, token string) {
+	fingerprint := tokenFingerprint(token)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.courses[courseId] != fingerprint {
+		t.courses[courseId] = fingerprint
+		t.changed = true
+	}
+}
+
+// Save writes which token worked for each course, if that has changed. Courses are dropped if the
+// token that worked for them is no longer in the config file.
+func (t *CourseTokens) Save() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.changed {
+		return nil
+	}
+
+	known := make(map[string]bool, len(t.tokens))
+	for _, token := range t.tokens {
+		known[tokenFingerprint(token)] = true
+	}
+	for courseId, fingerprint := range t.courses {
+		if !known[fingerprint] {
+			delete(t.courses, courseId)
+		}
+	}
+
+	if err := saveState(courseTokensStateFile, t.courses); err != nil {
+		return err
+	}
+	t.changed = false
+	return nil
+}
+
+// tokenFingerprint identifies a token without giving it away.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tokenDenied reports whether an API call failed because the token it was made with cannot see
+// the course, so that another token might.
+func tokenDenied(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && (httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden)
+}
+
+// tokensFor returns the access tokens to try, in turn, for an API call about a course, or about no
+// course in particular if courseId is zero, which is always made with the token in the config file.
+func (canvas *CanvasApi) tokensFor(courseId uint64) []string {
+	if canvas.CourseTokens == nil || courseId == 0 {
+		return []string{canvas.Token}
+	}
+	return canvas.CourseTokens.For(courseId)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportStats accumulates, for each host, how requests were made: whether they reused an idle
+// connection or had to open a new one, and how long the DNS lookup, TLS handshake and wait for
+// the first byte of the response took. Its methods do nothing on a nil TransportStats.
+type TransportStats struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+}
+
+type hostStats struct {
+	requests    uint64
+	newConns    uint64
+	reusedConns uint64
+
+	dnsLookups    uint64
+	dnsTime       time.Duration
+	tlsHandshakes uint64
+	tlsTime       time.Duration
+	responses     uint64
+	firstByteTime time.Duration
+}
+
+func NewTransportStats() *TransportStats {
+	return &TransportStats{hosts: make(map[string]*hostStats)}
+}
+
+// requestTrace records the connection events of a single request.
+type requestTrace struct {
+	mu        sync.Mutex
+	start     time.Time
+	gotConn   bool
+	reused    bool
+	dnsStart  time.Time
+	dnsTime   time.Duration
+	dnsDone   bool
+	tlsStart  time.Time
+	tlsTime   time.Duration
+	tlsDone   bool
+	firstByte time.Duration
+	gotByte   bool
+}
+
+func (r *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.gotConn = true
+			r.reused = info.Reused
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.dnsTime = time.Since(r.dnsStart)
+			r.dnsDone = true
+		},
+		TLSHandshakeStart: func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.tlsTime = time.Since(r.tlsStart)
+			r.tlsDone = true
+		},
+		GotFirstResponseByte: func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.firstByte = time.Since(r.start)
+			r.gotByte = true
+		},
+	}
+}
+
+func (s *TransportStats) record(host string, r *requestTrace) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := s.hosts[host]
+	if !ok {
+		h = &hostStats{}
+		s.hosts[host] = h
+	}
+
+	h.requests++
+	if r.gotConn {
+		if r.reused {
+			h.reusedConns++
+		} else {
+			h.newConns++
+		}
+	}
+	if r.dnsDone {
+		h.dnsLookups++
+		h.dnsTime += r.dnsTime
+	}
+	if r.tlsDone {
+		h.tlsHandshakes++
+		h.tlsTime += r.tlsTime
+	}
+	if r.gotByte {
+		h.responses++
+		h.firstByteTime += r.firstByte
+	}
+}
+
+// LogSummary logs, in verbose mode or to the log file, how well connections to each host were
+// reused and how long setting them up took.
+func (s *TransportStats) LogSummary() {
+	if s == nil || (logLevel < LogVerbose && logFile == nil) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hosts := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	average := func(total time.Duration, n uint64) time.Duration {
+		return (total / time.Duration(n)).Round(time.Millisecond)
+	}
+
+	for _, host := range hosts {
+		h := s.hosts[host]
+
+		var reuse float64
+		if conns := h.newConns + h.reusedConns; conns > 0 {
+			reuse = 100 * float64(h.reusedConns) / float64(conns)
+		}
+		summary := fmt.Sprintf("%d requests, %d new connections and %d reused (%.0f%% reuse)", h.requests, h.newConns, h.reusedConns, reuse)
+
+		// Requests over reused connections do not look up or handshake, and neither do plain
+		// HTTP requests or requests to an IP address, so only average those that did.
+		var timings []string
+		if h.dnsLookups > 0 {
+			timings = append(timings, fmt.Sprintf("DNS lookup %s", average(h.dnsTime, h.dnsLookups)))
+		}
+		if h.tlsHandshakes > 0 {
+			timings = append(timings, fmt.Sprintf("TLS handshake %s", average(h.tlsTime, h.tlsHandshakes)))
+		}
+		if h.responses > 0 {
+			timings = append(timings, fmt.Sprintf("time to first byte %s", average(h.firstByteTime, h.responses)))
+		}
+		if len(timings) > 0 {
+			summary += "; average " + strings.Join(timings, ", ")
+		}
+
+		logDebugf("Connections to %s: %s", host, summary)
+	}
+}
+
+// tracingTransport records the connection events of every request in stats.
+type tracingTransport struct {
+	base  http.RoundTripper
+	stats *TransportStats
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &requestTrace{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+
+	res, err := t.base.RoundTrip(req)
+	t.stats.record(req.URL.Host, trace)
+	return res, err
+}
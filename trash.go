@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Directory within the sync directory used by canvas-sync for its own files.
+	dataDirName = ".canvas-sync"
+
+	trashTimeFormat = "2006-01-02T15-04-05"
+
+	defaultTrashRetention = 30 * 24 * time.Hour
+)
+
+// Trash holds the previous copies of files that a sync replaces or removes. Each sync run gets its
+// own timestamped directory in .canvas-sync/trash under the sync directory, mirroring the layout
+// of the sync directory itself. Files in other directories that content_type_rules save files
+// under are kept in the trash in that directory instead.
+type Trash struct {
+	roots []string
+	run   string
+}
+
+func NewTrash(roots []string, now time.Time) *Trash {
+	return &Trash{
+		roots: roots,
+		run:   now.Format(trashTimeFormat),
+	}
+}
+
+func trashDirectory(rootDirectory string) string {
+	return filepath.Join(rootDirectory, dataDirName, "trash")
+}
+
+// Keep puts a copy of the file at path into the trash, leaving the original in place so that it
+// can be atomically replaced afterwards. It does nothing if there is no file at path.
+func (trash *Trash) Keep(path string) error {
+	trashPath, err := trash.pathFor(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+		return err
+	}
+
+	// A hard link costs nothing, but not every filesystem supports them.
+	if err := os.Link(path, trashPath); err == nil {
+		return nil
+	}
+
+	return os.Rename(path, trashPath)
+}
+
+func (trash *Trash) pathFor(path string) (string, error) {
+	root := syncRootOf(trash.roots, path)
+	if root == "" {
+		return "", fmt.Errorf("cannot trash %s: outside of %s", path, trash.roots[0])
+	}
+
+	rel, _ := pathWithin(root, path)
+	return filepath.Join(trashDirectory(root), trash.run, rel), nil
+}
+
+// PruneTrash deletes the trash directories of sync runs older than the retention period.
+func PruneTrash(rootDirectory string, retention time.Duration, now time.Time) (removed int, err error) {
+	dir := trashDirectory(rootDirectory)
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		trashedAt, err := time.ParseInLocation(trashTimeFormat, entry.Name(), time.Local)
+		if err != nil {
+			// Not created by canvas-sync
+			continue
+		}
+
+		if now.Sub(trashedAt) < retention {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// runTrash implements the trash subcommand.
+func runTrash(args []string) error {
+	if len(args) != 1 || args[0] != "prune" {
+		return fmt.Errorf("usage: canvas-sync trash prune")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, root := range config.SyncRoots() {
+		removed, err := PruneTrash(root, config.TrashRetention(), time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Removed %d expired trash directories from %s.\n", removed, trashDirectory(root))
+	}
+	return nil
+}
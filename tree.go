@@ -5,14 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
-
-	atomicFile "github.com/natefinch/atomic"
+	"sort"
+	"strings"
 )
 
 type CourseTree struct {
 	Course
 
+	// Set if the user is not allowed to list the folders in the course.
+	FoldersForbidden bool
+	// Folders whose files the user is not allowed to list.
+	ForbiddenFolders []uint64
+
 	root   *TreeFolder
 	lookup map[uint64]*TreeFolder
 }
@@ -47,7 +53,16 @@ func NewCourseTree(course Course, folders []Folder, files []File) (*CourseTree,
 	}
 
 	for _, file := range files {
-		lookup[file.FolderId].files = append(lookup[file.FolderId].files, &TreeFile{File: file})
+		folder, ok := lookup[file.FolderId]
+		if !ok {
+			continue
+		}
+		folder.files = append(folder.files, &TreeFile{File: file})
+	}
+
+	for _, folder := range lookup {
+		sortFolders(folder.folders)
+		uniqueFileNames(folder.files)
 	}
 
 	tree := &CourseTree{
@@ -75,6 +90,10 @@ func (tree *CourseTree) Traverse(callback func(folder *TreeFolder, level int) er
 		return nil
 	}
 
+	if tree.root == nil {
+		return nil
+	}
+
 	return f(tree.root, 0)
 }
 
@@ -94,119 +113,202 @@ func (tree *CourseTree) TraverseWithParents(callback func(folder *TreeFolder, pa
 		return nil
 	}
 
+	if tree.root == nil {
+		return nil
+	}
+
 	return f(tree.root, nil)
 }
 
-type TreeFolder struct {
-	Folder
+// TraverseSubfoldersFirst is like TraverseWithParents but calls callback for a folder after its
+// subfolders, which is the order that Canvas shows files in, as it lists a folder's subfolders
+// before its files.
+func (tree *CourseTree) TraverseSubfoldersFirst(callback func(folder *TreeFolder, parents []*TreeFolder) error) error {
+	var f func(*TreeFolder, []*TreeFolder) error
+	f = func(folder *TreeFolder, parents []*TreeFolder) error {
+		for _, childFolder := range folder.folders {
+			if err := f(childFolder, append(parents, folder)); err != nil {
+				return err
+			}
+		}
 
-	folders []*TreeFolder
-	files   []*TreeFile
-}
+		return callback(folder, parents)
+	}
 
-type TreeFile struct {
-	File
-}
+	if tree.root == nil {
+		return nil
+	}
 
-type FileToSync struct {
-	File File
-	Path string
+	return f(tree.root, nil)
 }
 
-// Traverse over a course tree and check whether the files and folders exist on the local disk in
-// the directory tree at rootDirectory. Send files that do not exist or are not up-to-date with the
-// copy on Canvas to the fileToSyncC channel.
-// This does NOT close the fileToSyncC channel after exiting.
-func filesToSync(ctx context.Context, rootDirectory string, fileToSyncC chan<- FileToSync, tree *CourseTree) error {
-	var f func(folder *TreeFolder, pathElems []string, parentsNotOnDisk bool) error
-	f = func(folder *TreeFolder, pathElems []string, parentsNotOnDisk bool) error {
-		folderPath := filepath.Join(pathElems...)
-
-		// Check whether this folder exists on the disk.
-		// If the folder is not on the disk, then its files are not too and so we can speed up by
-		// not checking for them. Furthermore, if one of a folder's parent folders are not on the
-		// disk, then the folder cannot be either, and so we can avoid an unnecessary Stat.
-		var folderNotOnDisk bool
-		if parentsNotOnDisk {
-			folderNotOnDisk = true
-		} else {
-			_, err := os.Stat(folderPath)
-			if err != nil && !errors.Is(err, os.ErrNotExist) {
-				return err
-			}
-			if errors.Is(err, os.ErrNotExist) {
-				folderNotOnDisk = true
-			}
+// LocalPath returns the path of the directory under rootDirectory where the files of a folder
+// are synced to. parents are the folder's ancestors, starting with the root folder of the course.
+func (tree *CourseTree) LocalPath(rootDirectory string, folder *TreeFolder, parents []*TreeFolder) string {
+	pathElems := []string{rootDirectory, tree.Course.localDirectory()}
+
+	// The root folder of the course is the course directory itself.
+	if len(parents) > 0 {
+		for _, parent := range parents[1:] {
+			pathElems = append(pathElems, localName(parent.Name))
 		}
+		pathElems = append(pathElems, localName(folder.Name))
+	}
+
+	return filepath.Join(pathElems...)
+}
 
+// Size returns the total size of the files in the tree. It must only be called after the tree
+// has been built.
+func (tree *CourseTree) Size() int64 {
+	var size int64
+	tree.Traverse(func(folder *TreeFolder, level int) error {
 		for _, file := range folder.files {
-			filePath := filepath.Join(folderPath, file.FileName)
-
-			if !folderNotOnDisk {
-				fi, err := os.Stat(filePath)
-				if err != nil && !errors.Is(err, os.ErrNotExist) {
-					return err
-				}
-
-				if err == nil && file.UpdatedAt.Equal(fi.ModTime()) && file.Size == fi.Size() {
-					// The file exists on disk and is up-to-date with the copy on Canvas. No need
-					// to download again.
-					continue
-				}
-			}
+			size += file.Size
+		}
+		return nil
+	})
+	return size
+}
 
-			// File does not exist on disk or is not up-to-date with the copy on Canvas.
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case fileToSyncC <- FileToSync{File: file.File, Path: filePath}:
+// sortFolders orders folders as Canvas shows them: by position, with folders that have none
+// after those that do, and then by name.
+func sortFolders(folders []*TreeFolder) {
+	sort.Slice(folders, func(i, j int) bool {
+		a, b := folders[i], folders[j]
+		if a.Position != b.Position {
+			if a.Position == 0 || b.Position == 0 {
+				return b.Position == 0
 			}
+			return a.Position < b.Position
 		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
 
-		for _, childFolder := range folder.folders {
-			// Recurse
-			if err := f(childFolder, append(pathElems, childFolder.Name), folderNotOnDisk); err != nil {
-				return err
-			}
+// SetFolderTimes sets the modification times of the directories under rootDirectory that the
+// folders in the tree are synced to, to when the folders were last updated on Canvas. It is called
+// once the files have been synced, as adding files to a directory changes its modification time.
+// Directories that do not exist are left alone.
+func (tree *CourseTree) SetFolderTimes(rootDirectory string) {
+	tree.TraverseWithParents(func(folder *TreeFolder, parents []*TreeFolder) error {
+		if folder.UpdatedAt.IsZero() {
+			return nil
 		}
 
+		path := tree.LocalPath(rootDirectory, folder, parents)
+		if err := os.Chtimes(longPath(path), folder.UpdatedAt, folder.UpdatedAt); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logDebugf("Cannot set the time of %s: %s", path, err)
+		}
 		return nil
-	}
+	})
+}
 
-	// Start recursing from the root folder of the course tree
-	err := f(tree.root, []string{rootDirectory, tree.Course.Name}, false)
-	if err != nil {
-		return err
-	}
+// syncedTree is a tree whose files were synced into directory.
+type syncedTree struct {
+	tree      *CourseTree
+	directory string
+}
 
-	return nil
+type TreeFolder struct {
+	Folder
+
+	folders []*TreeFolder
+	files   []*TreeFile
 }
 
-func downloadAndWriteFile(ctx context.Context, api *CanvasApi, file FileToSync) error {
-	if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
-		return err
-	}
+type TreeFile struct {
+	File
+}
 
-	f, err := os.CreateTemp(filepath.Dir(file.Path), "canvassync")
-	if err != nil {
-		return err
+type FileToSync struct {
+	File     File   `json:"file"`
+	CourseId uint64 `json:"course_id"`
+	Path     string `json:"path"`
+	// Download the file even if the local copy looks up-to-date.
+	Force bool `json:"force,omitempty"`
+}
+
+// uniqueFileNames renames files in a folder that would be saved with the same name, which can
+// happen when they are not saved with the name shown on Canvas, by adding their ID. The file
+// uploaded first keeps the name.
+func uniqueFileNames(files []*TreeFile) {
+	byName := make(map[string][]*TreeFile)
+	for _, file := range files {
+		name := localName(file.FileName)
+		byName[name] = append(byName[name], file)
 	}
-	defer func() {
-		f.Close()
-		os.Remove(f.Name())
-	}()
 
-	if err := api.DownloadFile(ctx, f, file.File.DownloadUrl); err != nil {
-		return err
+	for _, clashing := range byName {
+		if len(clashing) < 2 {
+			continue
+		}
+		sort.Slice(clashing, func(i, j int) bool { return clashing[i].Id < clashing[j].Id })
+		for _, file := range clashing[1:] {
+			ext := path.Ext(file.FileName)
+			file.FileName = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(file.FileName, ext), file.Id, ext)
+		}
 	}
+}
 
-	if err := os.Chtimes(f.Name(), file.File.UpdatedAt, file.File.UpdatedAt); err != nil {
+// folderFilesToSync checks whether the files in a folder exist on the local disk in the directory
+// folderPath. Files that do not exist or are not up-to-date with the copy on Canvas are sent to the
+// fileToSyncC channel.
+// This does NOT close the fileToSyncC channel after exiting.
+func folderFilesToSync(ctx context.Context, fileToSyncC chan<- FileToSync, courseId uint64, folder *TreeFolder, folderPath string) error {
+	// If the folder is not on the disk, then its files are not too and so we can speed up by not
+	// checking for them.
+	_, err := os.Stat(longPath(folderPath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
+	folderNotOnDisk := errors.Is(err, os.ErrNotExist)
+	refresh := refreshFromContext(ctx)
+	rules := contentRulesFromContext(ctx)
+
+	for _, file := range folder.files {
+		filePath, ok := rules.Route(file.File, filepath.Join(folderPath, localName(file.FileName)))
+		if !ok {
+			logDebugf("Not downloading %s: content_type_rules skip %s files", file.FileName, file.ContentType)
+			continue
+		}
+		force := refresh.Wants(courseId, filePath)
+		routed := filepath.Dir(filePath) != folderPath
 
-	if err := atomicFile.ReplaceFile(f.Name(), file.Path); err != nil {
-		return err
+		if (!folderNotOnDisk || routed) && !force {
+			needsSync, err := fileNeedsSync(file, filePath)
+			if err != nil {
+				return err
+			}
+			if !needsSync {
+				// No need to download again.
+				continue
+			}
+		}
+
+		// File does not exist on disk or is not up-to-date with the copy on Canvas.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case fileToSyncC <- FileToSync{File: file.File, CourseId: courseId, Path: filePath, Force: force}:
+		}
 	}
 
 	return nil
 }
+
+// fileNeedsSync reports whether a file does not exist on disk at filePath or is not up-to-date
+// with the copy on Canvas.
+func fileNeedsSync(file *TreeFile, filePath string) (bool, error) {
+	fi, err := os.Stat(longPath(filePath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	return err != nil || !file.UpdatedAt.Equal(fi.ModTime()) || file.Size != fi.Size(), nil
+}
+
+// safeFileName makes a title from Canvas, which may contain slashes, into a file name.
+func safeFileName(title string) string {
+	return localName(strings.TrimSpace(strings.NewReplacer("/", "-", "\\", "-").Replace(title)))
+}
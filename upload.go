@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadSlot is where Canvas says to upload a file to, in the first step of an upload.
+type uploadSlot struct {
+	UploadUrl    string            `json:"upload_url"`
+	UploadParams map[string]string `json:"upload_params"`
+	// The name of the form field for the file, if not "file".
+	FileParam string `json:"file_param"`
+}
+
+func (api *CanvasApi) MakeUploadToFolderUrl(folderId uint64) string {
+	return fmt.Sprintf("%s/api/v1/folders/%d/files", api.RootUrl, folderId)
+}
+
+func (api *CanvasApi) MakeUploadToUserUrl() string {
+	return fmt.Sprintf("%s/api/v1/users/self/files", api.RootUrl)
+}
+
+// UploadFile uploads a file to Canvas with its three-step upload API: it tells Canvas about the
+// file at apiCall, such as MakeUploadToFolderUrl, with params, which name the file and say what to
+// do if one with the same name is already there; sends the content from r, size bytes long, to
+// where Canvas says; and confirms the upload, returning the file as it now is on Canvas.
+func (canvas *CanvasApi) UploadFile(ctx context.Context, apiCall string, params url.Values, r io.Reader, size int64) (File, error) {
+	params.Set("size", strconv.FormatInt(size, 10))
+	var slot uploadSlot
+	if err := canvas.post(ctx, apiCall, params, &slot); err != nil {
+		return File{}, err
+	}
+	if slot.UploadUrl == "" {
+		return File{}, fmt.Errorf("Canvas did not say where to upload %s", params.Get("name"))
+	}
+
+	res, err := canvas.sendUpload(ctx, slot, params.Get("name"), r, size)
+	if err != nil {
+		return File{}, err
+	}
+	defer res.Body.Close()
+
+	// Canvas either redirects to where the upload is confirmed, or responds with the file.
+	location := res.Header.Get("Location")
+	switch {
+	case res.StatusCode >= 300 && res.StatusCode < 400:
+	case res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated:
+		var file File
+		if err := json.NewDecoder(res.Body).Decode(&file); err == nil && file.Id != 0 {
+			canvas.prepareFile(&file)
+			return file, nil
+		}
+	default:
+		return File{}, apiError(slot.UploadUrl, res)
+	}
+	if location == "" {
+		return File{}, fmt.Errorf("Canvas did not confirm the upload of %s", params.Get("name"))
+	}
+
+	// The location is relative to the upload URL.
+	if u, err := url.Parse(slot.UploadUrl); err == nil {
+		if loc, err := u.Parse(location); err == nil {
+			location = loc.String()
+		}
+	}
+	file, err := getAPI[File](withoutListingCache(ctx), canvas, location)
+	if err != nil {
+		return File{}, fmt.Errorf("cannot confirm the upload of %s: %w", params.Get("name"), err)
+	}
+	canvas.prepareFile(&file)
+	return file, nil
+}
+
+// sendUpload sends the content of a file to where Canvas said to upload it, without the access
+// token, as a form with the parameters Canvas gave followed by the file.
+func (canvas *CanvasApi) sendUpload(ctx context.Context, slot uploadSlot, name string, r io.Reader, size int64) (*http.Response, error) {
+	fileParam := slot.FileParam
+	if fileParam == "" {
+		fileParam = "file"
+	}
+
+	// Some storage services need the length of the form up front, so the content is streamed
+	// between the rest of the form, which is built first.
+	var head bytes.Buffer
+	form := multipart.NewWriter(&head)
+	for key, value := range slot.UploadParams {
+		if err := form.WriteField(key, value); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := form.CreateFormFile(fileParam, name); err != nil {
+		return nil, err
+	}
+	tail := fmt.Sprintf("\r\n--%s--\r\n", form.Boundary())
+
+	body := io.MultiReader(&head, io.LimitReader(r, size), strings.NewReader(tail))
+	req, err := http.NewRequestWithContext(ctx, "POST", slot.UploadUrl, body)
+	if err != nil {
+		return nil, fmt.Errorf("new request error for %s: %w", redactUrl(slot.UploadUrl), err)
+	}
+	req.ContentLength = int64(head.Len()) + size + int64(len(tail))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	// Redirects lead to where the upload is confirmed, which needs the access token.
+	client := *canvas.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		logDebugf("POST %s: %v", redactUrl(slot.UploadUrl), err)
+		return nil, fmt.Errorf("client error for %s: %w", redactUrl(slot.UploadUrl), err)
+	}
+	logDebugf("POST %s: %s in %s", redactUrl(slot.UploadUrl), res.Status, time.Since(start).Round(time.Millisecond))
+	return res, nil
+}
+
+// post makes an authenticated POST request to the API with a form, decoding the response into v.
+func (canvas *CanvasApi) post(ctx context.Context, apiCall string, form url.Values, v any) error {
+	return canvas.send(ctx, "POST", apiCall, form, v)
+}
+
+// delete makes an authenticated DELETE request to the API, decoding the response into v.
+func (canvas *CanvasApi) delete(ctx context.Context, apiCall string, v any) error {
+	return canvas.send(ctx, "DELETE", apiCall, nil, v)
+}
+
+// send makes an authenticated request to the API that changes something on Canvas, with a form if
+// it is not nil, decoding the response into v.
+func (canvas *CanvasApi) send(ctx context.Context, method string, apiCall string, form url.Values, v any) error {
+	if canvas.Limiter != nil {
+		if err := canvas.Limiter.Acquire(ctx, courseFromContext(ctx)); err != nil {
+			return err
+		}
+		defer canvas.Limiter.Release()
+	}
+
+	reqCtx := ctx
+	if canvas.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, canvas.Timeout)
+		defer cancel()
+	}
+
+	apiCall = canvas.masquerade(apiCall)
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(reqCtx, method, apiCall, body)
+	if err != nil {
+		return fmt.Errorf("new request error for %s: %w", apiCall, err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", canvas.tokensFor(courseFromContext(ctx))[0]))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	start := time.Now()
+	res, err := canvas.Client.Do(req)
+	if err != nil {
+		logDebugf("%s %s: %v", method, redactUrl(apiCall), err)
+		return fmt.Errorf("client error for %s: %w", apiCall, err)
+	}
+	defer res.Body.Close()
+	logDebugf("%s %s: %s in %s", method, redactUrl(apiCall), res.Status, time.Since(start).Round(time.Millisecond))
+	metrics.APIRequest(isRateLimited(res))
+	canvas.Limiter.Observe(res, time.Since(start))
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		httpErr := apiError(apiCall, res)
+		if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") != "" {
+			return &TokenError{httpErr}
+		}
+		if isInsufficientScope(httpErr) {
+			return &ScopeError{httpErr}
+		}
+		return httpErr
+	}
+
+	counted := &countingReader{r: res.Body}
+	err = json.NewDecoder(counted).Decode(v)
+	canvas.Usage.AddRequest(courseFromContext(ctx), counted.n)
+	if err != nil {
+		return fmt.Errorf("cannot decode the response from %s: %w", apiCall, err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const usageStateFile = "usage.json"
+
+// UsageCounts is how much canvas-sync has asked of Canvas and its file storage.
+type UsageCounts struct {
+	// API calls made and the bytes received in their responses.
+	Requests int64 `json:"requests"`
+	APIBytes int64 `json:"api_bytes"`
+	// Files downloaded, including any that failed part way through, and the bytes received.
+	Downloads     int64 `json:"downloads"`
+	DownloadBytes int64 `json:"download_bytes"`
+}
+
+func (c *UsageCounts) add(other UsageCounts) {
+	c.Requests += other.Requests
+	c.APIBytes += other.APIBytes
+	c.Downloads += other.Downloads
+	c.DownloadBytes += other.DownloadBytes
+}
+
+// MonthUsage is the usage in a calendar month, in total and by course. Usage that is not on
+// behalf of a particular course, such as listing the courses, is only in the total.
+type MonthUsage struct {
+	UsageCounts
+	Courses map[uint64]*UsageCounts `json:"courses"`
+}
+
+// Usage accounts for the network traffic of every run, by month. It is kept in the state
+// directory between runs.
+type Usage struct {
+	mu     sync.Mutex
+	months map[string]*MonthUsage
+}
+
+func LoadUsage() (*Usage, error) {
+	months := make(map[string]*MonthUsage)
+	if err := loadState(usageStateFile, &months); err != nil {
+		return nil, err
+	}
+
+	return &Usage{months: months}, nil
+}
+
+func (u *Usage) Save() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return saveState(usageStateFile, u.months)
+}
+
+func (u *Usage) add(courseId uint64, counts UsageCounts) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := time.Now().Format("2006-01")
+	month, ok := u.months[key]
+	if !ok {
+		month = &MonthUsage{Courses: make(map[uint64]*UsageCounts)}
+		u.months[key] = month
+	}
+
+	month.add(counts)
+	if courseId != 0 {
+		course, ok := month.Courses[courseId]
+		if !ok {
+			course = &UsageCounts{}
+			month.Courses[courseId] = course
+		}
+		course.add(counts)
+	}
+}
+
+// AddRequest records an API call whose response had the given number of bytes.
+func (u *Usage) AddRequest(courseId uint64, bytes int64) {
+	if u == nil {
+		return
+	}
+	u.add(courseId, UsageCounts{Requests: 1, APIBytes: bytes})
+}
+
+// AddDownload records a download of a file of which the given number of bytes were received.
+func (u *Usage) AddDownload(courseId uint64, bytes int64) {
+	if u == nil {
+		return
+	}
+	u.add(courseId, UsageCounts{Downloads: 1, DownloadBytes: bytes})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runStats prints how much space each course takes up on disk and, with --usage, how much
+// network traffic canvas-sync has used each month.
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	usage := flags.Bool("usage", false, "show the network traffic used each month")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: canvas-sync stats [--usage]")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := LoadManifest()
+	if err != nil {
+		return err
+	}
+
+	// The manifest does not record course names, but the course directory is the next best thing.
+	courseNames := make(map[uint64]string)
+	storage := make(map[uint64]int64)
+	var files int
+	for _, entry := range manifest.Entries() {
+		storage[entry.CourseId] += entry.Size
+		files++
+		if strings.HasPrefix(entry.Path, config.GroupsDirectory()+string(filepath.Separator)) {
+			continue
+		}
+		if rel, err := filepath.Rel(config.Directory, entry.Path); err == nil {
+			courseNames[entry.CourseId] = strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		}
+	}
+
+	courseName := func(courseId uint64) string {
+		if name, ok := courseNames[courseId]; ok {
+			return name
+		}
+		return fmt.Sprintf("course %d", courseId)
+	}
+
+	if !*usage {
+		var total int64
+		for _, size := range storage {
+			total += size
+		}
+		fmt.Printf("%d files (%s) synced to %s\n", files, humanize.Bytes(uint64(total)), config.Directory)
+		for _, courseId := range sortedKeys(storage) {
+			fmt.Printf("  %s: %s\n", courseName(courseId), humanize.Bytes(uint64(storage[courseId])))
+		}
+		return nil
+	}
+
+	u, err := LoadUsage()
+	if err != nil {
+		return err
+	}
+
+	if len(u.months) == 0 {
+		fmt.Println("No network usage recorded yet.")
+		return nil
+	}
+
+	months := make([]string, 0, len(u.months))
+	for month := range u.months {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+
+	for _, key := range months {
+		month := u.months[key]
+		fmt.Printf("%s: %s in %d downloads, %s in %d API calls\n", key,
+			humanize.Bytes(uint64(month.DownloadBytes)), month.Downloads,
+			humanize.Bytes(uint64(month.APIBytes)), month.Requests)
+		for _, courseId := range sortedKeys(month.Courses) {
+			course := month.Courses[courseId]
+			fmt.Printf("  %s: %s in %d downloads, %d API calls\n", courseName(courseId),
+				humanize.Bytes(uint64(course.DownloadBytes)), course.Downloads, course.Requests)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys[V any](m map[uint64]V) []uint64 {
+	keys := make([]uint64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Name of the directory, next to an updated file, that holds its previous versions.
+const versionsDirName = ".versions"
+
+// keepVersion copies the file at path into the .versions directory beside it as name.vN.ext,
+// where N is one more than the latest version already kept. It does nothing if there is no file
+// at path.
+func keepVersion(path string) error {
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	dir := filepath.Join(filepath.Dir(path), versionsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	latest, err := latestVersion(dir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	versionPath := filepath.Join(dir, versionName(filepath.Base(path), latest+1))
+
+	// A hard link costs nothing, but not every filesystem supports them.
+	if err := os.Link(path, versionPath); err == nil {
+		return nil
+	}
+
+	return os.Rename(path, versionPath)
+}
+
+// versionName returns the name of the nth version of a file, e.g. "notes.v2.pdf".
+func versionName(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.v%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// latestVersion returns the highest version number of name kept in dir, or zero if there are none.
+func latestVersion(dir string, name string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + ".v"
+
+	latest := 0
+	for _, entry := range entries {
+		n := entry.Name()
+		if !strings.HasPrefix(n, prefix) || !strings.HasSuffix(n, ext) {
+			continue
+		}
+		n = strings.TrimSuffix(strings.TrimPrefix(n, prefix), ext)
+
+		if v, err := strconv.Atoi(n); err == nil && v > latest {
+			latest = v
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+const defaultWatchdogTimeout = 10 * time.Minute
+
+var errStalled = errors.New("sync stalled")
+
+// Watchdog cancels a sync that has stopped making progress, first writing the state of the
+// pipeline and the stacks of all goroutines to a diagnostics file in the state directory so that
+// the hang can be reported.
+type Watchdog struct {
+	pipeline *Pipeline
+	timeout  time.Duration
+
+	// Path of the diagnostics file, set if the watchdog fired.
+	fired atomic.Pointer[string]
+}
+
+func NewWatchdog(pipeline *Pipeline, timeout time.Duration) *Watchdog {
+	return &Watchdog{pipeline: pipeline, timeout: timeout}
+}
+
+// Run checks for progress until the context is cancelled, calling cancel if there has been none
+// for the watchdog's timeout.
+func (w *Watchdog) Run(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(w.timeout / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// A paused sync is not expected to make progress.
+			if w.pipeline.Pauser.Paused() {
+				w.pipeline.Progress()
+				continue
+			}
+			if time.Since(w.pipeline.LastProgress()) < w.timeout {
+				continue
+			}
+
+			path, err := w.writeDiagnostics()
+			if err != nil {
+				path = fmt.Sprintf("(could not write diagnostics: %s)", err)
+			}
+			w.fired.Store(&path)
+			cancel()
+			return
+		}
+	}
+}
+
+// Err returns an error describing the stall if the watchdog cancelled the sync, or nil otherwise.
+func (w *Watchdog) Err() error {
+	path := w.fired.Load()
+	if path == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: no progress for %s; diagnostics written to %s", errStalled, w.timeout, *path)
+}
+
+func (w *Watchdog) writeDiagnostics() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("diagnostics-%s.txt", time.Now().Format("2006-01-02T15-04-05")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w.pipeline.Dump(f)
+	fmt.Fprintln(f)
+
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		return "", err
+	}
+
+	return path, f.Close()
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+const xattrSupported = false
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this system")
+
+func setXattr(path, name, value string) error {
+	return errXattrUnsupported
+}
+
+func getXattr(path, name string) (string, error) {
+	return "", errXattrUnsupported
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const xattrSupported = true
+
+// setXattr sets the extended attribute name of the file at path to value.
+func setXattr(path, name, value string) error {
+	if err := unix.Setxattr(path, name, []byte(value), 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// getXattr returns the value of the extended attribute name of the file at path.
+func getXattr(path, name string) (string, error) {
+	buf := make([]byte, 1024)
+	n, err := unix.Getxattr(path, name, buf)
+	if err != nil {
+		return "", &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	return string(buf[:n]), nil
+}